@@ -0,0 +1,261 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//AddressTxRecord 本地地址交易索引中关注地址参与的交易单
+type AddressTxRecord struct {
+	Key         string `storm:"id"` //address:txid
+	Address     string `storm:"index"`
+	TxID        string
+	BlockHeight uint64 `storm:"index"`
+	BlockHash   string
+}
+
+//AddressTxIndex 由扫描结果维护的关注地址交易索引，用于core模式查询地址的交易记录
+type AddressTxIndex struct {
+	stormFile
+}
+
+//NewAddressTxIndex 创建地址交易索引，数据库文件在首次使用时打开
+func NewAddressTxIndex(dbFile string) *AddressTxIndex {
+	return &AddressTxIndex{stormFile{path: dbFile}}
+}
+
+//Apply 记录区块中提取成功的交易单涉及的关注地址
+func (index *AddressTxIndex) Apply(height uint64, results []ExtractResult) error {
+
+	db, err := index.open()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, result := range results {
+		if !result.Success {
+			continue
+		}
+
+		for _, record := range addressTxRecords(height, result) {
+			err = tx.Save(record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+//addressTxRecords 交易单提取结果中关注地址的索引记录，同一地址只记录一次
+func addressTxRecords(height uint64, result ExtractResult) []*AddressTxRecord {
+
+	records := make(map[string]*AddressTxRecord)
+	add := func(address, blockHash string) {
+		key := address + ":" + result.TxID
+		if _, exist := records[key]; exist {
+			return
+		}
+		records[key] = &AddressTxRecord{
+			Key:         key,
+			Address:     address,
+			TxID:        result.TxID,
+			BlockHeight: height,
+			BlockHash:   blockHash,
+		}
+	}
+
+	for _, extractData := range []map[string]*openwallet.TxExtractData{result.extractData, result.extractOmniData} {
+		for _, data := range extractData {
+			for _, input := range data.TxInputs {
+				add(input.Address, input.BlockHash)
+			}
+			for _, output := range data.TxOutputs {
+				add(output.Address, output.BlockHash)
+			}
+		}
+	}
+
+	list := make([]*AddressTxRecord, 0, len(records))
+	for _, record := range records {
+		list = append(list, record)
+	}
+	return list
+}
+
+//Rollback 删除被孤立区块中的交易单记录
+func (index *AddressTxIndex) Rollback(height uint64) error {
+
+	db, err := index.open()
+	if err != nil {
+		return err
+	}
+
+	err = db.Select(q.Eq("BlockHeight", height)).Delete(&AddressTxRecord{})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//Find 查询地址参与的已确认交易单，多个地址参与的交易单只返回一条
+func (index *AddressTxIndex) Find(addresses ...string) ([]*AddressTxRecord, error) {
+
+	db, err := index.open()
+	if err != nil {
+		return nil, err
+	}
+
+	txs := make(map[string]*AddressTxRecord)
+	for _, address := range addresses {
+		var records []*AddressTxRecord
+		err = db.Find("Address", address, &records)
+		if err != nil && err != storm.ErrNotFound {
+			return nil, err
+		}
+		for _, record := range records {
+			txs[record.TxID] = record
+		}
+	}
+
+	list := make([]*AddressTxRecord, 0, len(txs))
+	for _, record := range txs {
+		list = append(list, record)
+	}
+	return list, nil
+}
+
+//addressTxIndex 返回地址交易索引，没有开启或不是core模式时返回nil
+func (bs *ILCBlockScanner) addressTxIndex() *AddressTxIndex {
+	if !bs.wm.Config.AddressTxIndex || bs.wm.Config.RPCServerType != RPCServerCore {
+		return nil
+	}
+
+	bs.addressTxIndexMu.Lock()
+	defer bs.addressTxIndexMu.Unlock()
+
+	if bs.addressTxs == nil {
+		bs.addressTxs = NewAddressTxIndex(filepath.Join(bs.wm.Config.DBPath, bs.wm.Config.AddressTxIndexFile))
+	}
+	return bs.addressTxs
+}
+
+//indexAddressTx 用区块的提取结果更新地址交易索引，没有开启索引时忽略
+func (bs *ILCBlockScanner) indexAddressTx(height uint64, results []ExtractResult) error {
+
+	index := bs.addressTxIndex()
+	if index == nil || height == 0 {
+		return nil
+	}
+
+	err := index.Apply(height, results)
+	if err != nil {
+		bs.wm.Log.Std.Error("block height: %d update address transaction index failed. unexpected error: %v", height, err)
+	}
+	return err
+}
+
+//rollbackAddressTxIndex 删除被孤立区块在地址交易索引中的记录
+func (bs *ILCBlockScanner) rollbackAddressTxIndex(height uint64) error {
+
+	index := bs.addressTxIndex()
+	if index == nil {
+		return nil
+	}
+
+	err := index.Rollback(height)
+	if err != nil {
+		bs.wm.Log.Std.Error("block height: %d rollback address transaction index failed. unexpected error: %v", height, err)
+	}
+	return err
+}
+
+//getAddressTransactionsByIndex 从地址交易索引分页查询地址的交易单
+//与insight的addrs/txs一致：未确认交易在前，已确认交易按区块高度从高到低排列
+func (bs *ILCBlockScanner) getAddressTransactionsByIndex(offset, limit int, address ...string) ([]*Transaction, error) {
+
+	index := bs.addressTxIndex()
+	if index == nil {
+		return nil, fmt.Errorf("address transaction index is not enabled")
+	}
+
+	records, err := index.Find(address...)
+	if err != nil {
+		return nil, err
+	}
+
+	//跟踪中的交易池交易
+	confirmed := make(map[string]bool, len(records))
+	for _, record := range records {
+		confirmed[record.TxID] = true
+	}
+	for _, txid := range bs.memPool.txIDsByAddress(address...) {
+		if !confirmed[txid] {
+			records = append(records, &AddressTxRecord{TxID: txid})
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.BlockHeight != b.BlockHeight {
+			if a.BlockHeight == 0 || b.BlockHeight == 0 {
+				return a.BlockHeight == 0
+			}
+			return a.BlockHeight > b.BlockHeight
+		}
+		return a.TxID < b.TxID
+	})
+
+	trxs := make([]*Transaction, 0)
+	if offset < 0 || offset >= len(records) || limit <= 0 {
+		return trxs, nil
+	}
+	end := offset + limit
+	if end > len(records) {
+		end = len(records)
+	}
+
+	for _, record := range records[offset:end] {
+		trx, err := bs.wm.GetTransaction(record.TxID)
+		if err != nil {
+			return nil, err
+		}
+
+		//优先使用索引记录的区块
+		if record.BlockHeight > 0 && trx.BlockHeight == 0 {
+			trx.BlockHeight = record.BlockHeight
+			trx.BlockHash = record.BlockHash
+		}
+
+		trxs = append(trxs, trx)
+	}
+
+	return trxs, nil
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+func TestILCBlockScanner_GetTransactionsByAddress_Core(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ilcoin-addresstx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	wm, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice", "carol_addr": "carol"})
+	wm.Config.AddressTxIndex = true
+	wm.Config.DBPath = dir
+	saveTestScanned(bs, node)
+	defer bs.addressTxIndex().Close()
+	bs.Restart()
+
+	alice := testAddress("alice_addr")
+	carol := testAddress("carol_addr")
+	coin := openwallet.Coin{Symbol: Symbol}
+
+	deposit := newTestTx("deposit", []testTxIn{{node.chain[1].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "1"}, testTxOut{"carol_addr", "2"})
+	depositBlock := node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), deposit)
+
+	spend := newTestTx("spend", []testTxIn{{deposit.TxID, 0}}, testTxOut{"bob_addr", "0.5"})
+	other := newTestTx("other", []testTxIn{{node.chain[0].Txs[0].TxID, 0}}, testTxOut{"carol_addr", "3"})
+	spendBlock := node.mine("a3", newTestTx("coinbase_a3", nil, testTxOut{"miner_addr", "50"}), spend, other)
+
+	pending := newTestTx("pending", []testTxIn{{deposit.TxID, 1}}, testTxOut{"alice_addr", "1.9"})
+	node.addMemPool(pending)
+
+	bs.ScanBlockTask()
+
+	txIDs := func(list []*openwallet.TxExtractData) string {
+		ids := make([]string, 0)
+		for _, data := range list {
+			ids = append(ids, data.Transaction.TxID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	//未确认交易在前，已确认交易按高度从高到低，同一区块按交易单号排列
+	confirmed := []string{spend.TxID, other.TxID}
+	sort.Strings(confirmed)
+	all := []string{pending.TxID, confirmed[0], confirmed[1], deposit.TxID}
+
+	list, err := bs.GetTransactionsByAddress(0, 10, coin, alice, carol)
+	if err != nil {
+		t.Fatalf("GetTransactionsByAddress unexpected error: %v", err)
+	}
+	if got := txIDs(list); got != strings.Join(all, ",") {
+		t.Errorf("transactions = %s, want %s", got, strings.Join(all, ","))
+	}
+	for _, data := range list {
+		switch data.Transaction.TxID {
+		case deposit.TxID:
+			if data.Transaction.BlockHeight != depositBlock.Height || data.Transaction.BlockHash != depositBlock.Hash || len(data.TxOutputs) != 2 {
+				t.Errorf("deposit data = %d %s outputs: %d", data.Transaction.BlockHeight, data.Transaction.BlockHash, len(data.TxOutputs))
+			}
+		case spend.TxID:
+			if data.Transaction.BlockHeight != spendBlock.Height || len(data.TxInputs) != 1 || data.TxInputs[0].Address != alice {
+				t.Errorf("spend data = %d inputs: %d", data.Transaction.BlockHeight, len(data.TxInputs))
+			}
+		}
+	}
+
+	//分页
+	for _, test := range []struct {
+		offset, limit int
+		want          []string
+	}{
+		{1, 2, all[1:3]},
+		{3, 10, all[3:]},
+		{4, 10, nil},
+	} {
+		list, err = bs.GetTransactionsByAddress(test.offset, test.limit, coin, alice, carol)
+		if err != nil {
+			t.Fatalf("GetTransactionsByAddress unexpected error: %v", err)
+		}
+		if got := txIDs(list); got != strings.Join(test.want, ",") {
+			t.Errorf("offset %d limit %d: transactions = %s, want %s", test.offset, test.limit, got, strings.Join(test.want, ","))
+		}
+	}
+
+	list, _ = bs.GetTransactionsByAddress(0, 10, coin, alice)
+	if got, want := txIDs(list), strings.Join([]string{pending.TxID, spend.TxID, deposit.TxID}, ","); got != want {
+		t.Errorf("alice transactions = %s, want %s", got, want)
+	}
+
+	//被孤立区块中的交易单不再返回
+	node.removeMemPool(pending.TxID)
+	node.reorg(spendBlock.Height - 1)
+	node.mine("b3")
+	node.mine("b4")
+	bs.ScanBlockTask()
+
+	list, _ = bs.GetTransactionsByAddress(0, 10, coin, alice, carol)
+	if got := txIDs(list); got != deposit.TxID {
+		t.Errorf("transactions after reorg = %s, want %s", got, deposit.TxID)
+	}
+
+	//没有开启索引
+	wm.Config.AddressTxIndex = false
+	if _, err := bs.GetTransactionsByAddress(0, 10, coin, alice); err == nil {
+		t.Errorf("GetTransactionsByAddress without index should be failed")
+	}
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/blocktree/go-owcdrivers/addressEncoder"
+	"github.com/blocktree/go-owcrypt"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shopspring/decimal"
+)
+
+//getRawBlockByCore 获取原始区块数据（getblock verbosity = 0），在本地解析区块头及交易单
+func (wm *WalletManager) getRawBlockByCore(hash string) (*Block, error) {
+
+	result, err := wm.WalletClient.Call("getblock", []interface{}{hash, 0})
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := wm.decodeRawBlock(result.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Hash != hash {
+		return nil, fmt.Errorf("raw block hash %s is not equal to %s", block.Hash, hash)
+	}
+
+	//原始区块数据不包含高度，通过区块头接口获取
+	header, err := wm.WalletClient.Call("getblockheader", []interface{}{hash, true})
+	if err != nil {
+		return nil, err
+	}
+
+	block.Height = header.Get("height").Uint()
+	if confirmations := header.Get("confirmations").Int(); confirmations > 0 {
+		block.Confirmations = uint64(confirmations)
+	}
+
+	for _, tx := range block.txDetails {
+		tx.BlockHeight = block.Height
+		tx.Confirmations = block.Confirmations
+	}
+
+	return block, nil
+}
+
+//decodeRawBlock 解析原始区块数据，生成与json解析一致的区块及交易单
+func (wm *WalletManager) decodeRawBlock(rawHex string) (*Block, error) {
+
+	raw, err := hex.DecodeString(rawHex)
+	if err != nil {
+		return nil, err
+	}
+
+	//按btcd的格式解析，btcTransaction只能解析它自己创建的交易单（版本2，不支持coinbase及超过255个输入输出），不能用于区块
+	var msgBlock wire.MsgBlock
+	reader := bytes.NewReader(raw)
+	err = msgBlock.Deserialize(reader)
+	if err != nil {
+		return nil, fmt.Errorf("decode raw block failed, unexpected error: %v", err)
+	}
+	if reader.Len() > 0 {
+		return nil, fmt.Errorf("decode raw block failed, %d bytes left after the last transaction", reader.Len())
+	}
+
+	err = verifyRawBlock(&msgBlock)
+	if err != nil {
+		return nil, fmt.Errorf("decode raw block failed, %v", err)
+	}
+
+	obj := &Block{}
+	obj.Hash = msgBlock.BlockHash().String()
+	obj.Merkleroot = msgBlock.Header.MerkleRoot.String()
+	obj.Version = uint64(msgBlock.Header.Version)
+	obj.Time = uint64(msgBlock.Header.Timestamp.Unix())
+	if msgBlock.Header.PrevBlock != (chainhash.Hash{}) {
+		obj.Previousblockhash = msgBlock.Header.PrevBlock.String()
+	}
+
+	obj.isVerbose = true
+	obj.tx = make([]string, 0, len(msgBlock.Transactions))
+	obj.txDetails = make([]*Transaction, 0, len(msgBlock.Transactions))
+	for _, msgTx := range msgBlock.Transactions {
+		txObj := wm.newTxByRaw(msgTx)
+		txObj.BlockHash = obj.Hash
+		txObj.Blocktime = int64(obj.Time)
+		obj.txDetails = append(obj.txDetails, txObj)
+		obj.tx = append(obj.tx, txObj.TxID)
+	}
+
+	return obj, nil
+}
+
+//witnessCommitmentPrefix coinbase中见证数据承诺输出的前缀：OP_RETURN 0x24 0xaa21a9ed
+var witnessCommitmentPrefix = []byte{txscript.OP_RETURN, txscript.OP_DATA_36, 0xaa, 0x21, 0xa9, 0xed}
+
+//blockMerkleRoot 由交易单hash计算默克尔根
+func blockMerkleRoot(hashes []chainhash.Hash) chainhash.Hash {
+
+	if len(hashes) == 0 {
+		return chainhash.Hash{}
+	}
+
+	level := append([]chainhash.Hash{}, hashes...)
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([]chainhash.Hash, 0, len(level)/2)
+		for i := 0; i < len(level); i += 2 {
+			var buf [chainhash.HashSize * 2]byte
+			copy(buf[:chainhash.HashSize], level[i][:])
+			copy(buf[chainhash.HashSize:], level[i+1][:])
+			next = append(next, chainhash.DoubleHashH(buf[:]))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+//verifyRawBlock 校验解析出的交易单与区块头一致，区块hash只覆盖区块头，交易单格式不一致时由此发现：
+//交易单hash的默克尔根等于区块头的默克尔根，有见证数据时coinbase中的见证数据承诺与见证hash一致
+func verifyRawBlock(msgBlock *wire.MsgBlock) error {
+
+	if len(msgBlock.Transactions) == 0 {
+		return fmt.Errorf("block has no transactions")
+	}
+
+	var (
+		txHashes      = make([]chainhash.Hash, len(msgBlock.Transactions))
+		witnessHashes = make([]chainhash.Hash, len(msgBlock.Transactions))
+		hasWitness    = false
+	)
+
+	for i, msgTx := range msgBlock.Transactions {
+		txHashes[i] = msgTx.TxHash()
+		//coinbase的见证hash按0计算
+		if i > 0 {
+			witnessHashes[i] = msgTx.WitnessHash()
+		}
+		if msgTx.HasWitness() {
+			hasWitness = true
+		}
+	}
+
+	if root := blockMerkleRoot(txHashes); root != msgBlock.Header.MerkleRoot {
+		return fmt.Errorf("merkle root of transactions %s is not equal to header %s", root, msgBlock.Header.MerkleRoot)
+	}
+
+	if !hasWitness {
+		return nil
+	}
+
+	coinbase := msgBlock.Transactions[0]
+	var commitment []byte
+	for _, out := range coinbase.TxOut {
+		if len(out.PkScript) >= len(witnessCommitmentPrefix)+chainhash.HashSize && bytes.HasPrefix(out.PkScript, witnessCommitmentPrefix) {
+			commitment = out.PkScript[len(witnessCommitmentPrefix) : len(witnessCommitmentPrefix)+chainhash.HashSize]
+		}
+	}
+	if commitment == nil {
+		return fmt.Errorf("block has witness data without witness commitment")
+	}
+
+	if len(coinbase.TxIn) == 0 || len(coinbase.TxIn[0].Witness) != 1 || len(coinbase.TxIn[0].Witness[0]) != chainhash.HashSize {
+		return fmt.Errorf("coinbase witness nonce is invalid")
+	}
+
+	witnessRoot := blockMerkleRoot(witnessHashes)
+	commit := chainhash.DoubleHashB(append(witnessRoot[:], coinbase.TxIn[0].Witness[0]...))
+	if !bytes.Equal(commit, commitment) {
+		return fmt.Errorf("witness commitment %x is not equal to witness data %x", commitment, commit)
+	}
+
+	return nil
+}
+
+//newTxByRaw 由原始交易单生成交易单模型
+func (wm *WalletManager) newTxByRaw(msgTx *wire.MsgTx) *Transaction {
+
+	obj := Transaction{}
+	obj.TxID = msgTx.TxHash().String()
+	obj.Version = uint64(msgTx.Version)
+	obj.LockTime = int64(msgTx.LockTime)
+	obj.Size = uint64(msgTx.SerializeSize())
+	obj.Decimals = wm.Decimal()
+
+	obj.Vins = make([]*Vin, 0, len(msgTx.TxIn))
+	for i, in := range msgTx.TxIn {
+		input := &Vin{N: uint64(i)}
+		if in.PreviousOutPoint.Index == wire.MaxPrevOutIndex && in.PreviousOutPoint.Hash == (chainhash.Hash{}) {
+			input.Coinbase = hex.EncodeToString(in.SignatureScript)
+			obj.IsCoinBase = true
+		} else {
+			input.TxID = in.PreviousOutPoint.Hash.String()
+			input.Vout = uint64(in.PreviousOutPoint.Index)
+		}
+		obj.Vins = append(obj.Vins, input)
+	}
+
+	obj.Vouts = make([]*Vout, 0, len(msgTx.TxOut))
+	for i, out := range msgTx.TxOut {
+		output := &Vout{N: uint64(i)}
+		output.Value = decimal.New(out.Value, -wm.Decimal()).String()
+		output.ScriptPubKey = hex.EncodeToString(out.PkScript)
+		output.Type, output.Addr = wm.decodeScriptPubKey(out.PkScript)
+		obj.Vouts = append(obj.Vouts, output)
+	}
+
+	return &obj
+}
+
+//decodeScriptPubKey 解析锁定脚本的类型及地址，类型名称与core的scriptPubKey.type一致
+func (wm *WalletManager) decodeScriptPubKey(script []byte) (string, string) {
+
+	p2pkh := addressEncoder.BTC_mainnetAddressP2PKH
+	p2sh := addressEncoder.BTC_mainnetAddressP2SH
+	if wm.Config.IsTestNet {
+		p2pkh = addressEncoder.BTC_testnetAddressP2PKH
+		p2sh = addressEncoder.BTC_testnetAddressP2SH
+	}
+
+	switch txscript.GetScriptClass(script) {
+	case txscript.PubKeyHashTy:
+		return "pubkeyhash", addressEncoder.AddressEncode(script[3:23], p2pkh)
+	case txscript.ScriptHashTy:
+		return "scripthash", addressEncoder.AddressEncode(script[2:22], p2sh)
+	case txscript.WitnessV0PubKeyHashTy:
+		address, _ := scriptPubKeyToBech32Address(script, wm.Config.IsTestNet)
+		return "witness_v0_keyhash", address
+	case txscript.WitnessV0ScriptHashTy:
+		address, _ := scriptPubKeyToBech32Address(script, wm.Config.IsTestNet)
+		return "witness_v0_scripthash", address
+	case txscript.PubKeyTy:
+		//core把P2PK的公钥显示为对应的P2PKH地址
+		pubKey := script[1 : len(script)-1]
+		return "pubkey", addressEncoder.AddressEncode(owcrypt.Hash(pubKey, 0, owcrypt.HASH_ALG_HASH160), p2pkh)
+	case txscript.MultiSigTy:
+		return "multisig", ""
+	case txscript.NullDataTy:
+		return "nulldata", ""
+	}
+
+	return "nonstandard", ""
+}
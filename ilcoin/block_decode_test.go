@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestDecodeScriptPubKey(t *testing.T) {
+
+	wm := NewWalletManager()
+	wm.Config.IsTestNet = false
+
+	tests := []struct {
+		script  string
+		typ     string
+		address string
+	}{
+		{
+			script:  "76a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1888ac",
+			typ:     "pubkeyhash",
+			address: "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa",
+		},
+		{
+			script:  "4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac",
+			typ:     "pubkey",
+			address: "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa",
+		},
+		{
+			script:  "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+			typ:     "witness_v0_keyhash",
+			address: "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+		},
+		{
+			script:  "6a0b68656c6c6f20776f726c64",
+			typ:     "nulldata",
+			address: "",
+		},
+	}
+
+	for i, test := range tests {
+		script, _ := hex.DecodeString(test.script)
+		typ, address := wm.decodeScriptPubKey(script)
+		if typ != test.typ || address != test.address {
+			t.Errorf("case %d: decodeScriptPubKey = %s %s, want %s %s", i, typ, address, test.typ, test.address)
+		}
+	}
+}
+
+func TestGetRawBlockByCore(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	fund := newTestTx("fund", nil, testTxOut{"alice_addr", "10"})
+	node.mine("a1", fund)
+	pay := newTestTx("pay", []testTxIn{{TxID: fund.TxID, Vout: 0}}, testTxOut{"bob_addr", "7"}, testTxOut{"alice_addr", "2.9"})
+	node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), pay)
+	node.mine("a3")
+
+	wm, _, _ := newTestScanner(node, nil)
+
+	hash := node.chain[2].Hash
+	verbose, err := wm.getBlockByCore(hash, 2)
+	if err != nil {
+		t.Fatalf("getBlockByCore unexpected error: %v", err)
+	}
+	raw, err := wm.getRawBlockByCore(hash)
+	if err != nil {
+		t.Fatalf("getRawBlockByCore unexpected error: %v", err)
+	}
+
+	//本地解析的区块与json解析的结果一致
+	if !reflect.DeepEqual(raw.BlockHeader(Symbol), verbose.BlockHeader(Symbol)) {
+		t.Errorf("raw block header = %+v, want %+v", raw.BlockHeader(Symbol), verbose.BlockHeader(Symbol))
+	}
+	if !reflect.DeepEqual(raw.tx, verbose.tx) {
+		t.Errorf("raw block txs = %v, want %v", raw.tx, verbose.tx)
+	}
+	for i, tx := range raw.txDetails {
+		want := verbose.txDetails[i]
+		if tx.TxID != want.TxID || tx.BlockHeight != want.BlockHeight || tx.BlockHash != want.BlockHash || tx.Confirmations != want.Confirmations {
+			t.Errorf("raw tx[%d] = %+v, want %+v", i, tx, want)
+		}
+		if !reflect.DeepEqual(tx.Vins, want.Vins) {
+			t.Errorf("raw tx[%d] vins = %+v, want %+v", i, tx.Vins, want.Vins)
+		}
+		if !reflect.DeepEqual(tx.Vouts, want.Vouts) {
+			t.Errorf("raw tx[%d] vouts = %+v, want %+v", i, tx.Vouts, want.Vouts)
+		}
+	}
+}
+
+func TestILCBlockScanner_ScanBlock_DecodeRawBlock(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	fund := newTestTx("fund", nil, testTxOut{"alice_addr", "10"})
+	node.mine("a1", fund)
+	pay := newTestTx("pay", []testTxIn{{TxID: fund.TxID, Vout: 0}}, testTxOut{"bob_addr", "7"}, testTxOut{"alice_addr", "2.9"})
+	node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), pay)
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice", "bob_addr": "bob"})
+	wm.Config.DecodeRawBlock = true
+
+	err := bs.ScanBlock(2)
+	if err != nil {
+		t.Fatalf("ScanBlock unexpected error: %v", err)
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	alice := observer.data["alice"]
+	if len(alice) != 1 || len(alice[0].TxInputs) != 1 || len(alice[0].TxOutputs) != 1 {
+		t.Fatalf("alice extract data = %+v", alice)
+	}
+	if alice[0].TxInputs[0].Amount != "10" || alice[0].TxOutputs[0].Amount != "2.9" || alice[0].Transaction.Fees != "0.10000000" {
+		t.Errorf("alice input = %+v, output = %+v, fees = %s", alice[0].TxInputs[0], alice[0].TxOutputs[0], alice[0].Transaction.Fees)
+	}
+	if alice[0].TxOutputs[0].Address != testAddress("alice_addr") || alice[0].Transaction.BlockHeight != 2 {
+		t.Errorf("alice output = %+v", alice[0].TxOutputs[0])
+	}
+	bob := observer.data["bob"]
+	if len(bob) != 1 || len(bob[0].TxOutputs) != 1 || bob[0].TxOutputs[0].Amount != "7" {
+		t.Errorf("bob extract data = %+v", bob)
+	}
+}
+
+//newTestSegwitBlock 包含一笔隔离见证交易单的区块，coinbase带见证数据承诺
+func newTestSegwitBlock() (*wire.MsgBlock, *wire.MsgTx) {
+
+	prev := chainhash.DoubleHashH([]byte("segwit_prev"))
+	segTx := wire.NewMsgTx(2)
+	segTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&prev, 1), nil, wire.TxWitness{bytes.Repeat([]byte{0x30}, 71), bytes.Repeat([]byte{0x02}, 33)}))
+	segTx.AddTxOut(wire.NewTxOut(90000000, append([]byte{0x00, 0x14}, bytes.Repeat([]byte{0x01}, 20)...)))
+
+	nonce := make([]byte, chainhash.HashSize)
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte("segwit"), wire.TxWitness{nonce}))
+	coinbase.AddTxOut(wire.NewTxOut(5000000000, testScript("miner_addr")))
+
+	witnessRoot := blockMerkleRoot([]chainhash.Hash{{}, segTx.WitnessHash()})
+	commitment := chainhash.DoubleHashB(append(witnessRoot[:], nonce...))
+	coinbase.AddTxOut(wire.NewTxOut(0, append(append([]byte{}, witnessCommitmentPrefix...), commitment...)))
+
+	header := wire.BlockHeader{Version: 0x20000000, Timestamp: time.Unix(1500000000, 0), Bits: 0x1d00ffff}
+	header.MerkleRoot = blockMerkleRoot([]chainhash.Hash{coinbase.TxHash(), segTx.TxHash()})
+	msgBlock := wire.NewMsgBlock(&header)
+	msgBlock.AddTransaction(coinbase)
+	msgBlock.AddTransaction(segTx)
+	return msgBlock, segTx
+}
+
+func serializeTestBlock(t *testing.T, msgBlock *wire.MsgBlock) string {
+	var buf bytes.Buffer
+	if err := msgBlock.Serialize(&buf); err != nil {
+		t.Fatalf("serialize block unexpected error: %v", err)
+	}
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func TestWalletManager_DecodeRawBlock_Verify(t *testing.T) {
+
+	wm := NewWalletManager()
+	wm.Config.IsTestNet = false
+
+	msgBlock, segTx := newTestSegwitBlock()
+	block, err := wm.decodeRawBlock(serializeTestBlock(t, msgBlock))
+	if err != nil {
+		t.Fatalf("decodeRawBlock unexpected error: %v", err)
+	}
+	if len(block.txDetails) != 2 || block.txDetails[1].TxID != segTx.TxHash().String() || block.txDetails[1].Vouts[0].Type != "witness_v0_keyhash" {
+		t.Errorf("segwit tx = %+v", block.txDetails[1])
+	}
+
+	//见证数据与coinbase的承诺不一致
+	segTx.TxIn[0].Witness[0][0] ^= 0xff
+	if _, err := wm.decodeRawBlock(serializeTestBlock(t, msgBlock)); err == nil || !strings.Contains(err.Error(), "witness commitment") {
+		t.Errorf("tampered witness error = %v", err)
+	}
+
+	//交易单与区块头的默克尔根不一致
+	msgBlock, segTx = newTestSegwitBlock()
+	segTx.TxOut[0].Value++
+	if _, err := wm.decodeRawBlock(serializeTestBlock(t, msgBlock)); err == nil || !strings.Contains(err.Error(), "merkle root") {
+		t.Errorf("tampered transaction error = %v", err)
+	}
+
+	//最后一个交易单之后还有数据
+	msgBlock, _ = newTestSegwitBlock()
+	if _, err := wm.decodeRawBlock(serializeTestBlock(t, msgBlock) + "00"); err == nil || !strings.Contains(err.Error(), "bytes left") {
+		t.Errorf("trailing bytes error = %v", err)
+	}
+}
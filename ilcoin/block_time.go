@@ -0,0 +1,206 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	medianTimeSpan     = 11    //中位时间取最近区块的数量，与节点一致
+	blockTimeCacheSize = 10000 //按时间查找区块的区块头缓存数量
+)
+
+//blockTimeHeader 按时间查找区块使用的区块头
+type blockTimeHeader struct {
+	Height     uint64
+	Hash       string
+	Time       int64
+	MedianTime int64 //中位时间，0表示未获取
+}
+
+//blockTimeCache 按高度缓存的区块头，只缓存已达到最终确认深度的区块，避免分叉后使用旧的区块
+type blockTimeCache struct {
+	mu      sync.Mutex
+	headers map[uint64]*blockTimeHeader
+}
+
+func newBlockTimeCache() *blockTimeCache {
+	return &blockTimeCache{
+		headers: make(map[uint64]*blockTimeHeader),
+	}
+}
+
+func (c *blockTimeCache) get(height uint64) (*blockTimeHeader, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header, ok := c.headers[height]
+	if !ok {
+		return nil, false
+	}
+	h := *header
+	return &h, true
+}
+
+func (c *blockTimeCache) put(header *blockTimeHeader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.headers) >= blockTimeCacheSize {
+		//超过数量时整体清空，二分查找很快会重新填充需要的区块头
+		c.headers = make(map[uint64]*blockTimeHeader)
+	}
+	h := *header
+	c.headers[header.Height] = &h
+}
+
+//GetBlockHeightByTime 查找第一个时间不早于t的区块高度
+//区块时间不是严格递增的，先以单调递增的中位时间二分查找，再在中位时间覆盖的区块中找出第一个不早于t的区块
+//t晚于最新区块的时间时返回错误
+func (wm *WalletManager) GetBlockHeightByTime(t time.Time) (uint64, error) {
+
+	tip, err := wm.GetBlockHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	height, err := wm.blockHeightByTime(t.Unix(), tip)
+	if err != nil {
+		return 0, err
+	}
+
+	if height > tip {
+		return 0, fmt.Errorf("no block at or after %s, latest block height: %d", t.UTC().Format(time.RFC3339), tip)
+	}
+
+	return height, nil
+}
+
+//blockHeightByTime 在[0, tip]中查找第一个时间不早于t的区块高度，都早于t时返回tip+1
+func (wm *WalletManager) blockHeightByTime(t int64, tip uint64) (uint64, error) {
+
+	//中位时间不早于t的第一个区块
+	low, high := uint64(0), tip+1
+	for low < high {
+		mid := low + (high-low)/2
+
+		medianTime, err := wm.getMedianTimePast(mid, tip)
+		if err != nil {
+			return 0, err
+		}
+
+		if medianTime < t {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+
+	//中位时间不早于t时，其覆盖的区块中至少一半不早于t，从中找出第一个
+	start := uint64(0)
+	if low >= medianTimeSpan {
+		start = low - (medianTimeSpan - 1)
+	}
+	end := low
+	if end > tip {
+		end = tip
+	}
+
+	for height := start; height <= end; height++ {
+		header, err := wm.getBlockTimeHeader(height, tip)
+		if err != nil {
+			return 0, err
+		}
+		if header.Time >= t {
+			return height, nil
+		}
+	}
+
+	return tip + 1, nil
+}
+
+//getMedianTimePast 区块的中位时间，包含区块本身在内最近11个区块时间的中位数
+func (wm *WalletManager) getMedianTimePast(height, tip uint64) (int64, error) {
+
+	header, err := wm.getBlockTimeHeader(height, tip)
+	if err != nil {
+		return 0, err
+	}
+
+	if header.MedianTime > 0 {
+		return header.MedianTime, nil
+	}
+
+	//浏览器不返回中位时间，由前面的区块计算
+	times := make([]int64, 0, medianTimeSpan)
+	for i := uint64(0); i < medianTimeSpan && i <= height; i++ {
+		prev, err := wm.getBlockTimeHeader(height-i, tip)
+		if err != nil {
+			return 0, err
+		}
+		times = append(times, prev.Time)
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	header.MedianTime = times[len(times)/2]
+
+	wm.cacheBlockTimeHeader(header, tip)
+
+	return header.MedianTime, nil
+}
+
+//getBlockTimeHeader 获取区块的时间，优先使用缓存
+func (wm *WalletManager) getBlockTimeHeader(height, tip uint64) (*blockTimeHeader, error) {
+
+	if header, ok := wm.blockTimes.get(height); ok {
+		return header, nil
+	}
+
+	hash, err := wm.GetBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &blockTimeHeader{Height: height, Hash: hash}
+
+	if wm.Config.RPCServerType == RPCServerExplorer {
+		result, err := wm.ExplorerClient.Call(fmt.Sprintf("block/%s", hash), nil, "GET")
+		if err != nil {
+			return nil, err
+		}
+		header.Time = result.Get("time").Int()
+	} else {
+		result, err := wm.WalletClient.Call("getblockheader", []interface{}{hash, true})
+		if err != nil {
+			return nil, err
+		}
+		header.Time = result.Get("time").Int()
+		header.MedianTime = result.Get("mediantime").Int()
+	}
+
+	wm.cacheBlockTimeHeader(header, tip)
+
+	return header, nil
+}
+
+//cacheBlockTimeHeader 缓存已达到最终确认深度的区块头
+func (wm *WalletManager) cacheBlockTimeHeader(header *blockTimeHeader, tip uint64) {
+	if header.Height+wm.Config.FinalityDepth <= tip {
+		wm.blockTimes.put(header)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//newTestExplorer 用模拟节点的主链数据提供insight的区块接口
+func newTestExplorer(node *testNode) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+
+		path := strings.TrimPrefix(r.URL.Path, "/insight-api/")
+		var resp interface{}
+		switch {
+		case path == "status":
+			resp = map[string]interface{}{"info": map[string]interface{}{"blocks": len(node.chain) - 1}}
+		case strings.HasPrefix(path, "block-index/"):
+			height, _ := strconv.Atoi(strings.TrimPrefix(path, "block-index/"))
+			if height >= len(node.chain) {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			resp = map[string]interface{}{"blockHash": node.chain[height].Hash}
+		case strings.HasPrefix(path, "block/"):
+			block, ok := node.blocks[strings.TrimPrefix(path, "block/")]
+			if !ok {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			resp = map[string]interface{}{"hash": block.Hash, "height": block.Height, "time": block.Time}
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestWalletManager_GetBlockHeightByTime(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	//高度12的区块时间早于高度11
+	base := node.chain[0].Time
+	for i := 1; i <= 40; i++ {
+		blockTime := base + int64(i)*600
+		if i == 12 {
+			blockTime = base + 10*600 + 300
+		}
+		node.mineAt(blockTime, fmt.Sprintf("a%d", i))
+	}
+
+	explorer := newTestExplorer(node)
+	defer explorer.Close()
+
+	core, _, _ := newTestScanner(node, nil)
+
+	explorerWM := NewWalletManager()
+	explorerWM.Config.RPCServerType = RPCServerExplorer
+	explorerWM.ExplorerClient = NewExplorer(explorer.URL+"/insight-api/", false)
+
+	tests := []struct {
+		time int64
+		want uint64
+	}{
+		{base - 1, 0},
+		{base, 0},
+		{base + 1, 1},
+		{base + 15*600, 15},
+		{base + 10*600 + 200, 11},
+		{base + 11*600 - 100, 11},
+		{base + 12*600 - 100, 13},
+		{base + 40*600, 40},
+	}
+
+	for name, wm := range map[string]*WalletManager{"core": core, "explorer": explorerWM} {
+		for _, test := range tests {
+			height, err := wm.GetBlockHeightByTime(time.Unix(test.time, 0))
+			if err != nil {
+				t.Errorf("%s GetBlockHeightByTime(%d) unexpected error: %v", name, test.time, err)
+				continue
+			}
+			if height != test.want {
+				t.Errorf("%s GetBlockHeightByTime(%d) = %d, want %d", name, test.time, height, test.want)
+			}
+		}
+
+		if _, err := wm.GetBlockHeightByTime(time.Unix(base+40*600+1, 0)); err == nil {
+			t.Errorf("%s GetBlockHeightByTime after the latest block should be failed", name)
+		}
+	}
+
+	//已达到最终确认深度的区块头使用缓存
+	core.GetBlockHeightByTime(time.Unix(base+5*600, 0))
+	hashCalls, headerCalls := node.callCount("getblockhash"), node.callCount("getblockheader")
+	height, err := core.GetBlockHeightByTime(time.Unix(base+5*600, 0))
+	if err != nil || height != 5 {
+		t.Fatalf("GetBlockHeightByTime = %d, %v, want 5", height, err)
+	}
+	if node.callCount("getblockhash") != hashCalls || node.callCount("getblockheader") != headerCalls {
+		t.Errorf("cached block headers are requested again")
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+const (
+	localBlockchainBucket = "blockchain"
+	localCurrentBlockKey  = "currentBlockHead"
+)
+
+//LocalBlockchainDAI 基于storm的本地区块链数据访问接口，外部没有设置BlockchainDAI时扫描器默认使用
+//数据按币种分节点保存，区块头只保留最新的MaxBlockCache个
+type LocalBlockchainDAI struct {
+	openwallet.BlockchainDAIBase
+	stormFile
+
+	mu            sync.Mutex
+	maxBlockCache uint64
+}
+
+//NewLocalBlockchainDAI 创建本地区块链数据访问接口，数据库文件在首次使用时打开
+//maxBlockCache 保留的区块头数量，0则不清理
+func NewLocalBlockchainDAI(dbFile string, maxBlockCache uint64) *LocalBlockchainDAI {
+	return &LocalBlockchainDAI{
+		stormFile:     stormFile{path: dbFile},
+		maxBlockCache: maxBlockCache,
+	}
+}
+
+//openNode 打开数据库，返回币种的数据节点
+func (dai *LocalBlockchainDAI) openNode(symbol string) (storm.Node, error) {
+	db, err := dai.open()
+	if err != nil {
+		return nil, err
+	}
+	return db.From(symbol), nil
+}
+
+//SaveCurrentBlockHead 记录已扫描的区块高度和hash
+func (dai *LocalBlockchainDAI) SaveCurrentBlockHead(header *openwallet.BlockHeader) error {
+	node, err := dai.openNode(header.Symbol)
+	if err != nil {
+		return err
+	}
+	return node.Set(localBlockchainBucket, localCurrentBlockKey, header)
+}
+
+//GetCurrentBlockHead 获取已扫描的区块高度和hash
+func (dai *LocalBlockchainDAI) GetCurrentBlockHead(symbol string) (*openwallet.BlockHeader, error) {
+	node, err := dai.openNode(symbol)
+	if err != nil {
+		return nil, err
+	}
+	var header openwallet.BlockHeader
+	err = node.Get(localBlockchainBucket, localCurrentBlockKey, &header)
+	if err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+//SaveLocalBlockHead 保存区块头，并清理超出保留深度的旧区块头
+func (dai *LocalBlockchainDAI) SaveLocalBlockHead(header *openwallet.BlockHeader) error {
+	node, err := dai.openNode(header.Symbol)
+	if err != nil {
+		return err
+	}
+
+	err = node.Save(header)
+	if err != nil {
+		return err
+	}
+
+	return dai.pruneBlockHeads(node, header.Height)
+}
+
+//pruneBlockHeads 删除高度不大于height-maxBlockCache的区块头
+func (dai *LocalBlockchainDAI) pruneBlockHeads(node storm.Node, height uint64) error {
+	dai.mu.Lock()
+	maxBlockCache := dai.maxBlockCache
+	dai.mu.Unlock()
+
+	if maxBlockCache == 0 || height <= maxBlockCache {
+		return nil
+	}
+
+	//区块头以高度为主键，按高度顺序存储，清理过的高度不会再遍历
+	var expired []*openwallet.BlockHeader
+	err := node.Range("Height", uint64(0), height-maxBlockCache, &expired)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	for _, header := range expired {
+		err = node.DeleteStruct(header)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//GetLocalBlockHeadByHeight 获取指定高度的区块头
+func (dai *LocalBlockchainDAI) GetLocalBlockHeadByHeight(height uint64, symbol string) (*openwallet.BlockHeader, error) {
+	node, err := dai.openNode(symbol)
+	if err != nil {
+		return nil, err
+	}
+	var header openwallet.BlockHeader
+	err = node.One("Height", height, &header)
+	if err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+//SaveUnscanRecord 保存未扫记录
+func (dai *LocalBlockchainDAI) SaveUnscanRecord(record *openwallet.UnscanRecord) error {
+	node, err := dai.openNode(record.Symbol)
+	if err != nil {
+		return err
+	}
+	return node.Save(record)
+}
+
+//DeleteUnscanRecordByHeight 删除指定高度的未扫记录
+func (dai *LocalBlockchainDAI) DeleteUnscanRecordByHeight(height uint64, symbol string) error {
+	node, err := dai.openNode(symbol)
+	if err != nil {
+		return err
+	}
+	err = node.Select(q.Eq("BlockHeight", height)).Delete(&openwallet.UnscanRecord{})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//DeleteUnscanRecordByID 删除指定的未扫记录
+func (dai *LocalBlockchainDAI) DeleteUnscanRecordByID(id string, symbol string) error {
+	node, err := dai.openNode(symbol)
+	if err != nil {
+		return err
+	}
+	err = node.DeleteStruct(&openwallet.UnscanRecord{ID: id})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//GetUnscanRecords 获取币种的全部未扫记录
+func (dai *LocalBlockchainDAI) GetUnscanRecords(symbol string) ([]*openwallet.UnscanRecord, error) {
+	node, err := dai.openNode(symbol)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*openwallet.UnscanRecord, 0)
+	err = node.All(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//SetMaxBlockCache 设置保留的区块头数量，0则不清理
+func (dai *LocalBlockchainDAI) SetMaxBlockCache(max uint64, symbol string) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	dai.maxBlockCache = max
+	return nil
+}
+
+//blockchainDAI 返回外部设置的区块链数据访问接口，没有设置时使用本地数据库
+func (bs *ILCBlockScanner) blockchainDAI() openwallet.BlockchainDAI {
+	if bs.BlockchainDAI != nil {
+		return bs.BlockchainDAI
+	}
+
+	bs.localDAIMu.Lock()
+	defer bs.localDAIMu.Unlock()
+
+	//数据目录在加载配置后才确定，首次使用时才创建
+	if bs.localDAI == nil {
+		dbFile := filepath.Join(bs.wm.Config.DBPath, bs.wm.Config.BlockchainFile)
+		bs.localDAI = NewLocalBlockchainDAI(dbFile, bs.wm.Config.MaxBlockCache)
+	}
+	return bs.localDAI
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+func TestLocalBlockchainDAI(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ilcoin-dai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dai := NewLocalBlockchainDAI(filepath.Join(dir, "db", "blockchain.db"), 3)
+	defer dai.Close()
+
+	if _, err := dai.GetCurrentBlockHead(Symbol); err == nil {
+		t.Errorf("GetCurrentBlockHead of empty database should be failed")
+	}
+
+	for i := uint64(1); i <= 6; i++ {
+		err = dai.SaveLocalBlockHead(&openwallet.BlockHeader{Height: i, Hash: fmt.Sprintf("hash%d", i), Symbol: Symbol})
+		if err != nil {
+			t.Fatalf("SaveLocalBlockHead unexpected error: %v", err)
+		}
+	}
+	dai.SaveCurrentBlockHead(&openwallet.BlockHeader{Height: 6, Hash: "hash6", Symbol: Symbol})
+
+	//重新打开数据库，数据仍然存在
+	dai.Close()
+
+	current, err := dai.GetCurrentBlockHead(Symbol)
+	if err != nil || current.Height != 6 || current.Hash != "hash6" {
+		t.Errorf("GetCurrentBlockHead = %+v, %v, want 6 hash6", current, err)
+	}
+
+	//只保留最新的3个区块头
+	for i := uint64(1); i <= 6; i++ {
+		header, err := dai.GetLocalBlockHeadByHeight(i, Symbol)
+		if i <= 3 {
+			if err == nil {
+				t.Errorf("block head %d should be pruned", i)
+			}
+			continue
+		}
+		if err != nil || header.Hash != fmt.Sprintf("hash%d", i) {
+			t.Errorf("GetLocalBlockHeadByHeight(%d) = %+v, %v", i, header, err)
+		}
+	}
+
+	//其他币种的数据相互独立
+	if _, err := dai.GetLocalBlockHeadByHeight(6, "BTC"); err == nil {
+		t.Errorf("block head of other symbol should not be found")
+	}
+
+	records := []*openwallet.UnscanRecord{
+		openwallet.NewUnscanRecord(5, "tx1", "failed", Symbol),
+		openwallet.NewUnscanRecord(5, "tx2", "failed", Symbol),
+		openwallet.NewUnscanRecord(6, "tx3", "failed", Symbol),
+	}
+	for _, r := range records {
+		dai.SaveUnscanRecord(r)
+	}
+
+	dai.DeleteUnscanRecordByID(records[2].ID, Symbol)
+	list, _ := dai.GetUnscanRecords(Symbol)
+	if len(list) != 2 {
+		t.Errorf("unscan records = %d, want 2", len(list))
+	}
+
+	dai.DeleteUnscanRecordByHeight(5, Symbol)
+	list, _ = dai.GetUnscanRecords(Symbol)
+	if len(list) != 0 {
+		t.Errorf("unscan records = %d, want 0", len(list))
+	}
+
+	//没有记录时删除不报错
+	if err := dai.DeleteUnscanRecordByHeight(5, Symbol); err != nil {
+		t.Errorf("DeleteUnscanRecordByHeight unexpected error: %v", err)
+	}
+}
+
+func TestILCBlockScanner_DefaultBlockchainDAI(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ilcoin-dai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	for i := 1; i <= 2; i++ {
+		node.mine(fmt.Sprintf("a%d", i))
+	}
+
+	//没有设置BlockchainDAI，使用本地数据库
+	wm, bs, observer := newTestScanner(node, nil)
+	bs.BlockchainDAI = nil
+	wm.Config.DBPath = dir
+	wm.Config.MaxBlockCache = 3
+	saveTestScanned(bs, node)
+	defer bs.localDAI.Close()
+
+	for i := 3; i <= 8; i++ {
+		node.mine(fmt.Sprintf("a%d", i))
+	}
+
+	bs.Restart()
+	bs.ScanBlockTask()
+	observer.waitHeaders(t, 6)
+
+	height, hash, err := bs.GetLocalNewBlock()
+	tip := node.chain[len(node.chain)-1]
+	if err != nil || height != tip.Height || hash != tip.Hash {
+		t.Errorf("GetLocalNewBlock = %d %s %v, want %d %s", height, hash, err, tip.Height, tip.Hash)
+	}
+
+	for _, b := range node.chain {
+		_, err := bs.GetLocalBlock(b.Height)
+		if b.Height <= 5 && err == nil {
+			t.Errorf("local block %d should be pruned", b.Height)
+		}
+		if b.Height > 5 && err != nil {
+			t.Errorf("GetLocalBlock(%d) unexpected error: %v", b.Height, err)
+		}
+	}
+}
@@ -16,6 +16,7 @@
 package ilcoin
 
 import (
+	"fmt"
 	"path/filepath"
 	"testing"
 
@@ -286,3 +287,97 @@ func TestGetLocalBlock(t *testing.T) {
 	}
 	log.Info("blocks = ", len(blocks))
 }
+
+func TestILCBlockScanner_ScanBlockTask_DeepReorg(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	for i := 1; i <= 5; i++ {
+		node.mine(fmt.Sprintf("a%d", i))
+	}
+
+	_, bs, observer := newTestScanner(node, nil)
+	saveTestScanned(bs, node)
+	orphans := append([]*testBlock{}, node.chain[3:]...)
+
+	//高度2之后的区块全部被替换
+	node.reorg(2)
+	for i := 3; i <= 6; i++ {
+		node.mine(fmt.Sprintf("b%d", i))
+	}
+
+	bs.Restart()
+	bs.ScanBlockTask()
+
+	headers := observer.waitHeaders(t, 3+4)
+
+	//先按从高到低的顺序通知所有被孤立的区块
+	for i, header := range headers[:3] {
+		orphan := orphans[len(orphans)-1-i]
+		if !header.Fork || header.Hash != orphan.Hash || header.Height != orphan.Height {
+			t.Errorf("fork notify[%d] = %d %s fork: %v, want %d %s", i, header.Height, header.Hash, header.Fork, orphan.Height, orphan.Hash)
+		}
+	}
+
+	//再从共同祖先的下一个区块开始通知主链区块
+	for i, header := range headers[3:] {
+		block := node.chain[3+i]
+		if header.Fork || header.Hash != block.Hash {
+			t.Errorf("block notify[%d] = %d %s fork: %v, want %d %s", i, header.Height, header.Hash, header.Fork, block.Height, block.Hash)
+		}
+	}
+
+	current, err := bs.GetScannedBlockHeader()
+	if err != nil {
+		t.Fatalf("GetScannedBlockHeader unexpected error: %v", err)
+	}
+	tip := node.chain[len(node.chain)-1]
+	if current.Height != tip.Height || current.Hash != tip.Hash {
+		t.Errorf("scanned block = %d %s, want %d %s", current.Height, current.Hash, tip.Height, tip.Hash)
+	}
+}
+
+func TestILCBlockScanner_ScanBlock_Verbose(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	fund := newTestTx("fund", nil, testTxOut{"alice_addr", "10"})
+	node.mine("a1", fund)
+	pay := newTestTx("pay", []testTxIn{{TxID: fund.TxID, Vout: 0}}, testTxOut{"bob_addr", "7"}, testTxOut{"alice_addr", "2.9"})
+	node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), pay)
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice", "bob_addr": "bob"})
+
+	block, err := wm.GetBlockWithTransactions(node.chain[2].Hash)
+	if err != nil {
+		t.Fatalf("GetBlockWithTransactions unexpected error: %v", err)
+	}
+	if !block.isVerbose || len(block.txDetails) != 2 || len(block.tx) != 2 || block.tx[1] != pay.TxID {
+		t.Fatalf("GetBlockWithTransactions block txs = %v, details = %d", block.tx, len(block.txDetails))
+	}
+
+	err = bs.ScanBlock(2)
+	if err != nil {
+		t.Fatalf("ScanBlock unexpected error: %v", err)
+	}
+
+	//区块内的交易单不再逐笔查询，只查询输入引用的上一笔交易单
+	if n := node.callCount("getrawtransaction"); n != 1 {
+		t.Errorf("getrawtransaction called %d times, want 1", n)
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	alice := observer.data["alice"]
+	if len(alice) != 1 || len(alice[0].TxInputs) != 1 || len(alice[0].TxOutputs) != 1 {
+		t.Fatalf("alice extract data = %+v", alice)
+	}
+	if alice[0].TxInputs[0].Amount != "10" || alice[0].Transaction.Fees != "0.10000000" {
+		t.Errorf("alice input = %+v, fees = %s", alice[0].TxInputs[0], alice[0].Transaction.Fees)
+	}
+	if alice[0].Transaction.BlockHash != node.chain[2].Hash || alice[0].Transaction.BlockHeight != 2 {
+		t.Errorf("alice transaction block = %d %s", alice[0].Transaction.BlockHeight, alice[0].Transaction.BlockHash)
+	}
+}
@@ -16,12 +16,15 @@
 package ilcoin
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/tidwall/gjson"
 	"net/url"
+	"sort"
 	"strings"
-	//"sync"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blocktree/openwallet/common"
@@ -34,7 +37,6 @@ import (
 const (
 	//blockchainBucket = "blockchain" //区块链数据集合
 	//periodOfTask      = 5 * time.Second //定时任务执行隔间
-	maxExtractingSize = 6 //并发的扫描线程数
 
 	RPCServerCore     = 0 //RPC服务，ilcoin核心钱包
 	RPCServerExplorer = 1 //RPC服务，insight-API
@@ -45,13 +47,44 @@ type ILCBlockScanner struct {
 	*openwallet.BlockScannerBase
 
 	CurrentBlockHeight   uint64             //当前区块高度
-	extractingCH         chan struct{}      //扫描工作令牌
+	extracting           *extractLimiter    //扫描工作令牌
 	wm                   *WalletManager     //钱包管理者
 	IsScanMemPool        bool               //是否扫描交易池
 	RescanLastBlockCount uint64             //重扫上N个区块数量
-	//socketIO             *gosocketio.Client //socketIO客户端
-	//setupSocketIOOnce    sync.Once
-	//stopSocketIO         chan struct{}
+	socketIO             *gosocketio.Client //socketIO客户端
+	socketIOMu           sync.Mutex
+	stopSocketIO         chan struct{} //关闭后停止socketIO监听
+	socketIODone         chan struct{} //socketIO监听线程已退出
+	socketIOConnected    int32         //socketIO是否已连接
+	zmqMu                sync.Mutex
+	stopZMQ              chan struct{}        //关闭后停止zmq订阅
+	zmqWG                sync.WaitGroup       //zmq订阅线程
+	zmqRawTxConnected    int32                //已连接的zmqpubrawtx订阅数量
+	scanRunning          int32                //扫描任务是否正在运行
+	scanPending          int32                //是否有等待执行的扫描任务
+	memPool              *memPoolTracker      //跟踪中的交易池交易
+	confirmations        *confirmationTracker //跟踪确认数的到账交易
+	unscanRetries        *unscanRetryTracker  //未扫记录的重试状态
+	blockFailHeight      uint64               //连续获取失败的区块高度，只在扫描任务中访问
+	blockFailures        int                  //该高度连续失败的次数
+	taskMu               sync.Mutex
+	taskCtx              context.Context    //扫描任务的上下文，暂停或停止时取消
+	taskCancel           context.CancelFunc //取消扫描任务的上下文
+	taskWG               sync.WaitGroup     //运行中的扫描任务
+	stopTask             chan struct{}      //关闭后定时任务退出
+	taskDone             chan struct{}      //定时任务已退出
+	localDAIMu           sync.Mutex
+	localDAI             *LocalBlockchainDAI //没有外部设置BlockchainDAI时使用的本地数据库
+	utxoIndexMu          sync.Mutex
+	utxos                *UTXOIndex //关注地址的未花索引
+	addressTxIndexMu     sync.Mutex
+	addressTxs           *AddressTxIndex //关注地址的交易索引
+	eventLogMu           sync.Mutex
+	eventLog             *ScanEventLog //扫描事件日志
+	subscribersMu        sync.RWMutex
+	subscribers          map[string]*scanSubscriber //有名称的订阅者
+	scanStateMu          sync.Mutex
+	state                *ScanStateStore //需要在重启后恢复的扫描器状态
 
 	//用于实现浏览器
 	IsSkipFailedBlock bool                                    //是否跳过失败区块
@@ -66,6 +99,8 @@ type ExtractResult struct {
 	BlockHeight     uint64
 	Success         bool
 	IsOmniTransfer  bool
+	prevOutputs     []string //交易单花费的输出，txid:vout
+	err             error    //提取失败的原因
 }
 
 //SaveResult 保存结果
@@ -81,12 +116,15 @@ func NewILCBlockScanner(wm *WalletManager) *ILCBlockScanner {
 		BlockScannerBase: openwallet.NewBlockScannerBase(),
 	}
 
-	bs.extractingCH = make(chan struct{}, maxExtractingSize)
+	bs.extracting = newExtractLimiter(wm.Config.ExtractWorkers)
 	bs.wm = wm
 	bs.IsScanMemPool = true
 	bs.RescanLastBlockCount = 0
-	//bs.stopSocketIO = make(chan struct{})
 	bs.BTCBlockObservers = make(map[BTCBlockScanNotificationObject]bool)
+	bs.memPool = newMemPoolTracker()
+	bs.confirmations = newConfirmationTracker()
+	bs.unscanRetries = newUnscanRetryTracker()
+	bs.taskCtx, bs.taskCancel = context.WithCancel(context.Background())
 	//bs.RPCServer = RPCServerCore
 
 	//设置扫描任务
@@ -113,8 +151,34 @@ func (bs *ILCBlockScanner) SetRescanBlockHeight(height uint64) error {
 }
 
 //ScanBlockTask 扫描任务
+//socketIO收到新区块时会与定时任务同时触发，同一时间只运行一个扫描任务，运行期间的触发合并为一次补扫
+//扫描器已暂停或停止时马上返回
 func (bs *ILCBlockScanner) ScanBlockTask() {
 
+	ctx, ok := bs.beginTask()
+	if !ok {
+		return
+	}
+	defer bs.taskWG.Done()
+
+	atomic.StoreInt32(&bs.scanPending, 1)
+
+	for atomic.CompareAndSwapInt32(&bs.scanRunning, 0, 1) {
+		for atomic.SwapInt32(&bs.scanPending, 0) == 1 {
+			bs.scanBlockTask(ctx)
+		}
+		atomic.StoreInt32(&bs.scanRunning, 0)
+
+		//释放前可能有新的触发
+		if atomic.LoadInt32(&bs.scanPending) == 0 {
+			return
+		}
+	}
+}
+
+//scanBlockTask 扫描区块及交易池，ctx取消后不再处理新的区块，正在处理的区块不保存，下次从本地高度继续扫描
+func (bs *ILCBlockScanner) scanBlockTask(ctx context.Context) {
+
 	//获取本地区块高度
 	blockHeader, err := bs.GetScannedBlockHeader()
 	if err != nil {
@@ -125,9 +189,10 @@ func (bs *ILCBlockScanner) ScanBlockTask() {
 	currentHeight := blockHeader.Height
 	currentHash := blockHeader.Hash
 
+scanLoop:
 	for {
 
-		if !bs.Scanning {
+		if ctx.Err() != nil {
 			//区块扫描器已暂停，马上结束本次任务
 			return
 		}
@@ -146,145 +211,220 @@ func (bs *ILCBlockScanner) ScanBlockTask() {
 			break
 		}
 
-		//继续扫描下一个区块
-		currentHeight = currentHeight + 1
+		//并发预读取后续的区块，按高度顺序逐个处理
+		fetchCtx, quit := context.WithCancel(ctx)
+		pending := bs.prefetchBlocks(fetchCtx, currentHeight+1, maxHeight, bs.wm.Config.PrefetchBlockCount, bs.ScanAddressFunc)
 
-		bs.wm.Log.Std.Info("block scanner scanning height: %d ...", currentHeight)
+		for result := range pending {
 
-		hash, err := bs.wm.GetBlockHash(currentHeight)
-		if err != nil {
-			//下一个高度找不到会报异常
-			bs.wm.Log.Std.Info("block scanner can not get new block hash; unexpected error: %v", err)
-			break
-		}
+			fetched := <-result
 
-		if bs.wm.Config.OmniSupport {
-			//判断omni的区块高度是否一致
-			omniBlockHash, err := bs.wm.GetOmniBlockHash(currentHeight)
-			if err != nil {
-				bs.wm.Log.Std.Error("omni block is not synced to the same height of mainnet")
+			if ctx.Err() != nil {
+				//区块扫描器已暂停，预读取的结果可能不完整，马上结束本次任务
+				quit()
 				return
 			}
 
-			//判断omni的hash是否与hc节点的hash一致
-			if omniBlockHash != hash {
-				bs.wm.Log.Std.Error("omni block is not synced to the same hash of mainnet")
+			//继续扫描下一个区块
+			currentHeight = fetched.height
+
+			bs.wm.Log.Std.Info("block scanner scanning height: %d ...", currentHeight)
+
+			if fetched.hashErr != nil {
+				//下一个高度找不到会报异常
+				bs.wm.Log.Std.Info("block scanner can not get new block hash; unexpected error: %v", fetched.hashErr)
+				quit()
+				break scanLoop
+			}
+
+			if fetched.omniErr != nil {
+				bs.wm.Log.Std.Error("%v", fetched.omniErr)
+				quit()
 				return
 			}
-		}
 
-		block, err := bs.wm.GetBlock(hash)
-		if err != nil {
-			bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
+			if fetched.blockErr != nil {
+				bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", fetched.blockErr)
 
-			//记录未扫区块
-			unscanRecord := openwallet.NewUnscanRecord(currentHeight, "", err.Error(), bs.wm.Symbol())
-			bs.SaveUnscanRecord(unscanRecord)
-			bs.wm.Log.Std.Info("block height: %d extract failed.", currentHeight)
-			continue
-		}
+				//连续失败过多时记录未扫区块并跳过，由未扫记录的重试处理，避免扫描一直停在这个高度
+				if bs.skipFailedBlock(fetched.height, fetched.blockErr) {
+					currentHash = fetched.hash
+					bs.SaveLocalNewBlock(currentHeight, currentHash)
+					quit()
+					continue scanLoop
+				}
 
-		isFork := false
+				//停止本次扫描，下次从本地高度重新获取该区块，跳过它会使下一个区块的前一区块hash不一致而误判为分叉
+				currentHeight = fetched.height - 1
+				quit()
+				break scanLoop
+			}
 
-		//判断hash是否上一区块的hash
-		if currentHash != block.Previousblockhash {
+			block := fetched.block
 
-			bs.wm.Log.Std.Info("block has been fork on height: %d.", currentHeight)
-			bs.wm.Log.Std.Info("block height: %d local hash = %s ", currentHeight-1, currentHash)
-			bs.wm.Log.Std.Info("block height: %d mainnet hash = %s ", currentHeight-1, block.Previousblockhash)
+			//判断hash是否上一区块的hash
+			if currentHash != block.Previousblockhash {
 
-			bs.wm.Log.Std.Info("delete recharge records on block height: %d.", currentHeight-1)
+				bs.wm.Log.Std.Info("block has been fork on height: %d.", currentHeight)
+				bs.wm.Log.Std.Info("block height: %d local hash = %s ", currentHeight-1, currentHash)
+				bs.wm.Log.Std.Info("block height: %d mainnet hash = %s ", currentHeight-1, block.Previousblockhash)
 
-			//查询本地分叉的区块
-			forkBlock, _ := bs.GetLocalBlock(currentHeight - 1)
+				//已预读取的区块可能属于旧的分支，停止预读取
+				quit()
 
-			//删除上一区块链的所有充值记录
-			//bs.DeleteRechargesByHeight(currentHeight - 1)
-			//删除上一区块链的未扫记录
-			bs.DeleteUnscanRecord(currentHeight - 1)
-			currentHeight = currentHeight - 2 //倒退2个区块重新扫描
-			if currentHeight <= 0 {
-				currentHeight = 1
-			}
+				//回溯本地区块，找出与主链一致的共同祖先，及所有被孤立的本地区块
+				ancestor, forkBlocks, err := bs.findForkPoint(currentHeight-1, currentHash)
+				if err != nil {
+					bs.wm.Log.Std.Error("block scanner can not find fork point; unexpected error: %v", err)
+					break scanLoop
+				}
 
-			localBlock, err := bs.GetLocalBlock(currentHeight)
-			if err != nil {
-				bs.wm.Log.Std.Error("block scanner can not get local block; unexpected error: %v", err)
+				bs.wm.Log.Std.Info("block fork depth: %d, common ancestor height: %d, hash: %s", len(forkBlocks), ancestor.Height, ancestor.Hash)
+
+				for _, forkBlock := range forkBlocks {
+					bs.wm.Log.Std.Info("delete recharge records on block height: %d.", forkBlock.Height)
+					//删除分叉区块的未扫记录
+					bs.DeleteUnscanRecord(forkBlock.Height)
+					//撤销分叉区块对未花索引的修改
+					bs.rollbackUTXOIndex(forkBlock.Height)
+					bs.rollbackAddressTxIndex(forkBlock.Height)
+				}
 
-				//查找core钱包的RPC
-				bs.wm.Log.Info("block scanner prev block height:", currentHeight)
+				//从共同祖先的下一个区块重新扫描
+				currentHeight = ancestor.Height
+				currentHash = ancestor.Hash
 
-				prevHash, err := bs.wm.GetBlockHash(currentHeight)
-				if err != nil {
-					bs.wm.Log.Std.Error("block scanner can not get prev block; unexpected error: %v", err)
-					break
+				bs.wm.Log.Std.Info("rescan block on height: %d, hash: %s .", currentHeight+1, currentHash)
+
+				//重新记录一个新扫描起点
+				bs.SaveLocalNewBlock(ancestor.Height, ancestor.Hash)
+
+				//通知分叉区块给观测者，从最高的分叉区块开始依次回滚，并通知需要撤销的交易记录
+				for _, forkBlock := range forkBlocks {
+					bs.newForkBlockNotify(forkBlock)
 				}
 
-				localBlock, err = bs.wm.GetBlock(prevHash)
-				if err != nil {
-					bs.wm.Log.Std.Error("block scanner can not get prev block; unexpected error: %v", err)
-					break
+				//重新开始预读取
+				continue scanLoop
+
+			} else {
+
+				if len(fetched.results) == 0 {
+					bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", "BatchExtractTransaction block is nil.")
+				} else {
+					err = bs.saveExtractResults(block.Height, fetched.results)
+					if err != nil {
+						bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+					}
+
+					//通知跟踪中的交易池交易已被确认或替换
+					bs.confirmMemPoolTxs(block, fetched.results)
 				}
 
+				//重置当前区块的hash
+				currentHash = fetched.hash
+				bs.blockFailures = 0
+
+				//保存本地新高度
+				bs.SaveLocalNewBlock(currentHeight, currentHash)
+				bs.SaveLocalBlock(block)
+
+				//通知新区块给观测者，异步处理
+				bs.newBlockNotify(block, false)
+
+				//通知到账交易的确认数
+				bs.updateConfirmations(block)
 			}
+		}
 
-			//重置当前区块的hash
-			currentHash = localBlock.Hash
+		quit()
+	}
 
-			bs.wm.Log.Std.Info("rescan block on height: %d, hash: %s .", currentHeight, currentHash)
+	//重扫前N个块，为保证记录找到
+	for i := currentHeight - bs.RescanLastBlockCount; i < currentHeight && ctx.Err() == nil; i++ {
+		bs.scanBlock(ctx, i)
+	}
 
-			//重新记录一个新扫描起点
-			bs.SaveLocalNewBlock(localBlock.Height, localBlock.Hash)
+	if bs.IsScanMemPool && ctx.Err() == nil {
+		//扫描交易内存池，socketIO或zmq已连接时由推送实时提取交易池的交易，只检查跟踪中的交易是否离开交易池
+		bs.scanTxMemPool(ctx, !bs.IsSocketIOConnected() && !bs.IsZMQConnected())
+	}
 
-			isFork = true
+	//重扫失败区块
+	if ctx.Err() == nil {
+		bs.rescanFailedRecord(ctx)
+	}
 
-			if forkBlock != nil {
+}
 
-				//通知分叉区块给观测者，异步处理
-				bs.newBlockNotify(forkBlock, isFork)
-			}
+//findForkPoint 从已扫描的最新区块开始，逐个回溯本地区块，直到找到与节点主链hash一致的共同祖先，
+//本地区块头缺失的区块同样视为被孤立。返回共同祖先区块，及被孤立的本地区块（按高度从高到低排列）
+func (bs *ILCBlockScanner) findForkPoint(tipHeight uint64, tipHash string) (*Block, []*Block, error) {
 
-		} else {
+	var (
+		forkBlocks = make([]*Block, 0)
+		//本地区块的hash，由已扫描的最新区块开始，沿前一区块hash向下
+		localHash = tipHash
+	)
 
-			err = bs.BatchExtractTransaction(block.Height, block.Hash, block.tx)
-			if err != nil {
-				bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
-			}
+	for height := tipHeight; ; height-- {
+
+		localBlock := bs.forkPointLocalBlock(height, localHash)
 
-			//重置当前区块的hash
-			currentHash = hash
+		mainHash, err := bs.wm.GetBlockHash(height)
+		if err != nil {
+			return nil, nil, err
+		}
 
-			//保存本地新高度
-			bs.SaveLocalNewBlock(currentHeight, currentHash)
-			bs.SaveLocalBlock(block)
+		if localBlock != nil && localBlock.Hash == mainHash {
+			return localBlock, forkBlocks, nil
+		}
 
-			isFork = false
+		if height == 0 {
+			return nil, nil, fmt.Errorf("can not find common ancestor down to the genesis block")
+		}
 
-			//通知新区块给观测者，异步处理
-			bs.newBlockNotify(block, isFork)
+		if localBlock == nil {
+			//该高度的本地区块未知，不能作为共同祖先，继续向下比较
+			localHash = ""
+			continue
 		}
 
+		bs.wm.Log.Std.Info("block height: %d local hash = %s, mainnet hash = %s ", height, localBlock.Hash, mainHash)
+
+		forkBlocks = append(forkBlocks, localBlock)
+		localHash = localBlock.Previousblockhash
 	}
+}
 
-	//重扫前N个块，为保证记录找到
-	for i := currentHeight - bs.RescanLastBlockCount; i < currentHeight; i++ {
-		bs.scanBlock(i)
+//forkPointLocalBlock 获取本地在该高度的区块，hash不为空时必须与之一致。
+//本地没有区块头（未保存、已清理或读取失败）时，由节点按hash获取被孤立的区块，仍获取不到则只保留高度及hash
+func (bs *ILCBlockScanner) forkPointLocalBlock(height uint64, hash string) *Block {
+
+	localBlock, err := bs.GetLocalBlock(height)
+	if err == nil && len(localBlock.Hash) > 0 && (len(hash) == 0 || localBlock.Hash == hash) {
+		return localBlock
 	}
 
-	if bs.IsScanMemPool {
-		//扫描交易内存池
-		bs.ScanTxMemPool()
+	if len(hash) == 0 {
+		bs.wm.Log.Std.Error("block scanner can not get local block on height: %d; unexpected error: %v", height, err)
+		return nil
 	}
 
-	//重扫失败区块
-	bs.RescanFailedRecord()
+	block, err := bs.wm.GetBlock(hash)
+	if err != nil || block.Hash != hash {
+		bs.wm.Log.Std.Error("block scanner can not get orphaned block: %s on height: %d; unexpected error: %v", hash, height, err)
+		return &Block{Hash: hash, Height: height}
+	}
+	block.Height = height
 
+	return block
 }
 
 //ScanBlock 扫描指定高度区块
 func (bs *ILCBlockScanner) ScanBlock(height uint64) error {
 
-	block, err := bs.scanBlock(height)
+	block, err := bs.scanBlock(context.Background(), height)
 	if err != nil {
 		return err
 	}
@@ -295,7 +435,7 @@ func (bs *ILCBlockScanner) ScanBlock(height uint64) error {
 	return nil
 }
 
-func (bs *ILCBlockScanner) scanBlock(height uint64) (*Block, error) {
+func (bs *ILCBlockScanner) scanBlock(ctx context.Context, height uint64) (*Block, error) {
 
 	hash, err := bs.wm.GetBlockHash(height)
 	if err != nil {
@@ -304,20 +444,29 @@ func (bs *ILCBlockScanner) scanBlock(height uint64) (*Block, error) {
 		return nil, err
 	}
 
-	block, err := bs.wm.GetBlock(hash)
+	block, err := bs.wm.GetBlockWithTransactions(hash)
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
 
 		//记录未扫区块
-		unscanRecord := openwallet.NewUnscanRecord(height, "", err.Error(), bs.wm.Symbol())
-		bs.SaveUnscanRecord(unscanRecord)
+		bs.saveFailedRecord(height, "", err)
 		bs.wm.Log.Std.Info("block height: %d extract failed.", height)
 		return nil, err
 	}
 
 	bs.wm.Log.Std.Info("block scanner scanning height: %d ...", block.Height)
 
-	err = bs.BatchExtractTransaction(block.Height, block.Hash, block.tx)
+	if len(block.tx) == 0 {
+		err = errors.New("BatchExtractTransaction block is nil.")
+	} else {
+		results, extractErr := bs.extractBlock(ctx, block)
+		if extractErr != nil {
+			//已取消，不保存不完整的提取结果
+			return nil, extractErr
+		}
+		err = bs.saveExtractResults(block.Height, results)
+		bs.confirmMemPoolTxs(block, results)
+	}
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
 	}
@@ -330,6 +479,15 @@ func (bs *ILCBlockScanner) scanBlock(height uint64) (*Block, error) {
 
 //ScanTxMemPool 扫描交易内存池
 func (bs *ILCBlockScanner) ScanTxMemPool() {
+	bs.scanTxMemPool(context.Background(), true)
+}
+
+//scanTxMemPool 扫描交易池，extract = true时提取未提取过的交易，并检查跟踪中的交易是否离开交易池
+func (bs *ILCBlockScanner) scanTxMemPool(ctx context.Context, extract bool) {
+
+	if !extract && bs.memPool.len() == 0 {
+		return
+	}
 
 	bs.wm.Log.Std.Info("block scanner scanning mempool ...")
 
@@ -340,247 +498,234 @@ func (bs *ILCBlockScanner) ScanTxMemPool() {
 		return
 	}
 
-	if txIDsInMemPool == nil || len(txIDsInMemPool) == 0 {
-		return
+	if extract {
+		//已提取过的交易不再重复提取
+		txIDs := bs.memPool.unseen(txIDsInMemPool)
+		if len(txIDs) > 0 {
+			err = bs.batchExtractTransaction(ctx, 0, "", txIDs)
+			if err != nil {
+				bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+			}
+		}
 	}
 
-	err = bs.BatchExtractTransaction(0, "", txIDsInMemPool)
-	if err != nil {
-		bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+	if ctx.Err() != nil {
+		return
 	}
 
+	bs.checkMemPoolTxs(txIDsInMemPool)
 }
 
-//rescanFailedRecord 重扫失败记录
-func (bs *ILCBlockScanner) RescanFailedRecord() {
-
-	var (
-		blockMap = make(map[uint64][]string)
-	)
-
-	list, err := bs.GetUnscanRecords()
-	if err != nil {
-		bs.wm.Log.Std.Info("block scanner can not get rescan data; unexpected error: %v", err)
-	}
+//newBlockNotify 获得新区块后，通知给观测者
+func (bs *ILCBlockScanner) newBlockNotify(block *Block, isFork bool) {
+	header := block.BlockHeader(bs.wm.Symbol())
+	header.Fork = isFork
+	bs.NewBlockNotify(header)
 
-	//组合成批处理
-	for _, r := range list {
+	//记录到事件日志，送达给订阅者
+	logged := *header
+	bs.appendScanEvents(&ScanEvent{Height: header.Height, Type: ScanEventBlock, Header: &logged})
+}
 
-		if _, exist := blockMap[r.BlockHeight]; !exist {
-			blockMap[r.BlockHeight] = make([]string, 0)
-		}
+//BatchExtractTransaction 批量提取交易单
+//ilcoin 1M的区块链可以容纳3000笔交易，批量多线程处理，速度更快
+//提取或通知失败的交易单返回*ExtractError
+func (bs *ILCBlockScanner) BatchExtractTransaction(blockHeight uint64, blockHash string, txs []string) error {
+	return bs.batchExtractTransaction(context.Background(), blockHeight, blockHash, txs)
+}
 
-		if len(r.TxID) > 0 {
-			arr := blockMap[r.BlockHeight]
-			arr = append(arr, r.TxID)
+//batchExtractTransaction 批量提取交易单，ctx取消后不再提取剩余的交易单，已提取的结果也不通知
+func (bs *ILCBlockScanner) batchExtractTransaction(ctx context.Context, blockHeight uint64, blockHash string, txs []string) error {
 
-			blockMap[r.BlockHeight] = arr
-		}
+	if len(txs) == 0 {
+		return errors.New("BatchExtractTransaction block is nil.")
 	}
 
-	for height, txs := range blockMap {
-
-		if height == 0 {
-			continue
-		}
-
-		var hash string
-
-		bs.wm.Log.Std.Info("block scanner rescanning height: %d ...", height)
-
-		if len(txs) == 0 {
+	results, err := bs.extractBlockTransaction(ctx, blockHeight, blockHash, txs)
+	if err != nil {
+		return err
+	}
 
-			hash, err := bs.wm.GetBlockHash(height)
-			if err != nil {
-				//下一个高度找不到会报异常
-				bs.wm.Log.Std.Info("block scanner can not get new block hash; unexpected error: %v", err)
-				continue
-			}
+	return bs.saveExtractResults(blockHeight, results)
+}
 
-			block, err := bs.wm.GetBlock(hash)
-			if err != nil {
-				bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
-				continue
-			}
+//extractBlock 提取区块内的交易单，区块已包含交易单详情时直接提取，否则逐笔查询交易单
+func (bs *ILCBlockScanner) extractBlock(ctx context.Context, block *Block) ([]ExtractResult, error) {
+	return bs.extractBlockWith(ctx, block, bs.ScanAddressFunc)
+}
 
-			txs = block.tx
-		}
+//extractBlockWith 使用指定的地址查询方法提取区块内的交易单
+func (bs *ILCBlockScanner) extractBlockWith(ctx context.Context, block *Block, scanAddressFunc openwallet.BlockScanAddressFunc) ([]ExtractResult, error) {
 
-		err = bs.BatchExtractTransaction(height, hash, txs)
-		if err != nil {
-			bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
-			continue
+	if block.isVerbose {
+		//先缓存区块内所有交易单的输出，区块内花费同区块的输出时无需再查询
+		for _, trx := range block.txDetails {
+			bs.wm.TxOutCache.AddTransaction(trx)
 		}
-
-		//删除未扫记录
-		bs.DeleteUnscanRecord(height)
+		return bs.extractParallel(ctx, len(block.txDetails), func(i int) ExtractResult {
+			return bs.ExtractTransactionDetail(block.txDetails[i], scanAddressFunc)
+		})
 	}
 
-	//删除未没有找到交易记录的重扫记录
-	bs.DeleteUnscanRecordNotFindTX()
+	return bs.extractParallel(ctx, len(block.tx), func(i int) ExtractResult {
+		return bs.ExtractTransaction(block.Height, block.Hash, block.tx[i], scanAddressFunc)
+	})
 }
 
-//newBlockNotify 获得新区块后，通知给观测者
-func (bs *ILCBlockScanner) newBlockNotify(block *Block, isFork bool) {
-	header := block.BlockHeader(bs.wm.Symbol())
-	header.Fork = isFork
-	bs.NewBlockNotify(header)
+//extractBlockTransaction 多线程提取交易单，提取结果按交易单的顺序返回
+func (bs *ILCBlockScanner) extractBlockTransaction(ctx context.Context, blockHeight uint64, blockHash string, txs []string) ([]ExtractResult, error) {
+	return bs.extractParallel(ctx, len(txs), func(i int) ExtractResult {
+		return bs.ExtractTransaction(blockHeight, blockHash, txs[i], bs.ScanAddressFunc)
+	})
 }
 
-//BatchExtractTransaction 批量提取交易单
-//ilcoin 1M的区块链可以容纳3000笔交易，批量多线程处理，速度更快
-func (bs *ILCBlockScanner) BatchExtractTransaction(blockHeight uint64, blockHash string, txs []string) error {
+//extractParallel 使用工作令牌并发执行count个提取工作，提取结果按序号返回
+//ctx取消后不再分派新的提取工作，等待已分派的工作结束后返回ctx的错误
+func (bs *ILCBlockScanner) extractParallel(ctx context.Context, count int, extract func(i int) ExtractResult) ([]ExtractResult, error) {
 
 	var (
-		quit       = make(chan struct{})
-		done       = 0 //完成标记
-		failed     = 0
-		shouldDone = len(txs) //需要完成的总数
+		results = make([]ExtractResult, count)
+		wg      sync.WaitGroup
 	)
 
-	if len(txs) == 0 {
-		return errors.New("BatchExtractTransaction block is nil.")
-	}
-
-	//生产通道
-	producer := make(chan ExtractResult)
-	defer close(producer)
+	//并发数跟随配置
+	bs.extracting.configure(bs.wm.Config.ExtractWorkers, bs.wm.Config.MaxExtractWorkers, bs.wm.Config.AdaptiveExtract)
 
-	//消费通道
-	worker := make(chan ExtractResult)
-	defer close(worker)
+	for i := 0; i < count; i++ {
+		//获取工作令牌
+		if bs.extracting.acquire(ctx) != nil {
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
 
-	//保存工作
-	saveWork := func(height uint64, result chan ExtractResult) {
-		//回收创建的地址
-		for gets := range result {
+			//导出提出的交易
+			start := time.Now()
+			results[i] = extract(i)
 
-			if gets.Success {
+			//释放，记录延迟及是否失败
+			bs.extracting.release(time.Since(start), !results[i].Success)
 
-				notifyErr := bs.newExtractDataNotify(height, gets.extractData)
-				//saveErr := bs.SaveRechargeToWalletDB(height, gets.Recharges)
-				if notifyErr != nil {
-					failed++ //标记保存失败数
-					bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
-				}
+		}(i)
+	}
 
-				notifyErr = nil
-				notifyErr = bs.newExtractDataNotify(height, gets.extractOmniData)
-				if notifyErr != nil {
-					failed++ //标记保存失败数
-					bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
-				}
+	wg.Wait()
 
-			} else {
-				//记录未扫区块
-				unscanRecord := openwallet.NewUnscanRecord(height, "", "", bs.wm.Symbol())
-				bs.SaveUnscanRecord(unscanRecord)
-				bs.wm.Log.Std.Info("block height: %d extract failed.", height)
-				failed++ //标记保存失败数
-			}
-			//累计完成的线程数
-			done++
-			if done == shouldDone {
-				//bs.wm.Log.Std.Info("done = %d, shouldDone = %d ", done, len(txs))
-				close(quit) //关闭通道，等于给通道传入nil
-			}
-		}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	//提取工作
-	extractWork := func(eblockHeight uint64, eBlockHash string, mTxs []string, eProducer chan ExtractResult) {
-		for _, txid := range mTxs {
-			bs.extractingCH <- struct{}{}
-			//shouldDone++
-			go func(mBlockHeight uint64, mTxid string, end chan struct{}, mProducer chan<- ExtractResult) {
+	return results, nil
+}
 
-				//导出提出的交易
-				mProducer <- bs.ExtractTransaction(mBlockHeight, eBlockHash, mTxid, bs.ScanAddressFunc)
-				//释放
-				<-end
+//ExtractConcurrency 当前并发提取交易单的数量，自适应模式下随延迟及错误率变化
+func (bs *ILCBlockScanner) ExtractConcurrency() int {
+	return bs.extracting.concurrency()
+}
 
-			}(eblockHeight, txid, bs.extractingCH, eProducer)
-		}
-	}
+//ExtractError 批量提取时提取或通知失败的交易单
+type ExtractError struct {
+	BlockHeight uint64
+	Failed      map[string]error //失败的原因，key = txid
+}
+
+func (e *ExtractError) Error() string {
 
-	/*	开启导出的线程	*/
+	txids := make([]string, 0, len(e.Failed))
+	for txid := range e.Failed {
+		txids = append(txids, txid)
+	}
+	sort.Strings(txids)
 
-	//独立线程运行消费
-	go saveWork(blockHeight, worker)
+	reasons := make([]string, 0, len(txids))
+	for _, txid := range txids {
+		reasons = append(reasons, fmt.Sprintf("%s: %v", txid, e.Failed[txid]))
+	}
 
-	//独立线程运行生产
-	go extractWork(blockHeight, blockHash, txs, producer)
+	return fmt.Sprintf("block height: %d, %d transactions extract failed; %s", e.BlockHeight, len(e.Failed), strings.Join(reasons, "; "))
+}
 
-	//以下使用生产消费模式
-	bs.extractRuntime(producer, worker, quit)
+//saveExtractResults 按顺序通知提取结果，提取失败的记录未扫区块
+func (bs *ILCBlockScanner) saveExtractResults(height uint64, results []ExtractResult) error {
 
-	if failed > 0 {
-		return fmt.Errorf("block scanner saveWork failed")
-	} else {
-		return nil
+	failed := bs.saveExtractResultsTx(height, results)
+	if len(failed) > 0 {
+		return &ExtractError{BlockHeight: height, Failed: failed}
 	}
 
-	//return nil
+	return nil
 }
 
-//extractRuntime 提取运行时
-func (bs *ILCBlockScanner) extractRuntime(producer chan ExtractResult, worker chan ExtractResult, quit chan struct{}) {
+//saveExtractResultsTx 按顺序通知提取结果，提取或通知失败的交易单记录为未扫记录，返回失败的交易单及原因
+func (bs *ILCBlockScanner) saveExtractResultsTx(height uint64, results []ExtractResult) map[string]error {
 
 	var (
-		values = make([]ExtractResult, 0)
+		failed = make(map[string]error)
 	)
 
-	for {
+	if height == 0 {
+		//跟踪交易池中涉及关注地址的交易
+		bs.trackMemPoolResults(results)
+	} else {
+		//跟踪已入块的到账交易的确认数
+		bs.trackConfirmations(height, results)
+	}
 
-		var activeWorker chan<- ExtractResult
-		var activeValue ExtractResult
+	//更新未花索引及地址交易索引，失败的交易单记录为未扫，重扫时再更新
+	indexErr := bs.indexUTXO(height, results)
+	if indexErr == nil {
+		indexErr = bs.indexAddressTx(height, results)
+	}
 
-		//当数据队列有数据时，释放顶部，传输给消费者
-		if len(values) > 0 {
-			activeWorker = worker
-			activeValue = values[0]
+	for _, gets := range results {
 
-		}
+		if gets.Success {
 
-		select {
+			notifyErr := indexErr
+			if notifyErr == nil {
+				notifyErr = bs.newExtractDataNotify(height, gets.extractData)
+			}
+			if notifyErr == nil {
+				notifyErr = bs.newExtractDataNotify(height, gets.extractOmniData)
+			}
+			if notifyErr != nil {
+				//记录通知失败的交易单
+				bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
+				bs.saveFailedRecord(height, gets.TxID, notifyErr)
+				failed[gets.TxID] = notifyErr //标记保存失败
+			}
 
-		//生成者不断生成数据，插入到数据队列尾部
-		case pa := <-producer:
-			values = append(values, pa)
-		case <-quit:
-			//退出
-			//bs.wm.Log.Std.Info("block scanner have been scanned!")
-			return
-		case activeWorker <- activeValue:
-			//wm.Log.Std.Info("Get %d", len(activeValue))
-			values = values[1:]
+		} else {
+			//记录提取失败的交易单
+			reason := gets.err
+			if reason == nil {
+				reason = fmt.Errorf("extract transaction failed")
+			}
+			bs.saveFailedRecord(height, gets.TxID, reason)
+			bs.wm.Log.Std.Info("block height: %d, txid: %s extract failed.", height, gets.TxID)
+			failed[gets.TxID] = reason //标记保存失败
 		}
 	}
 
+	return failed
 }
 
 //ExtractTransaction 提取交易单
 func (bs *ILCBlockScanner) ExtractTransaction(blockHeight uint64, blockHash string, txid string, scanAddressFunc openwallet.BlockScanAddressFunc) ExtractResult {
 
-	var (
-		result = ExtractResult{
-			BlockHeight:     blockHeight,
-			TxID:            txid,
-			extractData:     make(map[string]*openwallet.TxExtractData),
-			extractOmniData: make(map[string]*openwallet.TxExtractData),
-		}
-
-		omniTrx *OmniTransaction
-	)
-
 	//bs.wm.Log.Std.Debug("block scanner scanning tx: %s ...", txid)
 	//获取ilcoin的交易单
 	trx, err := bs.wm.GetTransaction(txid)
 
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not extract transaction data; unexpected error: %v", err)
-		result.Success = false
-		return result
+		return ExtractResult{
+			BlockHeight: blockHeight,
+			TxID:        txid,
+			Success:     false,
+			err:         err,
+		}
 	}
 
 	//优先使用传入的高度
@@ -589,37 +734,47 @@ func (bs *ILCBlockScanner) ExtractTransaction(blockHeight uint64, blockHash stri
 		trx.BlockHash = blockHash
 	}
 
+	result := bs.ExtractTransactionDetail(trx, scanAddressFunc)
+	result.BlockHeight = blockHeight
+
+	return result
+}
+
+//ExtractTransactionDetail 提取已获取详情的交易单
+func (bs *ILCBlockScanner) ExtractTransactionDetail(trx *Transaction, scanAddressFunc openwallet.BlockScanAddressFunc) ExtractResult {
+
+	var (
+		result = ExtractResult{
+			BlockHeight:     trx.BlockHeight,
+			TxID:            trx.TxID,
+			extractData:     make(map[string]*openwallet.TxExtractData),
+			extractOmniData: make(map[string]*openwallet.TxExtractData),
+		}
+
+		omniTrx *OmniTransaction
+	)
+
 	if bs.wm.Config.OmniSupport {
 		//获取omni的交易单
-		omniTrx, _ = bs.wm.GetOmniTransaction(txid)
+		omniTrx, _ = bs.wm.GetOmniTransaction(trx.TxID)
 	}
 
 	if omniTrx != nil {
 		result.IsOmniTransfer = true
 	}
 
+	for _, vin := range trx.Vins {
+		if len(vin.Coinbase) == 0 && len(vin.TxID) > 0 {
+			result.prevOutputs = append(result.prevOutputs, txOutCacheKey(vin.TxID, vin.Vout))
+		}
+	}
+
 	bs.extractTransaction(trx, &result, scanAddressFunc)
 
 	if omniTrx != nil {
 		bs.extractOmniTransaction(omniTrx, &result, scanAddressFunc)
 	}
 
-	////bs.wm.Log.Debug("start extractTransaction")
-	//bs.extractTransaction(trx, &result, scanAddressFunc)
-	////bs.wm.Log.Debug("end extractTransaction")
-	//
-	//if bs.wm.Config.OmniSupport {
-	//	//获取omni的交易单
-	//	omniTrx, err := bs.wm.GetOmniTransaction(txid)
-	//	if err != nil {
-	//		//bs.wm.Log.Std.Info("block scanner can not extract omni transaction data; unexpected error: %v", err)
-	//		result.Success = true
-	//		return result
-	//	}
-	//
-	//	bs.extractOmniTransaction(omniTrx, &result, scanAddressFunc)
-	//}
-
 	return result
 
 }
@@ -769,6 +924,9 @@ func (bs *ILCBlockScanner) extractTransaction(trx *Transaction, result *ExtractR
 		vin := trx.Vins
 		blocktime := trx.Blocktime
 
+		//缓存交易单的输出，供后续交易单的输入使用
+		bs.wm.TxOutCache.AddTransaction(trx)
+
 		//检查交易单输入信息是否完整，不完整查上一笔交易单的输出填充数据
 		for _, input := range vin {
 
@@ -784,22 +942,16 @@ func (bs *ILCBlockScanner) extractTransaction(trx *Transaction, result *ExtractR
 				intxid := input.TxID
 				vout := input.Vout
 
-				preTx, err := bs.wm.GetTransaction(intxid)
+				//优先从输出缓存中查找
+				preOut, err := bs.wm.getPrevTxOut(intxid, vout)
 				if err != nil {
 					success = false
+					result.err = fmt.Errorf("can not get previous output %s:%d; %v", intxid, vout, err)
 					break
-				} else {
-					preVouts := preTx.Vouts
-					if len(preVouts) > int(vout) {
-						preOut := preVouts[vout]
-						input.Addr = preOut.Addr
-						input.Value = preOut.Value
-						//vinout = append(vinout, output[vout])
-						success = true
-
-						//bs.wm.Log.Debug("GetTxOut:", output[vout])
-
-					}
+				} else if preOut != nil {
+					input.Addr = preOut.Addr
+					input.Value = preOut.Value
+					success = true
 				}
 
 			}
@@ -842,8 +994,6 @@ func (bs *ILCBlockScanner) extractTransaction(trx *Transaction, result *ExtractR
 
 		}
 
-		success = true
-
 	}
 	result.Success = success
 }
@@ -998,46 +1148,43 @@ func (bs *ILCBlockScanner) extractTxOutput(trx *Transaction, result *ExtractResu
 	return to, totalAmount
 }
 
-//newExtractDataNotify 发送通知
+//newExtractDataNotify 发送通知，观测者处理失败时返回错误
 func (bs *ILCBlockScanner) newExtractDataNotify(height uint64, extractData map[string]*openwallet.TxExtractData) error {
 
+	//已确认的提取结果记录到事件日志，送达给订阅者
+	notifyErr := bs.appendExtractDataEvents(height, extractData)
+
 	for o, _ := range bs.Observers {
 		for key, data := range extractData {
 			err := o.BlockExtractDataNotify(key, data)
 			if err != nil {
 				bs.wm.Log.Error("BlockExtractDataNotify unexpected error:", err)
-				//记录未扫区块
-				unscanRecord := openwallet.NewUnscanRecord(height, "", "ExtractData Notify failed.", bs.wm.Symbol())
-				err = bs.SaveUnscanRecord(unscanRecord)
-				if err != nil {
-					bs.wm.Log.Std.Error("block height: %d, save unscan record failed. unexpected error: %v", height, err.Error())
-				}
-
+				notifyErr = fmt.Errorf("ExtractData Notify failed. %v", err)
 			}
 		}
 	}
 
-	return nil
+	return notifyErr
 }
 
 //DeleteUnscanRecordNotFindTX 删除未没有找到交易记录的重扫记录
+//重扫时不再自动调用，节点没有开启txindex时这类记录会按退避重试并转入死信，由运维确认后再删除
 func (bs *ILCBlockScanner) DeleteUnscanRecordNotFindTX() error {
 
 	//删除找不到交易单
 	reason := "[-5]No information available about transaction"
 
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
-	}
+	dai := bs.blockchainDAI()
 
-	list, err := bs.BlockchainDAI.GetUnscanRecords(bs.wm.Symbol())
+	list, err := dai.GetUnscanRecords(bs.wm.Symbol())
 	if err != nil {
 		return err
 	}
 
 	for _, r := range list {
 		if strings.HasPrefix(r.Reason, reason) {
-			bs.BlockchainDAI.DeleteUnscanRecordByID(r.ID, bs.wm.Symbol())
+			dai.DeleteUnscanRecordByID(r.ID, bs.wm.Symbol())
+			bs.forgetUnscanRetry(r.ID)
 		}
 	}
 	return nil
@@ -1231,11 +1378,9 @@ func (bs *ILCBlockScanner) ExtractTransactionData(txid string, scanTargetFunc op
 //SaveTxToWalletDB 保存交易记录到钱包数据库
 func (bs *ILCBlockScanner) SaveUnscanRecord(record *openwallet.UnscanRecord) error {
 
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
-	}
+	dai := bs.blockchainDAI()
 
-	return bs.BlockchainDAI.SaveUnscanRecord(record)
+	return dai.SaveUnscanRecord(record)
 }
 
 //GetWalletByAddress 获取地址对应的钱包
@@ -1277,11 +1422,9 @@ func (wm *WalletManager) getBlockHeightByCore() (uint64, error) {
 //GetLocalNewBlock 获取本地记录的区块高度和hash
 func (bs *ILCBlockScanner) GetLocalNewBlock() (uint64, string, error) {
 
-	if bs.BlockchainDAI == nil {
-		return 0, "", fmt.Errorf("Blockchain DAI is not setup ")
-	}
+	dai := bs.blockchainDAI()
 
-	header, err := bs.BlockchainDAI.GetCurrentBlockHead(bs.wm.Symbol())
+	header, err := dai.GetCurrentBlockHead(bs.wm.Symbol())
 	if err != nil {
 		return 0, "", err
 	}
@@ -1292,9 +1435,7 @@ func (bs *ILCBlockScanner) GetLocalNewBlock() (uint64, string, error) {
 //SaveLocalNewBlock 记录区块高度和hash到本地
 func (bs *ILCBlockScanner) SaveLocalNewBlock(blockHeight uint64, blockHash string) error {
 
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
-	}
+	dai := bs.blockchainDAI()
 
 	header := &openwallet.BlockHeader{
 		Hash:   blockHash,
@@ -1303,15 +1444,13 @@ func (bs *ILCBlockScanner) SaveLocalNewBlock(blockHeight uint64, blockHash strin
 		Symbol: bs.wm.Symbol(),
 	}
 
-	return bs.BlockchainDAI.SaveCurrentBlockHead(header)
+	return dai.SaveCurrentBlockHead(header)
 }
 
 //SaveLocalBlock 记录本地新区块
 func (bs *ILCBlockScanner) SaveLocalBlock(block *Block) error {
 
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
-	}
+	dai := bs.blockchainDAI()
 
 	header := &openwallet.BlockHeader{
 		Hash:              block.Hash,
@@ -1322,7 +1461,7 @@ func (bs *ILCBlockScanner) SaveLocalBlock(block *Block) error {
 		Symbol:            bs.wm.Symbol(),
 	}
 
-	return bs.BlockchainDAI.SaveLocalBlockHead(header)
+	return dai.SaveLocalBlockHead(header)
 }
 
 //GetBlockHash 根据区块高度获得区块hash
@@ -1353,18 +1492,19 @@ func (wm *WalletManager) getBlockHashByCore(height uint64) (string, error) {
 //GetLocalBlock 获取本地区块数据
 func (bs *ILCBlockScanner) GetLocalBlock(height uint64) (*Block, error) {
 
-	if bs.BlockchainDAI == nil {
-		return nil, fmt.Errorf("Blockchain DAI is not setup ")
-	}
+	dai := bs.blockchainDAI()
 
-	header, err := bs.BlockchainDAI.GetLocalBlockHeadByHeight(height, bs.wm.Symbol())
+	header, err := dai.GetLocalBlockHeadByHeight(height, bs.wm.Symbol())
 	if err != nil {
 		return nil, err
 	}
 
 	block := &Block{
-		Hash:   header.Hash,
-		Height: header.Height,
+		Hash:              header.Hash,
+		Height:            header.Height,
+		Merkleroot:        header.Merkleroot,
+		Previousblockhash: header.Previousblockhash,
+		Time:              header.Time,
 	}
 
 	return block, nil
@@ -1399,6 +1539,20 @@ func (wm *WalletManager) getBlockByCore(hash string, format ...uint64) (*Block,
 	return wm.NewBlock(result), nil
 }
 
+//GetBlockWithTransactions 获取区块数据及区块内的交易单详情
+//core模式使用getblock verbosity = 2，一次获取所有交易单，开启DecodeRawBlock则获取原始区块在本地解析；
+//explorer模式只有交易单ID
+func (wm *WalletManager) GetBlockWithTransactions(hash string) (*Block, error) {
+
+	if wm.Config.RPCServerType == RPCServerExplorer {
+		return wm.getBlockByExplorer(hash)
+	} else if wm.Config.DecodeRawBlock {
+		return wm.getRawBlockByCore(hash)
+	} else {
+		return wm.getBlockByCore(hash, 2)
+	}
+}
+
 //GetTxIDsInMemPool 获取待处理的交易池中的交易单IDs
 func (wm *WalletManager) GetTxIDsInMemPool() ([]string, error) {
 
@@ -1432,6 +1586,32 @@ func (wm *WalletManager) getTxIDsInMemPoolByCore() ([]string, error) {
 	return txids, nil
 }
 
+//GetMemPoolEntryTime 获取交易进入交易池的时间
+func (wm *WalletManager) GetMemPoolEntryTime(txid string) (time.Time, error) {
+
+	if wm.Config.RPCServerType == RPCServerExplorer {
+		return wm.getMemPoolEntryTimeByExplorer(txid)
+	} else {
+		return wm.getMemPoolEntryTimeByCore(txid)
+	}
+}
+
+//getMemPoolEntryTimeByCore 获取交易进入节点交易池的时间
+func (wm *WalletManager) getMemPoolEntryTimeByCore(txid string) (time.Time, error) {
+
+	result, err := wm.WalletClient.Call("getmempoolentry", []interface{}{txid})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	entryTime := result.Get("time").Int()
+	if entryTime <= 0 {
+		return time.Time{}, fmt.Errorf("mempool entry of %s has no time", txid)
+	}
+
+	return time.Unix(entryTime, 0), nil
+}
+
 //GetTransaction 获取交易单
 func (wm *WalletManager) GetTransaction(txid string) (*Transaction, error) {
 
@@ -1521,20 +1701,18 @@ func (wm *WalletManager) getTxOutByCore(txid string, vout uint64) (*Vout, error)
 //获取未扫记录
 func (bs *ILCBlockScanner) GetUnscanRecords() ([]*openwallet.UnscanRecord, error) {
 
-	if bs.BlockchainDAI == nil {
-		return nil, fmt.Errorf("Blockchain DAI is not setup ")
-	}
+	dai := bs.blockchainDAI()
 
-	return bs.BlockchainDAI.GetUnscanRecords(bs.wm.Symbol())
+	return dai.GetUnscanRecords(bs.wm.Symbol())
 }
 
 //DeleteUnscanRecord 删除指定高度的未扫记录
 func (bs *ILCBlockScanner) DeleteUnscanRecord(height uint64) error {
-	if bs.BlockchainDAI == nil {
-		return fmt.Errorf("Blockchain DAI is not setup ")
-	}
+	dai := bs.blockchainDAI()
 
-	return bs.BlockchainDAI.DeleteUnscanRecordByHeight(height, bs.wm.Symbol())
+	bs.forgetUnscanRetryHeight(height)
+
+	return dai.DeleteUnscanRecordByHeight(height, bs.wm.Symbol())
 }
 
 //GetAssetsAccountBalanceByAddress 查询账户相关地址的交易记录
@@ -1637,7 +1815,16 @@ func (bs *ILCBlockScanner) GetTransactionsByAddress(offset, limit int, coin open
 		array = make([]*openwallet.TxExtractData, 0)
 	)
 
-	trxs, err := bs.wm.getMultiAddrTransactionsByExplorer(offset, limit, address...)
+	var (
+		trxs []*Transaction
+		err  error
+	)
+
+	if bs.wm.Config.RPCServerType == RPCServerExplorer {
+		trxs, err = bs.wm.getMultiAddrTransactionsByExplorer(offset, limit, address...)
+	} else {
+		trxs, err = bs.getAddressTransactionsByIndex(offset, limit, address...)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -1678,30 +1865,46 @@ func (bs *ILCBlockScanner) GetTransactionsByAddress(offset, limit int, coin open
 //Run 运行
 func (bs *ILCBlockScanner) Run() error {
 
-	////使用浏览器，开启socketIO监听内存池交易
-	//if bs.wm.Config.RPCServerType == RPCServerExplorer {
-	//	if bs.socketIO == nil {
-	//		go bs.setupSocketIO()
-	//	}
-	//}
+	if bs.IsClose() {
+		return fmt.Errorf("block scanner has been closed")
+	}
 
-	bs.BlockScannerBase.Run()
+	if bs.ScanAddressFunc == nil {
+		return fmt.Errorf("BlockScanAddressFunc is not set up")
+	}
+
+	if bs.isTaskRunning() {
+		bs.wm.Log.Warning("block scanner is running... ")
+		return nil
+	}
+
+	//使用浏览器，开启socketIO监听新区块及内存池交易
+	if bs.wm.Config.RPCServerType == RPCServerExplorer && bs.wm.Config.EnableSocketIO {
+		bs.startSocketIO()
+	}
+
+	//使用核心钱包，配置了zmq推送地址则订阅新区块及交易池交易
+	if bs.wm.Config.RPCServerType == RPCServerCore {
+		bs.startZMQ()
+	}
+
+	bs.startTask()
 
 	return nil
 }
 
-////Stop 停止扫描
+//Stop 停止扫描，取消运行中的扫描任务，并等待其退出
 func (bs *ILCBlockScanner) Stop() error {
 
-	//if bs.socketIO != nil {
-	//	bs.socketIO.Close()
-	//	bs.socketIO = nil
-	//}
-	//
-	////通知停止线程
-	//bs.stopSocketIO <- struct{}{}
+	if bs.IsClose() {
+		return fmt.Errorf("block scanner has been closed")
+	}
+
+	//关闭socketIO连接，等待监听线程退出
+	bs.stopSocketIOListen()
+	bs.stopZMQListen()
 
-	bs.BlockScannerBase.Stop()
+	bs.stopTaskLoop()
 	return nil
 }
 
@@ -1728,22 +1931,39 @@ func (bs *ILCBlockScanner) Stop() error {
 
 /******************* 使用insight socket.io 监听区块 *******************/
 
+//socketIOURL 由浏览器API地址生成socketIO的websocket地址
+func socketIOURL(serverAPI string) (string, error) {
+
+	apiUrl, err := url.Parse(serverAPI)
+	if err != nil {
+		return "", err
+	}
+
+	if len(apiUrl.Host) == 0 {
+		return "", fmt.Errorf("invalid server api: %s", serverAPI)
+	}
+
+	scheme := "ws"
+	if apiUrl.Scheme == "https" || apiUrl.Scheme == "wss" {
+		scheme = "wss"
+	}
+
+	return scheme + "://" + apiUrl.Host + "/socket.io/?EIO=3&transport=websocket", nil
+}
+
 func (bs *ILCBlockScanner) connectSocketIO(disconnected chan struct{}) (*gosocketio.Client, error) {
 
 	var (
 		room = "inv"
 	)
 
-	apiUrl, err := url.Parse(bs.wm.Config.ServerAPI)
+	socketURL, err := socketIOURL(bs.wm.Config.ServerAPI)
 	if err != nil {
 		return nil, err
 	}
-	domain := apiUrl.Hostname()
-	port := common.NewString(apiUrl.Port()).Int()
+
 	bs.wm.Log.Info("block scanner socketIO connecting")
-	socketIO, err := gosocketio.Dial(
-		gosocketio.GetUrl(domain, port, false),
-		transport.GetDefaultWebsocketTransport())
+	socketIO, err := gosocketio.Dial(socketURL, transport.GetDefaultWebsocketTransport())
 	if err != nil {
 		return nil, err
 	}
@@ -1752,9 +1972,21 @@ func (bs *ILCBlockScanner) connectSocketIO(disconnected chan struct{}) (*gosocke
 		//bs.wm.Log.Info("block scanner socketIO get new transaction received: ", args)
 		txMap, ok := args.(map[string]interface{})
 		if ok {
-			txid := txMap["txid"].(string)
+			txid, _ := txMap["txid"].(string)
+			if len(txid) == 0 {
+				return
+			}
 			//bs.wm.Log.Debugf("new tx: %s", txid)
-			errInner := bs.BatchExtractTransaction(0, "", []string{txid})
+			//已提取过的交易（如轮询时已提取）不再重复提取
+			if len(bs.memPool.unseen([]string{txid})) == 0 {
+				return
+			}
+			ctx, running := bs.beginTask()
+			if !running {
+				return
+			}
+			defer bs.taskWG.Done()
+			errInner := bs.batchExtractTransaction(ctx, 0, "", []string{txid})
 			if errInner != nil {
 				bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", errInner)
 			}
@@ -1766,32 +1998,23 @@ func (bs *ILCBlockScanner) connectSocketIO(disconnected chan struct{}) (*gosocke
 		return nil, err
 	}
 
-	/*
-		err = bs.socketIO.On("block", func(h *gosocketio.Channel, args interface{}) {
-			bs.wm.Log.Info("block scanner socketIO get new block received: ", args)
-			hash, ok := args.(string)
-			if ok {
-
-				block, errInner := bs.wm.GetBlock(hash)
-				if errInner != nil {
-					bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", errInner)
-				}
-
-				errInner = bs.scanBlock(block)
-				if errInner != nil {
-					bs.wm.Log.Std.Info("block scanner can not block: %d; unexpected error: %v", block.Height, errInner)
-				}
-			}
-
-		})
-		if err != nil {
-			return err
-		}
-	*/
+	err = socketIO.On("block", func(h *gosocketio.Channel, hash string) {
+		bs.wm.Log.Info("block scanner socketIO get new block received: ", hash)
+		//马上执行扫描任务，不需要等待下一个定时周期
+		go bs.ScanBlockTask()
+	})
+	if err != nil {
+		socketIO.Close()
+		return nil, err
+	}
 
 	err = socketIO.On(gosocketio.OnDisconnection, func(h *gosocketio.Channel) {
 		bs.wm.Log.Info("block scanner socketIO disconnected")
-		disconnected <- struct{}{}
+		atomic.StoreInt32(&bs.socketIOConnected, 0)
+		select {
+		case disconnected <- struct{}{}:
+		default:
+		}
 	})
 	if err != nil {
 		socketIO.Close()
@@ -1800,70 +2023,128 @@ func (bs *ILCBlockScanner) connectSocketIO(disconnected chan struct{}) (*gosocke
 
 	err = socketIO.On(gosocketio.OnConnection, func(h *gosocketio.Channel) {
 		bs.wm.Log.Info("block scanner socketIO connected")
-		h.Emit("subscribe", room)
 	})
 	if err != nil {
 		socketIO.Close()
 		return nil, err
 	}
+
+	//连接事件可能在注册处理方法之前已经触发，注册完成后再订阅
+	if !socketIO.IsAlive() {
+		socketIO.Close()
+		return nil, fmt.Errorf("socketIO connection closed before subscribing")
+	}
+
+	err = socketIO.Emit("subscribe", room)
+	if err != nil {
+		socketIO.Close()
+		return nil, err
+	}
+
+	atomic.StoreInt32(&bs.socketIOConnected, 1)
+
 	return socketIO, nil
 }
 
-//setupSocketIO 配置socketIO监听新区块
-func (bs *ILCBlockScanner) setupSocketIO() error {
+//setupSocketIO 配置socketIO监听新区块，连接断开后按指数退避的等待时间重连，直到stop被关闭
+func (bs *ILCBlockScanner) setupSocketIO(stop, done chan struct{}) {
 
-	//bs.wm.Log.Info("block scanner use socketIO to listen new data")
-	//
-	//var (
-	//	err error
-	//	//连接状态通道
-	//	reconnect = make(chan bool, 1)
-	//	//断开状态通道
-	//	disconnected = make(chan struct{}, 1)
-	//	//重连时的等待时间
-	//	reconnectWait = 5
-	//	socketIO      *gosocketio.Client
-	//)
-	//
-	//defer func() {
-	//	close(reconnect)
-	//	close(disconnected)
-	//}()
-	//
-	////启动连接
-	//reconnect <- true
-	//
-	////重连运行时
-	//for {
-	//	select {
-	//	case <-reconnect:
-	//		//重新连接
-	//		socketIO, err = bs.connectSocketIO(disconnected)
-	//		bs.socketIO = socketIO
-	//		if err != nil {
-	//			bs.wm.Log.Errorf("Connect socketIO failed unexpected error: %v", err)
-	//			disconnected <- struct{}{}
-	//		}
-	//
-	//	case <-disconnected:
-	//
-	//		if bs.socketIO != nil {
-	//			bs.socketIO.Close()
-	//		}
-	//
-	//		//重新连接，前等待
-	//		bs.wm.Log.Info("Auto reconnect after", reconnectWait, "seconds...")
-	//		time.Sleep(time.Duration(reconnectWait) * time.Second)
-	//		reconnect <- true
-	//	case <-bs.stopSocketIO:
-	//		bs.wm.Log.Info("block scanner socketIO has been stopped")
-	//		return nil
-	//	}
-	//}
+	bs.wm.Log.Info("block scanner use socketIO to listen new data")
 
-	return nil
+	var (
+		//断开状态通道
+		disconnected = make(chan struct{}, 1)
+		//重连时的等待时间
+		reconnectWait = bs.wm.Config.PushReconnectWait
+	)
+
+	defer func() {
+		atomic.StoreInt32(&bs.socketIOConnected, 0)
+		close(done)
+	}()
+
+	for {
+
+		socketIO, err := bs.connectSocketIO(disconnected)
+		if err != nil {
+			bs.wm.Log.Errorf("Connect socketIO failed unexpected error: %v", err)
+		} else {
+
+			//连接成功，重置重连等待时间
+			reconnectWait = bs.wm.Config.PushReconnectWait
+
+			bs.socketIOMu.Lock()
+			bs.socketIO = socketIO
+			bs.socketIOMu.Unlock()
+
+			select {
+			case <-disconnected:
+			case <-stop:
+			}
+
+			bs.socketIOMu.Lock()
+			bs.socketIO = nil
+			bs.socketIOMu.Unlock()
+
+			socketIO.Close()
+			atomic.StoreInt32(&bs.socketIOConnected, 0)
+
+			//清除关闭连接时产生的断开通知
+			select {
+			case <-disconnected:
+			default:
+			}
+		}
+
+		//重新连接，前等待
+		bs.wm.Log.Info("Auto reconnect after", reconnectWait, "...")
+		select {
+		case <-time.After(reconnectWait):
+		case <-stop:
+			bs.wm.Log.Info("block scanner socketIO has been stopped")
+			return
+		}
+
+		reconnectWait = reconnectWait * 2
+		if reconnectWait > bs.wm.Config.PushMaxReconnectWait {
+			reconnectWait = bs.wm.Config.PushMaxReconnectWait
+		}
+	}
 }
 
+//startSocketIO 启动socketIO监听，已启动则忽略
+func (bs *ILCBlockScanner) startSocketIO() {
+	bs.socketIOMu.Lock()
+	defer bs.socketIOMu.Unlock()
+
+	if bs.stopSocketIO != nil {
+		return
+	}
+
+	bs.stopSocketIO = make(chan struct{})
+	bs.socketIODone = make(chan struct{})
+	go bs.setupSocketIO(bs.stopSocketIO, bs.socketIODone)
+}
+
+//stopSocketIOListen 关闭socketIO连接，等待监听线程退出
+func (bs *ILCBlockScanner) stopSocketIOListen() {
+	bs.socketIOMu.Lock()
+	stop, done := bs.stopSocketIO, bs.socketIODone
+	bs.stopSocketIO, bs.socketIODone = nil, nil
+	bs.socketIOMu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+}
+
+//IsSocketIOConnected socketIO是否已连接，连接断开时扫描任务通过轮询扫描交易池
+func (bs *ILCBlockScanner) IsSocketIOConnected() bool {
+	return atomic.LoadInt32(&bs.socketIOConnected) == 1
+}
 
 //SupportBlockchainDAI 支持外部设置区块链数据访问接口
 //@optional
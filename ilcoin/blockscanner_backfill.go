@@ -0,0 +1,199 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//AddressBirthday 需要补扫历史交易的地址，Height大于0时从该高度开始，否则从Time之后的第一个区块开始
+type AddressBirthday struct {
+	Address   string //地址
+	SourceKey string //提取结果通知的数据源标识
+	Time      int64  //地址创建时间，unix时间戳
+	Height    uint64 //地址创建时的区块高度
+}
+
+//NewAddressBirthday 以地址的创建时间作为补扫的起点，提取结果按钱包ID通知
+func NewAddressBirthday(address *openwallet.Address) *AddressBirthday {
+	return &AddressBirthday{
+		Address:   address.Address,
+		SourceKey: address.AccountID,
+		Time:      address.CreatedTime,
+	}
+}
+
+//AddressBackfill 后台补扫地址历史交易的任务
+type AddressBackfill struct {
+	cancel   context.CancelFunc
+	done     chan struct{}
+	mu       sync.Mutex
+	progress *BlockRangeProgress
+	err      error
+}
+
+//Progress 当前进度，未开始扫描时为nil
+func (b *AddressBackfill) Progress() *BlockRangeProgress {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.progress == nil {
+		return nil
+	}
+	p := *b.progress
+	return &p
+}
+
+//Done 补扫结束时关闭
+func (b *AddressBackfill) Done() <-chan struct{} {
+	return b.done
+}
+
+//Wait 等待补扫结束，返回最终进度及错误，中断后可用ResumeBlockRange继续
+func (b *AddressBackfill) Wait() (*BlockRangeProgress, error) {
+	<-b.done
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.progress, b.err
+}
+
+//Cancel 取消补扫
+func (b *AddressBackfill) Cancel() {
+	b.cancel()
+}
+
+func (b *AddressBackfill) update(progress *BlockRangeProgress, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if progress != nil {
+		b.progress = progress
+	}
+	b.err = err
+}
+
+//BackfillAddresses 后台补扫新导入地址的历史交易，只提取这些地址，提取结果以BlockExtractDataNotify通知观测者
+//起点为所有地址中最早的创建高度，终点为扫描器已扫描的高度，之后的区块由扫描器提取
+//扫描器暂停或停止时补扫也会取消
+func (bs *ILCBlockScanner) BackfillAddresses(addresses []*AddressBirthday, progressFunc BlockRangeProgressFunc) (*AddressBackfill, error) {
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no address to backfill")
+	}
+
+	watched := make(map[string]string, len(addresses))
+	for _, a := range addresses {
+		if a == nil || len(a.Address) == 0 {
+			return nil, fmt.Errorf("backfill address is empty")
+		}
+		watched[a.Address] = a.SourceKey
+	}
+
+	taskCtx, running := bs.beginTask()
+	if !running {
+		return nil, fmt.Errorf("block scanner is not running")
+	}
+
+	ctx, cancel := context.WithCancel(taskCtx)
+	backfill := &AddressBackfill{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	scanAddressFunc := func(address string) (string, bool) {
+		sourceKey, ok := watched[address]
+		return sourceKey, ok
+	}
+
+	go func() {
+		defer bs.taskWG.Done()
+		defer close(backfill.done)
+		defer cancel()
+
+		start, end, err := bs.backfillRange(addresses)
+		if err != nil {
+			bs.wm.Log.Std.Error("address backfill can not resolve block range; unexpected error: %v", err)
+			backfill.update(nil, err)
+			return
+		}
+
+		progress := &BlockRangeProgress{Start: start, End: end, Next: start}
+		backfill.update(progress, nil)
+
+		if progress.Finished() {
+			return
+		}
+
+		bs.wm.Log.Std.Info("address backfill %d addresses from height: %d to %d", len(addresses), start, end)
+
+		progress, err = bs.ResumeBlockRange(ctx, progress, scanAddressFunc, func(p *BlockRangeProgress) {
+			backfill.update(p, nil)
+			if progressFunc != nil {
+				progressFunc(p)
+			}
+		})
+		backfill.update(progress, err)
+
+		if err != nil {
+			bs.wm.Log.Std.Info("address backfill stopped at height: %d; unexpected error: %v", progress.Next, err)
+		}
+	}()
+
+	return backfill, nil
+}
+
+//backfillRange 补扫的区块范围，起点为最早的创建高度，终点为扫描器已扫描的高度
+func (bs *ILCBlockScanner) backfillRange(addresses []*AddressBirthday) (uint64, uint64, error) {
+
+	end, err := bs.backfillEndHeight()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := end + 1
+	for _, a := range addresses {
+		height := a.Height
+		if height == 0 && a.Time > 0 {
+			height, err = bs.wm.blockHeightByTime(a.Time, end)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		if height < start {
+			start = height
+		}
+	}
+
+	if start > end {
+		//创建时间晚于已扫描的区块，由扫描器提取
+		return end + 1, end, nil
+	}
+
+	return start, end, nil
+}
+
+//backfillEndHeight 扫描器已扫描的高度，未开始扫描时为节点的最新高度
+func (bs *ILCBlockScanner) backfillEndHeight() (uint64, error) {
+
+	header, err := bs.GetScannedBlockHeader()
+	if err == nil && header.Height > 0 {
+		return header.Height, nil
+	}
+
+	return bs.wm.GetBlockHeight()
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+func TestILCBlockScanner_BackfillAddresses(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	//dave在高度2、5收款，erin在高度7收款
+	pays := map[int]string{2: "dave_addr", 5: "dave_addr", 7: "erin_addr"}
+	for i := 1; i <= 8; i++ {
+		txs := []*testTx{newTestTx(fmt.Sprintf("coinbase_a%d", i), nil, testTxOut{"alice_addr", "50"})}
+		if label, ok := pays[i]; ok {
+			txs = append(txs, newTestTx(fmt.Sprintf("pay_%s_%d", label, i), nil, testTxOut{label, "1"}))
+		}
+		node.mine(fmt.Sprintf("a%d", i), txs...)
+	}
+
+	_, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	saveTestScanned(bs, node)
+
+	//dave在高度4的区块时间前1秒创建，erin指定创建高度
+	dave := NewAddressBirthday(&openwallet.Address{Address: testAddress("dave_addr"), AccountID: "dave", CreatedTime: node.chain[4].Time - 1})
+	erin := &AddressBirthday{Address: testAddress("erin_addr"), SourceKey: "erin", Height: 6}
+
+	reported := make([]uint64, 0)
+	backfill, err := bs.BackfillAddresses([]*AddressBirthday{dave, erin}, func(p *BlockRangeProgress) {
+		reported = append(reported, p.Height)
+	})
+	if err != nil {
+		t.Fatalf("BackfillAddresses unexpected error: %v", err)
+	}
+
+	select {
+	case <-backfill.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("backfill timeout")
+	}
+
+	progress, err := backfill.Wait()
+	if err != nil {
+		t.Fatalf("backfill unexpected error: %v", err)
+	}
+	if progress.Start != 4 || progress.End != 8 || !progress.Finished() {
+		t.Errorf("backfill progress = %+v, want range 4 - 8", progress)
+	}
+	if fmt.Sprint(reported) != "[4 5 6 7 8]" {
+		t.Errorf("reported heights = %v, want [4 5 6 7 8]", reported)
+	}
+
+	observer.mu.Lock()
+	heights := func(key string) []uint64 {
+		list := make([]uint64, 0)
+		for _, data := range observer.data[key] {
+			list = append(list, data.Transaction.BlockHeight)
+		}
+		return list
+	}
+	daveHeights, erinHeights, alice := heights("dave"), heights("erin"), len(observer.data["alice"])
+	observer.mu.Unlock()
+
+	//只提取补扫的地址，创建前的交易不提取
+	if fmt.Sprint(daveHeights) != "[5]" || fmt.Sprint(erinHeights) != "[7]" || alice != 0 {
+		t.Errorf("extract data dave = %v, erin = %v, alice = %d, want [5], [7], 0", daveHeights, erinHeights, alice)
+	}
+
+	//创建时间晚于已扫描的区块，无需补扫
+	future := &AddressBirthday{Address: testAddress("frank_addr"), SourceKey: "frank", Time: node.chain[8].Time + 1}
+	backfill, err = bs.BackfillAddresses([]*AddressBirthday{future}, nil)
+	if err != nil {
+		t.Fatalf("BackfillAddresses unexpected error: %v", err)
+	}
+	if progress, err := backfill.Wait(); err != nil || progress.Start != 9 || !progress.Finished() {
+		t.Errorf("future backfill = %+v, %v, want finished from 9", progress, err)
+	}
+
+	if _, err := bs.BackfillAddresses(nil, nil); err == nil {
+		t.Errorf("backfill without address should be failed")
+	}
+
+	//扫描器暂停时不能补扫
+	bs.Pause()
+	if _, err := bs.BackfillAddresses([]*AddressBirthday{erin}, nil); err == nil {
+		t.Errorf("backfill while paused should be failed")
+	}
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//确认数变化类型
+const (
+	TxConfirming = "confirming" //确认数增加，未达到最终确认深度
+	TxFinalized  = "finalized"  //达到最终确认深度，不再通知
+)
+
+//TxConfirmationEvent 已入块的到账交易确认数变化
+type TxConfirmationEvent struct {
+	Type          string                    //确认数变化类型
+	SourceKey     string                    //数据源标识
+	TxID          string                    //交易单号
+	BlockHeight   uint64                    //交易所在的区块高度
+	BlockHash     string                    //交易所在的区块hash
+	Confirmations uint64                    //当前确认数
+	Data          *openwallet.TxExtractData //提取结果，Confirm已更新为当前确认数
+}
+
+//ConfirmationNotificationObject 到账交易确认数被通知对象
+//通过AddObserver添加的观测者，如果同时实现了此接口，每个新区块都会收到到账交易的确认数，直到最终确认
+type ConfirmationNotificationObject interface {
+
+	//TxConfirmationNotify 到账交易确认数变化
+	//@required
+	TxConfirmationNotify(event *TxConfirmationEvent) error
+}
+
+//trackedConfirmation 跟踪确认数的到账交易
+type trackedConfirmation struct {
+	sourceKey string
+	data      *openwallet.TxExtractData
+}
+
+//key 跟踪记录的标识，sourceKey:txid
+func (tx *trackedConfirmation) key() string {
+	return tx.sourceKey + ":" + tx.data.Transaction.TxID
+}
+
+//confirmationTracker 记录未达到最终确认深度的到账交易，key = sourceKey:txid
+//跟踪记录同时保存在扫描器状态数据库，首次使用时恢复
+type confirmationTracker struct {
+	mu     sync.Mutex
+	txs    map[string]*trackedConfirmation
+	loaded bool
+}
+
+func newConfirmationTracker() *confirmationTracker {
+	return &confirmationTracker{
+		txs: make(map[string]*trackedConfirmation),
+	}
+}
+
+func (t *confirmationTracker) add(sourceKey string, data *openwallet.TxExtractData) *trackedConfirmation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx := &trackedConfirmation{sourceKey: sourceKey, data: data}
+	t.txs[tx.key()] = tx
+	return tx
+}
+
+//isLoaded 是否已从状态数据库恢复
+func (t *confirmationTracker) isLoaded() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.loaded
+}
+
+//load 恢复状态数据库中的跟踪记录
+func (t *confirmationTracker) load(records []*ConfirmationRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, record := range records {
+		if record.Data == nil || record.Data.Transaction == nil {
+			continue
+		}
+		t.txs[record.Key] = &trackedConfirmation{sourceKey: record.SourceKey, data: record.Data}
+	}
+	t.loaded = true
+}
+
+//removeBlock 停止跟踪被孤立区块中的交易，返回停止跟踪的记录
+func (t *confirmationTracker) removeBlock(blockHash string) []*trackedConfirmation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := make([]*trackedConfirmation, 0)
+	for key, tx := range t.txs {
+		if tx.data.Transaction.BlockHash == blockHash {
+			delete(t.txs, key)
+			removed = append(removed, tx)
+		}
+	}
+	return removed
+}
+
+//list 跟踪中的交易，按区块高度及交易单号排列
+func (t *confirmationTracker) list() []*trackedConfirmation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]*trackedConfirmation, 0, len(t.txs))
+	for _, tx := range t.txs {
+		list = append(list, tx)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i].data.Transaction, list[j].data.Transaction
+		if a.BlockHeight != b.BlockHeight {
+			return a.BlockHeight < b.BlockHeight
+		}
+		if a.TxID != b.TxID {
+			return a.TxID < b.TxID
+		}
+		return list[i].sourceKey < list[j].sourceKey
+	})
+	return list
+}
+
+func (t *confirmationTracker) remove(tx *trackedConfirmation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.txs, tx.key())
+}
+
+func (t *confirmationTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.txs)
+}
+
+//confirmationObservers 实现了确认数接口的观测者
+func (bs *ILCBlockScanner) confirmationObservers() []ConfirmationNotificationObject {
+	bs.Mu.RLock()
+	defer bs.Mu.RUnlock()
+
+	observers := make([]ConfirmationNotificationObject, 0)
+	for o, _ := range bs.Observers {
+		if co, ok := o.(ConfirmationNotificationObject); ok {
+			observers = append(observers, co)
+		}
+	}
+	return observers
+}
+
+//loadConfirmations 从状态数据库恢复上次运行时跟踪中的交易，只在首次成功时恢复
+func (bs *ILCBlockScanner) loadConfirmations() {
+
+	if bs.confirmations.isLoaded() {
+		return
+	}
+
+	records, err := bs.scanState().ConfirmationRecords()
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not load tracked confirmations; unexpected error: %v", err)
+		return
+	}
+
+	bs.confirmations.load(records)
+}
+
+//saveConfirmation 保存跟踪中的交易，重启后继续通知确认数
+func (bs *ILCBlockScanner) saveConfirmation(tx *trackedConfirmation) {
+	err := bs.scanState().SaveConfirmationRecord(&ConfirmationRecord{
+		Key:       tx.key(),
+		SourceKey: tx.sourceKey,
+		Data:      tx.data,
+	})
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not save tracked confirmation %s; unexpected error: %v", tx.key(), err)
+	}
+}
+
+//deleteConfirmation 删除停止跟踪的交易
+func (bs *ILCBlockScanner) deleteConfirmation(tx *trackedConfirmation) {
+	err := bs.scanState().DeleteConfirmationRecord(tx.key())
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not delete tracked confirmation %s; unexpected error: %v", tx.key(), err)
+	}
+}
+
+//removeBlockConfirmations 停止跟踪被孤立区块中的交易
+func (bs *ILCBlockScanner) removeBlockConfirmations(blockHash string) {
+	bs.loadConfirmations()
+	for _, tx := range bs.confirmations.removeBlock(blockHash) {
+		bs.deleteConfirmation(tx)
+	}
+}
+
+//trackConfirmations 跟踪区块中到账交易的确认数，已达到最终确认深度的忽略（如重扫旧区块）
+func (bs *ILCBlockScanner) trackConfirmations(height uint64, results []ExtractResult) {
+
+	if height == 0 || len(bs.confirmationObservers()) == 0 {
+		return
+	}
+
+	bs.loadConfirmations()
+
+	scannedHeight := bs.GetScannedBlockHeight()
+	if scannedHeight >= height && scannedHeight-height+1 >= bs.wm.Config.FinalityDepth {
+		return
+	}
+
+	for _, result := range results {
+		if !result.Success {
+			continue
+		}
+		for _, extractData := range []map[string]*openwallet.TxExtractData{result.extractData, result.extractOmniData} {
+			for key, data := range extractData {
+				if len(data.TxOutputs) == 0 || data.Transaction == nil {
+					continue
+				}
+				bs.saveConfirmation(bs.confirmations.add(key, data))
+			}
+		}
+	}
+}
+
+//updateConfirmations 新区块时通知跟踪中交易的确认数，达到最终确认深度后停止跟踪
+func (bs *ILCBlockScanner) updateConfirmations(block *Block) {
+
+	bs.loadConfirmations()
+
+	if bs.confirmations.len() == 0 {
+		return
+	}
+
+	observers := bs.confirmationObservers()
+
+	for _, tx := range bs.confirmations.list() {
+
+		if tx.data.Transaction.BlockHeight > block.Height {
+			continue
+		}
+
+		confirmations := block.Height - tx.data.Transaction.BlockHeight + 1
+
+		event := &TxConfirmationEvent{
+			Type:          TxConfirming,
+			SourceKey:     tx.sourceKey,
+			TxID:          tx.data.Transaction.TxID,
+			BlockHeight:   tx.data.Transaction.BlockHeight,
+			BlockHash:     tx.data.Transaction.BlockHash,
+			Confirmations: confirmations,
+			Data:          confirmedExtractData(tx.data, confirmations),
+		}
+
+		if confirmations >= bs.wm.Config.FinalityDepth {
+			event.Type = TxFinalized
+			bs.confirmations.remove(tx)
+			bs.deleteConfirmation(tx)
+		}
+
+		for _, o := range observers {
+			notifyErr := o.TxConfirmationNotify(event)
+			if notifyErr != nil {
+				bs.wm.Log.Error("TxConfirmationNotify unexpected error:", notifyErr)
+			}
+		}
+	}
+}
+
+//confirmedExtractData 复制提取结果，并更新确认数，不修改已通知给观测者的数据
+func confirmedExtractData(data *openwallet.TxExtractData, confirmations uint64) *openwallet.TxExtractData {
+
+	copied := *data
+
+	if data.Transaction != nil {
+		tx := *data.Transaction
+		tx.Confirm = int64(confirmations)
+		copied.Transaction = &tx
+	}
+
+	copied.TxInputs = make([]*openwallet.TxInput, 0, len(data.TxInputs))
+	for _, input := range data.TxInputs {
+		in := *input
+		in.Confirm = int64(confirmations)
+		copied.TxInputs = append(copied.TxInputs, &in)
+	}
+
+	copied.TxOutputs = make([]*openwallet.TxOutPut, 0, len(data.TxOutputs))
+	for _, output := range data.TxOutputs {
+		out := *output
+		out.Confirm = int64(confirmations)
+		copied.TxOutputs = append(copied.TxOutputs, &out)
+	}
+
+	return &copied
+}
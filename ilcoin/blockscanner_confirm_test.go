@@ -0,0 +1,176 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+//testConfirmationObserver 收集到账交易的确认数变化
+type testConfirmationObserver struct {
+	*testObserver
+	eventsMu sync.Mutex
+	events   []*TxConfirmationEvent
+}
+
+func (o *testConfirmationObserver) TxConfirmationNotify(event *TxConfirmationEvent) error {
+	o.eventsMu.Lock()
+	defer o.eventsMu.Unlock()
+	o.events = append(o.events, event)
+	return nil
+}
+
+func (o *testConfirmationObserver) takeEvents() []*TxConfirmationEvent {
+	o.eventsMu.Lock()
+	defer o.eventsMu.Unlock()
+	events := o.events
+	o.events = nil
+	return events
+}
+
+func TestILCBlockScanner_ConfirmationTracking(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.FinalityDepth = 3
+	confirmObserver := &testConfirmationObserver{testObserver: newTestObserver()}
+	bs.AddObserver(confirmObserver)
+	saveTestScanned(bs, node)
+	bs.Restart()
+
+	deposit := newTestTx("deposit", []testTxIn{{node.chain[1].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "1"})
+	depositBlock := node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), deposit)
+
+	for i, want := range []struct {
+		eventType     string
+		confirmations uint64
+	}{
+		{TxConfirming, 1},
+		{TxConfirming, 2},
+		{TxFinalized, 3},
+	} {
+		bs.ScanBlockTask()
+		events := confirmObserver.takeEvents()
+		if len(events) != 1 {
+			t.Fatalf("round %d: events count = %d, want 1", i, len(events))
+		}
+		e := events[0]
+		if e.Type != want.eventType || e.Confirmations != want.confirmations || e.TxID != deposit.TxID ||
+			e.SourceKey != "alice" || e.BlockHeight != depositBlock.Height || e.BlockHash != depositBlock.Hash {
+			t.Errorf("round %d: event = %s %d %s %s, want %s %d %s alice", i, e.Type, e.Confirmations, e.TxID, e.SourceKey, want.eventType, want.confirmations, deposit.TxID)
+		}
+		if e.Data.TxOutputs[0].Confirm != int64(want.confirmations) || e.Data.Transaction.Confirm != int64(want.confirmations) {
+			t.Errorf("round %d: data confirm = %d, want %d", i, e.Data.TxOutputs[0].Confirm, want.confirmations)
+		}
+		node.mine(fmt.Sprintf("a%d", i+3))
+	}
+
+	//最终确认后不再通知
+	bs.ScanBlockTask()
+	if events := confirmObserver.takeEvents(); len(events) != 0 {
+		t.Fatalf("events after finalized = %d, want 0", len(events))
+	}
+
+	//已通知的提取结果不被修改
+	observer.mu.Lock()
+	if confirm := observer.data["alice"][0].TxOutputs[0].Confirm; confirm != 1 {
+		t.Errorf("notified extract data confirm = %d, want 1", confirm)
+	}
+	observer.mu.Unlock()
+
+	//被孤立区块中的交易停止跟踪
+	tip := node.chain[len(node.chain)-1]
+	orphan := newTestTx("orphan_deposit", []testTxIn{{tip.Txs[0].TxID, 0}}, testTxOut{"alice_addr", "2"})
+	node.mine("c1", newTestTx("coinbase_c1", nil, testTxOut{"miner_addr", "50"}), orphan)
+	bs.ScanBlockTask()
+	if events := confirmObserver.takeEvents(); len(events) != 1 || events[0].TxID != orphan.TxID {
+		t.Fatalf("orphan deposit is not tracked")
+	}
+
+	node.reorg(tip.Height)
+	node.mine("d1")
+	node.mine("d2")
+	bs.ScanBlockTask()
+	if events := confirmObserver.takeEvents(); len(events) != 0 {
+		t.Fatalf("events for orphaned deposit = %d, want 0", len(events))
+	}
+}
+
+func TestILCBlockScanner_ConfirmationTracking_Restart(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	wm, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.FinalityDepth = 3
+	confirmObserver := &testConfirmationObserver{testObserver: newTestObserver()}
+	bs.AddObserver(confirmObserver)
+	saveTestScanned(bs, node)
+	bs.Restart()
+
+	deposit := newTestTx("deposit", []testTxIn{{node.chain[1].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "1"})
+	depositBlock := node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), deposit)
+	bs.ScanBlockTask()
+	if events := confirmObserver.takeEvents(); len(events) != 1 || events[0].Confirmations != 1 {
+		t.Fatalf("deposit is not tracked before restart")
+	}
+
+	//停止扫描器并关闭状态数据库，新的扫描器使用同一个数据目录
+	bs.Stop()
+	bs.scanState().Close()
+
+	wm2, bs2, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm2.Config.FinalityDepth = 3
+	confirmObserver2 := &testConfirmationObserver{testObserver: newTestObserver()}
+	bs2.AddObserver(confirmObserver2)
+	saveTestScanned(bs2, node)
+	bs2.Restart()
+	defer bs2.scanState().Close()
+
+	for i, want := range []struct {
+		eventType     string
+		confirmations uint64
+	}{
+		{TxConfirming, 2},
+		{TxFinalized, 3},
+	} {
+		node.mine(fmt.Sprintf("b%d", i))
+		bs2.ScanBlockTask()
+		events := confirmObserver2.takeEvents()
+		if len(events) != 1 {
+			t.Fatalf("round %d: events count = %d after restart, want 1", i, len(events))
+		}
+		e := events[0]
+		if e.Type != want.eventType || e.Confirmations != want.confirmations || e.TxID != deposit.TxID ||
+			e.SourceKey != "alice" || e.BlockHash != depositBlock.Hash || e.Data.TxOutputs[0].Confirm != int64(want.confirmations) {
+			t.Errorf("round %d: event = %s %d %s %s, want %s %d %s alice", i, e.Type, e.Confirmations, e.TxID, e.SourceKey, want.eventType, want.confirmations, deposit.TxID)
+		}
+	}
+
+	//最终确认后从状态数据库删除
+	records, err := bs2.scanState().ConfirmationRecords()
+	if err != nil || len(records) != 0 {
+		t.Errorf("confirmation records after finalized = %d, %v", len(records), err)
+	}
+}
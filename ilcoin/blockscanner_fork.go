@@ -0,0 +1,226 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"context"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+const (
+	TxActionReverted = "reverted" //被孤立区块中的交易，已入账的输入输出需要撤销
+)
+
+//BlockForkNotificationObject 分叉回滚被通知对象
+//通过AddObserver添加的观测者，如果同时实现了此接口，分叉时会收到被孤立区块中需要撤销的提取结果
+type BlockForkNotificationObject interface {
+
+	//BlockExtractDataRevertNotify 被孤立区块的提取结果通知，data.Transaction.TxAction = "reverted"
+	//@required
+	BlockExtractDataRevertNotify(sourceKey string, data *openwallet.TxExtractData) error
+}
+
+//forkObservers 实现了分叉回滚接口的观测者
+func (bs *ILCBlockScanner) forkObservers() []BlockForkNotificationObject {
+	bs.Mu.RLock()
+	defer bs.Mu.RUnlock()
+
+	observers := make([]BlockForkNotificationObject, 0)
+	for o := range bs.Observers {
+		if fo, ok := o.(BlockForkNotificationObject); ok {
+			observers = append(observers, fo)
+		}
+	}
+	return observers
+}
+
+//newForkBlockNotify 通知分叉区块给观测者，并通知被孤立区块中需要撤销的交易记录
+//撤销通知失败时保存撤销记录，扫描任务重扫失败记录时重试
+func (bs *ILCBlockScanner) newForkBlockNotify(forkBlock *Block) {
+
+	bs.newBlockNotify(forkBlock, true)
+
+	//被孤立区块中的交易不再跟踪确认数，新分支重新提取时再跟踪
+	bs.removeBlockConfirmations(forkBlock.Hash)
+
+	logged, err := bs.notifyRevertData(forkBlock.Height, forkBlock.Hash, false)
+	if err != nil {
+		bs.wm.Log.Std.Error("block height: %d, hash: %s notify revert data failed. unexpected error: %v", forkBlock.Height, forkBlock.Hash, err)
+		bs.saveRevertRecord(forkBlock.Height, forkBlock.Hash, logged, err)
+	}
+}
+
+//notifyRevertData 提取被孤立区块需要撤销的交易记录，追加到事件日志，并通知给实现了分叉回滚接口的观测者
+//logged = true 表示已追加过事件日志，不再重复追加，返回事件日志是否已追加
+//部分通知失败时仍通知其余的记录，返回第一个错误
+func (bs *ILCBlockScanner) notifyRevertData(height uint64, blockHash string, logged bool) (bool, error) {
+
+	if bs.scanEventLog() == nil {
+		logged = true
+	}
+
+	observers := bs.forkObservers()
+	if len(observers) == 0 && logged {
+		return logged, nil
+	}
+
+	revertData, err := bs.ExtractRevertData(blockHash)
+	if err != nil {
+		return logged, err
+	}
+
+	var notifyErr error
+
+	if !logged {
+		notifyErr = bs.appendRevertDataEvents(height, revertData)
+		logged = notifyErr == nil
+	}
+
+	for _, o := range observers {
+		for key, list := range revertData {
+			for _, data := range list {
+				err := o.BlockExtractDataRevertNotify(key, data)
+				if err != nil {
+					bs.wm.Log.Error("BlockExtractDataRevertNotify unexpected error:", err)
+					if notifyErr == nil {
+						notifyErr = err
+					}
+				}
+			}
+		}
+	}
+
+	return logged, notifyErr
+}
+
+//saveRevertRecord 保存撤销失败的区块，并累计失败次数
+func (bs *ILCBlockScanner) saveRevertRecord(height uint64, hash string, logged bool, reason error) {
+
+	state := bs.scanState()
+
+	record, err := state.GetRevertRecord(hash)
+	if err != nil || record == nil {
+		record = &RevertRecord{Hash: hash, Height: height}
+	}
+	record.Attempts++
+	record.LastError = reason.Error()
+	record.Logged = logged
+
+	err = state.SaveRevertRecord(record)
+	if err != nil {
+		bs.wm.Log.Std.Error("block height: %d, hash: %s save revert record failed. unexpected error: %v", height, hash, err)
+	}
+}
+
+//retryRevertRecords 重试撤销失败的区块，成功后删除撤销记录
+//重试时再次通知全部观测者，观测者需要按交易单号去重
+func (bs *ILCBlockScanner) retryRevertRecords(ctx context.Context) {
+
+	state := bs.scanState()
+
+	records, err := state.RevertRecords()
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not get revert records; unexpected error: %v", err)
+		return
+	}
+
+	for _, record := range records {
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		bs.wm.Log.Std.Info("block scanner retry revert block height: %d, hash: %s ...", record.Height, record.Hash)
+
+		logged, err := bs.notifyRevertData(record.Height, record.Hash, record.Logged)
+		if err != nil {
+			bs.wm.Log.Std.Error("block height: %d, hash: %s notify revert data failed. unexpected error: %v", record.Height, record.Hash, err)
+			bs.saveRevertRecord(record.Height, record.Hash, logged, err)
+			continue
+		}
+
+		err = state.DeleteRevertRecord(record.Hash)
+		if err != nil {
+			bs.wm.Log.Std.Error("block height: %d, hash: %s delete revert record failed. unexpected error: %v", record.Height, record.Hash, err)
+		}
+	}
+}
+
+//GetRevertRecords 撤销通知失败，等待重试的被孤立区块
+func (bs *ILCBlockScanner) GetRevertRecords() ([]*RevertRecord, error) {
+	return bs.scanState().RevertRecords()
+}
+
+//ExtractRevertData 用当前的ScanAddressFunc重新提取被孤立区块的交易单，提取结果标记为撤销
+//有交易单提取失败时返回ExtractError，由撤销记录整体重试
+func (bs *ILCBlockScanner) ExtractRevertData(blockHash string) (map[string][]*openwallet.TxExtractData, error) {
+
+	var (
+		revertData = make(map[string][]*openwallet.TxExtractData)
+		failed     = make(map[string]error)
+	)
+
+	//节点仍保存了被孤立的区块，可以通过hash查询
+	block, err := bs.wm.GetBlockWithTransactions(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	//撤销的数据需要完整通知，不随扫描任务取消
+	results, err := bs.extractBlock(context.Background(), block)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		if !result.Success {
+			bs.wm.Log.Std.Error("block height: %d, txid: %s extract revert data failed.", block.Height, result.TxID)
+			failed[result.TxID] = result.err
+			continue
+		}
+
+		for _, extractData := range []map[string]*openwallet.TxExtractData{result.extractData, result.extractOmniData} {
+			for key, data := range extractData {
+				markTxExtractDataReverted(data, block)
+				revertData[key] = append(revertData[key], data)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return nil, &ExtractError{BlockHeight: block.Height, Failed: failed}
+	}
+
+	return revertData, nil
+}
+
+//markTxExtractDataReverted 标记提取结果为撤销，区块信息统一为被孤立的区块
+func markTxExtractDataReverted(data *openwallet.TxExtractData, block *Block) {
+	for _, input := range data.TxInputs {
+		input.BlockHeight = block.Height
+		input.BlockHash = block.Hash
+	}
+	for _, output := range data.TxOutputs {
+		output.BlockHeight = block.Height
+		output.BlockHash = block.Hash
+	}
+	if data.Transaction != nil {
+		data.Transaction.BlockHeight = block.Height
+		data.Transaction.BlockHash = block.Hash
+		data.Transaction.TxAction = TxActionReverted
+	}
+}
@@ -0,0 +1,379 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+type testForkObserver struct {
+	*testObserver
+	mu       sync.Mutex
+	reverted map[string][]*openwallet.TxExtractData
+	failures int //前failures次通知返回错误
+}
+
+func (o *testForkObserver) BlockExtractDataRevertNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failures > 0 {
+		o.failures--
+		return fmt.Errorf("observer is busy")
+	}
+	o.reverted[sourceKey] = append(o.reverted[sourceKey], data)
+	return nil
+}
+
+func TestILCBlockScanner_ExtractRevertData(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	fund := newTestTx("fund", nil, testTxOut{"alice_addr", "10"})
+	node.mine("a1", fund)
+	pay := newTestTx("pay", []testTxIn{{TxID: fund.TxID, Vout: 0}}, testTxOut{"bob_addr", "7"}, testTxOut{"alice_addr", "2.9"})
+	orphan := node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), pay)
+
+	_, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice", "bob_addr": "bob"})
+	observer := &testForkObserver{testObserver: newTestObserver(), reverted: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(observer)
+	saveTestScanned(bs, node)
+
+	node.reorg(1)
+	node.mine("b2")
+	node.mine("b3")
+
+	bs.Restart()
+	bs.ScanBlockTask()
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+
+	alice := observer.reverted["alice"]
+	if len(alice) != 1 {
+		t.Fatalf("alice reverted data count = %d, want 1", len(alice))
+	}
+	if len(alice[0].TxInputs) != 1 || alice[0].TxInputs[0].Amount != "10" || alice[0].TxInputs[0].SourceTxID != fund.TxID {
+		t.Errorf("alice reverted inputs = %+v", alice[0].TxInputs)
+	}
+	if len(alice[0].TxOutputs) != 1 || alice[0].TxOutputs[0].Amount != "2.9" {
+		t.Errorf("alice reverted outputs = %+v", alice[0].TxOutputs)
+	}
+
+	//分叉区块的通知使用本地保存的完整区块头
+	for _, h := range observer.waitHeaders(t, 3) {
+		if h.Fork && (h.Hash != orphan.Hash || h.Previousblockhash != orphan.Prev || h.Time != uint64(orphan.Time)) {
+			t.Errorf("fork header = %+v, want hash %s, prev %s, time %d", h, orphan.Hash, orphan.Prev, orphan.Time)
+		}
+	}
+
+	bob := observer.reverted["bob"]
+	if len(bob) != 1 || len(bob[0].TxOutputs) != 1 || bob[0].TxOutputs[0].Amount != "7" {
+		t.Fatalf("bob reverted data = %+v", bob)
+	}
+
+	for _, data := range []*openwallet.TxExtractData{alice[0], bob[0]} {
+		if data.Transaction.TxAction != TxActionReverted || data.Transaction.TxID != pay.TxID {
+			t.Errorf("reverted transaction = %+v", data.Transaction)
+		}
+		if data.Transaction.BlockHash != orphan.Hash || data.Transaction.BlockHeight != orphan.Height {
+			t.Errorf("reverted transaction block = %d %s, want %d %s", data.Transaction.BlockHeight, data.Transaction.BlockHash, orphan.Height, orphan.Hash)
+		}
+	}
+}
+
+func TestILCBlockScanner_BlockFetchFailed(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	_, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	observer := &testForkObserver{testObserver: newTestObserver(), reverted: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(observer)
+	saveTestScanned(bs, node)
+
+	node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"alice_addr", "50"}))
+	failed := node.mine("a3")
+	node.mine("a4")
+
+	//第3个区块获取失败
+	var dropBlock int32 = 1
+	node.fail = func(method string, params []json.RawMessage) error {
+		var hash string
+		if method == "getblock" && len(params) > 0 && json.Unmarshal(params[0], &hash) == nil &&
+			hash == failed.Hash && atomic.LoadInt32(&dropBlock) == 1 {
+			return fmt.Errorf("[-1]connection reset")
+		}
+		return nil
+	}
+
+	bs.Restart()
+	bs.ScanBlockTask()
+
+	header, _ := bs.GetScannedBlockHeader()
+	if header.Height != 2 || header.Hash != node.chain[2].Hash {
+		t.Fatalf("scanned block = %d %s, want stop before the failed block", header.Height, header.Hash)
+	}
+
+	atomic.StoreInt32(&dropBlock, 0)
+	bs.ScanBlockTask()
+
+	header, _ = bs.GetScannedBlockHeader()
+	if header.Height != 4 || header.Hash != node.chain[4].Hash {
+		t.Fatalf("scanned block = %d %s, want 4 %s", header.Height, header.Hash, node.chain[4].Hash)
+	}
+
+	headers := observer.waitHeaders(t, 3)
+	for _, h := range headers {
+		if h.Fork {
+			t.Errorf("block %d %s notified as fork", h.Height, h.Hash)
+		}
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if len(observer.reverted) != 0 {
+		t.Errorf("reverted data = %v, want none", observer.reverted)
+	}
+}
+
+func TestILCBlockScanner_BlockFetchFailedSkip(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.BlockMaxFailures = 2
+	saveTestScanned(bs, node)
+
+	node.mine("a2")
+	failed := node.mine("a3", newTestTx("coinbase_a3", nil, testTxOut{"alice_addr", "50"}))
+	node.mine("a4")
+
+	//第3个区块一直获取失败
+	var dropBlock int32 = 1
+	node.fail = func(method string, params []json.RawMessage) error {
+		var hash string
+		if method == "getblock" && len(params) > 0 && json.Unmarshal(params[0], &hash) == nil &&
+			hash == failed.Hash && atomic.LoadInt32(&dropBlock) == 1 {
+			return fmt.Errorf("[-32700]block decode failed")
+		}
+		return nil
+	}
+
+	bs.Restart()
+	bs.ScanBlockTask()
+
+	header, _ := bs.GetScannedBlockHeader()
+	if header.Height != 2 || len(unscanRecordTxIDs(bs)) != 0 {
+		t.Fatalf("scanned block = %d, unscan records = %v, want stop before the failed block", header.Height, unscanRecordTxIDs(bs))
+	}
+
+	//连续失败达到上限，记录未扫区块并继续扫描后面的区块
+	bs.ScanBlockTask()
+
+	header, _ = bs.GetScannedBlockHeader()
+	if header.Height != 4 || header.Hash != node.chain[4].Hash {
+		t.Fatalf("scanned block = %d %s, want 4 %s", header.Height, header.Hash, node.chain[4].Hash)
+	}
+	list, _ := bs.GetUnscanRecords()
+	if len(list) != 1 || list[0].BlockHeight != 3 || len(list[0].TxID) != 0 {
+		t.Fatalf("unscan records = %+v, want the whole block 3", list)
+	}
+	for _, h := range observer.waitHeaders(t, 2) {
+		if h.Fork || h.Height == 3 {
+			t.Errorf("block %d %s notified, fork = %v", h.Height, h.Hash, h.Fork)
+		}
+	}
+
+	//区块恢复后由未扫记录的重试补扫
+	atomic.StoreInt32(&dropBlock, 0)
+	expireUnscanRetries(bs)
+	bs.RescanFailedRecord()
+
+	if records := unscanRecordTxIDs(bs); len(records) != 0 {
+		t.Errorf("unscan records after rescan = %v", records)
+	}
+}
+
+func TestILCBlockScanner_RetryRevert(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+	orphan := node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"alice_addr", "50"}))
+
+	_, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	observer := &testForkObserver{testObserver: newTestObserver(), reverted: make(map[string][]*openwallet.TxExtractData), failures: 1}
+	bs.AddObserver(observer)
+	saveTestScanned(bs, node)
+
+	node.reorg(1)
+	node.mine("b2")
+	node.mine("b3")
+
+	bs.Restart()
+	bs.ScanBlockTask()
+
+	//撤销通知失败，保存撤销记录，扫描任务重扫失败记录时已重试一次
+	records, err := bs.GetRevertRecords()
+	if err != nil {
+		t.Fatalf("GetRevertRecords unexpected error: %v", err)
+	}
+	observer.mu.Lock()
+	reverted := len(observer.reverted["alice"])
+	observer.mu.Unlock()
+	if len(records) != 0 || reverted != 1 {
+		t.Fatalf("revert records = %d, reverted = %d, want retried in the same task", len(records), reverted)
+	}
+
+	//重试也失败时保留撤销记录
+	observer.mu.Lock()
+	observer.failures = 2
+	observer.reverted = make(map[string][]*openwallet.TxExtractData)
+	observer.mu.Unlock()
+	bs.newForkBlockNotify(&Block{Hash: orphan.Hash, Height: orphan.Height})
+	bs.RescanFailedRecord()
+
+	records, _ = bs.GetRevertRecords()
+	if len(records) != 1 || records[0].Hash != orphan.Hash || records[0].Height != orphan.Height || records[0].Attempts != 2 {
+		t.Fatalf("revert records = %+v, want %s failed twice", records, orphan.Hash)
+	}
+
+	bs.RescanFailedRecord()
+
+	records, _ = bs.GetRevertRecords()
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	alice := observer.reverted["alice"]
+	if len(records) != 0 || len(alice) != 1 || alice[0].Transaction.BlockHash != orphan.Hash {
+		t.Errorf("after retry revert records = %d, reverted = %+v", len(records), alice)
+	}
+}
+
+func TestILCBlockScanner_ForkMissingLocalHeader(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	fund := newTestTx("fund", nil, testTxOut{"alice_addr", "10"})
+	node.mine("a1", fund)
+	pay := newTestTx("pay", []testTxIn{{TxID: fund.TxID, Vout: 0}}, testTxOut{"alice_addr", "9.9"})
+	orphan := node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), pay)
+	coinbase := newTestTx("coinbase_a3", nil, testTxOut{"alice_addr", "50"})
+	tip := node.mine("a3", coinbase)
+
+	_, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	observer := &testForkObserver{testObserver: newTestObserver(), reverted: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(observer)
+
+	//已扫描到a3，但本地没有a3的区块头
+	for _, b := range node.chain[:3] {
+		bs.SaveLocalBlock(&Block{Hash: b.Hash, Height: b.Height, Previousblockhash: b.Prev, Time: uint64(b.Time)})
+	}
+	bs.SaveLocalNewBlock(tip.Height, tip.Hash)
+
+	node.reorg(1)
+	node.mine("b2")
+	node.mine("b3")
+	replaced := node.mine("b4", newTestTx("coinbase_b4", nil, testTxOut{"alice_addr", "1"}))
+
+	bs.Restart()
+	bs.ScanBlockTask()
+
+	header, _ := bs.GetScannedBlockHeader()
+	if header.Height != replaced.Height || header.Hash != replaced.Hash {
+		t.Fatalf("scanned block = %d %s, want %d %s", header.Height, header.Hash, replaced.Height, replaced.Hash)
+	}
+
+	//a3及a2都作为分叉区块通知，并撤销其中的交易
+	forks := make(map[string]bool)
+	for _, h := range observer.waitHeaders(t, 5) {
+		if h.Fork {
+			forks[h.Hash] = true
+		}
+	}
+	if len(forks) != 2 || !forks[tip.Hash] || !forks[orphan.Hash] {
+		t.Errorf("fork headers = %v, want %s and %s", forks, tip.Hash, orphan.Hash)
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	reverted := make(map[string]bool)
+	for _, data := range observer.reverted["alice"] {
+		reverted[data.Transaction.TxID] = true
+	}
+	if len(reverted) != 2 || !reverted[coinbase.TxID] || !reverted[pay.TxID] {
+		t.Errorf("alice reverted transactions = %v", reverted)
+	}
+}
+
+func TestILCBlockScanner_RetryRevertExtractFailed(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+	prevTx := newTestTx("missing_prev", nil, testTxOut{"genesis_addr", "1"})
+	pay := newTestTx("pay_alice", []testTxIn{{prevTx.TxID, 0}}, testTxOut{"alice_addr", "1"})
+	orphan := node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"alice_addr", "50"}), pay)
+
+	_, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	observer := &testForkObserver{testObserver: newTestObserver(), reverted: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(observer)
+
+	//前置交易单不在节点上，被孤立区块的交易单提取失败，保存撤销记录
+	bs.newForkBlockNotify(&Block{Hash: orphan.Hash, Height: orphan.Height})
+
+	records, _ := bs.GetRevertRecords()
+	if len(records) != 1 || records[0].Hash != orphan.Hash || !strings.Contains(records[0].LastError, pay.TxID) {
+		t.Fatalf("revert records = %+v, want %s failed on %s", records, orphan.Hash, pay.TxID)
+	}
+	observer.mu.Lock()
+	reverted := len(observer.reverted["alice"])
+	observer.mu.Unlock()
+	if reverted != 0 {
+		t.Errorf("reverted = %d before all transactions are extracted", reverted)
+	}
+
+	node.mu.Lock()
+	node.txs[prevTx.TxID] = prevTx
+	node.mu.Unlock()
+	bs.RescanFailedRecord()
+
+	records, _ = bs.GetRevertRecords()
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	txids := make(map[string]bool)
+	for _, data := range observer.reverted["alice"] {
+		txids[data.Transaction.TxID] = true
+	}
+	if len(records) != 0 || len(txids) != 2 || !txids[pay.TxID] {
+		t.Errorf("after retry revert records = %d, reverted = %v", len(records), txids)
+	}
+}
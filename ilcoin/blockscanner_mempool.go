@@ -0,0 +1,378 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//交易池交易的状态变化
+const (
+	MemPoolTxConfirmed = "confirmed" //已被区块确认
+	MemPoolTxEvicted   = "evicted"   //被节点移出交易池
+	MemPoolTxExpired   = "expired"   //超过交易池有效期被移出
+	MemPoolTxReplaced  = "replaced"  //输入被其他交易花费（包括RBF替换）
+)
+
+//MemPoolTxEvent 跟踪中的交易池交易状态变化
+type MemPoolTxEvent struct {
+	Type        string                               //状态变化类型
+	TxID        string                               //交易单号
+	ReplacedBy  string                               //花费了相同输入的交易单号，Type = replaced
+	BlockHeight uint64                               //确认或替换交易所在的区块高度，交易池中的替换为0
+	BlockHash   string                               //确认或替换交易所在的区块hash
+	FirstSeen   time.Time                            //首次在交易池中提取到的时间
+	EntryTime   time.Time                            //进入节点（浏览器模式为insight）交易池的时间，查询不到时为零值
+	Data        map[string]*openwallet.TxExtractData //首次提取到的结果，key = sourceKey
+}
+
+//MemPoolNotificationObject 交易池交易状态被通知对象
+//通过AddObserver添加的观测者，如果同时实现了此接口，会收到关注地址的未确认交易的状态变化
+type MemPoolNotificationObject interface {
+
+	//MemPoolTxNotify 未确认交易被确认、移出交易池或被替换
+	//@required
+	MemPoolTxNotify(event *MemPoolTxEvent) error
+}
+
+//trackedMemPoolTx 跟踪中的交易池交易
+type trackedMemPoolTx struct {
+	txID        string
+	prevOutputs []string
+	firstSeen   time.Time
+	entryTime   time.Time
+	data        map[string]*openwallet.TxExtractData
+}
+
+//memPoolTracker 记录涉及关注地址的未确认交易，及已提取过的交易池交易
+type memPoolTracker struct {
+	mu     sync.Mutex
+	txs    map[string]*trackedMemPoolTx //跟踪中的交易，key = txid
+	spends map[string]string            //跟踪中的交易花费的输出，key = txid:vout，value = 花费的交易单号
+	seen   map[string]bool              //已提取过的交易池交易
+}
+
+func newMemPoolTracker() *memPoolTracker {
+	return &memPoolTracker{
+		txs:    make(map[string]*trackedMemPoolTx),
+		spends: make(map[string]string),
+		seen:   make(map[string]bool),
+	}
+}
+
+//add 跟踪未确认交易，已跟踪的交易忽略，返回是否为新跟踪的交易
+func (t *memPoolTracker) add(result ExtractResult) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.seen[result.TxID] = true
+
+	if _, exist := t.txs[result.TxID]; exist {
+		return false
+	}
+
+	data := make(map[string]*openwallet.TxExtractData)
+	for _, extractData := range []map[string]*openwallet.TxExtractData{result.extractData, result.extractOmniData} {
+		for key, d := range extractData {
+			data[key] = d
+		}
+	}
+	if len(data) == 0 {
+		return false
+	}
+
+	t.txs[result.TxID] = &trackedMemPoolTx{
+		txID:        result.TxID,
+		prevOutputs: result.prevOutputs,
+		firstSeen:   time.Now(),
+		data:        data,
+	}
+	for _, output := range result.prevOutputs {
+		t.spends[output] = result.TxID
+	}
+	return true
+}
+
+//setEntryTime 记录跟踪中交易进入节点交易池的时间
+func (t *memPoolTracker) setEntryTime(txid string, entryTime time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tx, exist := t.txs[txid]; exist {
+		tx.entryTime = entryTime
+	}
+}
+
+//remove 停止跟踪交易
+func (t *memPoolTracker) remove(txid string) *trackedMemPoolTx {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.removeLocked(txid)
+}
+
+func (t *memPoolTracker) removeLocked(txid string) *trackedMemPoolTx {
+	tx, exist := t.txs[txid]
+	if !exist {
+		return nil
+	}
+	delete(t.txs, txid)
+	for _, output := range tx.prevOutputs {
+		if t.spends[output] == txid {
+			delete(t.spends, output)
+		}
+	}
+	return tx
+}
+
+//conflicts 找出与txid花费了相同输出的跟踪中交易，并停止跟踪
+func (t *memPoolTracker) conflicts(txid string, prevOutputs []string) []*trackedMemPoolTx {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	replaced := make([]*trackedMemPoolTx, 0)
+	for _, output := range prevOutputs {
+		spender, exist := t.spends[output]
+		if !exist || spender == txid {
+			continue
+		}
+		if tx := t.removeLocked(spender); tx != nil {
+			replaced = append(replaced, tx)
+		}
+	}
+	return replaced
+}
+
+//isSpent 输出是否被跟踪中的交易花费，output = txid:vout
+func (t *memPoolTracker) isSpent(output string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, exist := t.spends[output]
+	return exist
+}
+
+//unspentOutputs 跟踪中交易的主链币收款输出，不包括已被其他跟踪中交易花费的输出
+func (t *memPoolTracker) unspentOutputs() []*openwallet.TxOutPut {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	outputs := make([]*openwallet.TxOutPut, 0)
+	for _, tx := range t.txs {
+		for _, data := range tx.data {
+			for _, output := range data.TxOutputs {
+				if output.Coin.IsContract {
+					continue
+				}
+				if _, spent := t.spends[txOutCacheKey(output.TxID, output.Index)]; spent {
+					continue
+				}
+				outputs = append(outputs, output)
+			}
+		}
+	}
+	return outputs
+}
+
+//txIDsByAddress 跟踪中的交易里有地址参与的交易单号
+func (t *memPoolTracker) txIDsByAddress(addresses ...string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	watched := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		watched[address] = true
+	}
+
+	txids := make([]string, 0)
+	for txid, tx := range t.txs {
+		if trackedTxHasAddress(tx, watched) {
+			txids = append(txids, txid)
+		}
+	}
+	return txids
+}
+
+func trackedTxHasAddress(tx *trackedMemPoolTx, watched map[string]bool) bool {
+	for _, data := range tx.data {
+		for _, input := range data.TxInputs {
+			if watched[input.Address] {
+				return true
+			}
+		}
+		for _, output := range data.TxOutputs {
+			if watched[output.Address] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//unseen 交易池中未提取过的交易
+func (t *memPoolTracker) unseen(txids []string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]string, 0)
+	for _, txid := range txids {
+		if !t.seen[txid] {
+			list = append(list, txid)
+		}
+	}
+	return list
+}
+
+//refresh 只保留仍在交易池中的已提取记录，返回已离开交易池的跟踪中交易
+func (t *memPoolTracker) refresh(txids []string) []*trackedMemPoolTx {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	inMemPool := make(map[string]bool, len(txids))
+	for _, txid := range txids {
+		inMemPool[txid] = true
+	}
+
+	for txid := range t.seen {
+		if !inMemPool[txid] {
+			delete(t.seen, txid)
+		}
+	}
+
+	missing := make([]*trackedMemPoolTx, 0)
+	for txid, tx := range t.txs {
+		if !inMemPool[txid] {
+			missing = append(missing, tx)
+		}
+	}
+	return missing
+}
+
+//len 跟踪中的交易数量
+func (t *memPoolTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.txs)
+}
+
+//memPoolObservers 实现了交易池状态接口的观测者
+func (bs *ILCBlockScanner) memPoolObservers() []MemPoolNotificationObject {
+	bs.Mu.RLock()
+	defer bs.Mu.RUnlock()
+
+	observers := make([]MemPoolNotificationObject, 0)
+	for o, _ := range bs.Observers {
+		if mo, ok := o.(MemPoolNotificationObject); ok {
+			observers = append(observers, mo)
+		}
+	}
+	return observers
+}
+
+//newMemPoolTxNotify 通知交易池交易的状态变化
+func (bs *ILCBlockScanner) newMemPoolTxNotify(eventType string, tx *trackedMemPoolTx, replacedBy string, block *Block) {
+
+	event := &MemPoolTxEvent{
+		Type:       eventType,
+		TxID:       tx.txID,
+		ReplacedBy: replacedBy,
+		FirstSeen:  tx.firstSeen,
+		EntryTime:  tx.entryTime,
+		Data:       tx.data,
+	}
+	if block != nil {
+		event.BlockHeight = block.Height
+		event.BlockHash = block.Hash
+	}
+
+	bs.wm.Log.Std.Info("mempool transaction: %s %s", tx.txID, eventType)
+
+	for _, o := range bs.memPoolObservers() {
+		notifyErr := o.MemPoolTxNotify(event)
+		if notifyErr != nil {
+			bs.wm.Log.Error("MemPoolTxNotify unexpected error:", notifyErr)
+		}
+	}
+}
+
+//trackMemPoolResults 跟踪交易池中涉及关注地址的交易，并检查是否替换了跟踪中的交易
+func (bs *ILCBlockScanner) trackMemPoolResults(results []ExtractResult) {
+	for _, result := range results {
+		if !result.Success {
+			continue
+		}
+		for _, tx := range bs.memPool.conflicts(result.TxID, result.prevOutputs) {
+			bs.newMemPoolTxNotify(MemPoolTxReplaced, tx, result.TxID, nil)
+		}
+		if !bs.memPool.add(result) {
+			continue
+		}
+
+		//有效期从进入节点交易池开始计算，扫描器重启或晚于节点看到交易时，首次提取时间会偏晚
+		entryTime, err := bs.wm.GetMemPoolEntryTime(result.TxID)
+		if err != nil {
+			bs.wm.Log.Std.Info("block scanner can not get mempool entry time of %s; unexpected error: %v", result.TxID, err)
+			continue
+		}
+		bs.memPool.setEntryTime(result.TxID, entryTime)
+	}
+}
+
+//confirmMemPoolTxs 区块中的交易确认了跟踪中的交易，或花费了跟踪中交易的输入
+func (bs *ILCBlockScanner) confirmMemPoolTxs(block *Block, results []ExtractResult) {
+
+	if bs.memPool.len() == 0 {
+		return
+	}
+
+	for _, result := range results {
+		if tx := bs.memPool.remove(result.TxID); tx != nil {
+			bs.newMemPoolTxNotify(MemPoolTxConfirmed, tx, "", block)
+		}
+		for _, tx := range bs.memPool.conflicts(result.TxID, result.prevOutputs) {
+			bs.newMemPoolTxNotify(MemPoolTxReplaced, tx, result.TxID, block)
+		}
+	}
+}
+
+//checkMemPoolTxs 检查已离开交易池的跟踪中交易
+func (bs *ILCBlockScanner) checkMemPoolTxs(txIDsInMemPool []string) {
+
+	for _, tx := range bs.memPool.refresh(txIDsInMemPool) {
+
+		trx, err := bs.wm.GetTransaction(tx.txID)
+		if err == nil && len(trx.BlockHash) > 0 {
+			//已被打包，扫描到该区块时再通知确认
+			continue
+		}
+
+		//查询不到进入交易池的时间时，以首次提取的时间估算
+		entryTime := tx.entryTime
+		if entryTime.IsZero() {
+			entryTime = tx.firstSeen
+		}
+
+		eventType := MemPoolTxEvicted
+		if time.Since(entryTime) >= bs.wm.Config.MemPoolExpiry {
+			eventType = MemPoolTxExpired
+		}
+
+		if bs.memPool.remove(tx.txID) != nil {
+			bs.newMemPoolTxNotify(eventType, tx, "", nil)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+//testMemPoolObserver 收集交易池交易的状态变化
+type testMemPoolObserver struct {
+	*testObserver
+	eventsMu sync.Mutex
+	events   []*MemPoolTxEvent
+}
+
+func (o *testMemPoolObserver) MemPoolTxNotify(event *MemPoolTxEvent) error {
+	o.eventsMu.Lock()
+	defer o.eventsMu.Unlock()
+	o.events = append(o.events, event)
+	return nil
+}
+
+//takeEvents 取出已收到的状态变化
+func (o *testMemPoolObserver) takeEvents() []*MemPoolTxEvent {
+	o.eventsMu.Lock()
+	defer o.eventsMu.Unlock()
+	events := o.events
+	o.events = nil
+	return events
+}
+
+func TestILCBlockScanner_MemPoolTracking(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	for _, label := range []string{"a1", "a2", "a3", "a4", "a5"} {
+		node.mine(label)
+	}
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	memPoolObserver := &testMemPoolObserver{testObserver: newTestObserver()}
+	bs.AddObserver(memPoolObserver)
+	saveTestScanned(bs, node)
+	bs.Restart()
+
+	coinbase := func(height int) string {
+		return node.chain[height].Txs[0].TxID
+	}
+
+	txConfirm := newTestTx("confirm", []testTxIn{{coinbase(1), 0}}, testTxOut{"alice_addr", "1"})
+	txRBF := newTestTx("rbf", []testTxIn{{coinbase(2), 0}}, testTxOut{"alice_addr", "2"})
+	txEvict := newTestTx("evict", []testTxIn{{coinbase(3), 0}}, testTxOut{"alice_addr", "3"})
+	txDoubleSpend := newTestTx("double_spend", []testTxIn{{coinbase(4), 0}}, testTxOut{"alice_addr", "4"})
+	txOther := newTestTx("other", []testTxIn{{coinbase(5), 0}}, testTxOut{"bob_addr", "5"})
+	for _, tx := range []*testTx{txConfirm, txRBF, txEvict, txDoubleSpend, txOther} {
+		node.addMemPool(tx)
+	}
+
+	bs.ScanTxMemPool()
+	if count := bs.memPool.len(); count != 4 {
+		t.Fatalf("tracked mempool transactions = %d, want 4", count)
+	}
+
+	//已提取过的交易不再重复提取
+	calls := node.callCount("getrawtransaction")
+	bs.ScanTxMemPool()
+	if count := node.callCount("getrawtransaction"); count != calls {
+		t.Errorf("getrawtransaction called %d times for seen mempool transactions", count-calls)
+	}
+	if count := len(observer.data["alice"]); count != 4 {
+		t.Errorf("alice extract data count = %d, want 4", count)
+	}
+
+	//确认；RBF替换；被驱逐；区块中的双花替换
+	txReplacement := newTestTx("rbf_replacement", []testTxIn{{coinbase(2), 0}}, testTxOut{"carol_addr", "2"})
+	node.removeMemPool(txRBF.TxID)
+	node.addMemPool(txReplacement)
+	node.removeMemPool(txEvict.TxID)
+	txConflict := newTestTx("conflict", []testTxIn{{coinbase(4), 0}}, testTxOut{"carol_addr", "4"})
+	block := node.mine("a6", newTestTx("coinbase_a6", nil, testTxOut{"miner_addr", "50"}), txConfirm, txConflict)
+	node.removeMemPool(txDoubleSpend.TxID)
+
+	bs.ScanBlockTask()
+
+	events := memPoolObserver.takeEvents()
+	want := []struct {
+		eventType  string
+		txid       string
+		replacedBy string
+		height     uint64
+	}{
+		{MemPoolTxConfirmed, txConfirm.TxID, "", block.Height},
+		{MemPoolTxReplaced, txDoubleSpend.TxID, txConflict.TxID, block.Height},
+		{MemPoolTxReplaced, txRBF.TxID, txReplacement.TxID, 0},
+		{MemPoolTxEvicted, txEvict.TxID, "", 0},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("mempool events count = %d, want %d", len(events), len(want))
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Type != w.eventType || e.TxID != w.txid || e.ReplacedBy != w.replacedBy || e.BlockHeight != w.height {
+			t.Errorf("events[%d] = %s %s %s %d, want %s %s %s %d", i, e.Type, e.TxID, e.ReplacedBy, e.BlockHeight, w.eventType, w.txid, w.replacedBy, w.height)
+		}
+		if data := e.Data["alice"]; data == nil || data.Transaction.TxID != w.txid {
+			t.Errorf("events[%d] data is not the extracted alice data", i)
+		}
+	}
+	if count := bs.memPool.len(); count != 0 {
+		t.Errorf("tracked mempool transactions = %d, want 0", count)
+	}
+
+	//交易离开交易池时已被打包，等扫描到区块时再通知确认
+	txLate := newTestTx("late", []testTxIn{{block.Txs[0].TxID, 0}}, testTxOut{"alice_addr", "6"})
+	node.addMemPool(txLate)
+	bs.ScanTxMemPool()
+	lateBlock := node.mine("a7", newTestTx("coinbase_a7", nil, testTxOut{"miner_addr", "50"}), txLate)
+	bs.ScanTxMemPool()
+	if events := memPoolObserver.takeEvents(); len(events) != 0 {
+		t.Fatalf("mempool events = %s before block scanned, want none", events[0].Type)
+	}
+	bs.ScanBlockTask()
+	if events := memPoolObserver.takeEvents(); len(events) != 1 || events[0].Type != MemPoolTxConfirmed || events[0].BlockHash != lateBlock.Hash {
+		t.Fatalf("late transaction is not confirmed by block %s", lateBlock.Hash)
+	}
+
+	//超过有效期离开交易池
+	txExpire := newTestTx("expire", []testTxIn{{lateBlock.Txs[0].TxID, 0}}, testTxOut{"alice_addr", "7"})
+	node.addMemPool(txExpire)
+	bs.ScanTxMemPool()
+	wm.Config.MemPoolExpiry = time.Nanosecond
+	node.removeMemPool(txExpire.TxID)
+	bs.ScanTxMemPool()
+	if events := memPoolObserver.takeEvents(); len(events) != 1 || events[0].Type != MemPoolTxExpired || events[0].TxID != txExpire.TxID {
+		t.Fatalf("expired transaction is not notified")
+	}
+
+	//有效期从进入节点交易池开始计算，而不是扫描器首次提取的时间
+	wm.Config.MemPoolExpiry = time.Hour
+	entered := time.Now().Add(-2 * time.Hour).Unix()
+	fund := node.mine("a8", newTestTx("coinbase_a8", nil, testTxOut{"miner_addr", "25"}, testTxOut{"miner_addr", "25"}))
+	txEnteredEarly := newTestTx("entered_early", []testTxIn{{fund.Txs[0].TxID, 0}}, testTxOut{"alice_addr", "8"})
+	txEnteredNow := newTestTx("entered_now", []testTxIn{{fund.Txs[0].TxID, 1}}, testTxOut{"alice_addr", "9"})
+	node.addMemPoolAt(entered, txEnteredEarly)
+	node.addMemPool(txEnteredNow)
+	bs.ScanTxMemPool()
+	node.removeMemPool(txEnteredEarly.TxID)
+	node.removeMemPool(txEnteredNow.TxID)
+	bs.ScanTxMemPool()
+	eventTypes := make(map[string]*MemPoolTxEvent)
+	for _, e := range memPoolObserver.takeEvents() {
+		eventTypes[e.TxID] = e
+	}
+	if e := eventTypes[txEnteredEarly.TxID]; e == nil || e.Type != MemPoolTxExpired || e.EntryTime.Unix() != entered {
+		t.Errorf("transaction entered the mempool 2 hours ago is not expired: %+v", e)
+	}
+	if e := eventTypes[txEnteredNow.TxID]; e == nil || e.Type != MemPoolTxEvicted {
+		t.Errorf("transaction entered the mempool just now is not evicted: %+v", e)
+	}
+}
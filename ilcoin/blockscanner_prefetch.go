@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//prefetchBlock 预读取的区块数据
+type prefetchBlock struct {
+	height   uint64
+	hash     string
+	block    *Block
+	results  []ExtractResult //区块内交易单的提取结果，未通知观测者
+	hashErr  error           //获取区块hash失败
+	omniErr  error           //omni节点未同步到相同的区块
+	blockErr error           //获取区块数据失败
+}
+
+//prefetchBlocks 并发预读取[start, end]高度的区块及交易单，最多领先处理进度count个区块
+//返回的通道按高度顺序输出各区块的结果通道，取消ctx停止继续预读取，预读取中的区块不再分派新的提取工作
+func (bs *ILCBlockScanner) prefetchBlocks(ctx context.Context, start, end, count uint64, scanAddressFunc openwallet.BlockScanAddressFunc) <-chan chan *prefetchBlock {
+
+	if count == 0 {
+		count = 1
+	}
+
+	pending := make(chan chan *prefetchBlock, count)
+
+	go func() {
+		defer close(pending)
+		for height := start; height <= end; height++ {
+			result := make(chan *prefetchBlock, 1)
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				return
+			}
+			go func(mHeight uint64, mResult chan<- *prefetchBlock) {
+				mResult <- bs.fetchBlock(ctx, mHeight, scanAddressFunc)
+			}(height, result)
+		}
+	}()
+
+	return pending
+}
+
+//fetchBlock 获取区块及提取区块内的交易单
+func (bs *ILCBlockScanner) fetchBlock(ctx context.Context, height uint64, scanAddressFunc openwallet.BlockScanAddressFunc) *prefetchBlock {
+
+	fetched := &prefetchBlock{height: height}
+
+	hash, err := bs.wm.GetBlockHash(height)
+	if err != nil {
+		fetched.hashErr = err
+		return fetched
+	}
+	fetched.hash = hash
+
+	if bs.wm.Config.OmniSupport {
+		//判断omni的区块高度是否一致
+		omniBlockHash, err := bs.wm.GetOmniBlockHash(height)
+		if err != nil {
+			fetched.omniErr = fmt.Errorf("omni block is not synced to the same height of mainnet")
+			return fetched
+		}
+
+		//判断omni的hash是否与hc节点的hash一致
+		if omniBlockHash != hash {
+			fetched.omniErr = fmt.Errorf("omni block is not synced to the same hash of mainnet")
+			return fetched
+		}
+	}
+
+	block, err := bs.wm.GetBlockWithTransactions(hash)
+	if err != nil {
+		fetched.blockErr = err
+		return fetched
+	}
+	fetched.block = block
+
+	if len(block.tx) > 0 {
+		//已取消时结果为空，由调用者丢弃
+		fetched.results, _ = bs.extractBlockWith(ctx, block, scanAddressFunc)
+	}
+
+	return fetched
+}
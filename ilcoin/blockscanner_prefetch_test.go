@@ -0,0 +1,152 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestILCBlockScanner_ScanBlockTask_Prefetch(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	for i := 1; i <= 30; i++ {
+		node.mine(fmt.Sprintf("a%d", i),
+			newTestTx(fmt.Sprintf("coinbase_a%d", i), nil, testTxOut{"miner_addr", "50"}),
+			newTestTx(fmt.Sprintf("pay_a%d", i), nil, testTxOut{"alice_addr", fmt.Sprintf("%d", i)}),
+		)
+	}
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.PrefetchBlockCount = 4
+	bs.SaveLocalNewBlock(1, node.chain[1].Hash)
+
+	bs.Restart()
+	bs.ScanBlockTask()
+
+	headers := observer.waitHeaders(t, 29)
+	for i, header := range headers {
+		if header.Height != uint64(i+2) || header.Hash != node.chain[i+2].Hash || header.Fork {
+			t.Errorf("headers[%d] = %d %s, want %d %s", i, header.Height, header.Hash, i+2, node.chain[i+2].Hash)
+		}
+	}
+
+	//提取结果按区块高度顺序通知
+	observer.mu.Lock()
+	alice := observer.data["alice"]
+	observer.mu.Unlock()
+	if len(alice) != 29 {
+		t.Fatalf("alice extract data count = %d, want 29", len(alice))
+	}
+	for i, data := range alice {
+		if data.Transaction.BlockHeight != uint64(i+2) {
+			t.Errorf("alice data[%d] height = %d, want %d", i, data.Transaction.BlockHeight, i+2)
+		}
+	}
+
+	//扫描高度严格按顺序保存
+	dai := bs.BlockchainDAI.(*testBlockchainDAI)
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	for i, height := range dai.history[1:] {
+		if height != uint64(i+2) {
+			t.Fatalf("saved scanned height history = %v", dai.history)
+		}
+	}
+}
+
+func TestILCBlockScanner_ScanBlockTask_PrefetchReorg(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	for i := 1; i <= 10; i++ {
+		node.mine(fmt.Sprintf("a%d", i))
+	}
+	a8 := node.chain[8].Hash
+
+	wm, bs, observer := newTestScanner(node, nil)
+	wm.Config.PrefetchBlockCount = 4
+	bs.SaveLocalBlock(&Block{Hash: node.chain[1].Hash, Height: 1})
+	bs.SaveLocalNewBlock(1, node.chain[1].Hash)
+
+	//预读取到a8时，节点切换到新的分支
+	var once sync.Once
+	node.hook = func(method string, params []json.RawMessage) {
+		if method != "getblock" {
+			return
+		}
+		var hash string
+		json.Unmarshal(params[0], &hash)
+		if hash != a8 {
+			return
+		}
+		once.Do(func() {
+			node.reorg(5)
+			for i := 6; i <= 12; i++ {
+				node.mine(fmt.Sprintf("b%d", i))
+			}
+		})
+	}
+
+	bs.Restart()
+	bs.ScanBlockTask()
+
+	current, err := bs.GetScannedBlockHeader()
+	if err != nil {
+		t.Fatalf("GetScannedBlockHeader unexpected error: %v", err)
+	}
+	if current.Height != 12 || current.Hash != node.chain[12].Hash {
+		t.Fatalf("scanned block = %d %s, want %d %s", current.Height, current.Hash, 12, node.chain[12].Hash)
+	}
+
+	//本地保存的区块都属于新的主链
+	for h := uint64(2); h <= 12; h++ {
+		local, err := bs.GetLocalBlock(h)
+		if err != nil || local.Hash != node.chain[h].Hash {
+			t.Errorf("local block %d = %v, want %s", h, local, node.chain[h].Hash)
+		}
+	}
+
+	//最后一次分叉通知之后，按顺序通知新主链的区块
+	headers := observer.waitHeaders(t, 11)
+	last := -1
+	for i, header := range headers {
+		if header.Fork {
+			last = i
+		}
+	}
+	next := uint64(6)
+	if last >= 0 {
+		next = headers[last].Height
+	}
+	for _, header := range headers[last+1:] {
+		if header.Height < next {
+			continue
+		}
+		if header.Height != next || header.Hash != node.chain[next].Hash {
+			t.Errorf("header = %d %s, want %d %s", header.Height, header.Hash, next, node.chain[next].Hash)
+		}
+		next++
+	}
+	if next != 13 {
+		t.Errorf("main chain notified up to %d, want 12", next-1)
+	}
+}
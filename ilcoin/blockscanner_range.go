@@ -0,0 +1,171 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//BlockRangeProgress 区块范围扫描的进度，中断后可传给ResumeBlockRange继续扫描
+type BlockRangeProgress struct {
+	Start         uint64   `json:"start"`
+	End           uint64   `json:"end"`
+	Next          uint64   `json:"next"`          //下一个待扫描的高度，大于End表示已完成
+	Height        uint64   `json:"height"`        //刚完成的区块高度
+	BlockHash     string   `json:"blockHash"`     //刚完成的区块hash
+	TxCount       int      `json:"txCount"`       //刚完成区块的交易单数量
+	Failures      int      `json:"failures"`      //刚完成区块提取或通知失败的交易单数量
+	FailedTxIDs   []string `json:"failedTxIDs"`   //刚完成区块提取或通知失败的交易单
+	TotalTxCount  int      `json:"totalTxCount"`  //已扫描的交易单总数
+	TotalFailures int      `json:"totalFailures"` //已扫描的失败总数
+}
+
+//Finished 是否已扫描完整个范围
+func (p *BlockRangeProgress) Finished() bool {
+	return p.Next > p.End
+}
+
+//BlockRangeProgressFunc 每完成一个区块回调一次进度，按高度顺序调用
+type BlockRangeProgressFunc func(progress *BlockRangeProgress)
+
+//ScanBlockRange 使用指定的地址查询方法扫描[start, end]高度的历史区块，提取结果通知给观测者
+//不改变扫描器保存的扫描高度，不记录未扫记录，可以在扫描器运行时为新导入的地址补扫历史交易
+//失败的交易单在进度中返回，获取区块失败或ctx取消时返回当前进度及错误，可用ResumeBlockRange继续扫描
+func (bs *ILCBlockScanner) ScanBlockRange(ctx context.Context, start, end uint64, scanAddressFunc openwallet.BlockScanAddressFunc, progressFunc BlockRangeProgressFunc) (*BlockRangeProgress, error) {
+	return bs.ResumeBlockRange(ctx, &BlockRangeProgress{Start: start, End: end, Next: start}, scanAddressFunc, progressFunc)
+}
+
+//ResumeBlockRange 从上次返回或回调的进度继续扫描区块范围
+func (bs *ILCBlockScanner) ResumeBlockRange(ctx context.Context, last *BlockRangeProgress, scanAddressFunc openwallet.BlockScanAddressFunc, progressFunc BlockRangeProgressFunc) (*BlockRangeProgress, error) {
+
+	if last == nil || last.Start > last.End {
+		return last, fmt.Errorf("invalid block range")
+	}
+
+	if scanAddressFunc == nil {
+		return last, fmt.Errorf("BlockScanAddressFunc is not set up")
+	}
+
+	progress := *last
+	if progress.Next < progress.Start {
+		progress.Next = progress.Start
+	}
+
+	if progress.Finished() {
+		return &progress, nil
+	}
+
+	maxHeight, err := bs.wm.GetBlockHeight()
+	if err != nil {
+		return &progress, err
+	}
+
+	if progress.End > maxHeight {
+		return &progress, fmt.Errorf("block range end: %d is beyond the chain height: %d", progress.End, maxHeight)
+	}
+
+	bs.wm.Log.Std.Info("block scanner scanning range: %d - %d ...", progress.Next, progress.End)
+
+	fetchCtx, quit := context.WithCancel(ctx)
+	defer quit()
+
+	pending := bs.prefetchBlocks(fetchCtx, progress.Next, progress.End, bs.wm.Config.PrefetchBlockCount, scanAddressFunc)
+
+	for result := range pending {
+
+		fetched := <-result
+
+		if err := ctx.Err(); err != nil {
+			//预读取的结果可能不完整，从当前高度续扫
+			return &progress, err
+		}
+
+		if fetched.hashErr != nil {
+			return &progress, fetched.hashErr
+		}
+
+		if fetched.omniErr != nil {
+			return &progress, fetched.omniErr
+		}
+
+		if fetched.blockErr != nil {
+			return &progress, fetched.blockErr
+		}
+
+		failed := bs.notifyRangeResults(fetched.height, fetched.results)
+
+		progress.Height = fetched.height
+		progress.BlockHash = fetched.hash
+		progress.TxCount = len(fetched.results)
+		progress.Failures = len(failed)
+		progress.FailedTxIDs = failed
+		progress.TotalTxCount += progress.TxCount
+		progress.TotalFailures += progress.Failures
+		progress.Next = fetched.height + 1
+
+		if progressFunc != nil {
+			p := progress
+			progressFunc(&p)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return &progress, err
+	}
+
+	return &progress, nil
+}
+
+//notifyRangeResults 按顺序通知区块范围扫描的提取结果，返回提取或通知失败的交易单
+func (bs *ILCBlockScanner) notifyRangeResults(height uint64, results []ExtractResult) []string {
+
+	failed := make([]string, 0)
+
+	//更新未花索引及地址交易索引
+	indexErr := bs.indexUTXO(height, results)
+	if indexErr == nil {
+		indexErr = bs.indexAddressTx(height, results)
+	}
+
+	for _, gets := range results {
+
+		if !gets.Success {
+			bs.wm.Log.Std.Info("block height: %d, txid: %s extract failed. unexpected error: %v", height, gets.TxID, gets.err)
+			failed = append(failed, gets.TxID)
+			continue
+		}
+
+		notifyErr := indexErr
+		if notifyErr == nil {
+			notifyErr = bs.newExtractDataNotify(height, gets.extractData)
+		}
+		if notifyErr == nil {
+			notifyErr = bs.newExtractDataNotify(height, gets.extractOmniData)
+		}
+		if notifyErr != nil {
+			bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
+			failed = append(failed, gets.TxID)
+		}
+	}
+
+	sort.Strings(failed)
+
+	return failed
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestILCBlockScanner_ScanBlockRange(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+	node.mine("a2")
+
+	//高度3-6每个区块都有carol的交易单，高度4有一笔前置交易单不存在的交易单
+	missing := newTestTx("missing_prev", nil, testTxOut{"genesis_addr", "1"})
+	failedTx := newTestTx("pay_carol_failed", []testTxIn{{missing.TxID, 0}}, testTxOut{"carol_addr", "9"})
+	for i := 3; i <= 6; i++ {
+		txs := []*testTx{
+			newTestTx(fmt.Sprintf("coinbase_a%d", i), nil, testTxOut{"miner_addr", "50"}),
+			newTestTx(fmt.Sprintf("pay_carol_%d", i), []testTxIn{{node.chain[i-2].Txs[0].TxID, 0}}, testTxOut{"carol_addr", "1"}),
+		}
+		if i == 4 {
+			txs = append(txs, failedTx)
+		}
+		node.mine(fmt.Sprintf("a%d", i), txs...)
+	}
+
+	_, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	saveTestScanned(bs, node)
+	dai := bs.BlockchainDAI.(*testBlockchainDAI)
+	scanned, _ := bs.GetScannedBlockHeader()
+	savedCount := len(dai.history)
+
+	carolFunc := func(address string) (string, bool) {
+		if address == testAddress("carol_addr") {
+			return "carol", true
+		}
+		return "", false
+	}
+
+	carolHeights := func() []uint64 {
+		observer.mu.Lock()
+		defer observer.mu.Unlock()
+		heights := make([]uint64, 0)
+		for _, data := range observer.data["carol"] {
+			heights = append(heights, data.Transaction.BlockHeight)
+		}
+		return heights
+	}
+
+	//扫描到高度4后中断
+	ctx, cancel := context.WithCancel(context.Background())
+	reported := make([]*BlockRangeProgress, 0)
+	progress, err := bs.ScanBlockRange(ctx, 3, 6, carolFunc, func(p *BlockRangeProgress) {
+		reported = append(reported, p)
+		if p.Height == 4 {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Fatalf("ScanBlockRange error = %v, want canceled", err)
+	}
+	if progress.Next != 5 || progress.Finished() {
+		t.Fatalf("progress next = %d after cancel, want 5", progress.Next)
+	}
+	if len(reported) != 2 || reported[0].Height != 3 || reported[0].TxCount != 2 || reported[0].Failures != 0 {
+		t.Fatalf("reported progress = %+v", reported)
+	}
+	if p := reported[1]; p.Height != 4 || p.TxCount != 3 || p.Failures != 1 || p.FailedTxIDs[0] != failedTx.TxID || p.BlockHash != node.chain[4].Hash {
+		t.Errorf("progress of height 4 = %+v", p)
+	}
+
+	//继续扫描剩余的区块
+	progress, err = bs.ResumeBlockRange(context.Background(), progress, carolFunc, func(p *BlockRangeProgress) {
+		reported = append(reported, p)
+	})
+	if err != nil {
+		t.Fatalf("ResumeBlockRange unexpected error: %v", err)
+	}
+	if !progress.Finished() || progress.TotalTxCount != 9 || progress.TotalFailures != 1 {
+		t.Errorf("final progress = %+v, want 9 transactions and 1 failure", progress)
+	}
+	if len(reported) != 4 || reported[2].Height != 5 || reported[3].Height != 6 {
+		t.Errorf("reported %d progress after resume, want heights 5 and 6", len(reported))
+	}
+
+	if heights := carolHeights(); fmt.Sprint(heights) != "[3 4 5 6]" {
+		t.Errorf("carol extract data heights = %v, want [3 4 5 6]", heights)
+	}
+
+	//不改变扫描高度，不记录未扫记录，不通知新区块
+	if header, _ := bs.GetScannedBlockHeader(); header.Height != scanned.Height || header.Hash != scanned.Hash {
+		t.Errorf("scanned block = %d %s, want %d %s", header.Height, header.Hash, scanned.Height, scanned.Hash)
+	}
+	if len(dai.history) != savedCount {
+		t.Errorf("scanned height saved %d times by range scan", len(dai.history)-savedCount)
+	}
+	if records := unscanRecordTxIDs(bs); len(records) != 0 {
+		t.Errorf("unscan records = %v after range scan, want none", records)
+	}
+	observer.mu.Lock()
+	headers := len(observer.headers)
+	observer.mu.Unlock()
+	if headers != 0 {
+		t.Errorf("block headers notified %d times by range scan", headers)
+	}
+
+	//已完成的进度不再扫描
+	done, err := bs.ResumeBlockRange(context.Background(), progress, carolFunc, nil)
+	if err != nil || done.TotalTxCount != 9 {
+		t.Errorf("resume finished range = %+v, %v", done, err)
+	}
+
+	if _, err := bs.ScanBlockRange(context.Background(), 5, 7, carolFunc, nil); err == nil {
+		t.Errorf("range beyond chain height should be failed")
+	}
+	if _, err := bs.ScanBlockRange(context.Background(), 5, 4, carolFunc, nil); err == nil {
+		t.Errorf("invalid range should be failed")
+	}
+	if _, err := bs.ScanBlockRange(context.Background(), 3, 4, nil, nil); err == nil {
+		t.Errorf("range scan without scan address func should be failed")
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/graarh/golang-socketio"
+	"github.com/graarh/golang-socketio/transport"
+)
+
+//testSocketIOServer 模拟insight的socket.io服务
+type testSocketIOServer struct {
+	server      *gosocketio.Server
+	http        *httptest.Server
+	connections int32
+}
+
+func newTestSocketIOServer() *testSocketIOServer {
+	s := &testSocketIOServer{
+		server: gosocketio.NewServer(transport.GetDefaultWebsocketTransport()),
+	}
+	s.server.On(gosocketio.OnConnection, func(c *gosocketio.Channel) {
+		atomic.AddInt32(&s.connections, 1)
+	})
+	s.server.On("subscribe", func(c *gosocketio.Channel, room string) {
+		c.Join(room)
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/socket.io/", s.server)
+	s.http = httptest.NewServer(mux)
+	return s
+}
+
+func (s *testSocketIOServer) Close() {
+	s.dropAll()
+	s.http.Close()
+}
+
+//dropAll 断开所有已订阅的连接
+func (s *testSocketIOServer) dropAll() {
+	for _, c := range s.server.List("inv") {
+		c.Close()
+	}
+}
+
+func waitCondition(t *testing.T, desc string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("wait %s timeout", desc)
+}
+
+//waitScanIdle 等待推送触发的扫描任务结束
+func waitScanIdle(t *testing.T, bs *ILCBlockScanner) {
+	waitCondition(t, "scan task finished", func() bool {
+		return atomic.LoadInt32(&bs.scanRunning) == 0 && atomic.LoadInt32(&bs.scanPending) == 0
+	})
+}
+
+func TestSocketIOURL(t *testing.T) {
+	tests := []struct {
+		api  string
+		want string
+	}{
+		{"http://127.0.0.1:3001", "ws://127.0.0.1:3001/socket.io/?EIO=3&transport=websocket"},
+		{"http://insight.example.com/insight-api", "ws://insight.example.com/socket.io/?EIO=3&transport=websocket"},
+		{"https://insight.example.com", "wss://insight.example.com/socket.io/?EIO=3&transport=websocket"},
+	}
+	for _, test := range tests {
+		got, err := socketIOURL(test.api)
+		if err != nil {
+			t.Errorf("socketIOURL(%s) unexpected error: %v", test.api, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("socketIOURL(%s) = %s, want %s", test.api, got, test.want)
+		}
+	}
+
+	if _, err := socketIOURL("127.0.0.1"); err == nil {
+		t.Errorf("socketIOURL without host should be failed")
+	}
+}
+
+func TestILCBlockScanner_SocketIO(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	sio := newTestSocketIOServer()
+	defer sio.Close()
+
+	node.mine("a1")
+	node.mine("a2")
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice", "bob_addr": "bob"})
+	wm.Config.ServerAPI = sio.http.URL
+	wm.Config.PushReconnectWait = 10 * time.Millisecond
+	wm.Config.PushMaxReconnectWait = 50 * time.Millisecond
+	saveTestScanned(bs, node)
+
+	bs.Restart()
+	bs.startSocketIO()
+
+	waitCondition(t, "socketIO subscribed", func() bool {
+		return sio.server.Amount("inv") == 1 && bs.IsSocketIOConnected()
+	})
+
+	aliceData := func() int {
+		observer.mu.Lock()
+		defer observer.mu.Unlock()
+		return len(observer.data["alice"])
+	}
+
+	//tx事件：提取内存池交易
+	tx := newTestTx("pay_alice", []testTxIn{{node.chain[1].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "1"})
+	node.addMemPool(tx)
+	sio.server.BroadcastTo("inv", "tx", map[string]interface{}{"txid": tx.TxID, "valueOut": 1})
+	waitCondition(t, "tx extracted", func() bool { return aliceData() == 1 })
+
+	//block事件：马上扫描新区块
+	block := node.mine("a3", newTestTx("coinbase_a3", nil, testTxOut{"bob_addr", "50"}))
+	sio.server.BroadcastTo("inv", "block", block.Hash)
+	headers := observer.waitHeaders(t, 1)
+	if headers[0].Height != 3 || headers[0].Hash != block.Hash {
+		t.Errorf("block header = %d %s, want 3 %s", headers[0].Height, headers[0].Hash, block.Hash)
+	}
+	waitCondition(t, "block extracted", func() bool {
+		observer.mu.Lock()
+		defer observer.mu.Unlock()
+		return len(observer.data["bob"]) == 1
+	})
+	waitScanIdle(t, bs)
+
+	//socketIO已连接，扫描任务不轮询提取交易池的交易
+	silent := newTestTx("pay_alice_silent", []testTxIn{{node.chain[0].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "5"})
+	node.addMemPool(silent)
+	bs.ScanBlockTask()
+	if count := aliceData(); count != 1 {
+		t.Errorf("alice extract data count = %d while socketIO is connected, want 1", count)
+	}
+
+	//服务端断开后自动重连，并重新订阅
+	sio.dropAll()
+	waitCondition(t, "socketIO reconnected", func() bool {
+		return atomic.LoadInt32(&sio.connections) == 2 && sio.server.Amount("inv") == 1 && bs.IsSocketIOConnected()
+	})
+
+	tx2 := newTestTx("pay_alice_2", []testTxIn{{node.chain[2].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "2"})
+	node.addMemPool(tx2)
+	sio.server.BroadcastTo("inv", "tx", map[string]interface{}{"txid": tx2.TxID, "valueOut": 2})
+	waitCondition(t, "tx extracted after reconnect", func() bool { return aliceData() == 2 })
+
+	//重复推送已提取过的交易不再提取
+	calls := node.callCount("getrawtransaction")
+	sio.server.BroadcastTo("inv", "tx", map[string]interface{}{"txid": tx2.TxID, "valueOut": 2})
+	time.Sleep(100 * time.Millisecond)
+	if count := aliceData(); count != 2 || node.callCount("getrawtransaction") != calls {
+		t.Errorf("alice extract data count = %d after tx is pushed again, want 2", count)
+	}
+
+	//停止后关闭连接，监听线程退出
+	bs.Stop()
+	if bs.IsSocketIOConnected() {
+		t.Errorf("socketIO is still connected after stop")
+	}
+	waitCondition(t, "socketIO closed", func() bool { return sio.server.Amount("inv") == 0 })
+	time.Sleep(100 * time.Millisecond)
+	if count := atomic.LoadInt32(&sio.connections); count != 2 {
+		t.Errorf("socketIO connections = %d after stop, want 2", count)
+	}
+
+	//socketIO断开时轮询交易池，只提取未推送过的交易
+	bs.Restart()
+	bs.ScanBlockTask()
+	if count := aliceData(); count != 3 {
+		t.Errorf("alice extract data count = %d while socketIO is disconnected, want 3", count)
+	}
+}
+
+func TestILCBlockScanner_SocketIOReconnectBackoff(t *testing.T) {
+
+	sio := newTestSocketIOServer()
+	url := sio.http.URL
+	sio.Close()
+
+	wm := NewWalletManager()
+	wm.Config.ServerAPI = url
+	wm.Config.PushReconnectWait = 10 * time.Millisecond
+	wm.Config.PushMaxReconnectWait = 20 * time.Millisecond
+	bs := wm.Blockscanner
+
+	//服务不可用时持续重连，停止时马上退出
+	bs.startSocketIO()
+	time.Sleep(100 * time.Millisecond)
+	if bs.IsSocketIOConnected() {
+		t.Fatalf("socketIO should not be connected")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		bs.stopSocketIOListen()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("stop socketIO timeout")
+	}
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"path/filepath"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//RevertRecord 撤销通知失败的被孤立区块，扫描任务重扫失败记录时重试
+type RevertRecord struct {
+	Hash      string `storm:"id"`
+	Height    uint64 `storm:"index"`
+	Attempts  int    //已失败次数
+	LastError string //最近一次失败的原因
+	Logged    bool   //撤销事件已追加到事件日志
+}
+
+//ConfirmationRecord 跟踪确认数的到账交易，扫描器重启后继续跟踪
+type ConfirmationRecord struct {
+	Key       string `storm:"id"` //sourceKey:txid
+	SourceKey string
+	Data      *openwallet.TxExtractData
+}
+
+//UnscanRetryRecord 未扫记录的重试状态，扫描器重启后恢复
+type UnscanRetryRecord struct {
+	ID string `storm:"id"` //未扫记录ID
+	UnscanRetry
+}
+
+//ScanStateStore 扫描器需要在重启后恢复的状态
+type ScanStateStore struct {
+	stormFile
+}
+
+//NewScanStateStore 创建扫描器状态数据库，数据库文件在首次使用时打开
+func NewScanStateStore(dbFile string) *ScanStateStore {
+	return &ScanStateStore{stormFile{path: dbFile}}
+}
+
+//SaveRevertRecord 保存撤销失败的区块
+func (s *ScanStateStore) SaveRevertRecord(record *RevertRecord) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return db.Save(record)
+}
+
+//GetRevertRecord 获取撤销失败的区块，不存在时返回nil
+func (s *ScanStateStore) GetRevertRecord(hash string) (*RevertRecord, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	var record RevertRecord
+	err = db.One("Hash", hash, &record)
+	if err == storm.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+//DeleteRevertRecord 删除撤销失败的区块
+func (s *ScanStateStore) DeleteRevertRecord(hash string) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	err = db.DeleteStruct(&RevertRecord{Hash: hash})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//RevertRecords 全部撤销失败的区块，按高度从高到低排列
+func (s *ScanStateStore) RevertRecords() ([]*RevertRecord, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*RevertRecord, 0)
+	err = db.AllByIndex("Height", &list, storm.Reverse())
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//SaveConfirmationRecord 保存跟踪确认数的到账交易
+func (s *ScanStateStore) SaveConfirmationRecord(record *ConfirmationRecord) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return db.Save(record)
+}
+
+//DeleteConfirmationRecord 删除停止跟踪的到账交易
+func (s *ScanStateStore) DeleteConfirmationRecord(key string) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	err = db.DeleteStruct(&ConfirmationRecord{Key: key})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//ConfirmationRecords 全部跟踪确认数的到账交易
+func (s *ScanStateStore) ConfirmationRecords() ([]*ConfirmationRecord, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*ConfirmationRecord, 0)
+	err = db.All(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//SaveUnscanRetryRecord 保存未扫记录的重试状态
+func (s *ScanStateStore) SaveUnscanRetryRecord(record *UnscanRetryRecord) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	return db.Save(record)
+}
+
+//DeleteUnscanRetryRecord 删除未扫记录的重试状态
+func (s *ScanStateStore) DeleteUnscanRetryRecord(id string) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	err = db.DeleteStruct(&UnscanRetryRecord{ID: id})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+//UnscanRetryRecords 全部未扫记录的重试状态
+func (s *ScanStateStore) UnscanRetryRecords() ([]*UnscanRetryRecord, error) {
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*UnscanRetryRecord, 0)
+	err = db.All(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+//scanState 返回扫描器状态数据库
+func (bs *ILCBlockScanner) scanState() *ScanStateStore {
+	bs.scanStateMu.Lock()
+	defer bs.scanStateMu.Unlock()
+
+	if bs.state == nil {
+		bs.state = NewScanStateStore(filepath.Join(bs.wm.Config.DBPath, bs.wm.Config.ScanStateFile))
+	}
+	return bs.state
+}
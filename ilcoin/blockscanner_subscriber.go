@@ -0,0 +1,589 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+const (
+	ScanEventBlock       = "block"       //新区块或分叉区块
+	ScanEventExtractData = "extractData" //区块提取结果
+	ScanEventRevertData  = "revertData"  //被孤立区块需要撤销的提取结果
+
+	//每批读取的事件数量
+	scanEventBatchSize = 100
+)
+
+//ScanEvent 本地事件日志中的扫描事件，按写入顺序编号
+type ScanEvent struct {
+	Seq       uint64                    `storm:"id,increment"`
+	Height    uint64                    `storm:"index"`
+	Type      string                    //事件类型
+	Header    *openwallet.BlockHeader   //Type = block
+	SourceKey string                    //Type = extractData, revertData
+	Data      *openwallet.TxExtractData //Type = extractData, revertData
+}
+
+//scanSubscriberCursor 订阅者已送达的最后一个事件
+type scanSubscriberCursor struct {
+	Name string `storm:"id"`
+	Seq  uint64
+}
+
+//ScanEventLog 只追加的扫描事件日志，保存区块及提取结果的通知，供订阅者断线后重放
+type ScanEventLog struct {
+	stormFile
+}
+
+//NewScanEventLog 创建扫描事件日志，数据库文件在首次使用时打开
+func NewScanEventLog(dbFile string) *ScanEventLog {
+	return &ScanEventLog{stormFile{path: dbFile}}
+}
+
+//Append 按顺序追加事件
+func (l *ScanEventLog) Append(events ...*ScanEvent) error {
+
+	db, err := l.open()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, event := range events {
+		err = tx.Save(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//After 读取编号大于seq的事件，最多limit个
+func (l *ScanEventLog) After(seq uint64, limit int) ([]*ScanEvent, error) {
+
+	db, err := l.open()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*ScanEvent
+	err = db.Range("Seq", seq+1, uint64(math.MaxUint64), &events, storm.Limit(limit))
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return events, nil
+}
+
+//LastSeq 最后一个事件的编号，没有事件时为0
+func (l *ScanEventLog) LastSeq() (uint64, error) {
+
+	db, err := l.open()
+	if err != nil {
+		return 0, err
+	}
+
+	var events []*ScanEvent
+	err = db.All(&events, storm.Limit(1), storm.Reverse())
+	if err == storm.ErrNotFound || len(events) == 0 {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return events[0].Seq, nil
+}
+
+//SeqBeforeHeight 按写入顺序第一个高度不小于height的事件之前的编号，从此编号之后重放
+//没有这样的事件时返回最后一个事件的编号
+func (l *ScanEventLog) SeqBeforeHeight(height uint64) (uint64, error) {
+
+	db, err := l.open()
+	if err != nil {
+		return 0, err
+	}
+
+	var event ScanEvent
+	err = db.Select(q.Gte("Height", height)).Limit(1).First(&event)
+	if err == storm.ErrNotFound {
+		return l.LastSeq()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return event.Seq - 1, nil
+}
+
+//MinCursor 所有订阅者（包括已取消订阅的）游标中最小的编号，没有订阅者时exist = false
+func (l *ScanEventLog) MinCursor() (uint64, bool, error) {
+
+	db, err := l.open()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var cursors []*scanSubscriberCursor
+	err = db.All(&cursors)
+	if err != nil && err != storm.ErrNotFound {
+		return 0, false, err
+	}
+	if len(cursors) == 0 {
+		return 0, false, nil
+	}
+
+	lowest := cursors[0].Seq
+	for _, cursor := range cursors[1:] {
+		if cursor.Seq < lowest {
+			lowest = cursor.Seq
+		}
+	}
+	return lowest, true, nil
+}
+
+//Prune 删除编号不大于seq的事件，返回删除的数量
+func (l *ScanEventLog) Prune(seq uint64) (int, error) {
+
+	db, err := l.open()
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for {
+		var events []*ScanEvent
+		err = db.Range("Seq", uint64(0), seq, &events, storm.Limit(scanEventBatchSize))
+		if err == storm.ErrNotFound || len(events) == 0 {
+			return pruned, nil
+		}
+		if err != nil {
+			return pruned, err
+		}
+
+		tx, err := db.Begin(true)
+		if err != nil {
+			return pruned, err
+		}
+		for _, event := range events {
+			err = tx.DeleteStruct(event)
+			if err != nil {
+				tx.Rollback()
+				return pruned, err
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return pruned, err
+		}
+		pruned += len(events)
+	}
+}
+
+//Cursor 订阅者已送达的最后一个事件编号
+func (l *ScanEventLog) Cursor(name string) (uint64, bool, error) {
+
+	db, err := l.open()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var cursor scanSubscriberCursor
+	err = db.One("Name", name, &cursor)
+	if err == storm.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return cursor.Seq, true, nil
+}
+
+//SaveCursor 保存订阅者已送达的最后一个事件编号
+func (l *ScanEventLog) SaveCursor(name string, seq uint64) error {
+
+	db, err := l.open()
+	if err != nil {
+		return err
+	}
+	return db.Save(&scanSubscriberCursor{Name: name, Seq: seq})
+}
+
+//scanSubscriber 有名称的订阅者，在各自的线程中按游标依次送达事件，不阻塞扫描任务
+type scanSubscriber struct {
+	name   string
+	obj    openwallet.BlockScanNotificationObject
+	mu     sync.Mutex //同一时间只有一个线程送达
+	cursor uint64
+	wakeup chan struct{} //有新事件或游标被移动
+	quit   chan struct{} //已取消订阅
+}
+
+//notify 唤醒送达线程，已有未处理的唤醒时忽略
+func (sub *scanSubscriber) notify() {
+	select {
+	case sub.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+//scanEventLog 返回扫描事件日志，没有开启时返回nil
+func (bs *ILCBlockScanner) scanEventLog() *ScanEventLog {
+	if !bs.wm.Config.EventLog {
+		return nil
+	}
+
+	bs.eventLogMu.Lock()
+	defer bs.eventLogMu.Unlock()
+
+	if bs.eventLog == nil {
+		bs.eventLog = NewScanEventLog(filepath.Join(bs.wm.Config.DBPath, bs.wm.Config.EventLogFile))
+	}
+	return bs.eventLog
+}
+
+//Subscribe 添加有名称的订阅者，先重放游标之后的事件，再送达新的事件，事件在订阅者自己的线程中送达
+//fromHeight > 0 时从第一个高度不小于fromHeight的事件开始重放；
+//fromHeight = 0 时从上次送达的位置继续，新的订阅者只接收之后的事件
+//订阅者处理失败时停止送达，之后有新事件时从失败的事件重试
+//订阅者同时实现了BlockForkNotificationObject时，也会收到被孤立区块需要撤销的提取结果
+func (bs *ILCBlockScanner) Subscribe(name string, obj openwallet.BlockScanNotificationObject, fromHeight uint64) error {
+
+	eventLog := bs.scanEventLog()
+	if eventLog == nil {
+		return fmt.Errorf("scan event log is not enabled")
+	}
+
+	if len(name) == 0 || obj == nil {
+		return fmt.Errorf("subscriber name and object can not be empty")
+	}
+
+	cursor, exist, err := eventLog.Cursor(name)
+	if err != nil {
+		return err
+	}
+
+	if fromHeight > 0 {
+		cursor, err = eventLog.SeqBeforeHeight(fromHeight)
+	} else if !exist {
+		cursor, err = eventLog.LastSeq()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = eventLog.SaveCursor(name, cursor)
+	if err != nil {
+		return err
+	}
+
+	sub := &scanSubscriber{
+		name:   name,
+		obj:    obj,
+		cursor: cursor,
+		wakeup: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+	}
+
+	bs.subscribersMu.Lock()
+	if bs.subscribers == nil {
+		bs.subscribers = make(map[string]*scanSubscriber)
+	}
+	if old, exist := bs.subscribers[name]; exist {
+		close(old.quit)
+	}
+	bs.subscribers[name] = sub
+	bs.subscribersMu.Unlock()
+
+	bs.wm.Log.Std.Info("scan subscriber %s subscribed, replay from event: %d", name, cursor+1)
+
+	go bs.runScanSubscriber(eventLog, sub)
+	sub.notify()
+
+	return nil
+}
+
+//Unsubscribe 移除订阅者，游标保留，再次订阅时继续送达
+func (bs *ILCBlockScanner) Unsubscribe(name string) {
+	bs.subscribersMu.Lock()
+	defer bs.subscribersMu.Unlock()
+	if sub, exist := bs.subscribers[name]; exist {
+		close(sub.quit)
+		delete(bs.subscribers, name)
+	}
+}
+
+//runScanSubscriber 订阅者的送达线程，被唤醒时送达游标之后的事件，取消订阅后退出
+func (bs *ILCBlockScanner) runScanSubscriber(eventLog *ScanEventLog, sub *scanSubscriber) {
+	for {
+		select {
+		case <-sub.quit:
+			return
+		case <-sub.wakeup:
+			bs.deliverScanEvents(eventLog, sub)
+		}
+	}
+}
+
+//ReplayScanEvents 把订阅者的游标移到第一个高度不小于fromHeight的事件之前，重新送达之后的事件
+//已被删除的事件（见EventLogRetention）不能重放
+func (bs *ILCBlockScanner) ReplayScanEvents(name string, fromHeight uint64) error {
+
+	eventLog := bs.scanEventLog()
+	if eventLog == nil {
+		return fmt.Errorf("scan event log is not enabled")
+	}
+
+	bs.subscribersMu.RLock()
+	sub := bs.subscribers[name]
+	bs.subscribersMu.RUnlock()
+
+	if sub == nil {
+		return fmt.Errorf("subscriber %s is not found", name)
+	}
+
+	cursor, err := eventLog.SeqBeforeHeight(fromHeight)
+	if err != nil {
+		return err
+	}
+
+	sub.mu.Lock()
+	sub.cursor = cursor
+	err = eventLog.SaveCursor(name, cursor)
+	sub.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sub.notify()
+
+	return nil
+}
+
+//GetSubscriberHeight 订阅者已送达的最后一个事件的区块高度
+func (bs *ILCBlockScanner) GetSubscriberHeight(name string) (uint64, error) {
+
+	eventLog := bs.scanEventLog()
+	if eventLog == nil {
+		return 0, fmt.Errorf("scan event log is not enabled")
+	}
+
+	cursor, exist, err := eventLog.Cursor(name)
+	if err != nil {
+		return 0, err
+	}
+	if !exist {
+		return 0, fmt.Errorf("subscriber %s is not found", name)
+	}
+	if cursor == 0 {
+		return 0, nil
+	}
+
+	events, err := eventLog.After(cursor-1, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+	return events[0].Height, nil
+}
+
+//appendScanEvents 追加事件到日志，并唤醒所有订阅者的送达线程，没有开启日志时忽略
+func (bs *ILCBlockScanner) appendScanEvents(events ...*ScanEvent) error {
+
+	eventLog := bs.scanEventLog()
+	if eventLog == nil || len(events) == 0 {
+		return nil
+	}
+
+	err := eventLog.Append(events...)
+	if err != nil {
+		bs.wm.Log.Std.Error("append scan events failed. unexpected error: %v", err)
+		return err
+	}
+
+	bs.subscribersMu.RLock()
+	subs := make([]*scanSubscriber, 0, len(bs.subscribers))
+	for _, sub := range bs.subscribers {
+		subs = append(subs, sub)
+	}
+	bs.subscribersMu.RUnlock()
+
+	for _, sub := range subs {
+		sub.notify()
+	}
+
+	//每个新区块检查一次是否需要删除旧的事件
+	if events[0].Type == ScanEventBlock {
+		bs.pruneScanEvents(eventLog)
+	}
+
+	return nil
+}
+
+//pruneScanEvents 删除所有订阅者都已送达，且超出保留数量的事件
+//没有订阅者时按最后一个事件计算，只保留最近的事件
+func (bs *ILCBlockScanner) pruneScanEvents(eventLog *ScanEventLog) {
+
+	retention := bs.wm.Config.EventLogRetention
+	if retention == 0 {
+		return
+	}
+
+	delivered, exist, err := eventLog.MinCursor()
+	if err == nil && !exist {
+		delivered, err = eventLog.LastSeq()
+	}
+	if err != nil {
+		bs.wm.Log.Std.Error("prune scan events failed. unexpected error: %v", err)
+		return
+	}
+
+	if delivered <= retention {
+		return
+	}
+
+	pruned, err := eventLog.Prune(delivered - retention)
+	if err != nil {
+		bs.wm.Log.Std.Error("prune scan events failed. unexpected error: %v", err)
+		return
+	}
+	if pruned > 0 {
+		bs.wm.Log.Std.Info("pruned %d scan events before event: %d", pruned, delivered-retention+1)
+	}
+}
+
+//appendExtractDataEvents 追加已确认交易单的提取结果事件
+func (bs *ILCBlockScanner) appendExtractDataEvents(height uint64, extractData map[string]*openwallet.TxExtractData) error {
+
+	if height == 0 || len(extractData) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(extractData))
+	for key := range extractData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	events := make([]*ScanEvent, 0, len(keys))
+	for _, key := range keys {
+		events = append(events, &ScanEvent{
+			Height:    height,
+			Type:      ScanEventExtractData,
+			SourceKey: key,
+			Data:      extractData[key],
+		})
+	}
+
+	return bs.appendScanEvents(events...)
+}
+
+//appendRevertDataEvents 追加被孤立区块需要撤销的提取结果事件
+func (bs *ILCBlockScanner) appendRevertDataEvents(height uint64, revertData map[string][]*openwallet.TxExtractData) error {
+
+	keys := make([]string, 0, len(revertData))
+	for key := range revertData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	events := make([]*ScanEvent, 0)
+	for _, key := range keys {
+		for _, data := range revertData[key] {
+			events = append(events, &ScanEvent{
+				Height:    height,
+				Type:      ScanEventRevertData,
+				SourceKey: key,
+				Data:      data,
+			})
+		}
+	}
+
+	return bs.appendScanEvents(events...)
+}
+
+//deliverScanEvents 从订阅者的游标开始依次送达事件，直到日志末尾或订阅者处理失败
+func (bs *ILCBlockScanner) deliverScanEvents(eventLog *ScanEventLog, sub *scanSubscriber) {
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	for {
+
+		//已取消订阅
+		bs.subscribersMu.RLock()
+		current := bs.subscribers[sub.name]
+		bs.subscribersMu.RUnlock()
+		if current != sub {
+			return
+		}
+
+		events, err := eventLog.After(sub.cursor, scanEventBatchSize)
+		if err != nil {
+			bs.wm.Log.Std.Error("scan subscriber %s read events failed. unexpected error: %v", sub.name, err)
+			return
+		}
+		if len(events) == 0 {
+			return
+		}
+
+		delivered := sub.cursor
+		for _, event := range events {
+			switch event.Type {
+			case ScanEventBlock:
+				err = sub.obj.BlockScanNotify(event.Header)
+			case ScanEventExtractData:
+				err = sub.obj.BlockExtractDataNotify(event.SourceKey, event.Data)
+			case ScanEventRevertData:
+				//没有实现分叉回滚接口的订阅者跳过
+				if fo, ok := sub.obj.(BlockForkNotificationObject); ok {
+					err = fo.BlockExtractDataRevertNotify(event.SourceKey, event.Data)
+				}
+			}
+			if err != nil {
+				bs.wm.Log.Std.Error("scan subscriber %s handle event %d failed. unexpected error: %v", sub.name, event.Seq, err)
+				break
+			}
+			delivered = event.Seq
+		}
+
+		if delivered != sub.cursor {
+			sub.cursor = delivered
+			saveErr := eventLog.SaveCursor(sub.name, delivered)
+			if saveErr != nil {
+				bs.wm.Log.Std.Error("scan subscriber %s save cursor failed. unexpected error: %v", sub.name, saveErr)
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,366 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//testFlakySubscriber 可以模拟处理失败的订阅者
+type testFlakySubscriber struct {
+	*testObserver
+	failing int32
+}
+
+func (s *testFlakySubscriber) BlockScanNotify(header *openwallet.BlockHeader) error {
+	if atomic.LoadInt32(&s.failing) == 1 {
+		return fmt.Errorf("subscriber is down")
+	}
+	return s.testObserver.BlockScanNotify(header)
+}
+
+func (s *testFlakySubscriber) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	if atomic.LoadInt32(&s.failing) == 1 {
+		return fmt.Errorf("subscriber is down")
+	}
+	return s.testObserver.BlockExtractDataNotify(sourceKey, data)
+}
+
+//testSubscriberHeights 订阅者收到的区块高度，及收到的交易单
+func testSubscriberReceived(o *testObserver) ([]uint64, []string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	heights := make([]uint64, 0)
+	for _, header := range o.headers {
+		heights = append(heights, header.Height)
+	}
+	txids := make([]string, 0)
+	for _, data := range o.data["alice"] {
+		txids = append(txids, data.Transaction.TxID)
+	}
+	return heights, txids
+}
+
+//waitSubscriberReceived 等待订阅者的送达线程送达指定的区块及交易单
+func waitSubscriberReceived(t *testing.T, o *testObserver, wantHeights []uint64, wantTxIDs []string) {
+	t.Helper()
+	var heights []uint64
+	var txids []string
+	for i := 0; i < 500; i++ {
+		heights, txids = testSubscriberReceived(o)
+		if fmt.Sprint(heights) == fmt.Sprint(wantHeights) && fmt.Sprint(txids) == fmt.Sprint(wantTxIDs) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("received = %v %v, want %v %v", heights, txids, wantHeights, wantTxIDs)
+}
+
+func TestILCBlockScanner_SubscriberReplay(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ilcoin-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	wm, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.EventLog = true
+	wm.Config.DBPath = dir
+	saveTestScanned(bs, node)
+	defer bs.scanEventLog().Close()
+	bs.Restart()
+
+	//新的订阅者只接收之后的事件
+	first := newTestObserver()
+	if err := bs.Subscribe("wallet", first, 0); err != nil {
+		t.Fatalf("Subscribe unexpected error: %v", err)
+	}
+
+	deposit1 := newTestTx("deposit1", []testTxIn{{node.chain[1].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "1"})
+	b2 := node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), deposit1)
+	bs.ScanBlockTask()
+
+	waitSubscriberReceived(t, first, []uint64{b2.Height}, []string{deposit1.TxID})
+
+	//订阅者离线期间继续扫描
+	bs.Unsubscribe("wallet")
+
+	deposit2 := newTestTx("deposit2", []testTxIn{{b2.Txs[0].TxID, 0}}, testTxOut{"alice_addr", "2"})
+	b3 := node.mine("a3", newTestTx("coinbase_a3", nil, testTxOut{"miner_addr", "50"}), deposit2)
+	b4 := node.mine("a4")
+	bs.ScanBlockTask()
+
+	if heights, _ := testSubscriberReceived(first); len(heights) != 1 {
+		t.Fatalf("unsubscribed subscriber received %v", heights)
+	}
+
+	//重新打开日志，从保存的游标继续送达，不需要重扫区块
+	bs.scanEventLog().Close()
+	calls := node.callCount("getblock") + node.callCount("getrawtransaction")
+
+	second := newTestObserver()
+	if err := bs.Subscribe("wallet", second, 0); err != nil {
+		t.Fatalf("Subscribe unexpected error: %v", err)
+	}
+	defer bs.Unsubscribe("wallet")
+
+	waitSubscriberReceived(t, second, []uint64{b3.Height, b4.Height}, []string{deposit2.TxID})
+	if node.callCount("getblock")+node.callCount("getrawtransaction") != calls {
+		t.Errorf("resuming subscriber requested the node")
+	}
+
+	//送达线程处理完一批事件后保存游标
+	waitCondition(t, "subscriber cursor saved", func() bool {
+		height, err := bs.GetSubscriberHeight("wallet")
+		return err == nil && height == b4.Height
+	})
+
+	//从指定高度重放
+	if err := bs.ReplayScanEvents("wallet", b2.Height); err != nil {
+		t.Fatalf("ReplayScanEvents unexpected error: %v", err)
+	}
+	waitSubscriberReceived(t, second, []uint64{b3.Height, b4.Height, b2.Height, b3.Height, b4.Height},
+		[]string{deposit2.TxID, deposit1.TxID, deposit2.TxID})
+
+	//处理失败的订阅者保留游标，恢复后从失败的事件继续
+	flaky := &testFlakySubscriber{testObserver: newTestObserver(), failing: 1}
+	if err := bs.Subscribe("flaky", flaky, b2.Height); err != nil {
+		t.Fatalf("Subscribe unexpected error: %v", err)
+	}
+	defer bs.Unsubscribe("flaky")
+	if heights, _ := testSubscriberReceived(flaky.testObserver); len(heights) != 0 {
+		t.Fatalf("failing subscriber received %v", heights)
+	}
+
+	atomic.StoreInt32(&flaky.failing, 0)
+	b5 := node.mine("a5")
+	bs.ScanBlockTask()
+
+	waitSubscriberReceived(t, flaky.testObserver, []uint64{b2.Height, b3.Height, b4.Height, b5.Height},
+		[]string{deposit1.TxID, deposit2.TxID})
+
+	//没有开启事件日志
+	wm.Config.EventLog = false
+	if err := bs.Subscribe("other", newTestObserver(), 0); err == nil {
+		t.Errorf("Subscribe without event log should be failed")
+	}
+}
+
+//testBlockingSubscriber 处理区块通知时阻塞，直到release被关闭
+type testBlockingSubscriber struct {
+	*testObserver
+	release chan struct{}
+}
+
+func (s *testBlockingSubscriber) BlockScanNotify(header *openwallet.BlockHeader) error {
+	<-s.release
+	return s.testObserver.BlockScanNotify(header)
+}
+
+func TestILCBlockScanner_SubscriberRevertData(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	fund := newTestTx("fund", nil, testTxOut{"alice_addr", "10"})
+	node.mine("a1", fund)
+	pay := newTestTx("pay", []testTxIn{{TxID: fund.TxID, Vout: 0}}, testTxOut{"bob_addr", "7"}, testTxOut{"alice_addr", "2.9"})
+	orphan := node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), pay)
+
+	wm, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice", "bob_addr": "bob"})
+	wm.Config.EventLog = true
+	saveTestScanned(bs, node)
+	defer bs.scanEventLog().Close()
+
+	//实现了分叉回滚接口的订阅者收到撤销事件，其他订阅者跳过
+	forkSub := &testForkObserver{testObserver: newTestObserver(), reverted: make(map[string][]*openwallet.TxExtractData)}
+	if err := bs.Subscribe("fork", forkSub, 0); err != nil {
+		t.Fatalf("Subscribe unexpected error: %v", err)
+	}
+	defer bs.Unsubscribe("fork")
+	if err := bs.Subscribe("plain", newTestObserver(), 0); err != nil {
+		t.Fatalf("Subscribe unexpected error: %v", err)
+	}
+	defer bs.Unsubscribe("plain")
+
+	node.reorg(1)
+	node.mine("b2")
+	b3 := node.mine("b3")
+
+	bs.Restart()
+	bs.ScanBlockTask()
+
+	waitCondition(t, "revert data delivered", func() bool {
+		forkSub.mu.Lock()
+		defer forkSub.mu.Unlock()
+		return len(forkSub.reverted["alice"]) == 1 && len(forkSub.reverted["bob"]) == 1
+	})
+	forkSub.mu.Lock()
+	alice := forkSub.reverted["alice"][0]
+	forkSub.mu.Unlock()
+	if alice.Transaction.TxID != pay.TxID || alice.Transaction.BlockHash != orphan.Hash || alice.Transaction.TxAction != TxActionReverted {
+		t.Errorf("alice reverted data = %s %s %s", alice.Transaction.TxID, alice.Transaction.BlockHash, alice.Transaction.TxAction)
+	}
+
+	for _, name := range []string{"fork", "plain"} {
+		waitCondition(t, name+" subscriber delivered", func() bool {
+			height, err := bs.GetSubscriberHeight(name)
+			return err == nil && height == b3.Height
+		})
+	}
+
+	//撤销事件记录在日志中，可以重放
+	events, err := bs.scanEventLog().After(0, scanEventBatchSize)
+	if err != nil {
+		t.Fatalf("read events unexpected error: %v", err)
+	}
+	reverted := 0
+	for _, event := range events {
+		if event.Type == ScanEventRevertData {
+			reverted++
+			if event.Height != orphan.Height {
+				t.Errorf("revert event height = %d, want %d", event.Height, orphan.Height)
+			}
+		}
+	}
+	if reverted != 2 {
+		t.Errorf("revert events = %d, want 2", reverted)
+	}
+}
+
+func TestILCBlockScanner_SubscriberNonBlocking(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	wm, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.EventLog = true
+	saveTestScanned(bs, node)
+	defer bs.scanEventLog().Close()
+	bs.Restart()
+
+	slow := &testBlockingSubscriber{testObserver: newTestObserver(), release: make(chan struct{})}
+	if err := bs.Subscribe("slow", slow, 0); err != nil {
+		t.Fatalf("Subscribe unexpected error: %v", err)
+	}
+	defer bs.Unsubscribe("slow")
+
+	//订阅者阻塞时扫描任务不等待送达
+	b2 := node.mine("a2")
+	b3 := node.mine("a3")
+	scanned := make(chan struct{})
+	go func() {
+		bs.ScanBlockTask()
+		close(scanned)
+	}()
+	select {
+	case <-scanned:
+	case <-time.After(5 * time.Second):
+		close(slow.release)
+		t.Fatalf("scan task is blocked by the subscriber")
+	}
+	if bs.GetScannedBlockHeight() != b3.Height {
+		t.Errorf("scanned height = %d, want %d", bs.GetScannedBlockHeight(), b3.Height)
+	}
+
+	close(slow.release)
+	waitSubscriberReceived(t, slow.testObserver, []uint64{b2.Height, b3.Height}, []string{})
+}
+
+func TestILCBlockScanner_SubscriberPrune(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	wm, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.EventLog = true
+	wm.Config.EventLogRetention = 2
+	saveTestScanned(bs, node)
+	eventLog := bs.scanEventLog()
+	defer eventLog.Close()
+	bs.Restart()
+
+	first := func() uint64 {
+		events, err := eventLog.After(0, 1)
+		if err != nil || len(events) == 0 {
+			return 0
+		}
+		return events[0].Seq
+	}
+
+	wallet := newTestObserver()
+	if err := bs.Subscribe("wallet", wallet, 0); err != nil {
+		t.Fatalf("Subscribe unexpected error: %v", err)
+	}
+
+	//订阅者都已送达的事件只保留最近2个
+	heights := make([]uint64, 0)
+	for i := 0; i < 5; i++ {
+		heights = append(heights, node.mine(fmt.Sprintf("a%d", i+2)).Height)
+		bs.ScanBlockTask()
+		waitSubscriberReceived(t, wallet, heights, []string{})
+		waitCondition(t, "subscriber cursor saved", func() bool {
+			height, err := bs.GetSubscriberHeight("wallet")
+			return err == nil && height == heights[len(heights)-1]
+		})
+	}
+	lastSeq, _ := eventLog.LastSeq()
+	//每个区块事件追加时删除，删除时订阅者还未送达新事件
+	if seq := first(); seq != lastSeq-2 {
+		t.Errorf("first event = %d, last event = %d, want %d", seq, lastSeq, lastSeq-2)
+	}
+
+	//离线订阅者未送达的事件不删除
+	bs.Unsubscribe("wallet")
+	offline := make([]uint64, 0)
+	for i := 0; i < 4; i++ {
+		offline = append(offline, node.mine(fmt.Sprintf("b%d", i)).Height)
+		bs.ScanBlockTask()
+	}
+
+	resumed := newTestObserver()
+	if err := bs.Subscribe("wallet", resumed, 0); err != nil {
+		t.Fatalf("Subscribe unexpected error: %v", err)
+	}
+	defer bs.Unsubscribe("wallet")
+	waitSubscriberReceived(t, resumed, offline, []string{})
+
+	//关闭保留时不删除
+	wm.Config.EventLogRetention = 0
+	seq := first()
+	node.mine("c1")
+	bs.ScanBlockTask()
+	if first() != seq {
+		t.Errorf("events pruned while retention is disabled")
+	}
+}
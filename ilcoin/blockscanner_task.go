@@ -0,0 +1,145 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//扫描任务由扫描器自行调度，不使用BlockScannerBase的定时器
+//暂停或停止时取消扫描任务的上下文，运行中的扫描任务不再分派新的提取工作，正在处理的区块不保存
+//Pause、Stop等待运行中的扫描任务退出后返回，不能在观测者的通知中调用
+
+//beginTask 开始一个扫描任务，扫描器已暂停或停止时返回false，否则任务结束时需要调用taskWG.Done
+func (bs *ILCBlockScanner) beginTask() (context.Context, bool) {
+	bs.taskMu.Lock()
+	defer bs.taskMu.Unlock()
+
+	if bs.taskCtx.Err() != nil {
+		return nil, false
+	}
+
+	bs.taskWG.Add(1)
+	return bs.taskCtx, true
+}
+
+//isTaskRunning 定时任务是否运行中
+func (bs *ILCBlockScanner) isTaskRunning() bool {
+	bs.taskMu.Lock()
+	defer bs.taskMu.Unlock()
+	return bs.stopTask != nil
+}
+
+//resumeTaskLocked 上下文已取消时创建新的上下文，调用前需持有taskMu
+func (bs *ILCBlockScanner) resumeTaskLocked() {
+	if bs.taskCtx.Err() != nil {
+		bs.taskCtx, bs.taskCancel = context.WithCancel(context.Background())
+	}
+	bs.Scanning = true
+}
+
+//cancelTask 取消运行中的扫描任务，并等待其退出
+func (bs *ILCBlockScanner) cancelTask() (chan struct{}, chan struct{}) {
+	bs.taskMu.Lock()
+	bs.taskCancel()
+	bs.Scanning = false
+	stop, done := bs.stopTask, bs.taskDone
+	bs.taskMu.Unlock()
+
+	bs.taskWG.Wait()
+
+	return stop, done
+}
+
+//startTask 开始扫描，按PeriodOfTask定时执行扫描任务
+func (bs *ILCBlockScanner) startTask() {
+	bs.taskMu.Lock()
+	defer bs.taskMu.Unlock()
+
+	bs.resumeTaskLocked()
+
+	if bs.stopTask != nil {
+		return
+	}
+
+	bs.stopTask = make(chan struct{})
+	bs.taskDone = make(chan struct{})
+
+	go bs.runTaskLoop(bs.PeriodOfTask, bs.stopTask, bs.taskDone)
+}
+
+//runTaskLoop 定时执行扫描任务，关闭stop后退出
+func (bs *ILCBlockScanner) runTaskLoop(period time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+
+	defer close(done)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			bs.ScanBlockTask()
+		}
+	}
+}
+
+//stopTaskLoop 取消运行中的扫描任务，停止定时任务，等待两者退出
+func (bs *ILCBlockScanner) stopTaskLoop() {
+
+	stop, done := bs.cancelTask()
+	if stop == nil {
+		return
+	}
+
+	bs.taskMu.Lock()
+	if bs.stopTask == stop {
+		bs.stopTask = nil
+		bs.taskDone = nil
+		close(stop)
+	}
+	bs.taskMu.Unlock()
+
+	<-done
+}
+
+//Pause 暂停扫描，取消运行中的扫描任务并等待其退出，暂停期间定时及推送触发的扫描任务都不执行
+func (bs *ILCBlockScanner) Pause() error {
+
+	if bs.IsClose() {
+		return fmt.Errorf("block scanner has been closed")
+	}
+
+	bs.cancelTask()
+	return nil
+}
+
+//Restart 继续扫描，定时任务已停止时只恢复推送及手动触发的扫描任务
+func (bs *ILCBlockScanner) Restart() error {
+
+	if bs.IsClose() {
+		return fmt.Errorf("block scanner has been closed")
+	}
+
+	bs.taskMu.Lock()
+	bs.resumeTaskLocked()
+	bs.taskMu.Unlock()
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestILCBlockScanner_PauseCancelsExtraction(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	const (
+		txCount = 20
+		workers = 4
+	)
+
+	for i := 1; i <= txCount; i++ {
+		node.mine(fmt.Sprintf("a%d", i))
+	}
+
+	//每笔交易单花费之前区块的coinbase，提取时需要查询前置交易单
+	txs := []*testTx{newTestTx("coinbase_b", nil, testTxOut{"miner_addr", "50"})}
+	for i := 1; i <= txCount; i++ {
+		txs = append(txs, newTestTx(fmt.Sprintf("pay_%d", i), []testTxIn{{node.chain[i].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "1"}))
+	}
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.ExtractWorkers = workers
+	saveTestScanned(bs, node)
+	node.mine("b", txs...)
+
+	var (
+		blocked int32
+		release = make(chan struct{})
+	)
+	node.hook = func(method string, params []json.RawMessage) {
+		if method == "getrawtransaction" {
+			atomic.AddInt32(&blocked, 1)
+			<-release
+		}
+	}
+
+	scanned := make(chan struct{})
+	go func() {
+		bs.ScanBlockTask()
+		close(scanned)
+	}()
+
+	//所有工作令牌都在等待节点返回
+	waitCondition(t, "extracting", func() bool { return atomic.LoadInt32(&blocked) == workers })
+
+	paused := make(chan struct{})
+	go func() {
+		bs.Pause()
+		close(paused)
+	}()
+
+	//暂停需要等待已分派的提取工作结束
+	select {
+	case <-paused:
+		t.Fatalf("pause returned before in-flight extraction finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+
+	select {
+	case <-paused:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("pause timeout")
+	}
+	select {
+	case <-scanned:
+	default:
+		t.Fatalf("scan task is still running after pause")
+	}
+
+	//取消后不再分派新的提取工作，正在处理的区块不保存
+	if count := atomic.LoadInt32(&blocked); count != workers {
+		t.Errorf("getrawtransaction calls = %d after pause, want %d", count, workers)
+	}
+	header, _ := bs.GetScannedBlockHeader()
+	if header.Height != txCount {
+		t.Errorf("scanned height = %d after pause, want %d", header.Height, txCount)
+	}
+	if records := unscanRecordTxIDs(bs); len(records) != 0 {
+		t.Errorf("unscan records = %v after pause, want none", records)
+	}
+	observer.mu.Lock()
+	count := len(observer.data["alice"])
+	observer.mu.Unlock()
+	if count != 0 {
+		t.Errorf("alice extract data = %d after pause, want 0", count)
+	}
+
+	//暂停期间扫描任务不执行
+	bs.ScanBlockTask()
+	if header, _ := bs.GetScannedBlockHeader(); header.Height != txCount {
+		t.Errorf("scanned height = %d while paused, want %d", header.Height, txCount)
+	}
+
+	//继续扫描后从未保存的区块重新提取
+	bs.Restart()
+	bs.ScanBlockTask()
+
+	if header, _ := bs.GetScannedBlockHeader(); header.Height != txCount+1 {
+		t.Errorf("scanned height = %d after restart, want %d", header.Height, txCount+1)
+	}
+	observer.mu.Lock()
+	count = len(observer.data["alice"])
+	observer.mu.Unlock()
+	if count != txCount {
+		t.Errorf("alice extract data = %d after restart, want %d", count, txCount)
+	}
+}
+
+func TestILCBlockScanner_RunStop(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	_, bs, observer := newTestScanner(node, nil)
+	bs.PeriodOfTask = 10 * time.Millisecond
+	saveTestScanned(bs, node)
+	bs.IsScanMemPool = false
+
+	if err := bs.Run(); err != nil {
+		t.Fatalf("Run unexpected error: %v", err)
+	}
+	if err := bs.Run(); err != nil {
+		t.Fatalf("Run twice unexpected error: %v", err)
+	}
+
+	node.mine("a2")
+	headers := observer.waitHeaders(t, 1)
+	if headers[0].Height != 2 {
+		t.Errorf("block header height = %d, want 2", headers[0].Height)
+	}
+
+	if err := bs.Stop(); err != nil {
+		t.Fatalf("Stop unexpected error: %v", err)
+	}
+	if bs.isTaskRunning() {
+		t.Errorf("task is still running after stop")
+	}
+
+	//停止后定时任务不再执行
+	calls := node.callCount("getblockcount")
+	node.mine("a3")
+	time.Sleep(100 * time.Millisecond)
+	if count := node.callCount("getblockcount"); count != calls {
+		t.Errorf("getblockcount called %d times after stop", count-calls)
+	}
+
+	//再次运行后继续扫描
+	if err := bs.Run(); err != nil {
+		t.Fatalf("Run after stop unexpected error: %v", err)
+	}
+	headers = observer.waitHeaders(t, 2)
+	if headers[1].Height != 3 {
+		t.Errorf("block header height = %d, want 3", headers[1].Height)
+	}
+	bs.Stop()
+}
+
+func TestILCBlockScanner_BatchExtractError(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	_, bs, _ := newTestScanner(node, nil)
+
+	err := bs.BatchExtractTransaction(1, "", []string{testHash("missing_1"), node.chain[0].Txs[0].TxID, testHash("missing_2")})
+	extractErr, ok := err.(*ExtractError)
+	if !ok {
+		t.Fatalf("BatchExtractTransaction error = %v, want *ExtractError", err)
+	}
+	if extractErr.BlockHeight != 1 || len(extractErr.Failed) != 2 {
+		t.Fatalf("ExtractError = %d %v, want 2 failed transactions on height 1", extractErr.BlockHeight, extractErr.Failed)
+	}
+	for _, txid := range []string{testHash("missing_1"), testHash("missing_2")} {
+		if extractErr.Failed[txid] == nil {
+			t.Errorf("ExtractError missing failed transaction %s", txid)
+		}
+	}
+}
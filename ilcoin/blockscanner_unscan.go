@@ -0,0 +1,443 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+const (
+	maxUnscanRetryWait = 24 * time.Hour
+)
+
+//UnscanRetry 未扫记录的重试状态
+type UnscanRetry struct {
+	Record     *openwallet.UnscanRecord //未扫记录，TxID为空表示整个区块
+	Attempts   int                      //已失败次数
+	LastError  string                   //最近一次失败的原因
+	NextRetry  time.Time                //下次重试的时间
+	DeadLetter bool                     //失败次数达到上限，不再自动重试
+}
+
+//unscanRetryTracker 记录未扫记录的失败次数，key = 记录ID
+//重试状态同时保存在扫描器状态数据库，首次使用时恢复，重启后继续退避及保留死信
+type unscanRetryTracker struct {
+	mu      sync.Mutex
+	retries map[string]*UnscanRetry
+	loaded  bool
+}
+
+func newUnscanRetryTracker() *unscanRetryTracker {
+	return &unscanRetryTracker{
+		retries: make(map[string]*UnscanRetry),
+	}
+}
+
+//fail 累计失败次数，按指数退避计算下次重试时间，达到上限后转入死信
+func (t *unscanRetryTracker) fail(record *openwallet.UnscanRecord, reason string, retryWait time.Duration, maxAttempts int) UnscanRetry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	retry, exist := t.retries[record.ID]
+	if !exist {
+		retry = &UnscanRetry{}
+		t.retries[record.ID] = retry
+	}
+
+	retry.Record = record
+	retry.Attempts++
+	retry.LastError = reason
+
+	wait := retryWait
+	for i := 1; i < retry.Attempts && wait < maxUnscanRetryWait; i++ {
+		wait = wait * 2
+	}
+	if wait > maxUnscanRetryWait {
+		wait = maxUnscanRetryWait
+	}
+	retry.NextRetry = time.Now().Add(wait)
+
+	if maxAttempts > 0 && retry.Attempts >= maxAttempts {
+		retry.DeadLetter = true
+	}
+
+	return *retry
+}
+
+//isLoaded 是否已从状态数据库恢复
+func (t *unscanRetryTracker) isLoaded() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.loaded
+}
+
+//load 恢复状态数据库中的重试状态
+func (t *unscanRetryTracker) load(records []*UnscanRetryRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, record := range records {
+		if record.Record == nil {
+			continue
+		}
+		retry := record.UnscanRetry
+		t.retries[record.ID] = &retry
+	}
+	t.loaded = true
+}
+
+//due 到达重试时间的未扫记录，同时清除已不存在的记录的重试状态，返回被清除的记录ID
+func (t *unscanRetryTracker) due(records []*openwallet.UnscanRecord, now time.Time) ([]*openwallet.UnscanRecord, []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	exist := make(map[string]bool, len(records))
+	list := make([]*openwallet.UnscanRecord, 0, len(records))
+	for _, r := range records {
+		exist[r.ID] = true
+		retry, ok := t.retries[r.ID]
+		if ok && (retry.DeadLetter || now.Before(retry.NextRetry)) {
+			continue
+		}
+		list = append(list, r)
+	}
+
+	removed := make([]string, 0)
+	for id := range t.retries {
+		if !exist[id] {
+			delete(t.retries, id)
+			removed = append(removed, id)
+		}
+	}
+
+	return list, removed
+}
+
+func (t *unscanRetryTracker) get(id string) (UnscanRetry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	retry, exist := t.retries[id]
+	if !exist {
+		return UnscanRetry{}, false
+	}
+	return *retry, true
+}
+
+func (t *unscanRetryTracker) forget(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.retries, id)
+}
+
+func (t *unscanRetryTracker) forgetHeight(height uint64) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	removed := make([]string, 0)
+	for id, retry := range t.retries {
+		if retry.Record.BlockHeight == height {
+			delete(t.retries, id)
+			removed = append(removed, id)
+		}
+	}
+	return removed
+}
+
+//deadLetters 死信记录，按高度及交易单号排列
+func (t *unscanRetryTracker) deadLetters() []*UnscanRetry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]*UnscanRetry, 0)
+	for _, retry := range t.retries {
+		if retry.DeadLetter {
+			copied := *retry
+			list = append(list, &copied)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Record.BlockHeight != list[j].Record.BlockHeight {
+			return list[i].Record.BlockHeight < list[j].Record.BlockHeight
+		}
+		return list[i].Record.TxID < list[j].Record.TxID
+	})
+	return list
+}
+
+//saveFailedRecord 保存未扫记录，并累计失败次数，txid为空表示整个区块
+func (bs *ILCBlockScanner) saveFailedRecord(height uint64, txid string, reason error) {
+
+	unscanRecord := openwallet.NewUnscanRecord(height, txid, reason.Error(), bs.wm.Symbol())
+	err := bs.SaveUnscanRecord(unscanRecord)
+	if err != nil {
+		bs.wm.Log.Std.Error("block height: %d, txid: %s save unscan record failed. unexpected error: %v", height, txid, err)
+	}
+
+	bs.failUnscanRecord(unscanRecord, reason)
+}
+
+//skipFailedBlock 累计区块在同一高度连续获取失败的次数，达到BlockMaxFailures时保存整个区块的未扫记录，
+//返回是否跳过该区块
+func (bs *ILCBlockScanner) skipFailedBlock(height uint64, reason error) bool {
+
+	if bs.blockFailHeight != height {
+		bs.blockFailHeight = height
+		bs.blockFailures = 0
+	}
+	bs.blockFailures++
+
+	if bs.wm.Config.BlockMaxFailures <= 0 || bs.blockFailures < bs.wm.Config.BlockMaxFailures {
+		return false
+	}
+
+	bs.wm.Log.Std.Error("block height: %d failed %d times, skip it and save unscan record. last error: %v", height, bs.blockFailures, reason)
+	bs.saveFailedRecord(height, "", reason)
+	bs.blockFailures = 0
+
+	return true
+}
+
+//loadUnscanRetries 从状态数据库恢复上次运行时的重试状态，只在首次成功时恢复
+func (bs *ILCBlockScanner) loadUnscanRetries() {
+
+	if bs.unscanRetries.isLoaded() {
+		return
+	}
+
+	records, err := bs.scanState().UnscanRetryRecords()
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not load unscan retries; unexpected error: %v", err)
+		return
+	}
+
+	bs.unscanRetries.load(records)
+}
+
+//forgetUnscanRetry 清除未扫记录的重试状态
+func (bs *ILCBlockScanner) forgetUnscanRetry(id string) {
+	bs.unscanRetries.forget(id)
+	err := bs.scanState().DeleteUnscanRetryRecord(id)
+	if err != nil {
+		bs.wm.Log.Std.Error("unscan record: %s delete retry state failed. unexpected error: %v", id, err)
+	}
+}
+
+//forgetUnscanRetryHeight 清除一个区块的未扫记录的重试状态
+func (bs *ILCBlockScanner) forgetUnscanRetryHeight(height uint64) {
+	bs.loadUnscanRetries()
+	for _, id := range bs.unscanRetries.forgetHeight(height) {
+		bs.forgetUnscanRetry(id)
+	}
+}
+
+//failUnscanRecord 累计未扫记录的失败次数
+func (bs *ILCBlockScanner) failUnscanRecord(record *openwallet.UnscanRecord, reason error) {
+
+	bs.loadUnscanRetries()
+
+	retry := bs.unscanRetries.fail(record, reason.Error(), bs.wm.Config.UnscanRetryWait, bs.wm.Config.UnscanMaxAttempts)
+
+	err := bs.scanState().SaveUnscanRetryRecord(&UnscanRetryRecord{ID: record.ID, UnscanRetry: retry})
+	if err != nil {
+		bs.wm.Log.Std.Error("block height: %d, txid: %s save retry state failed. unexpected error: %v", record.BlockHeight, record.TxID, err)
+	}
+
+	if retry.DeadLetter {
+		bs.wm.Log.Std.Error("block height: %d, txid: %s failed %d times, moved to dead letter. last error: %s", record.BlockHeight, record.TxID, retry.Attempts, retry.LastError)
+	}
+}
+
+//deleteUnscanRecordByID 删除未扫记录及其重试状态
+func (bs *ILCBlockScanner) deleteUnscanRecordByID(id string) error {
+
+	dai := bs.blockchainDAI()
+
+	bs.forgetUnscanRetry(id)
+
+	return dai.DeleteUnscanRecordByID(id, bs.wm.Symbol())
+}
+
+//RescanFailedRecord 重扫到达重试时间的失败记录，有交易单号的只重新提取失败的交易单
+func (bs *ILCBlockScanner) RescanFailedRecord() {
+	bs.rescanFailedRecord(context.Background())
+}
+
+//rescanFailedRecord 重扫到达重试时间的失败记录，ctx取消后不再重扫剩余的区块
+func (bs *ILCBlockScanner) rescanFailedRecord(ctx context.Context) {
+
+	list, err := bs.GetUnscanRecords()
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not get rescan data; unexpected error: %v", err)
+		return
+	}
+
+	bs.loadUnscanRetries()
+
+	due, removed := bs.unscanRetries.due(list, time.Now())
+	for _, id := range removed {
+		bs.forgetUnscanRetry(id)
+	}
+
+	bs.rescanRecords(ctx, due)
+
+	//重试撤销失败的被孤立区块
+	bs.retryRevertRecords(ctx)
+}
+
+//rescanRecords 按区块高度分组重扫未扫记录
+func (bs *ILCBlockScanner) rescanRecords(ctx context.Context, records []*openwallet.UnscanRecord) error {
+
+	var (
+		blockMap = make(map[uint64][]*openwallet.UnscanRecord)
+		heights  = make([]uint64, 0)
+		failed   = 0
+	)
+
+	//组合成批处理
+	for _, r := range records {
+		if _, exist := blockMap[r.BlockHeight]; !exist {
+			heights = append(heights, r.BlockHeight)
+		}
+		blockMap[r.BlockHeight] = append(blockMap[r.BlockHeight], r)
+	}
+
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+
+	for _, height := range heights {
+
+		if height == 0 {
+			//交易池的交易由扫描交易池重新提取
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := bs.rescanHeight(ctx, height, blockMap[height])
+		if err != nil {
+			bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("block scanner rescan %d blocks failed", failed)
+	}
+
+	return nil
+}
+
+//rescanHeight 重扫一个区块的未扫记录，有整个区块的记录时重扫整个区块，否则只重新提取失败的交易单
+func (bs *ILCBlockScanner) rescanHeight(ctx context.Context, height uint64, records []*openwallet.UnscanRecord) error {
+
+	var (
+		wholeBlock = false
+		txs        = make([]string, 0)
+		results    []ExtractResult
+	)
+
+	for _, r := range records {
+		if len(r.TxID) == 0 {
+			wholeBlock = true
+		} else {
+			txs = append(txs, r.TxID)
+		}
+	}
+
+	bs.wm.Log.Std.Info("block scanner rescanning height: %d ...", height)
+
+	hash, err := bs.wm.GetBlockHash(height)
+	if err != nil {
+		for _, r := range records {
+			bs.failUnscanRecord(r, err)
+		}
+		return err
+	}
+
+	if wholeBlock {
+		block, err := bs.wm.GetBlockWithTransactions(hash)
+		if err != nil {
+			for _, r := range records {
+				bs.failUnscanRecord(r, err)
+			}
+			return err
+		}
+		results, err = bs.extractBlock(ctx, block)
+	} else {
+		results, err = bs.extractBlockTransaction(ctx, height, hash, txs)
+	}
+	if err != nil {
+		//已取消，保留未扫记录，不累计失败次数
+		return err
+	}
+
+	//失败的交易单会重新记录，并累计失败次数
+	failed := bs.saveExtractResultsTx(height, results)
+
+	for _, r := range records {
+		//整个区块的记录已被逐笔交易单的记录代替
+		if _, exist := failed[r.TxID]; len(r.TxID) == 0 || !exist {
+			bs.deleteUnscanRecordByID(r.ID)
+		}
+	}
+
+	if len(failed) > 0 {
+		return &ExtractError{BlockHeight: height, Failed: failed}
+	}
+
+	return nil
+}
+
+//GetDeadLetterRecords 失败次数达到上限，不再自动重试的未扫记录
+func (bs *ILCBlockScanner) GetDeadLetterRecords() []*UnscanRetry {
+	bs.loadUnscanRetries()
+	return bs.unscanRetries.deadLetters()
+}
+
+//RetryDeadLetterRecord 马上重试死信记录，再次失败时重新累计失败次数
+func (bs *ILCBlockScanner) RetryDeadLetterRecord(id string) error {
+
+	bs.loadUnscanRetries()
+
+	retry, exist := bs.unscanRetries.get(id)
+	if !exist || !retry.DeadLetter {
+		return fmt.Errorf("dead letter record: %s is not found", id)
+	}
+
+	bs.forgetUnscanRetry(id)
+
+	return bs.rescanRecords(context.Background(), []*openwallet.UnscanRecord{retry.Record})
+}
+
+//DiscardDeadLetterRecord 放弃死信记录，删除未扫记录
+func (bs *ILCBlockScanner) DiscardDeadLetterRecord(id string) error {
+
+	bs.loadUnscanRetries()
+
+	retry, exist := bs.unscanRetries.get(id)
+	if !exist || !retry.DeadLetter {
+		return fmt.Errorf("dead letter record: %s is not found", id)
+	}
+
+	bs.wm.Log.Std.Info("discard dead letter record, block height: %d, txid: %s", retry.Record.BlockHeight, retry.Record.TxID)
+
+	return bs.deleteUnscanRecordByID(id)
+}
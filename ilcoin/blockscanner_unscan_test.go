@@ -0,0 +1,325 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//unscanRecordTxIDs 未扫记录的交易单号，整个区块的记录为空字符串
+func unscanRecordTxIDs(bs *ILCBlockScanner) map[string]string {
+	list, _ := bs.GetUnscanRecords()
+	records := make(map[string]string)
+	for _, r := range list {
+		records[r.TxID] = r.ID
+	}
+	return records
+}
+
+//expireUnscanRetries 跳过退避等待，让所有未扫记录马上到达重试时间
+func expireUnscanRetries(bs *ILCBlockScanner) {
+	bs.unscanRetries.mu.Lock()
+	defer bs.unscanRetries.mu.Unlock()
+	for _, retry := range bs.unscanRetries.retries {
+		retry.NextRetry = time.Now()
+	}
+}
+
+func TestILCBlockScanner_UnscanRetry(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice", "bob_addr": "bob"})
+	wm.Config.UnscanRetryWait = time.Hour
+	wm.Config.UnscanMaxAttempts = 3
+	saveTestScanned(bs, node)
+	bs.Restart()
+
+	var (
+		requestedMu sync.Mutex
+		requested   = make(map[string]int)
+	)
+	node.hook = func(method string, params []json.RawMessage) {
+		if method == "getrawtransaction" {
+			var txid string
+			json.Unmarshal(params[0], &txid)
+			requestedMu.Lock()
+			requested[txid]++
+			requestedMu.Unlock()
+		}
+	}
+	takeRequested := func() map[string]int {
+		requestedMu.Lock()
+		defer requestedMu.Unlock()
+		r := requested
+		requested = make(map[string]int)
+		return r
+	}
+	extractCount := func(key string) int {
+		observer.mu.Lock()
+		defer observer.mu.Unlock()
+		return len(observer.data[key])
+	}
+
+	//前置交易单不在节点上，提取alice的交易单失败
+	prevTx := newTestTx("missing_prev", nil, testTxOut{"genesis_addr", "1"})
+	txAlice := newTestTx("pay_alice", []testTxIn{{prevTx.TxID, 0}}, testTxOut{"alice_addr", "1"})
+	txBob := newTestTx("pay_bob", []testTxIn{{node.chain[1].Txs[0].TxID, 0}}, testTxOut{"bob_addr", "2"})
+	node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), txAlice, txBob)
+
+	bs.ScanBlockTask()
+
+	records := unscanRecordTxIDs(bs)
+	if len(records) != 1 || len(records[txAlice.TxID]) == 0 {
+		t.Fatalf("unscan records = %v, want only %s", records, txAlice.TxID)
+	}
+	list, _ := bs.GetUnscanRecords()
+	if list[0].BlockHeight != 2 || !strings.Contains(list[0].Reason, prevTx.TxID) {
+		t.Errorf("unscan record = %d %s, want height 2 and reason of previous output", list[0].BlockHeight, list[0].Reason)
+	}
+	if extractCount("bob") != 1 || extractCount("alice") != 0 {
+		t.Errorf("extract data bob = %d, alice = %d, want 1 and 0", extractCount("bob"), extractCount("alice"))
+	}
+
+	//未到重试时间不重扫
+	takeRequested()
+	bs.RescanFailedRecord()
+	if r := takeRequested(); len(r) != 0 {
+		t.Errorf("rescan before retry time requested %v", r)
+	}
+	retry, _ := bs.unscanRetries.get(records[txAlice.TxID])
+	if retry.Attempts != 1 || retry.DeadLetter {
+		t.Errorf("retry = %d attempts, dead letter %v, want 1 attempt", retry.Attempts, retry.DeadLetter)
+	}
+
+	//退避时间翻倍，只重新提取失败的交易单
+	expireUnscanRetries(bs)
+	bs.RescanFailedRecord()
+	r := takeRequested()
+	if r[txAlice.TxID] == 0 || r[txBob.TxID] != 0 {
+		t.Errorf("rescan requested %v, want only %s", r, txAlice.TxID)
+	}
+	retry, _ = bs.unscanRetries.get(records[txAlice.TxID])
+	if retry.Attempts != 2 || time.Until(retry.NextRetry) < time.Hour+59*time.Minute {
+		t.Errorf("retry = %d attempts, next retry in %v, want 2 attempts in 2h", retry.Attempts, time.Until(retry.NextRetry))
+	}
+	if extractCount("bob") != 1 {
+		t.Errorf("bob extract data = %d after rescan, want 1", extractCount("bob"))
+	}
+
+	//达到最大失败次数转入死信，不再自动重试
+	expireUnscanRetries(bs)
+	bs.RescanFailedRecord()
+	deadLetters := bs.GetDeadLetterRecords()
+	if len(deadLetters) != 1 || deadLetters[0].Record.TxID != txAlice.TxID || deadLetters[0].Attempts != 3 {
+		t.Fatalf("dead letters = %v, want %s after 3 attempts", deadLetters, txAlice.TxID)
+	}
+	takeRequested()
+	expireUnscanRetries(bs)
+	bs.RescanFailedRecord()
+	if r := takeRequested(); len(r) != 0 {
+		t.Errorf("dead letter rescanned, requested %v", r)
+	}
+
+	//前置交易单可用后手动重试死信
+	node.mu.Lock()
+	node.txs[prevTx.TxID] = prevTx
+	node.mu.Unlock()
+
+	if err := bs.RetryDeadLetterRecord("unknown"); err == nil {
+		t.Errorf("retry unknown dead letter should be failed")
+	}
+	if err := bs.RetryDeadLetterRecord(deadLetters[0].Record.ID); err != nil {
+		t.Fatalf("RetryDeadLetterRecord unexpected error: %v", err)
+	}
+	if extractCount("alice") != 1 {
+		t.Errorf("alice extract data = %d after retry, want 1", extractCount("alice"))
+	}
+	if records := unscanRecordTxIDs(bs); len(records) != 0 {
+		t.Errorf("unscan records = %v after retry, want none", records)
+	}
+	if deadLetters := bs.GetDeadLetterRecords(); len(deadLetters) != 0 {
+		t.Errorf("dead letters = %d after retry, want none", len(deadLetters))
+	}
+
+	//整个区块的记录重扫后只保留失败的交易单
+	prevTx2 := newTestTx("missing_prev_2", nil, testTxOut{"genesis_addr", "1"})
+	txAlice2 := newTestTx("pay_alice_2", []testTxIn{{prevTx2.TxID, 0}}, testTxOut{"alice_addr", "3"})
+	node.mine("a3", newTestTx("coinbase_a3", nil, testTxOut{"bob_addr", "50"}), txAlice2)
+	saveTestScanned(bs, node)
+
+	bs.saveFailedRecord(3, "", fmt.Errorf("[-5]Block not found"))
+	wm.Config.UnscanMaxAttempts = 1
+	expireUnscanRetries(bs)
+	bs.RescanFailedRecord()
+
+	records = unscanRecordTxIDs(bs)
+	if len(records) != 1 || len(records[txAlice2.TxID]) == 0 {
+		t.Fatalf("unscan records = %v, want only %s", records, txAlice2.TxID)
+	}
+	if extractCount("bob") != 2 {
+		t.Errorf("bob extract data = %d after block rescan, want 2", extractCount("bob"))
+	}
+
+	//放弃死信，删除未扫记录
+	deadLetters = bs.GetDeadLetterRecords()
+	if len(deadLetters) != 1 || deadLetters[0].Record.TxID != txAlice2.TxID {
+		t.Fatalf("dead letters = %v, want %s", deadLetters, txAlice2.TxID)
+	}
+	if err := bs.DiscardDeadLetterRecord(deadLetters[0].Record.ID); err != nil {
+		t.Fatalf("DiscardDeadLetterRecord unexpected error: %v", err)
+	}
+	if records := unscanRecordTxIDs(bs); len(records) != 0 {
+		t.Errorf("unscan records = %v after discard, want none", records)
+	}
+	if deadLetters := bs.GetDeadLetterRecords(); len(deadLetters) != 0 {
+		t.Errorf("dead letters = %d after discard, want none", len(deadLetters))
+	}
+}
+
+func TestILCBlockScanner_UnscanRetry_Restart(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	var (
+		requestedMu sync.Mutex
+		requested   = 0
+	)
+	node.hook = func(method string, params []json.RawMessage) {
+		if method == "getblockhash" {
+			requestedMu.Lock()
+			requested++
+			requestedMu.Unlock()
+		}
+	}
+	takeRequested := func() int {
+		requestedMu.Lock()
+		defer requestedMu.Unlock()
+		r := requested
+		requested = 0
+		return r
+	}
+
+	//restart 停止扫描器并关闭状态数据库，新的扫描器使用同一个数据目录及区块链数据库
+	restart := func(bs *ILCBlockScanner) *ILCBlockScanner {
+		bs.Stop()
+		bs.scanState().Close()
+		wm, restarted, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+		wm.Config.UnscanRetryWait = time.Hour
+		wm.Config.UnscanMaxAttempts = 3
+		restarted.SetBlockchainDAI(bs.blockchainDAI())
+		restarted.Restart()
+		return restarted
+	}
+
+	wm, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.UnscanRetryWait = time.Hour
+	wm.Config.UnscanMaxAttempts = 3
+	saveTestScanned(bs, node)
+	bs.Restart()
+
+	prevTx := newTestTx("missing_prev", nil, testTxOut{"genesis_addr", "1"})
+	txAlice := newTestTx("pay_alice", []testTxIn{{prevTx.TxID, 0}}, testTxOut{"alice_addr", "1"})
+	node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), txAlice)
+	bs.ScanBlockTask()
+	records := unscanRecordTxIDs(bs)
+	if len(records) != 1 {
+		t.Fatalf("unscan records = %v, want %s", records, txAlice.TxID)
+	}
+
+	//重启后保留退避等待，未到重试时间不重扫
+	bs = restart(bs)
+	takeRequested()
+	bs.RescanFailedRecord()
+	if r := takeRequested(); r != 0 {
+		t.Errorf("rescan before retry time after restart requested %d blocks", r)
+	}
+	retry, exist := bs.unscanRetries.get(records[txAlice.TxID])
+	if !exist || retry.Attempts != 1 || retry.Record.TxID != txAlice.TxID || time.Until(retry.NextRetry) < 59*time.Minute {
+		t.Errorf("retry after restart = %d attempts, next retry in %v, want 1 attempt in 1h", retry.Attempts, time.Until(retry.NextRetry))
+	}
+
+	//累计的失败次数在重启后继续计算，死信在重启后仍然存在
+	expireUnscanRetries(bs)
+	bs.RescanFailedRecord()
+	expireUnscanRetries(bs)
+	bs.RescanFailedRecord()
+	if deadLetters := bs.GetDeadLetterRecords(); len(deadLetters) != 1 {
+		t.Fatalf("dead letters = %d before restart, want 1", len(deadLetters))
+	}
+
+	bs = restart(bs)
+	defer bs.scanState().Close()
+	deadLetters := bs.GetDeadLetterRecords()
+	if len(deadLetters) != 1 || deadLetters[0].Record.TxID != txAlice.TxID || deadLetters[0].Attempts != 3 ||
+		!strings.Contains(deadLetters[0].LastError, prevTx.TxID) {
+		t.Fatalf("dead letters after restart = %v, want %s after 3 attempts", deadLetters, txAlice.TxID)
+	}
+	takeRequested()
+	bs.RescanFailedRecord()
+	if r := takeRequested(); r != 0 {
+		t.Errorf("dead letter rescanned after restart, requested %d blocks", r)
+	}
+
+	//放弃死信后重试状态同时删除
+	if err := bs.DiscardDeadLetterRecord(deadLetters[0].Record.ID); err != nil {
+		t.Fatalf("DiscardDeadLetterRecord unexpected error: %v", err)
+	}
+	if list, err := bs.scanState().UnscanRetryRecords(); err != nil || len(list) != 0 {
+		t.Errorf("unscan retry records after discard = %d, %v", len(list), err)
+	}
+}
+
+func TestILCBlockScanner_UnscanRetry_TxNotFound(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+	node.mine("a2")
+
+	wm, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.UnscanRetryWait = time.Hour
+	wm.Config.UnscanMaxAttempts = 2
+	saveTestScanned(bs, node)
+
+	//节点找不到交易单的记录按退避重试，最后转入死信，不会被直接删除
+	txid := newTestTx("unknown_tx", nil, testTxOut{"alice_addr", "1"}).TxID
+	bs.saveFailedRecord(2, txid, fmt.Errorf("[-5]No information available about transaction"))
+
+	expireUnscanRetries(bs)
+	bs.RescanFailedRecord()
+
+	records := unscanRecordTxIDs(bs)
+	if len(records[txid]) == 0 {
+		t.Fatalf("unscan records = %v, want %s kept", records, txid)
+	}
+	deadLetters := bs.GetDeadLetterRecords()
+	if len(deadLetters) != 1 || deadLetters[0].Record.TxID != txid || deadLetters[0].Attempts != 2 {
+		t.Errorf("dead letters = %v, want %s after 2 attempts", deadLetters, txid)
+	}
+}
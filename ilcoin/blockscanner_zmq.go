@@ -0,0 +1,287 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	zmqDialTimeout = 10 * time.Second
+	//推送交易排队等待提取的最大数量，队列满时暂停接收
+	zmqRawTxQueueSize = 1000
+	//每批提取的推送交易数量
+	zmqRawTxBatchSize = 100
+)
+
+//zmqEndpoints 按推送地址分组需要订阅的主题，同一地址只建立一个连接
+func (bs *ILCBlockScanner) zmqEndpoints() map[string][]string {
+	endpoints := make(map[string][]string)
+	if len(bs.wm.Config.ZMQPubHashBlock) > 0 {
+		endpoints[bs.wm.Config.ZMQPubHashBlock] = append(endpoints[bs.wm.Config.ZMQPubHashBlock], ZMQTopicHashBlock)
+	}
+	if len(bs.wm.Config.ZMQPubRawTx) > 0 {
+		endpoints[bs.wm.Config.ZMQPubRawTx] = append(endpoints[bs.wm.Config.ZMQPubRawTx], ZMQTopicRawTx)
+	}
+	return endpoints
+}
+
+//startZMQ 订阅节点的zmq推送，已启动或没有配置推送地址则忽略
+func (bs *ILCBlockScanner) startZMQ() {
+	bs.zmqMu.Lock()
+	defer bs.zmqMu.Unlock()
+
+	if bs.stopZMQ != nil {
+		return
+	}
+
+	endpoints := bs.zmqEndpoints()
+	if len(endpoints) == 0 {
+		return
+	}
+
+	bs.stopZMQ = make(chan struct{})
+	for endpoint, topics := range endpoints {
+		bs.zmqWG.Add(1)
+		go bs.setupZMQ(endpoint, topics, bs.stopZMQ, &bs.zmqWG)
+	}
+}
+
+//stopZMQListen 关闭zmq连接，等待订阅线程退出
+func (bs *ILCBlockScanner) stopZMQListen() {
+	bs.zmqMu.Lock()
+	stop := bs.stopZMQ
+	bs.stopZMQ = nil
+	bs.zmqMu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	bs.zmqWG.Wait()
+}
+
+//IsZMQConnected 是否已订阅节点的zmqpubrawtx，已订阅时扫描任务不再轮询交易池
+func (bs *ILCBlockScanner) IsZMQConnected() bool {
+	return atomic.LoadInt32(&bs.zmqRawTxConnected) > 0
+}
+
+//setupZMQ 订阅一个推送地址，连接断开后按指数退避的等待时间重连，直到stop被关闭
+func (bs *ILCBlockScanner) setupZMQ(endpoint string, topics []string, stop chan struct{}, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	var (
+		reconnectWait = bs.wm.Config.PushReconnectWait
+		isRawTx       = false
+	)
+
+	for _, topic := range topics {
+		if topic == ZMQTopicRawTx {
+			isRawTx = true
+		}
+	}
+
+	for {
+
+		bs.wm.Log.Info("block scanner zmq connecting", endpoint, topics)
+		sub, err := dialZMQSubscriber(endpoint, topics, zmqDialTimeout, bs.wm.Config.ZMQIdleTimeout)
+		if err != nil {
+			bs.wm.Log.Errorf("Connect zmq %s failed unexpected error: %v", endpoint, err)
+		} else {
+
+			bs.wm.Log.Info("block scanner zmq connected", endpoint)
+
+			//连接成功，重置重连等待时间
+			reconnectWait = bs.wm.Config.PushReconnectWait
+
+			if isRawTx {
+				atomic.AddInt32(&bs.zmqRawTxConnected, 1)
+			}
+
+			//推送的交易按批提取，避免逐笔查询交易池
+			rawTxs := make(chan []byte, zmqRawTxQueueSize)
+			extracted := make(chan struct{})
+			go func() {
+				bs.extractZMQRawTxs(rawTxs)
+				close(extracted)
+			}()
+
+			readErr := make(chan error, 1)
+			go func() {
+				defer close(rawTxs)
+				for {
+					frames, recvErr := sub.recvMessage()
+					if recvErr != nil {
+						readErr <- recvErr
+						return
+					}
+					bs.handleZMQMessage(frames, rawTxs)
+				}
+			}()
+
+			stopped := false
+			select {
+			case err = <-readErr:
+				bs.wm.Log.Info("block scanner zmq disconnected", endpoint, err)
+				sub.Close()
+			case <-stop:
+				//关闭连接后等待接收线程退出
+				sub.Close()
+				<-readErr
+				stopped = true
+			}
+			<-extracted
+
+			if isRawTx {
+				atomic.AddInt32(&bs.zmqRawTxConnected, -1)
+			}
+
+			if stopped {
+				bs.wm.Log.Info("block scanner zmq has been stopped", endpoint)
+				return
+			}
+		}
+
+		//重新连接，前等待
+		bs.wm.Log.Info("Auto reconnect after", reconnectWait, "...")
+		select {
+		case <-time.After(reconnectWait):
+		case <-stop:
+			bs.wm.Log.Info("block scanner zmq has been stopped", endpoint)
+			return
+		}
+
+		reconnectWait = reconnectWait * 2
+		if reconnectWait > bs.wm.Config.PushMaxReconnectWait {
+			reconnectWait = bs.wm.Config.PushMaxReconnectWait
+		}
+	}
+}
+
+//handleZMQMessage 处理节点推送的消息，消息帧为：主题、内容、序号
+func (bs *ILCBlockScanner) handleZMQMessage(frames [][]byte, rawTxs chan<- []byte) {
+
+	if len(frames) < 2 {
+		return
+	}
+
+	switch string(frames[0]) {
+	case ZMQTopicHashBlock:
+		bs.wm.Log.Info("block scanner zmq get new block received: ", hex.EncodeToString(frames[1]))
+		//马上执行扫描任务，不需要等待下一个定时周期
+		go bs.ScanBlockTask()
+	case ZMQTopicRawTx:
+		rawTxs <- frames[1]
+	}
+}
+
+//extractZMQRawTxs 提取推送的交易，直到队列被关闭，每次取出队列中已有的交易作为一批
+func (bs *ILCBlockScanner) extractZMQRawTxs(rawTxs <-chan []byte) {
+	for raw := range rawTxs {
+		batch := [][]byte{raw}
+	drain:
+		for len(batch) < zmqRawTxBatchSize {
+			select {
+			case raw, ok := <-rawTxs:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, raw)
+			default:
+				break drain
+			}
+		}
+		bs.extractZMQRawTxBatch(batch)
+	}
+}
+
+//extractZMQRawTxBatch 提取一批节点推送的交易池交易
+func (bs *ILCBlockScanner) extractZMQRawTxBatch(batch [][]byte) {
+
+	trxs := make([]*Transaction, 0, len(batch))
+	for _, raw := range batch {
+		var msgTx wire.MsgTx
+		err := msgTx.Deserialize(bytes.NewReader(raw))
+		if err != nil {
+			bs.wm.Log.Std.Info("block scanner can not decode zmq raw transaction; unexpected error: %v", err)
+			continue
+		}
+
+		trx := bs.wm.newTxByRaw(&msgTx)
+		if trx.IsCoinBase {
+			continue
+		}
+		trxs = append(trxs, trx)
+	}
+
+	if len(trxs) == 0 {
+		return
+	}
+
+	//新区块中的交易也会推送，不在交易池的交易由区块扫描提取，每批只查询一次交易池
+	txIDsInMemPool, err := bs.wm.GetTxIDsInMemPool()
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not get mempool data; unexpected error: %v", err)
+		return
+	}
+	inMemPool := make(map[string]bool, len(txIDsInMemPool))
+	for _, txid := range txIDsInMemPool {
+		inMemPool[txid] = true
+	}
+
+	//已提取过的交易（如轮询时已提取、重连后节点重复推送）不再重复提取
+	pushed := make([]string, 0, len(trxs))
+	for _, trx := range trxs {
+		pushed = append(pushed, trx.TxID)
+	}
+	unseen := make(map[string]bool, len(trxs))
+	for _, txid := range bs.memPool.unseen(pushed) {
+		unseen[txid] = true
+	}
+
+	//扫描器已暂停或停止时不再提取
+	_, running := bs.beginTask()
+	if !running {
+		return
+	}
+	defer bs.taskWG.Done()
+
+	results := make([]ExtractResult, 0, len(trxs))
+	for _, trx := range trxs {
+		if !inMemPool[trx.TxID] || !unseen[trx.TxID] {
+			continue
+		}
+		delete(unseen, trx.TxID)
+		results = append(results, bs.ExtractTransactionDetail(trx, bs.ScanAddressFunc))
+	}
+
+	if len(results) == 0 {
+		return
+	}
+
+	err = bs.saveExtractResults(0, results)
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
+	}
+}
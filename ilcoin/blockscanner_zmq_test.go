@@ -0,0 +1,215 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func testRawTx(tx *testTx) []byte {
+	var buf bytes.Buffer
+	tx.msg.Serialize(&buf)
+	return buf.Bytes()
+}
+
+func TestILCBlockScanner_ZMQ(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	hashBlockPub := newTestZMQPublisher(t, "PUB")
+	defer hashBlockPub.Close()
+	rawTxPub := newTestZMQPublisher(t, "PUB")
+	defer rawTxPub.Close()
+
+	node.mine("a1")
+	node.mine("a2")
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.ZMQPubHashBlock = hashBlockPub.endpoint()
+	wm.Config.ZMQPubRawTx = rawTxPub.endpoint()
+	wm.Config.PushReconnectWait = 10 * time.Millisecond
+	wm.Config.PushMaxReconnectWait = 50 * time.Millisecond
+	saveTestScanned(bs, node)
+
+	bs.Restart()
+	bs.startZMQ()
+
+	waitCondition(t, "zmq subscribed", func() bool {
+		return hashBlockPub.subscribed(ZMQTopicHashBlock) == 1 && rawTxPub.subscribed(ZMQTopicRawTx) == 1 && bs.IsZMQConnected()
+	})
+
+	aliceData := func() []uint64 {
+		observer.mu.Lock()
+		defer observer.mu.Unlock()
+		heights := make([]uint64, 0)
+		for _, data := range observer.data["alice"] {
+			heights = append(heights, data.Transaction.BlockHeight)
+		}
+		return heights
+	}
+
+	//rawtx：提取交易池交易
+	tx := newTestTx("pay_alice", []testTxIn{{node.chain[1].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "1"})
+	node.addMemPool(tx)
+	rawTxPub.publish(ZMQTopicRawTx, testRawTx(tx))
+	waitCondition(t, "rawtx extracted", func() bool { return len(aliceData()) == 1 })
+
+	//区块中的交易同样会推送rawtx，由hashblock触发的区块扫描提取
+	blockTx := newTestTx("pay_alice_block", []testTxIn{{node.chain[2].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "2"})
+	block := node.mine("a3", newTestTx("coinbase_a3", nil, testTxOut{"miner_addr", "50"}), blockTx)
+	rawTxPub.publish(ZMQTopicRawTx, testRawTx(blockTx))
+
+	hash, _ := chainhash.NewHashFromStr(block.Hash)
+	body := make([]byte, chainhash.HashSize)
+	for i, b := range hash[:] {
+		body[chainhash.HashSize-1-i] = b
+	}
+	hashBlockPub.publish(ZMQTopicHashBlock, body)
+
+	headers := observer.waitHeaders(t, 1)
+	if headers[0].Height != 3 || headers[0].Hash != block.Hash {
+		t.Errorf("block header = %d %s, want 3 %s", headers[0].Height, headers[0].Hash, block.Hash)
+	}
+	waitCondition(t, "block extracted", func() bool { return len(aliceData()) >= 2 })
+	waitScanIdle(t, bs)
+	if heights := aliceData(); len(heights) != 2 || heights[0] != 0 || heights[1] != 3 {
+		t.Errorf("alice extract data heights = %v, want [0 3]", heights)
+	}
+
+	//已订阅rawtx，扫描任务不轮询提取交易池的交易
+	silent := newTestTx("pay_alice_silent", []testTxIn{{node.chain[0].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "5"})
+	node.addMemPool(silent)
+	bs.ScanBlockTask()
+	if heights := aliceData(); len(heights) != 2 {
+		t.Errorf("alice extract data heights = %v while zmq is connected", heights)
+	}
+
+	//断开后自动重连
+	rawTxPub.dropAll()
+	waitCondition(t, "zmq reconnected", func() bool {
+		return atomic.LoadInt32(&rawTxPub.connections) == 2 && rawTxPub.subscribed(ZMQTopicRawTx) == 1 && bs.IsZMQConnected()
+	})
+
+	tx2 := newTestTx("pay_alice_2", []testTxIn{{block.Txs[0].TxID, 0}}, testTxOut{"alice_addr", "3"})
+	node.addMemPool(tx2)
+	rawTxPub.publish(ZMQTopicRawTx, testRawTx(tx2))
+	waitCondition(t, "rawtx extracted after reconnect", func() bool { return len(aliceData()) == 3 })
+
+	//不再逐笔查询推送的交易是否在交易池，只查询跟踪中交易进入交易池的时间
+	if calls := node.callCount("getmempoolentry"); calls != 2 {
+		t.Errorf("getmempoolentry calls = %d, want 2", calls)
+	}
+
+	//停止后关闭连接，订阅线程退出
+	bs.Stop()
+	if bs.IsZMQConnected() {
+		t.Errorf("zmq is still connected after stop")
+	}
+	waitCondition(t, "zmq closed", func() bool {
+		return hashBlockPub.subscribed(ZMQTopicHashBlock) == 0 && rawTxPub.subscribed(ZMQTopicRawTx) == 0
+	})
+
+	//zmq断开时轮询交易池，只提取未推送过的交易
+	bs.Restart()
+	bs.ScanBlockTask()
+	if heights := aliceData(); len(heights) != 4 || heights[3] != 0 {
+		t.Errorf("alice extract data heights = %v while zmq is disconnected", heights)
+	}
+}
+
+func TestILCBlockScanner_ZMQRawTxBatch(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+	node.mine("a2")
+
+	_, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	saveTestScanned(bs, node)
+	bs.Restart()
+	defer bs.Stop()
+
+	//同一批推送的交易只查询一次交易池，不在交易池中的交易不提取
+	inMemPool := newTestTx("pay_alice", []testTxIn{{node.chain[1].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "1"})
+	inMemPool2 := newTestTx("pay_alice_2", []testTxIn{{node.chain[2].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "2"})
+	notInMemPool := newTestTx("pay_alice_3", []testTxIn{{node.chain[0].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "3"})
+	node.addMemPool(inMemPool)
+	node.addMemPool(inMemPool2)
+
+	rawTxs := make(chan []byte, 3)
+	rawTxs <- testRawTx(inMemPool)
+	rawTxs <- testRawTx(notInMemPool)
+	rawTxs <- testRawTx(inMemPool2)
+	close(rawTxs)
+
+	calls := node.callCount("getrawmempool")
+	bs.extractZMQRawTxs(rawTxs)
+	if got := node.callCount("getrawmempool") - calls; got != 1 {
+		t.Errorf("getrawmempool calls = %d, want 1", got)
+	}
+
+	//已提取过的交易再次推送时不再提取
+	rawTxs = make(chan []byte, 2)
+	rawTxs <- testRawTx(inMemPool)
+	rawTxs <- testRawTx(inMemPool)
+	close(rawTxs)
+	bs.extractZMQRawTxs(rawTxs)
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	txids := make(map[string]int)
+	for _, data := range observer.data["alice"] {
+		txids[data.Transaction.TxID]++
+	}
+	if len(txids) != 2 || txids[inMemPool.TxID] != 1 || txids[inMemPool2.TxID] != 1 {
+		t.Errorf("extracted transactions = %v", txids)
+	}
+}
+
+func TestILCBlockScanner_ZMQIdleTimeout(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	rawTxPub := newTestZMQPublisher(t, "PUB")
+	defer rawTxPub.Close()
+	atomic.StoreInt32(&rawTxPub.silent, 1)
+
+	node.mine("a1")
+
+	wm, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.ZMQPubRawTx = rawTxPub.endpoint()
+	wm.Config.ZMQIdleTimeout = 20 * time.Millisecond
+	wm.Config.PushReconnectWait = 10 * time.Millisecond
+	wm.Config.PushMaxReconnectWait = 20 * time.Millisecond
+	saveTestScanned(bs, node)
+
+	bs.Restart()
+	bs.startZMQ()
+	defer bs.Stop()
+
+	//节点没有推送也不回应心跳，连接超时后断开重连
+	waitCondition(t, "zmq reconnected after idle timeout", func() bool {
+		return atomic.LoadInt32(&rawTxPub.connections) >= 3
+	})
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blocktree/go-owcdrivers/owkeychain"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+const (
+	//ChangePolicyReuse 找零回到第一个输入的地址，原有的默认策略
+	ChangePolicyReuse = "reuse"
+	//ChangePolicyNew 在账户的找零分支派生新地址作为找零地址
+	ChangePolicyNew = "new"
+
+	//ChangePolicyExtParam 交易单扩展参数中指定找零策略的字段
+	ChangePolicyExtParam = "changePolicy"
+
+	//changeBranch HD路径中的找零分支
+	changeBranch = 1
+)
+
+//changeOutput 按找零策略获取交易单的找零输出。new策略在选币成功且需要找零输出时才派生新地址，
+//记录在rawTx.Change，由应用保存到账户，交易单构建失败时释放预留的索引
+type changeOutput struct {
+	decoder  *TransactionDecoder
+	wrapper  openwallet.WalletDAI
+	rawTx    *openwallet.RawTransaction
+	policy   string
+	template []byte
+	derived  *openwallet.Address
+}
+
+//changeOutput 按找零策略创建交易单的找零输出
+func (decoder *TransactionDecoder) changeOutput(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*changeOutput, error) {
+
+	policy := decoder.wm.Config.ChangePolicy
+	if len(rawTx.ExtParam) > 0 {
+		if p := rawTx.GetExtParam().Get(ChangePolicyExtParam).String(); len(p) > 0 {
+			policy = p
+		}
+	}
+
+	rawTx.Change = nil
+	change := &changeOutput{
+		decoder: decoder,
+		wrapper: wrapper,
+		rawTx:   rawTx,
+	}
+
+	switch policy {
+	case "", ChangePolicyReuse:
+		change.policy = ChangePolicyReuse
+	case ChangePolicyNew:
+		//派生地址的锁定脚本类型与索引无关，选币时用索引0的地址估算手续费及粉尘阈值
+		addr, err := decoder.changeAddressAt(rawTx.Account, 0)
+		if err != nil {
+			return nil, err
+		}
+		change.template, err = decoder.wm.addressScriptPubKey(addr.Address)
+		if err != nil {
+			return nil, err
+		}
+		change.policy = ChangePolicyNew
+	default:
+		return nil, fmt.Errorf("unknown change policy: %s", policy)
+	}
+
+	return change, nil
+}
+
+//Script 找零输出的锁定脚本，不派生新地址
+func (change *changeOutput) Script(inputs []*Unspent) ([]byte, error) {
+	if change.policy == ChangePolicyNew {
+		return change.template, nil
+	}
+	scripts, err := change.decoder.wm.outputScripts(inputs[0].Address)
+	if err != nil {
+		return nil, err
+	}
+	return scripts[0], nil
+}
+
+//Address 找零地址，new策略首次调用时派生新地址并预留索引
+func (change *changeOutput) Address(inputs []*Unspent) (string, error) {
+	if change.policy != ChangePolicyNew {
+		return inputs[0].Address, nil
+	}
+	if change.derived == nil {
+		addr, err := change.decoder.deriveChangeAddress(change.wrapper, change.rawTx.Account)
+		if err != nil {
+			return "", err
+		}
+		change.derived = addr
+		change.rawTx.Change = addr
+	}
+	return change.derived.Address, nil
+}
+
+//Release 交易单构建失败时释放派生地址预留的索引
+func (change *changeOutput) Release() {
+	if change.derived == nil {
+		return
+	}
+	change.decoder.wm.changeIndexes.release(change.rawTx.Account.AccountID, change.derived.Index)
+	if change.rawTx.Change == change.derived {
+		change.rawTx.Change = nil
+	}
+	change.derived = nil
+}
+
+//changeIndexReserver 记录每个账户已分配的找零地址索引。
+//派生的找零地址要等应用保存后才出现在钱包数据中，并发创建的交易单需要在进程内预留索引
+type changeIndexReserver struct {
+	mu       sync.Mutex
+	accounts map[string]*accountChangeIndex
+}
+
+//accountChangeIndex 账户下一个可分配的找零索引
+type accountChangeIndex struct {
+	mu   sync.Mutex
+	next uint64
+}
+
+func newChangeIndexReserver() *changeIndexReserver {
+	return &changeIndexReserver{
+		accounts: make(map[string]*accountChangeIndex),
+	}
+}
+
+//reserve 取已保存的下一个索引与进程内已分配索引中的较大者，并预留该索引。
+//同一账户的查询及分配在账户锁内完成
+func (r *changeIndexReserver) reserve(accountID string, saved func() (uint64, error)) (uint64, error) {
+
+	r.mu.Lock()
+	account, ok := r.accounts[accountID]
+	if !ok {
+		account = &accountChangeIndex{}
+		r.accounts[accountID] = account
+	}
+	r.mu.Unlock()
+
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	index, err := saved()
+	if err != nil {
+		return 0, err
+	}
+	if account.next > index {
+		index = account.next
+	}
+	account.next = index + 1
+
+	return index, nil
+}
+
+//release 回收构建失败的交易单预留的索引，只有它是最后分配的索引时才回收，避免与其他交易单冲突
+func (r *changeIndexReserver) release(accountID string, index uint64) {
+
+	r.mu.Lock()
+	account, ok := r.accounts[accountID]
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	account.mu.Lock()
+	defer account.mu.Unlock()
+
+	if account.next == index+1 {
+		account.next = index
+	}
+}
+
+//deriveChangeAddress 在账户的找零分支派生下一个地址，索引为已有找零地址的最大索引加1，
+//并跳过本进程已分配给其他交易单的索引
+func (decoder *TransactionDecoder) deriveChangeAddress(wrapper openwallet.WalletDAI, account *openwallet.AssetsAccount) (*openwallet.Address, error) {
+
+	index, err := decoder.wm.changeIndexes.reserve(account.AccountID, func() (uint64, error) {
+		addresses, err := wrapper.GetAddressList(0, -1, "AccountID", account.AccountID)
+		if err != nil {
+			return 0, err
+		}
+		next := uint64(0)
+		for _, a := range addresses {
+			if a.IsChange && a.Index >= next {
+				next = a.Index + 1
+			}
+		}
+		return next, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := decoder.changeAddressAt(account, index)
+	if err != nil {
+		decoder.wm.changeIndexes.release(account.AccountID, index)
+		return nil, err
+	}
+
+	return addr, nil
+}
+
+//changeAddressAt 派生账户找零分支指定索引的地址
+func (decoder *TransactionDecoder) changeAddressAt(account *openwallet.AssetsAccount, index uint64) (*openwallet.Address, error) {
+
+	if len(account.HDPath) == 0 || len(account.OwnerKeys) == 0 {
+		return nil, fmt.Errorf("account[%s] can not derive change address without hdPath and owner keys", account.AccountID)
+	}
+
+	//通过多个拥有者公钥生成地址
+	newKeys := make([][]byte, 0)
+	for _, pub := range account.OwnerKeys {
+		if len(pub) == 0 {
+			continue
+		}
+		pubkey, err := owkeychain.OWDecode(pub)
+		if err != nil {
+			return nil, err
+		}
+		branch, err := pubkey.GenPublicChild(changeBranch)
+		if err != nil {
+			return nil, err
+		}
+		newKey, err := branch.GenPublicChild(uint32(index))
+		if err != nil {
+			return nil, err
+		}
+		newKeys = append(newKeys, newKey.GetPublicKeyBytes())
+	}
+
+	if len(newKeys) == 0 {
+		return nil, fmt.Errorf("account[%s] owner keys are empty", account.AccountID)
+	}
+
+	var (
+		address, publicKey string
+		err                error
+	)
+	if len(newKeys) > 1 {
+		address, err = decoder.wm.Decoder.RedeemScriptToAddress(newKeys, account.Required, decoder.wm.Config.IsTestNet)
+	} else {
+		address, err = decoder.wm.Decoder.PublicKeyToAddress(newKeys[0], decoder.wm.Config.IsTestNet)
+		publicKey = hex.EncodeToString(newKeys[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &openwallet.Address{
+		AccountID:   account.AccountID,
+		Address:     address,
+		PublicKey:   publicKey,
+		Index:       index,
+		HDPath:      fmt.Sprintf("%s/%d/%d", account.HDPath, changeBranch, index),
+		Symbol:      strings.ToLower(decoder.wm.Symbol()),
+		Balance:     "0",
+		CreatedTime: time.Now().Unix(),
+		IsChange:    true,
+	}, nil
+}
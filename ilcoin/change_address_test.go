@@ -0,0 +1,275 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/blocktree/go-owcdrivers/owkeychain"
+	"github.com/blocktree/openwallet/openwallet"
+)
+
+//testWalletDAI 内存中的钱包数据，只支持按AccountID查询地址
+type testWalletDAI struct {
+	openwallet.WalletDAIBase
+	addresses []*openwallet.Address
+	accounts  []*openwallet.AssetsAccount
+}
+
+func (dai *testWalletDAI) GetAssetsAccountInfo(accountID string) (*openwallet.AssetsAccount, error) {
+	for _, a := range dai.accounts {
+		if a.AccountID == accountID {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("account[%s] not found", accountID)
+}
+
+func (dai *testWalletDAI) GetAddressList(offset, limit int, cols ...interface{}) ([]*openwallet.Address, error) {
+	list := make([]*openwallet.Address, 0)
+	for _, a := range dai.addresses {
+		if len(cols) >= 2 && cols[0] == "AccountID" && cols[1] != a.AccountID {
+			continue
+		}
+		list = append(list, a)
+	}
+	return list, nil
+}
+
+func (dai *testWalletDAI) GetAddress(address string) (*openwallet.Address, error) {
+	for _, a := range dai.addresses {
+		if a.Address == address {
+			return a, nil
+		}
+	}
+	return nil, nil
+}
+
+//newTestAccount 由固定种子创建的单签账户
+func newTestAccount(t *testing.T) (*openwallet.AssetsAccount, *owkeychain.ExtendedKey) {
+	seed := make([]byte, 32)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	pub, err := owkeychain.GetCoinRootPublicKey(seed, owkeychain.Bitcoin)
+	if err != nil {
+		t.Fatalf("GetCoinRootPublicKey unexpected error: %v", err)
+	}
+	return &openwallet.AssetsAccount{
+		AccountID: "test_account",
+		HDPath:    "m/44'/88'/0'",
+		OwnerKeys: []string{pub.OWEncode()},
+		Required:  1,
+	}, pub
+}
+
+func testChangeAddress(t *testing.T, wm *WalletManager, pub *owkeychain.ExtendedKey, index uint32) string {
+	branch, _ := pub.GenPublicChild(changeBranch)
+	child, _ := branch.GenPublicChild(index)
+	address, err := wm.Decoder.PublicKeyToAddress(child.GetPublicKeyBytes(), wm.Config.IsTestNet)
+	if err != nil {
+		t.Fatalf("PublicKeyToAddress unexpected error: %v", err)
+	}
+	return address
+}
+
+func TestTransactionDecoder_ChangeAddress(t *testing.T) {
+
+	wm := NewWalletManager()
+	//core模式下派生地址会导入到节点
+	wm.Config.RPCServerType = RPCServerExplorer
+	decoder := NewTransactionDecoder(wm)
+	account, pub := newTestAccount(t)
+	wrapper := &testWalletDAI{addresses: []*openwallet.Address{
+		{AccountID: account.AccountID, Address: "input_addr", Index: 0},
+	}}
+	usedUTXO := []*Unspent{{Address: "input_addr", Amount: "1"}}
+	rawTx := &openwallet.RawTransaction{Account: account}
+
+	//默认找零回到第一个输入地址
+	changeOutput, err := decoder.changeOutput(wrapper, rawTx)
+	if err != nil {
+		t.Fatalf("changeOutput unexpected error: %v", err)
+	}
+	change, err := changeOutput.Address(usedUTXO)
+	if err != nil || change != "input_addr" || rawTx.Change != nil {
+		t.Errorf("reuse change = %s, rawTx.Change = %v, err = %v", change, rawTx.Change, err)
+	}
+
+	//扩展参数指定派生新的找零地址，获取地址前不派生
+	rawTx.SetExtParam(ChangePolicyExtParam, ChangePolicyNew)
+	changeOutput, err = decoder.changeOutput(wrapper, rawTx)
+	if err != nil {
+		t.Fatalf("changeOutput unexpected error: %v", err)
+	}
+	script, err := changeOutput.Script(usedUTXO)
+	if want, _ := wm.addressScriptPubKey(testChangeAddress(t, wm, pub, 0)); err != nil || !bytes.Equal(script, want) || rawTx.Change != nil {
+		t.Errorf("new change script = %x, want %x, rawTx.Change = %v, err = %v", script, want, rawTx.Change, err)
+	}
+	change, err = changeOutput.Address(usedUTXO)
+	if err != nil {
+		t.Fatalf("Address unexpected error: %v", err)
+	}
+	if want := testChangeAddress(t, wm, pub, 0); change != want {
+		t.Errorf("new change = %s, want %s", change, want)
+	}
+	if rawTx.Change == nil || rawTx.Change.Address != change || !rawTx.Change.IsChange ||
+		rawTx.Change.Index != 0 || rawTx.Change.HDPath != "m/44'/88'/0'/1/0" || rawTx.Change.AccountID != account.AccountID {
+		t.Errorf("rawTx.Change = %+v", rawTx.Change)
+	}
+
+	//应用保存找零地址后，下一次派生使用下一个索引
+	wrapper.addresses = append(wrapper.addresses, rawTx.Change,
+		&openwallet.Address{AccountID: account.AccountID, Address: "change_3", Index: 3, IsChange: true},
+		&openwallet.Address{AccountID: "other", Address: "other_change", Index: 9, IsChange: true},
+	)
+	changeOutput, err = decoder.changeOutput(wrapper, rawTx)
+	if err != nil {
+		t.Fatalf("changeOutput unexpected error: %v", err)
+	}
+	change, _ = changeOutput.Address(usedUTXO)
+	if want := testChangeAddress(t, wm, pub, 4); change != want || rawTx.Change.HDPath != "m/44'/88'/0'/1/4" {
+		t.Errorf("next change = %s, want %s, path %s", change, want, rawTx.Change.HDPath)
+	}
+
+	//构建失败释放索引，下一次派生重新使用
+	changeOutput.Release()
+	if rawTx.Change != nil {
+		t.Errorf("rawTx.Change after release = %+v", rawTx.Change)
+	}
+	changeOutput, _ = decoder.changeOutput(wrapper, rawTx)
+	change, _ = changeOutput.Address(usedUTXO)
+	if want := testChangeAddress(t, wm, pub, 4); change != want {
+		t.Errorf("change after release = %s, want %s", change, want)
+	}
+
+	//配置的默认策略
+	wm.Config.ChangePolicy = ChangePolicyNew
+	rawTx = &openwallet.RawTransaction{Account: &openwallet.AssetsAccount{AccountID: "watch_only"}}
+	if _, err = decoder.changeOutput(wrapper, rawTx); err == nil {
+		t.Errorf("account without owner keys should fail to derive change address")
+	}
+
+	rawTx.SetExtParam(ChangePolicyExtParam, "random")
+	if _, err = decoder.changeOutput(wrapper, rawTx); err == nil {
+		t.Errorf("unknown change policy should fail")
+	}
+}
+
+func TestTransactionDecoder_ChangeAddressConcurrent(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+	node.mine("b1", newTestTx("cb1", nil, testTxOut{"a", "1"}))
+
+	wm, wrapper, account := newTestWallet(node, "a")
+	wm.Config.ChangePolicy = ChangePolicyNew
+	hdAccount, pub := newTestAccount(t)
+	account.HDPath = hdAccount.HDPath
+	account.OwnerKeys = hdAccount.OwnerKeys
+	decoder := NewTransactionDecoder(wm)
+
+	//找零地址保存前并发创建的交易单不能派生相同的索引
+	const builds = 8
+	var (
+		wg      sync.WaitGroup
+		rawTxs  = make([]*openwallet.RawTransaction, builds)
+		errs    = make([]error, builds)
+		indexes = make(map[uint64]string)
+	)
+	for i := 0; i < builds; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rawTxs[i] = newTestRawTx(account, "0.0001", map[string]string{"b": "0.1"})
+			errs[i] = decoder.CreateILCRawTransaction(wrapper, rawTxs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, rawTx := range rawTxs {
+		if errs[i] != nil {
+			t.Fatalf("build %d unexpected error: %v", i, errs[i])
+		}
+		if rawTx.Change == nil {
+			t.Fatalf("build %d without change address", i)
+		}
+		if other, ok := indexes[rawTx.Change.Index]; ok {
+			t.Errorf("build %d reuses change index %d of %s", i, rawTx.Change.Index, other)
+		}
+		indexes[rawTx.Change.Index] = rawTx.Change.Address
+	}
+	for index := uint64(0); index < builds; index++ {
+		if want := testChangeAddress(t, wm, pub, uint32(index)); indexes[index] != want {
+			t.Errorf("change index %d = %s, want %s", index, indexes[index], want)
+		}
+	}
+
+	//已保存的找零地址索引更大时从其后继续
+	wrapper.addresses = append(wrapper.addresses,
+		&openwallet.Address{AccountID: account.AccountID, Address: "change_20", Index: 20, IsChange: true})
+	rawTx := newTestRawTx(account, "0.0001", map[string]string{"b": "0.1"})
+	if err := decoder.CreateILCRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("CreateILCRawTransaction unexpected error: %v", err)
+	}
+	if rawTx.Change == nil || rawTx.Change.Index != 21 {
+		t.Errorf("change after saved index = %+v", rawTx.Change)
+	}
+}
+
+func TestTransactionDecoder_ChangeAddressFailedBuild(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+	node.mine("b1", newTestTx("cb1", nil, testTxOut{"a", "1"}))
+
+	wm, wrapper, account := newTestWallet(node, "a")
+	wm.Config.ChangePolicy = ChangePolicyNew
+	hdAccount, pub := newTestAccount(t)
+	account.HDPath = hdAccount.HDPath
+	account.OwnerKeys = hdAccount.OwnerKeys
+	decoder := NewTransactionDecoder(wm)
+
+	//余额不足的交易单不派生找零地址
+	rawTx := newTestRawTx(account, "0.0001", map[string]string{"b": "2"})
+	if err := decoder.CreateILCRawTransaction(wrapper, rawTx); err == nil {
+		t.Fatalf("CreateILCRawTransaction should fail with insufficient balance")
+	}
+	if rawTx.Change != nil {
+		t.Errorf("failed build derives change address %+v", rawTx.Change)
+	}
+
+	//找零为粉尘作为手续费时不派生找零地址
+	rawTx = newTestRawTx(account, "0.0001", map[string]string{"b": "0.999975"})
+	if err := decoder.CreateILCRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("CreateILCRawTransaction unexpected error: %v", err)
+	}
+	if rawTx.Change != nil {
+		t.Errorf("build without change output derives change address %+v", rawTx.Change)
+	}
+
+	//之前的构建没有占用索引
+	rawTx = newTestRawTx(account, "0.0001", map[string]string{"b": "0.1"})
+	if err := decoder.CreateILCRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("CreateILCRawTransaction unexpected error: %v", err)
+	}
+	if want := testChangeAddress(t, wm, pub, 0); rawTx.Change == nil || rawTx.Change.Address != want {
+		t.Errorf("change = %+v, want index 0 address %s", rawTx.Change, want)
+	}
+}
@@ -0,0 +1,360 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	//CoinSelectionSmallestFirst 按金额从小到大选取，原有的默认策略
+	CoinSelectionSmallestFirst = "smallest"
+	//CoinSelectionLargestFirst 按金额从大到小选取，输入数量最少
+	CoinSelectionLargestFirst = "largest"
+	//CoinSelectionOldestFirst 按确认数从多到少选取
+	CoinSelectionOldestFirst = "oldest"
+	//CoinSelectionBranchAndBound 分支定界查找无需找零的组合，找不到时按金额从大到小选取
+	CoinSelectionBranchAndBound = "bnb"
+	//CoinSelectionPrivacy 只使用同一个地址的utxo，不混合多个地址
+	CoinSelectionPrivacy = "privacy"
+
+	//CoinSelectionExtParam 交易单扩展参数中指定选币策略的字段
+	CoinSelectionExtParam = "coinSelection"
+
+	//bnbMaxTries 分支定界最多尝试的节点数量
+	bnbMaxTries = 100000
+)
+
+//CoinSelectionParams 选币参数
+type CoinSelectionParams struct {
+	//要发送的总数量，不含手续费
+	Target decimal.Decimal
+	//最多使用的输入数量，0则不限制
+	MaxInputs int
+	//找零的成本，包括找零输出及日后花费它的手续费，分支定界时多出的数量低于此值则直接作为手续费
+	CostOfChange decimal.Decimal
+	//按选中的输入计算手续费，change为是否包含找零输出
+	FeeFunc func(inputs []*Unspent, change bool) (decimal.Decimal, error)
+}
+
+//CoinSelection 选币结果
+type CoinSelection struct {
+	Inputs  []*Unspent
+	Balance decimal.Decimal
+	Fees    decimal.Decimal
+	Change  decimal.Decimal
+}
+
+//CoinSelector 选币策略
+type CoinSelector interface {
+	SelectCoins(unspents []*Unspent, params *CoinSelectionParams) (*CoinSelection, error)
+}
+
+//NewCoinSelector 按名称创建选币策略，名称为空使用原有的从小到大选取
+func NewCoinSelector(name string) (CoinSelector, error) {
+	switch name {
+	case "", CoinSelectionSmallestFirst:
+		return &orderedCoinSelector{less: func(a, b *Unspent) bool {
+			return unspentAmount(a).LessThan(unspentAmount(b))
+		}}, nil
+	case CoinSelectionLargestFirst:
+		return &orderedCoinSelector{less: largerUnspent}, nil
+	case CoinSelectionOldestFirst:
+		return &orderedCoinSelector{less: func(a, b *Unspent) bool {
+			if a.Confirmations != b.Confirmations {
+				return a.Confirmations > b.Confirmations
+			}
+			return largerUnspent(a, b)
+		}}, nil
+	case CoinSelectionBranchAndBound:
+		return &bnbCoinSelector{fallback: &orderedCoinSelector{less: largerUnspent}}, nil
+	case CoinSelectionPrivacy:
+		return &privacyCoinSelector{}, nil
+	default:
+		return nil, fmt.Errorf("unknown coin selection: %s", name)
+	}
+}
+
+//coinSelector 获取交易单使用的选币策略，扩展参数未指定时使用配置的默认策略
+func (decoder *TransactionDecoder) coinSelector(rawTx *openwallet.RawTransaction) (CoinSelector, error) {
+	name := decoder.wm.Config.CoinSelection
+	if len(rawTx.ExtParam) > 0 {
+		if strategy := rawTx.GetExtParam().Get(CoinSelectionExtParam).String(); len(strategy) > 0 {
+			name = strategy
+		}
+	}
+	return NewCoinSelector(name)
+}
+
+//unspentAmount utxo的数量
+func unspentAmount(u *Unspent) decimal.Decimal {
+	amount, _ := decimal.NewFromString(u.Amount)
+	return amount
+}
+
+//largerUnspent 金额大的排前面，相同金额按确认数多的排前面
+func largerUnspent(a, b *Unspent) bool {
+	aAmount, bAmount := unspentAmount(a), unspentAmount(b)
+	if !aAmount.Equal(bAmount) {
+		return aAmount.GreaterThan(bAmount)
+	}
+	return a.Confirmations > b.Confirmations
+}
+
+//spendableUnspents 过滤不可花费的utxo
+func spendableUnspents(unspents []*Unspent) []*Unspent {
+	spendable := make([]*Unspent, 0, len(unspents))
+	for _, u := range unspents {
+		if u.Spendable {
+			spendable = append(spendable, u)
+		}
+	}
+	return spendable
+}
+
+//selectCoinsInOrder 按顺序累加utxo，直到足够支付发送数量及含找零输出的手续费
+func selectCoinsInOrder(unspents []*Unspent, params *CoinSelectionParams) (*CoinSelection, error) {
+
+	var (
+		usedUTXO = make([]*Unspent, 0)
+		balance  = decimal.Zero
+	)
+
+	for _, u := range unspents {
+		if params.MaxInputs > 0 && len(usedUTXO) >= params.MaxInputs {
+			break
+		}
+
+		usedUTXO = append(usedUTXO, u)
+		balance = balance.Add(unspentAmount(u))
+		if balance.LessThan(params.Target) {
+			continue
+		}
+
+		fees, err := params.FeeFunc(usedUTXO, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if balance.GreaterThanOrEqual(params.Target.Add(fees)) {
+			return &CoinSelection{
+				Inputs:  usedUTXO,
+				Balance: balance,
+				Fees:    fees,
+				Change:  balance.Sub(params.Target).Sub(fees),
+			}, nil
+		}
+	}
+
+	if params.MaxInputs > 0 && len(usedUTXO) >= params.MaxInputs && len(usedUTXO) < len(unspents) {
+		return nil, &maxInputsError{maxInputs: params.MaxInputs}
+	}
+
+	return nil, openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAccount, "The balance: %s is not enough! ", balance.String())
+}
+
+//maxInputsError 足够支付的utxo数量超过了单笔交易单的输入上限
+type maxInputsError struct {
+	maxInputs int
+}
+
+func (e *maxInputsError) Error() string {
+	return fmt.Sprintf("The transaction is use max inputs over: %d", e.maxInputs)
+}
+
+//orderedCoinSelector 按排序规则依次选取
+type orderedCoinSelector struct {
+	less func(a, b *Unspent) bool
+}
+
+func (s *orderedCoinSelector) SelectCoins(unspents []*Unspent, params *CoinSelectionParams) (*CoinSelection, error) {
+	sorted := spendableUnspents(unspents)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return s.less(sorted[i], sorted[j])
+	})
+	return selectCoinsInOrder(sorted, params)
+}
+
+//bnbCoinSelector 分支定界查找总额刚好覆盖发送数量及手续费的组合，不产生找零
+type bnbCoinSelector struct {
+	fallback CoinSelector
+}
+
+func (s *bnbCoinSelector) SelectCoins(unspents []*Unspent, params *CoinSelectionParams) (*CoinSelection, error) {
+
+	sorted := spendableUnspents(unspents)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return largerUnspent(sorted[i], sorted[j])
+	})
+
+	amounts := make([]decimal.Decimal, len(sorted))
+	//remaining[i]为第i个及之后所有utxo的总额，用于剪枝
+	remaining := make([]decimal.Decimal, len(sorted)+1)
+	remaining[len(sorted)] = decimal.Zero
+	for i := len(sorted) - 1; i >= 0; i-- {
+		amounts[i] = unspentAmount(sorted[i])
+		remaining[i] = remaining[i+1].Add(amounts[i])
+	}
+
+	var (
+		tries    = 0
+		selected = make([]int, 0)
+		best     []int
+		bestFees decimal.Decimal
+		bestSum  decimal.Decimal
+		feeErr   error
+	)
+
+	var search func(index int, sum decimal.Decimal) bool
+	search = func(index int, sum decimal.Decimal) bool {
+		tries++
+		if tries > bnbMaxTries || feeErr != nil {
+			return true
+		}
+
+		if len(selected) > 0 && sum.GreaterThanOrEqual(params.Target) {
+			inputs := make([]*Unspent, 0, len(selected))
+			for _, i := range selected {
+				inputs = append(inputs, sorted[i])
+			}
+			fees, err := params.FeeFunc(inputs, false)
+			if err != nil {
+				feeErr = err
+				return true
+			}
+			need := params.Target.Add(fees)
+			if sum.GreaterThan(need.Add(params.CostOfChange)) {
+				//已超出不找零的范围，继续加入只会更多
+				return false
+			}
+			if sum.GreaterThanOrEqual(need) {
+				waste := sum.Sub(need)
+				if best == nil || waste.LessThan(bestSum.Sub(params.Target).Sub(bestFees)) {
+					best = append([]int(nil), selected...)
+					bestFees = fees
+					bestSum = sum
+				}
+				//完全匹配，停止查找
+				return waste.IsZero()
+			}
+		}
+
+		if index >= len(sorted) || (params.MaxInputs > 0 && len(selected) >= params.MaxInputs) {
+			return false
+		}
+
+		//剩余的utxo全部加入也不足以支付发送数量
+		if sum.Add(remaining[index]).LessThan(params.Target) {
+			return false
+		}
+
+		//包含当前utxo
+		selected = append(selected, index)
+		if search(index+1, sum.Add(amounts[index])) {
+			return true
+		}
+		selected = selected[:len(selected)-1]
+
+		//不包含当前utxo，相同金额的utxo结果相同，跳过
+		next := index + 1
+		for next < len(sorted) && amounts[next].Equal(amounts[index]) {
+			next++
+		}
+		return search(next, sum)
+	}
+
+	search(0, decimal.Zero)
+
+	if feeErr != nil {
+		return nil, feeErr
+	}
+
+	if best == nil {
+		return s.fallback.SelectCoins(sorted, params)
+	}
+
+	usedUTXO := make([]*Unspent, 0, len(best))
+	for _, i := range best {
+		usedUTXO = append(usedUTXO, sorted[i])
+	}
+
+	//多出的数量低于找零成本，全部作为手续费
+	return &CoinSelection{
+		Inputs:  usedUTXO,
+		Balance: bestSum,
+		Fees:    bestSum.Sub(params.Target),
+		Change:  decimal.Zero,
+	}, nil
+}
+
+//privacyCoinSelector 只从一个地址选取，找零也回到该地址，避免关联账户的多个地址
+type privacyCoinSelector struct{}
+
+func (s *privacyCoinSelector) SelectCoins(unspents []*Unspent, params *CoinSelectionParams) (*CoinSelection, error) {
+
+	var (
+		groups       = make(map[string][]*Unspent)
+		addrs        = make([]string, 0)
+		best         *CoinSelection
+		maxInputsErr error
+	)
+
+	for _, u := range spendableUnspents(unspents) {
+		if _, ok := groups[u.Address]; !ok {
+			addrs = append(addrs, u.Address)
+		}
+		groups[u.Address] = append(groups[u.Address], u)
+	}
+	sort.Strings(addrs)
+
+	for _, addr := range addrs {
+		group := groups[addr]
+		sort.SliceStable(group, func(i, j int) bool {
+			return largerUnspent(group[i], group[j])
+		})
+		selection, err := selectCoinsInOrder(group, params)
+		if err != nil {
+			//只跳过余额不足或超过输入上限的地址，其他错误（如计算手续费失败）直接返回
+			if _, ok := err.(*maxInputsError); ok {
+				maxInputsErr = err
+				continue
+			}
+			if owErr, ok := err.(*openwallet.Error); ok && owErr.Code() == openwallet.ErrInsufficientBalanceOfAccount {
+				continue
+			}
+			return nil, err
+		}
+		//输入最少的优先，其次找零最少
+		if best == nil || len(selection.Inputs) < len(best.Inputs) ||
+			(len(selection.Inputs) == len(best.Inputs) && selection.Change.LessThan(best.Change)) {
+			best = selection
+		}
+	}
+
+	if best == nil {
+		//有地址的余额足够，只是超过了输入上限，由调用方决定是否合并utxo
+		if maxInputsErr != nil {
+			return nil, maxInputsErr
+		}
+		return nil, openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAccount, "no single address has enough balance")
+	}
+
+	return best, nil
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+)
+
+func testCoinSelectionUnspents() []*Unspent {
+	return []*Unspent{
+		{TxID: "A", Address: "a1", Amount: "0.1", Confirmations: 10, Spendable: true},
+		{TxID: "B", Address: "a1", Amount: "0.5", Confirmations: 2, Spendable: true},
+		{TxID: "C", Address: "a2", Amount: "1.0", Confirmations: 5, Spendable: true},
+		{TxID: "D", Address: "a2", Amount: "0.3", Confirmations: 100, Spendable: true},
+		{TxID: "E", Address: "a3", Amount: "5", Confirmations: 100, Spendable: false},
+	}
+}
+
+//testCoinSelectionParams 每个输入0.0001，每个输出0.00005的手续费
+func testCoinSelectionParams(target string, outputs int64) *CoinSelectionParams {
+	amount, _ := decimal.NewFromString(target)
+	return &CoinSelectionParams{
+		Target:       amount,
+		CostOfChange: decimal.RequireFromString("0.00015"),
+		FeeFunc: func(inputs []*Unspent, change bool) (decimal.Decimal, error) {
+			n := outputs
+			if change {
+				n++
+			}
+			return decimal.New(int64(len(inputs))*10000+n*5000, -8), nil
+		},
+	}
+}
+
+func checkTestSelection(t *testing.T, name string, selection *CoinSelection, err error, txids string, fees, change string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", name, err)
+	}
+	used := make([]string, 0)
+	for _, u := range selection.Inputs {
+		used = append(used, u.TxID)
+	}
+	if strings.Join(used, ",") != txids {
+		t.Errorf("%s: inputs = %v, want %s", name, used, txids)
+	}
+	if !selection.Fees.Equal(decimal.RequireFromString(fees)) {
+		t.Errorf("%s: fees = %s, want %s", name, selection.Fees, fees)
+	}
+	if !selection.Change.Equal(decimal.RequireFromString(change)) {
+		t.Errorf("%s: change = %s, want %s", name, selection.Change, change)
+	}
+}
+
+func TestCoinSelector_Strategies(t *testing.T) {
+
+	cases := []struct {
+		strategy string
+		target   string
+		outputs  int64
+		txids    string
+		fees     string
+		change   string
+	}{
+		//原有策略，从小到大
+		{CoinSelectionSmallestFirst, "0.35", 1, "A,D", "0.0003", "0.0497"},
+		{"", "0.35", 1, "A,D", "0.0003", "0.0497"},
+		{CoinSelectionLargestFirst, "0.35", 1, "C", "0.0002", "0.6498"},
+		{CoinSelectionOldestFirst, "0.35", 1, "D,A", "0.0003", "0.0497"},
+		//单个utxo刚好支付，不找零
+		{CoinSelectionBranchAndBound, "0.49985", 1, "B", "0.00015", "0"},
+		//两个utxo的组合刚好支付
+		{CoinSelectionBranchAndBound, "0.39975", 1, "D,A", "0.00025", "0"},
+		//多出的数量低于找零成本，作为手续费
+		{CoinSelectionBranchAndBound, "0.3997", 1, "D,A", "0.0003", "0"},
+		//没有无需找零的组合，按从大到小选取
+		{CoinSelectionBranchAndBound, "0.7", 1, "C", "0.0002", "0.2998"},
+		//只使用a2地址的utxo
+		{CoinSelectionPrivacy, "1.2", 1, "C,D", "0.0003", "0.0997"},
+		{CoinSelectionPrivacy, "0.35", 1, "B", "0.0002", "0.1498"},
+	}
+
+	for _, c := range cases {
+		selector, err := NewCoinSelector(c.strategy)
+		if err != nil {
+			t.Fatalf("NewCoinSelector(%s) unexpected error: %v", c.strategy, err)
+		}
+		selection, err := selector.SelectCoins(testCoinSelectionUnspents(), testCoinSelectionParams(c.target, c.outputs))
+		checkTestSelection(t, c.strategy+" "+c.target, selection, err, c.txids, c.fees, c.change)
+	}
+}
+
+func TestCoinSelector_Errors(t *testing.T) {
+
+	insufficient := func(name string, err error) {
+		owErr, ok := err.(*openwallet.Error)
+		if !ok || owErr.Code() != openwallet.ErrInsufficientBalanceOfAccount {
+			t.Errorf("%s: error = %v, want insufficient balance", name, err)
+		}
+	}
+
+	//不可花费的utxo不计入余额
+	selector, _ := NewCoinSelector(CoinSelectionSmallestFirst)
+	_, err := selector.SelectCoins(testCoinSelectionUnspents(), testCoinSelectionParams("1.9", 1))
+	insufficient("smallest", err)
+
+	//没有一个地址的余额足够支付
+	selector, _ = NewCoinSelector(CoinSelectionPrivacy)
+	_, err = selector.SelectCoins(testCoinSelectionUnspents(), testCoinSelectionParams("1.5", 1))
+	insufficient("privacy", err)
+
+	//超过最大输入数量
+	selector, _ = NewCoinSelector(CoinSelectionSmallestFirst)
+	params := testCoinSelectionParams("0.35", 1)
+	params.MaxInputs = 1
+	_, err = selector.SelectCoins(testCoinSelectionUnspents(), params)
+	if err == nil || !strings.Contains(err.Error(), "max inputs over") {
+		t.Errorf("max inputs: error = %v", err)
+	}
+
+	//每个地址的余额都只是超过了输入上限
+	selector, _ = NewCoinSelector(CoinSelectionPrivacy)
+	params = testCoinSelectionParams("1.2", 1)
+	params.MaxInputs = 1
+	_, err = selector.SelectCoins(testCoinSelectionUnspents(), params)
+	if _, ok := err.(*maxInputsError); !ok {
+		t.Errorf("privacy max inputs: error = %v", err)
+	}
+
+	//计算手续费失败不能当作余额不足
+	params = testCoinSelectionParams("0.2", 1)
+	params.FeeFunc = func(inputs []*Unspent, change bool) (decimal.Decimal, error) {
+		return decimal.Zero, fmt.Errorf("fee rate unavailable")
+	}
+	_, err = selector.SelectCoins(testCoinSelectionUnspents(), params)
+	if err == nil || err.Error() != "fee rate unavailable" {
+		t.Errorf("privacy fee error = %v", err)
+	}
+
+	if _, err = NewCoinSelector("random"); err == nil {
+		t.Errorf("unknown coin selection should fail")
+	}
+}
+
+func TestTransactionDecoder_CoinSelector(t *testing.T) {
+
+	wm := NewWalletManager()
+	wm.Config.CoinSelection = CoinSelectionLargestFirst
+	decoder := NewTransactionDecoder(wm)
+	params := testCoinSelectionParams("0.35", 1)
+
+	//未指定时使用配置的默认策略
+	rawTx := &openwallet.RawTransaction{}
+	selector, err := decoder.coinSelector(rawTx)
+	if err != nil {
+		t.Fatalf("coinSelector unexpected error: %v", err)
+	}
+	selection, err := selector.SelectCoins(testCoinSelectionUnspents(), params)
+	checkTestSelection(t, "config", selection, err, "C", "0.0002", "0.6498")
+
+	//扩展参数指定的策略优先
+	rawTx.SetExtParam(CoinSelectionExtParam, CoinSelectionOldestFirst)
+	selector, err = decoder.coinSelector(rawTx)
+	if err != nil {
+		t.Fatalf("coinSelector unexpected error: %v", err)
+	}
+	selection, err = selector.SelectCoins(testCoinSelectionUnspents(), params)
+	checkTestSelection(t, "extParam", selection, err, "D,A", "0.0003", "0.0497")
+
+	rawTx.SetExtParam(CoinSelectionExtParam, "random")
+	if _, err = decoder.coinSelector(rawTx); err == nil {
+		t.Errorf("unknown coin selection should fail")
+	}
+}
@@ -128,6 +128,66 @@ type WalletConfig struct {
 	MinFees decimal.Decimal
 	//数据目录
 	DataDir string
+	//扫描区块时并发预读取的区块数量
+	PrefetchBlockCount uint64
+	//core模式下获取原始区块数据，在本地解析交易单
+	DecodeRawBlock bool
+	//交易单输出缓存的最大数量，0则不缓存
+	TxOutCacheSize int
+	//浏览器模式下是否开启socketIO实时监听新区块及交易
+	EnableSocketIO bool
+	//core模式下节点zmqpubhashblock的推送地址，如：tcp://127.0.0.1:28332，为空则不订阅
+	ZMQPubHashBlock string
+	//core模式下节点zmqpubrawtx的推送地址，为空则不订阅
+	ZMQPubRawTx string
+	//zmq连接超过此时间没有收到推送则发送心跳，再等待相同时间仍没有回应则断开重连，0则不检查
+	ZMQIdleTimeout time.Duration
+	//推送连接（socketIO、zmq）断开后首次重连的等待时间，每次失败翻倍
+	PushReconnectWait time.Duration
+	//推送连接重连的最长等待时间
+	PushMaxReconnectWait time.Duration
+	//交易池交易的有效期，跟踪中的交易超过有效期离开交易池时通知为expired
+	MemPoolExpiry time.Duration
+	//最终确认深度，到账交易达到此确认数后通知finalized并停止跟踪
+	FinalityDepth uint64
+	//未扫记录首次重试的等待时间，每次失败翻倍
+	UnscanRetryWait time.Duration
+	//未扫记录的最大失败次数，达到后转入死信不再自动重试，0则一直重试
+	UnscanMaxAttempts int
+	//区块在同一高度连续获取失败的最大次数，达到后记录未扫区块并跳过，0则一直停在该高度重试
+	BlockMaxFailures int
+	//并发提取交易单的数量，自适应模式下为初始数量
+	ExtractWorkers int
+	//是否按延迟及错误率自动调整并发提取的数量
+	AdaptiveExtract bool
+	//自适应模式下并发提取的最大数量
+	MaxExtractWorkers int
+	//本地区块链数据库保留的区块头数量，超出的旧区块头被清理，0则不清理
+	MaxBlockCache uint64
+	//是否由扫描结果维护关注地址的本地未花索引，开启后查询未花及余额不再请求节点
+	UTXOIndex bool
+	//本地未花索引数据文件
+	UTXOIndexFile string
+	//core模式下是否由扫描结果维护关注地址的交易索引，用于查询地址的交易记录
+	AddressTxIndex bool
+	//本地地址交易索引数据文件
+	AddressTxIndexFile string
+	//是否把区块及提取结果的通知记录到本地事件日志，供有名称的订阅者断线后重放
+	EventLog bool
+	//本地事件日志数据文件
+	EventLogFile string
+	//所有订阅者都已送达的事件保留的数量，更早的事件被删除，0则全部保留
+	EventLogRetention uint64
+	//扫描器状态数据文件，保存撤销失败的分叉区块等需要在重启后恢复的状态
+	ScanStateFile string
+	//默认的选币策略，交易单可通过扩展参数coinSelection指定
+	CoinSelection string
+	//默认的找零策略，交易单可通过扩展参数changePolicy指定
+	ChangePolicy string
+	//计算粉尘阈值的每KB费率，与core的dustrelayfee一致
+	DustRelayFee decimal.Decimal
+	//需要的utxo超过MaxTxInputs时，是否自动创建合并utxo的交易单链，交易单可通过扩展参数autoConsolidate指定
+	AutoConsolidate bool
 }
 
 func NewConfig(symbol string, curveType uint32, decimals int32) *WalletConfig {
@@ -192,6 +252,51 @@ func NewConfig(symbol string, curveType uint32, decimals int32) *WalletConfig {
 	c.Decimals = decimals
 	//最低手续费
 	c.MinFees = decimal.Zero
+	//扫描区块时并发预读取的区块数量
+	c.PrefetchBlockCount = 10
+	//交易单输出缓存的最大数量
+	c.TxOutCacheSize = 100000
+	//浏览器模式下开启socketIO监听
+	c.EnableSocketIO = true
+	//zmq连接空闲检查
+	c.ZMQIdleTimeout = time.Minute
+	//推送连接重连等待时间
+	c.PushReconnectWait = time.Second
+	c.PushMaxReconnectWait = time.Minute
+	//交易池交易的有效期，与节点的mempoolexpiry默认值一致
+	c.MemPoolExpiry = 336 * time.Hour
+	//最终确认深度
+	c.FinalityDepth = 6
+	//未扫记录的重试
+	c.UnscanRetryWait = time.Minute
+	c.UnscanMaxAttempts = 10
+	c.BlockMaxFailures = 3
+	//并发提取交易单的数量
+	c.ExtractWorkers = 6
+	c.AdaptiveExtract = false
+	c.MaxExtractWorkers = 64
+	//本地区块链数据库保留的区块头数量
+	c.MaxBlockCache = 1000
+	//本地未花索引
+	c.UTXOIndex = false
+	c.UTXOIndexFile = "utxo.db"
+	//本地地址交易索引
+	c.AddressTxIndex = false
+	c.AddressTxIndexFile = "addresstx.db"
+	//本地事件日志
+	c.EventLog = false
+	c.EventLogFile = "events.db"
+	c.EventLogRetention = 100000
+	//扫描器状态
+	c.ScanStateFile = "scanstate.db"
+	//默认选币策略
+	c.CoinSelection = CoinSelectionSmallestFirst
+	//默认找零策略
+	c.ChangePolicy = ChangePolicyReuse
+	//粉尘费率
+	c.DustRelayFee = decimal.New(3, -5)
+	//自动合并utxo
+	c.AutoConsolidate = false
 	c.MainNetAddressPrefix = MainNetAddressPrefix
 	c.TestNetAddressPrefix = TestNetAddressPrefix
 
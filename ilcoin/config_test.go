@@ -51,4 +51,21 @@ func TestWalletManager_LoadAssetsConfig(t *testing.T) {
 		return
 	}
 	t.Logf("ServerAPI: %s", tw.Config.ServerAPI)
-}
\ No newline at end of file
+}
+func TestWalletManager_LoadAssetsConfigValidation(t *testing.T) {
+
+	cases := map[string]string{
+		"coinSelection": "coinSelection = random",
+		"changePolicy":  "changePolicy = always",
+	}
+
+	for name, ini := range cases {
+		c, err := config.NewConfigData("ini", []byte(ini))
+		if err != nil {
+			t.Fatalf("%s: NewConfigData unexpected error: %v", name, err)
+		}
+		if err := NewWalletManager().LoadAssetsConfig(c); err == nil {
+			t.Errorf("%s: invalid value should fail", name)
+		}
+	}
+}
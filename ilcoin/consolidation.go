@@ -0,0 +1,459 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	//ConsolidateExtParam 交易单扩展参数中指定是否自动合并utxo的字段
+	ConsolidateExtParam = "autoConsolidate"
+
+	//ChainRoleConsolidation 交易单链中合并utxo的交易单
+	ChainRoleConsolidation = "consolidation"
+	//ChainRolePayment 交易单链中最后的转账交易单
+	ChainRolePayment = "payment"
+
+	//交易单链写入扩展参数的字段
+	chainRoleExtParam      = "chainRole"
+	chainIndexExtParam     = "chainIndex"
+	chainDependsOnExtParam = "dependsOn"
+
+	//合并交易单的手续费使总额不足时，追加发送数量重新选币的次数
+	consolidateMaxTries = 10
+)
+
+//RawTransactionChain 按顺序排列的交易单链，依赖的交易单在前
+type RawTransactionChain struct {
+	//Transactions 交易单，合并utxo的交易单在前，转账交易单在最后
+	Transactions []*openwallet.RawTransaction
+	//DependsOn 每个交易单需要先签名的交易单序号
+	DependsOn [][]int
+	//Inputs 转账交易单除合并输出外直接花费的utxo
+	Inputs []*Unspent
+}
+
+//Payment 交易单链中的转账交易单
+func (chain *RawTransactionChain) Payment() *openwallet.RawTransaction {
+	return chain.Transactions[len(chain.Transactions)-1]
+}
+
+//IsBuilt 转账交易单是否已构建，存在依赖时需要依赖的交易单签名后调用CompleteRawTransactionChain
+func (chain *RawTransactionChain) IsBuilt() bool {
+	return chain.Payment().IsBuilt
+}
+
+//autoConsolidate 交易单是否自动合并utxo，扩展参数未指定时使用配置
+func (decoder *TransactionDecoder) autoConsolidate(rawTx *openwallet.RawTransaction) bool {
+	if len(rawTx.ExtParam) > 0 {
+		if v := rawTx.GetExtParam().Get(ConsolidateExtParam); v.Exists() {
+			return v.Bool()
+		}
+	}
+	return decoder.wm.Config.AutoConsolidate
+}
+
+//CreateRawTransactionChain 创建交易单，需要的utxo超过MaxTxInputs且开启自动合并时，
+//返回合并utxo的交易单及依赖它们的转账交易单，否则交易单链只有一个交易单。
+//超过输入上限在派生找零地址前返回，合并时使用同一次查询的utxo
+func (decoder *TransactionDecoder) CreateRawTransactionChain(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*RawTransactionChain, error) {
+
+	var (
+		err      error
+		unspents []*Unspent
+	)
+	if rawTx.Coin.IsContract {
+		err = decoder.CreateOmniRawTransaction(wrapper, rawTx)
+	} else {
+		unspents, err = decoder.listAccountUnspents(wrapper, rawTx.Account)
+		if err != nil {
+			return nil, err
+		}
+		err = decoder.createILCRawTransactionFromUnspents(wrapper, rawTx, unspents)
+	}
+
+	if err == nil {
+		return &RawTransactionChain{
+			Transactions: []*openwallet.RawTransaction{rawTx},
+			DependsOn:    [][]int{{}},
+		}, nil
+	}
+
+	if _, ok := err.(*maxInputsError); !ok || rawTx.Coin.IsContract || !decoder.autoConsolidate(rawTx) {
+		return nil, err
+	}
+
+	decoder.wm.Log.Std.Info("%s, build consolidation transactions", err.Error())
+
+	return decoder.createConsolidationChain(wrapper, rawTx, unspents)
+}
+
+//createConsolidationChain 把选中的utxo按MaxTxInputs分组合并到找零地址，转账交易单使用合并后的utxo。
+//金额不超过自身输入手续费的utxo不参与选币，合并输出为粉尘的分组不使用，
+//只有一个输入的最后一组及粉尘的最后一组在输入数量允许时由转账交易单直接花费
+func (decoder *TransactionDecoder) createConsolidationChain(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction, unspents []*Unspent) (*RawTransactionChain, error) {
+
+	var (
+		totalSend    = decimal.Zero
+		feesRate     = decimal.Zero
+		destinations = make([]string, 0)
+		maxInputs    = decoder.wm.Config.MaxTxInputs
+		extra        = decimal.Zero
+		excluded     = make(map[string]bool)
+	)
+
+	for addr, amount := range rawTx.To {
+		deamount, _ := decimal.NewFromString(amount)
+		totalSend = totalSend.Add(deamount)
+		destinations = append(destinations, addr)
+	}
+
+	if len(rawTx.FeeRate) == 0 {
+		rate, err := decoder.wm.EstimateFeeRate()
+		if err != nil {
+			return nil, err
+		}
+		feesRate = rate
+	} else {
+		feesRate, _ = decimal.NewFromString(rawTx.FeeRate)
+	}
+
+	//合并只会减少余额的utxo不参与选币
+	candidates := make([]*Unspent, 0, len(unspents))
+	for _, u := range unspents {
+		inputFee, err := decoder.wm.unspentInputFee(u, rawTx.Account, feesRate)
+		if err != nil {
+			return nil, err
+		}
+		if unspentAmount(u).GreaterThan(inputFee) {
+			candidates = append(candidates, u)
+		}
+	}
+	if skipped := len(unspents) - len(candidates); skipped > 0 {
+		decoder.wm.Log.Std.Info("skip %d utxo whose amount is not above its input fee", skipped)
+	}
+
+	selector, err := decoder.coinSelector(rawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	//合并输出及转账的找零都使用同一个地址，new策略派生的地址记录在第一个合并交易单
+	changeOutput, err := decoder.changeOutput(wrapper, rawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	outputScripts, err := decoder.wm.outputScripts(destinations...)
+	if err != nil {
+		return nil, err
+	}
+
+	costOfChange, err := decoder.wm.EstimateFee(1, 1, feesRate)
+	if err != nil {
+		return nil, err
+	}
+
+	for try := 0; try < consolidateMaxTries; try++ {
+
+		available := make([]*Unspent, 0, len(candidates))
+		for _, u := range candidates {
+			if !excluded[outPointKey(u)] {
+				available = append(available, u)
+			}
+		}
+
+		//不限制输入数量选币，再按MaxTxInputs分组
+		selection, err := selector.SelectCoins(available, &CoinSelectionParams{
+			Target:       totalSend.Add(extra),
+			CostOfChange: costOfChange,
+			FeeFunc: func(inputs []*Unspent, change bool) (decimal.Decimal, error) {
+				return decoder.wm.EstimateTxFee(rawTx.Account, inputs, outputScripts, feesRate)
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		groups := make([][]*Unspent, 0)
+		for s := 0; s < len(selection.Inputs); s += maxInputs {
+			e := s + maxInputs
+			if e > len(selection.Inputs) {
+				e = len(selection.Inputs)
+			}
+			groups = append(groups, selection.Inputs[s:e])
+		}
+
+		//只有一个输入的最后一组不需要合并
+		direct := make([]*Unspent, 0)
+		if last := groups[len(groups)-1]; len(groups) > 1 && len(last) == 1 {
+			direct = last
+			groups = groups[:len(groups)-1]
+		}
+
+		consolidateScript, err := changeOutput.Script(selection.Inputs)
+		if err != nil {
+			return nil, err
+		}
+		consolidateScripts := [][]byte{consolidateScript}
+		dustThreshold := decoder.wm.DustThreshold(consolidateScripts[0])
+
+		//合并后的utxo，交易单签名前txid未知
+		var (
+			consolidated     = make([]*Unspent, 0, len(groups))
+			consolidatedFees = make([]decimal.Decimal, 0, len(groups))
+			consolidateGroup = make([][]*Unspent, 0, len(groups))
+			balance          = decimal.Zero
+			dustGroup        []*Unspent
+		)
+		for i, group := range groups {
+			fees, err := decoder.wm.EstimateTxFee(rawTx.Account, group, consolidateScripts, feesRate)
+			if err != nil {
+				return nil, err
+			}
+			amount := decimal.Zero
+			for _, u := range group {
+				amount = amount.Add(unspentAmount(u))
+			}
+			amount = amount.Sub(fees)
+
+			//合并输出为粉尘
+			if amount.LessThanOrEqual(dustThreshold) {
+				if i == len(groups)-1 && len(consolidated) > 0 && len(consolidated)+len(direct)+len(group) <= maxInputs {
+					direct = append(direct, group...)
+					continue
+				}
+				dustGroup = group
+				break
+			}
+
+			consolidated = append(consolidated, &Unspent{
+				Amount:       amount.StringFixed(decoder.wm.Decimal()),
+				ScriptPubKey: hex.EncodeToString(consolidateScripts[0]),
+				Spendable:    true,
+			})
+			consolidatedFees = append(consolidatedFees, fees)
+			consolidateGroup = append(consolidateGroup, group)
+			balance = balance.Add(amount)
+		}
+
+		//不使用这组utxo重新选币
+		if dustGroup != nil {
+			decoder.wm.Log.Std.Info("consolidation of %d utxo is not above the dust threshold: %s, exclude them", len(dustGroup), dustThreshold.StringFixed(decoder.wm.Decimal()))
+			for _, u := range dustGroup {
+				excluded[outPointKey(u)] = true
+			}
+			continue
+		}
+
+		if len(consolidated)+len(direct) > maxInputs {
+			return nil, fmt.Errorf("The transaction needs %d utxo, more than can be consolidated into %d inputs", len(selection.Inputs), maxInputs)
+		}
+
+		for _, u := range direct {
+			balance = balance.Add(unspentAmount(u))
+		}
+
+		payInputs := append(consolidated[:len(consolidated):len(consolidated)], direct...)
+		payFees, err := decoder.wm.EstimateTxFee(rawTx.Account, payInputs, append(outputScripts[:len(outputScripts):len(outputScripts)], consolidateScripts...), feesRate)
+		if err != nil {
+			return nil, err
+		}
+
+		//合并的手续费使余额不足，追加差额重新选币
+		change := balance.Sub(totalSend).Sub(payFees)
+		if change.LessThan(decimal.Zero) {
+			extra = extra.Add(change.Neg())
+			continue
+		}
+
+		change, payFees, err = decoder.foldDustChangeScript(consolidateScript, change, payFees)
+		if err != nil {
+			return nil, err
+		}
+
+		//分组确定后才获取合并地址，new策略在这里派生
+		consolidateAddress, err := changeOutput.Address(selection.Inputs)
+		if err != nil {
+			return nil, err
+		}
+		changeAddr := rawTx.Change
+		rawTx.Change = nil
+
+		chain := &RawTransactionChain{
+			Transactions: make([]*openwallet.RawTransaction, 0, len(consolidateGroup)+1),
+			DependsOn:    make([][]int, 0, len(consolidateGroup)+1),
+			Inputs:       direct,
+		}
+		dependsOn := make([]int, 0, len(consolidateGroup))
+
+		for i, group := range consolidateGroup {
+			consolidateTx := &openwallet.RawTransaction{
+				Coin:     rawTx.Coin,
+				Account:  rawTx.Account,
+				To:       map[string]string{consolidateAddress: consolidated[i].Amount},
+				FeeRate:  feesRate.StringFixed(decoder.wm.Decimal()),
+				Fees:     consolidatedFees[i].StringFixed(decoder.wm.Decimal()),
+				Required: rawTx.Required,
+			}
+			if i == 0 {
+				consolidateTx.Change = changeAddr
+			}
+			consolidateTx.SetExtParam(chainRoleExtParam, ChainRoleConsolidation)
+			consolidateTx.SetExtParam(chainIndexExtParam, i)
+
+			amount, _ := decimal.NewFromString(consolidated[i].Amount)
+			err = decoder.createILCRawTransaction(wrapper, consolidateTx, group, map[string]decimal.Decimal{consolidateAddress: amount})
+			if err != nil {
+				changeOutput.Release()
+				return nil, err
+			}
+
+			chain.Transactions = append(chain.Transactions, consolidateTx)
+			chain.DependsOn = append(chain.DependsOn, []int{})
+			dependsOn = append(dependsOn, i)
+		}
+
+		rawTx.FeeRate = feesRate.StringFixed(decoder.wm.Decimal())
+		rawTx.Fees = payFees.StringFixed(decoder.wm.Decimal())
+		rawTx.IsBuilt = false
+		rawTx.SetExtParam(chainRoleExtParam, ChainRolePayment)
+		rawTx.SetExtParam(chainIndexExtParam, len(consolidateGroup))
+		rawTx.SetExtParam(chainDependsOnExtParam, dependsOn)
+
+		chain.Transactions = append(chain.Transactions, rawTx)
+		chain.DependsOn = append(chain.DependsOn, dependsOn)
+
+		decoder.wm.Log.Std.Notice("-----------------------------------------------")
+		decoder.wm.Log.Std.Notice("From Account: %s", rawTx.Account.AccountID)
+		decoder.wm.Log.Std.Notice("Consolidate: %d utxo into %d transactions", len(selection.Inputs)-len(direct), len(consolidateGroup))
+		decoder.wm.Log.Std.Notice("Direct Inputs: %d", len(direct))
+		decoder.wm.Log.Std.Notice("Consolidate Address: %s", consolidateAddress)
+		decoder.wm.Log.Std.Notice("Payment Fees: %v", rawTx.Fees)
+		decoder.wm.Log.Std.Notice("Change: %v", change.StringFixed(decoder.wm.Decimal()))
+		decoder.wm.Log.Std.Notice("-----------------------------------------------")
+
+		return chain, nil
+	}
+
+	return nil, openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAccount, "The balance is not enough to pay the consolidation fees! ")
+}
+
+//outPointKey utxo的前序输出
+func outPointKey(u *Unspent) string {
+	return fmt.Sprintf("%s:%d", u.TxID, u.Vout)
+}
+
+//chainTxID 交易单的txid，已广播的使用广播返回的txid，已验证签名的由签名后的交易单计算
+func chainTxID(rawTx *openwallet.RawTransaction) (string, error) {
+
+	if len(rawTx.TxID) > 0 {
+		return rawTx.TxID, nil
+	}
+
+	if !rawTx.IsCompleted {
+		return "", fmt.Errorf("transaction is not completed validation")
+	}
+
+	txBytes, err := hex.DecodeString(rawTx.RawHex)
+	if err != nil {
+		return "", err
+	}
+
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	if err := msgTx.Deserialize(bytes.NewReader(txBytes)); err != nil {
+		return "", err
+	}
+
+	return msgTx.TxHash().String(), nil
+}
+
+//CompleteRawTransactionChain 依赖的合并交易单签名验证或广播后，构建花费合并输出的转账交易单
+func (decoder *TransactionDecoder) CompleteRawTransactionChain(wrapper openwallet.WalletDAI, chain *RawTransactionChain) error {
+
+	if len(chain.Transactions) == 0 {
+		return fmt.Errorf("transaction chain is empty")
+	}
+
+	payment := chain.Payment()
+	if payment.IsBuilt {
+		return nil
+	}
+
+	var (
+		usedUTXO      = make([]*Unspent, 0)
+		outputAddrs   = make(map[string]decimal.Decimal)
+		balance       = decimal.Zero
+		totalSend     = decimal.Zero
+		changeAddress string
+	)
+
+	//合并交易单只有一个输出
+	for _, i := range chain.DependsOn[len(chain.Transactions)-1] {
+		dep := chain.Transactions[i]
+		txid, err := chainTxID(dep)
+		if err != nil {
+			return fmt.Errorf("consolidation transaction[%d] is not ready: %v", i, err)
+		}
+		for addr, amount := range dep.To {
+			script, err := decoder.wm.addressScriptPubKey(addr)
+			if err != nil {
+				return err
+			}
+			usedUTXO = append(usedUTXO, &Unspent{
+				TxID:         txid,
+				Vout:         0,
+				Address:      addr,
+				Amount:       amount,
+				ScriptPubKey: hex.EncodeToString(script),
+				Spendable:    true,
+			})
+			changeAddress = addr
+			deamount, _ := decimal.NewFromString(amount)
+			balance = balance.Add(deamount)
+		}
+	}
+
+	//不需要合并的utxo
+	for _, u := range chain.Inputs {
+		usedUTXO = append(usedUTXO, u)
+		balance = balance.Add(unspentAmount(u))
+	}
+
+	for addr, amount := range payment.To {
+		deamount, _ := decimal.NewFromString(amount)
+		totalSend = totalSend.Add(deamount)
+		outputAddrs = appendOutput(outputAddrs, addr, deamount)
+	}
+
+	fees, _ := decimal.NewFromString(payment.Fees)
+	changeAmount := balance.Sub(totalSend).Sub(fees)
+	if changeAmount.LessThan(decimal.Zero) {
+		return openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAccount, "The balance of the transaction chain: %s is not enough! ", balance.String())
+	}
+	if changeAmount.GreaterThan(decimal.Zero) {
+		outputAddrs = appendOutput(outputAddrs, changeAddress, changeAmount)
+	}
+
+	return decoder.createILCRawTransaction(wrapper, payment, usedUTXO, outputAddrs)
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTransactionDecoder_CreateRawTransactionChain(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+	node.mine("b1", newTestTx("cb1", nil,
+		testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"}))
+
+	wm, wrapper, account := newTestWallet(node, "a")
+	wm.Config.MaxTxInputs = 3
+	decoder := NewTransactionDecoder(wm)
+
+	//输入数量没有超过上限时只有一个交易单
+	chain, err := decoder.CreateRawTransactionChain(wrapper, newTestRawTx(account, "0.0001", map[string]string{"b": "0.15"}))
+	if err != nil {
+		t.Fatalf("CreateRawTransactionChain unexpected error: %v", err)
+	}
+	if len(chain.Transactions) != 1 || !chain.IsBuilt() || len(chain.DependsOn[0]) != 0 {
+		t.Errorf("single chain = %+v", chain)
+	}
+
+	//未开启自动合并
+	_, err = decoder.CreateRawTransactionChain(wrapper, newTestRawTx(account, "0.0001", map[string]string{"b": "0.45"}))
+	if err == nil || !strings.Contains(err.Error(), "max inputs over") {
+		t.Errorf("without consolidation error = %v", err)
+	}
+
+	rawTx := newTestRawTx(account, "0.0001", map[string]string{"b": "0.45"})
+	rawTx.SetExtParam(ConsolidateExtParam, true)
+	chain, err = decoder.CreateRawTransactionChain(wrapper, rawTx)
+	if err != nil {
+		t.Fatalf("CreateRawTransactionChain unexpected error: %v", err)
+	}
+
+	//5个utxo合并为3个及2个输入的交易单，转账交易单依赖它们
+	if len(chain.Transactions) != 3 || chain.Payment() != rawTx || chain.IsBuilt() {
+		t.Fatalf("chain transactions = %d, payment built = %v", len(chain.Transactions), chain.IsBuilt())
+	}
+	wantInputs := []int{3, 2}
+	wantAmounts := []int64{29995120, 19996600}
+	for i, consolidateTx := range chain.Transactions[:2] {
+		msgTx := decodeTestRawTx(t, consolidateTx)
+		if len(msgTx.TxIn) != wantInputs[i] || len(msgTx.TxOut) != 1 {
+			t.Fatalf("consolidation[%d] inputs = %d, outputs = %d", i, len(msgTx.TxIn), len(msgTx.TxOut))
+		}
+		if msgTx.TxOut[0].Value != wantAmounts[i] || !bytes.Equal(msgTx.TxOut[0].PkScript, testScript("a")) {
+			t.Errorf("consolidation[%d] output = %d", i, msgTx.TxOut[0].Value)
+		}
+		if len(chain.DependsOn[i]) != 0 || consolidateTx.GetExtParam().Get(chainRoleExtParam).String() != ChainRoleConsolidation {
+			t.Errorf("consolidation[%d] dependsOn = %v, ext = %s", i, chain.DependsOn[i], consolidateTx.ExtParam)
+		}
+	}
+	if deps := chain.DependsOn[2]; len(deps) != 2 || deps[0] != 0 || deps[1] != 1 {
+		t.Errorf("payment dependsOn = %v", deps)
+	}
+	if rawTx.GetExtParam().Get(chainDependsOnExtParam).Raw != "[0,1]" || rawTx.GetExtParam().Get(chainIndexExtParam).Int() != 2 {
+		t.Errorf("payment ext = %s", rawTx.ExtParam)
+	}
+	//2个输入，接收及找零2个输出：10 + 2 * 148 + 2 * 34 = 374
+	if rawTx.Fees != "0.00003740" {
+		t.Errorf("payment fees = %s", rawTx.Fees)
+	}
+
+	//依赖的交易单未签名时不能构建转账交易单
+	if err := decoder.CompleteRawTransactionChain(wrapper, chain); err == nil {
+		t.Errorf("complete chain with unsigned consolidation should fail")
+	}
+
+	//一个已广播，一个已验证签名
+	chain.Transactions[0].TxID = testHash("consolidation0")
+	chain.Transactions[1].IsCompleted = true
+	consolidation1 := decodeTestRawTx(t, chain.Transactions[1]).TxHash()
+	if err := decoder.CompleteRawTransactionChain(wrapper, chain); err != nil {
+		t.Fatalf("CompleteRawTransactionChain unexpected error: %v", err)
+	}
+	if !chain.IsBuilt() {
+		t.Fatalf("payment is not built")
+	}
+
+	msgTx := decodeTestRawTx(t, rawTx)
+	if len(msgTx.TxIn) != 2 ||
+		msgTx.TxIn[0].PreviousOutPoint.Hash.String() != testHash("consolidation0") || msgTx.TxIn[0].PreviousOutPoint.Index != 0 ||
+		msgTx.TxIn[1].PreviousOutPoint.Hash != consolidation1 || msgTx.TxIn[1].PreviousOutPoint.Index != 0 {
+		t.Errorf("payment inputs = %v", msgTx.TxIn)
+	}
+	outputs := make(map[string]int64)
+	for _, out := range msgTx.TxOut {
+		outputs[string(out.PkScript)] = out.Value
+	}
+	if len(outputs) != 2 || outputs[string(testScript("b"))] != 45000000 || outputs[string(testScript("a"))] != 4987980 {
+		t.Errorf("payment outputs = %v", outputs)
+	}
+
+	//合并后仍超过输入上限
+	wm.Config.MaxTxInputs = 2
+	rawTx = newTestRawTx(account, "0.0001", map[string]string{"b": "0.45"})
+	rawTx.SetExtParam(ConsolidateExtParam, true)
+	if _, err := decoder.CreateRawTransactionChain(wrapper, rawTx); err == nil {
+		t.Errorf("consolidation over max inputs should fail")
+	}
+}
+
+func TestTransactionDecoder_CreateRawTransactionChain_Dust(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+	//4个正常的utxo，3个低于自身输入手续费0.0000148，3个合并后为粉尘
+	node.mine("b1", newTestTx("cb1", nil,
+		testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"},
+		testTxOut{"a", "0.00001"}, testTxOut{"a", "0.00001"}, testTxOut{"a", "0.00001"},
+		testTxOut{"a", "0.000017"}, testTxOut{"a", "0.000017"}, testTxOut{"a", "0.000017"}))
+
+	wm, wrapper, account := newTestWallet(node, "a")
+	wm.Config.MaxTxInputs = 3
+	decoder := NewTransactionDecoder(wm)
+
+	rawTx := newTestRawTx(account, "0.0001", map[string]string{"b": "0.35"})
+	rawTx.SetExtParam(ConsolidateExtParam, true)
+	chain, err := decoder.CreateRawTransactionChain(wrapper, rawTx)
+	if err != nil {
+		t.Fatalf("CreateRawTransactionChain unexpected error: %v", err)
+	}
+
+	//只合并3个0.1，剩下的一个0.1由转账交易单直接花费
+	if len(chain.Transactions) != 2 || len(chain.Inputs) != 1 || chain.Inputs[0].Amount != "0.1" {
+		t.Fatalf("chain transactions = %d, direct inputs = %v", len(chain.Transactions), chain.Inputs)
+	}
+	consolidateTx := decodeTestRawTx(t, chain.Transactions[0])
+	if len(consolidateTx.TxIn) != 3 || len(consolidateTx.TxOut) != 1 || consolidateTx.TxOut[0].Value != 29995120 {
+		t.Fatalf("consolidation inputs = %d, outputs = %v", len(consolidateTx.TxIn), consolidateTx.TxOut)
+	}
+	if deps := chain.DependsOn[1]; len(deps) != 1 || deps[0] != 0 || rawTx.GetExtParam().Get(chainIndexExtParam).Int() != 1 {
+		t.Errorf("payment dependsOn = %v, ext = %s", deps, rawTx.ExtParam)
+	}
+	//2个输入，接收及找零2个输出：10 + 2 * 148 + 2 * 34 = 374
+	if rawTx.Fees != "0.00003740" {
+		t.Errorf("payment fees = %s", rawTx.Fees)
+	}
+
+	chain.Transactions[0].TxID = testHash("consolidation0")
+	if err := decoder.CompleteRawTransactionChain(wrapper, chain); err != nil {
+		t.Fatalf("CompleteRawTransactionChain unexpected error: %v", err)
+	}
+	msgTx := decodeTestRawTx(t, rawTx)
+	if len(msgTx.TxIn) != 2 ||
+		msgTx.TxIn[0].PreviousOutPoint.Hash.String() != testHash("consolidation0") ||
+		msgTx.TxIn[1].PreviousOutPoint.Hash.String() != chain.Inputs[0].TxID || msgTx.TxIn[1].PreviousOutPoint.Index != uint32(chain.Inputs[0].Vout) {
+		t.Errorf("payment inputs = %v", msgTx.TxIn)
+	}
+	outputs := make(map[string]int64)
+	for _, out := range msgTx.TxOut {
+		outputs[string(out.PkScript)] = out.Value
+	}
+	//29995120 + 10000000 - 35000000 - 3740
+	if len(outputs) != 2 || outputs[string(testScript("b"))] != 35000000 || outputs[string(testScript("a"))] != 4991380 {
+		t.Errorf("payment outputs = %v", outputs)
+	}
+}
+
+func TestTransactionDecoder_CreateRawTransactionChain_NewChange(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+	node.mine("b1", newTestTx("cb1", nil,
+		testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"}, testTxOut{"a", "0.1"}))
+
+	wm, wrapper, account := newTestWallet(node, "a")
+	wm.Config.MaxTxInputs = 3
+	wm.Config.ChangePolicy = ChangePolicyNew
+	hdAccount, pub := newTestAccount(t)
+	account.HDPath = hdAccount.HDPath
+	account.OwnerKeys = hdAccount.OwnerKeys
+	decoder := NewTransactionDecoder(wm)
+
+	rawTx := newTestRawTx(account, "0.0001", map[string]string{"b": "0.45"})
+	rawTx.SetExtParam(ConsolidateExtParam, true)
+	listUnspent := node.callCount("listunspent")
+	chain, err := decoder.CreateRawTransactionChain(wrapper, rawTx)
+	if err != nil {
+		t.Fatalf("CreateRawTransactionChain unexpected error: %v", err)
+	}
+
+	//超过输入上限的转账不派生找零地址，合并使用同一次查询的utxo
+	if calls := node.callCount("listunspent") - listUnspent; calls != 1 {
+		t.Errorf("listunspent calls = %d", calls)
+	}
+	change := chain.Transactions[0].Change
+	if want := testChangeAddress(t, wm, pub, 0); change == nil || change.Address != want || rawTx.Change != nil {
+		t.Fatalf("consolidation change = %+v, want index 0 address %s", change, want)
+	}
+	script, _ := wm.addressScriptPubKey(change.Address)
+	for i, consolidateTx := range chain.Transactions[:len(chain.Transactions)-1] {
+		if msgTx := decodeTestRawTx(t, consolidateTx); !bytes.Equal(msgTx.TxOut[0].PkScript, script) {
+			t.Errorf("consolidation[%d] output script = %x", i, msgTx.TxOut[0].PkScript)
+		}
+	}
+
+	//下一个交易单的找零地址紧接合并地址的索引
+	rawTx = newTestRawTx(account, "0.0001", map[string]string{"b": "0.15"})
+	if err := decoder.CreateILCRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("CreateILCRawTransaction unexpected error: %v", err)
+	}
+	if want := testChangeAddress(t, wm, pub, 1); rawTx.Change == nil || rawTx.Change.Address != want {
+		t.Errorf("next change = %+v, want index 1 address %s", rawTx.Change, want)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/blocktree/go-owcdrivers/btcTransaction"
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	//花费一个普通输出的输入大小：前序输出32 + 序号4 + 脚本长度1 + 签名及公钥107 + sequence 4
+	dustSpendSize = 32 + 4 + 1 + 107 + 4
+	//花费一个见证输出的输入大小，签名及公钥按见证数据的1/4计算
+	dustWitnessSpendSize = 32 + 4 + 1 + 107/4 + 4
+)
+
+//addressScriptPubKey 地址对应的锁定脚本，规则与btcTransaction构建输出时一致
+func (wm *WalletManager) addressScriptPubKey(address string) ([]byte, error) {
+
+	prefix := wm.Config.MainNetAddressPrefix
+	if wm.Config.IsTestNet {
+		prefix = wm.Config.TestNetAddressPrefix
+	}
+
+	if len(prefix.Bech32Prefix) > 0 && strings.HasPrefix(address, prefix.Bech32Prefix) {
+		program, err := btcTransaction.Bech32Decode(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bech32 address: %s", address)
+		}
+		return append([]byte{txscript.OP_0, byte(len(program))}, program...), nil
+	}
+
+	version, hash, err := btcTransaction.DecodeCheck(address)
+	if err != nil || len(hash) != 20 {
+		return nil, fmt.Errorf("invalid address: %s", address)
+	}
+
+	switch {
+	case bytes.Equal(version, prefix.P2PKHPrefix):
+		script := append([]byte{txscript.OP_DUP, txscript.OP_HASH160, txscript.OP_DATA_20}, hash...)
+		return append(script, txscript.OP_EQUALVERIFY, txscript.OP_CHECKSIG), nil
+	case bytes.Equal(version, prefix.P2WPKHPrefix), len(prefix.P2SHPrefix) > 0 && bytes.Equal(version, prefix.P2SHPrefix):
+		script := append([]byte{txscript.OP_HASH160, txscript.OP_DATA_20}, hash...)
+		return append(script, txscript.OP_EQUAL), nil
+	}
+
+	return nil, fmt.Errorf("invalid address: %s", address)
+}
+
+//DustThreshold 锁定脚本的粉尘阈值，低于此数量的输出节点不会转发，计算规则与core的GetDustThreshold一致：
+//(输出大小 + 花费它的输入大小) * dustRelayFee，nulldata输出不可花费，阈值为0
+func (wm *WalletManager) DustThreshold(script []byte) decimal.Decimal {
+
+	if txscript.GetScriptClass(script) == txscript.NullDataTy {
+		return decimal.Zero
+	}
+
+	size := int64(8 + wire.VarIntSerializeSize(uint64(len(script))) + len(script))
+	if txscript.IsWitnessProgram(script) {
+		size += dustWitnessSpendSize
+	} else {
+		size += dustSpendSize
+	}
+
+	//按最小单位整数计算，与core的CFeeRate::GetFee一致
+	feePerKB := wm.Config.DustRelayFee.Shift(wm.Decimal()).IntPart()
+	return decimal.New(feePerKB*size/1000, -wm.Decimal())
+}
+
+//AddressDustThreshold 发送到地址的粉尘阈值
+func (wm *WalletManager) AddressDustThreshold(address string) (decimal.Decimal, error) {
+	script, err := wm.addressScriptPubKey(address)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	return wm.DustThreshold(script), nil
+}
+
+//checkDustOutputs 检查接收输出是否低于粉尘阈值，节点会拒绝这样的交易单
+func (decoder *TransactionDecoder) checkDustOutputs(to map[string]decimal.Decimal) error {
+	for address, amount := range to {
+		threshold, err := decoder.wm.AddressDustThreshold(address)
+		if err != nil {
+			return openwallet.Errorf(openwallet.ErrAdressDecodeFailed, err.Error())
+		}
+		if amount.LessThan(threshold) {
+			return openwallet.Errorf(openwallet.ErrDustLimit, "the amount: %s send to [%s] is below the dust threshold: %s", amount.StringFixed(decoder.wm.Decimal()), address, threshold.StringFixed(decoder.wm.Decimal()))
+		}
+	}
+	return nil
+}
+
+//foldDustChange 找零低于粉尘阈值时不创建找零输出，全部作为手续费，返回实际的找零及手续费
+func (decoder *TransactionDecoder) foldDustChange(changeAddress string, change, fees decimal.Decimal) (decimal.Decimal, decimal.Decimal, error) {
+
+	if change.LessThanOrEqual(decimal.Zero) {
+		return decimal.Zero, fees, nil
+	}
+
+	script, err := decoder.wm.addressScriptPubKey(changeAddress)
+	if err != nil {
+		return change, fees, err
+	}
+
+	return decoder.foldDustChangeScript(script, change, fees)
+}
+
+//foldDustChangeScript 按找零输出的锁定脚本判断粉尘，找零地址未派生时使用
+func (decoder *TransactionDecoder) foldDustChangeScript(script []byte, change, fees decimal.Decimal) (decimal.Decimal, decimal.Decimal, error) {
+
+	if change.LessThanOrEqual(decimal.Zero) {
+		return decimal.Zero, fees, nil
+	}
+
+	threshold := decoder.wm.DustThreshold(script)
+	if change.LessThan(threshold) {
+		decoder.wm.Log.Std.Info("change: %s is below the dust threshold: %s, add it to fees", change.StringFixed(decoder.wm.Decimal()), threshold.StringFixed(decoder.wm.Decimal()))
+		return decimal.Zero, fees.Add(change), nil
+	}
+
+	return change, fees, nil
+}
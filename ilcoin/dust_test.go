@@ -0,0 +1,116 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+)
+
+func TestWalletManager_DustThreshold(t *testing.T) {
+
+	wm := NewWalletManager()
+	wm.Config.IsTestNet = false
+
+	hash20 := bytes.Repeat([]byte{0x01}, 20)
+	hash32 := bytes.Repeat([]byte{0x02}, 32)
+	p2wpkh := append([]byte{0x00, 0x14}, hash20...)
+
+	cases := []struct {
+		name   string
+		script []byte
+		want   string
+	}{
+		{"p2pkh", testScript("a"), "0.00000546"},
+		{"p2sh", append(append([]byte{0xa9, 0x14}, hash20...), 0x87), "0.0000054"},
+		{"p2wpkh", p2wpkh, "0.00000294"},
+		{"p2wsh", append([]byte{0x00, 0x20}, hash32...), "0.0000033"},
+		{"nulldata", []byte{0x6a, 0x04, 0x6f, 0x6d, 0x6e, 0x69}, "0"},
+	}
+	for _, c := range cases {
+		if got := wm.DustThreshold(c.script); !got.Equal(decimal.RequireFromString(c.want)) {
+			t.Errorf("%s dust threshold = %s, want %s", c.name, got, c.want)
+		}
+	}
+
+	//地址的锁定脚本类型
+	threshold, err := wm.AddressDustThreshold(testAddress("a"))
+	if err != nil || !threshold.Equal(decimal.RequireFromString("0.00000546")) {
+		t.Errorf("p2pkh address dust threshold = %s, err = %v", threshold, err)
+	}
+	bech32, _ := scriptPubKeyToBech32Address(p2wpkh, false)
+	threshold, err = wm.AddressDustThreshold(bech32)
+	if err != nil || !threshold.Equal(decimal.RequireFromString("0.00000294")) {
+		t.Errorf("p2wpkh address %s dust threshold = %s, err = %v", bech32, threshold, err)
+	}
+	if _, err = wm.AddressDustThreshold("invalid"); err == nil {
+		t.Errorf("invalid address should fail")
+	}
+
+	//按配置的粉尘费率计算
+	wm.Config.DustRelayFee = decimal.RequireFromString("0.0001")
+	if got := wm.DustThreshold(testScript("a")); !got.Equal(decimal.RequireFromString("0.0000182")) {
+		t.Errorf("p2pkh dust threshold at 0.0001/KB = %s", got)
+	}
+}
+
+func TestTransactionDecoder_CreateILCRawTransaction_Dust(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+	node.mine("b1", newTestTx("cb1", nil, testTxOut{"a", "0.001"}))
+
+	wm, wrapper, account := newTestWallet(node, "a")
+	decoder := NewTransactionDecoder(wm)
+	feeRate := decimal.RequireFromString("0.0001")
+	fees, _ := wm.EstimateFee(1, 2, feeRate)
+
+	//找零低于粉尘阈值，作为手续费，不创建找零输出
+	dustChange := decimal.RequireFromString("0.000003")
+	send := decimal.RequireFromString("0.001").Sub(fees).Sub(dustChange)
+	rawTx := newTestRawTx(account, "0.0001", map[string]string{"b": send.String()})
+	if err := decoder.CreateILCRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("CreateILCRawTransaction unexpected error: %v", err)
+	}
+	if msgTx := decodeTestRawTx(t, rawTx); len(msgTx.TxOut) != 1 {
+		t.Errorf("outputs = %d, want 1 without dust change", len(msgTx.TxOut))
+	}
+	if rawTx.Fees != fees.Add(dustChange).StringFixed(wm.Decimal()) {
+		t.Errorf("fees = %s, want %s", rawTx.Fees, fees.Add(dustChange))
+	}
+
+	//找零足够则创建找零输出
+	rawTx = newTestRawTx(account, "0.0001", map[string]string{"b": "0.0005"})
+	if err := decoder.CreateILCRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("CreateILCRawTransaction unexpected error: %v", err)
+	}
+	if msgTx := decodeTestRawTx(t, rawTx); len(msgTx.TxOut) != 2 {
+		t.Errorf("outputs = %d, want 2 with change", len(msgTx.TxOut))
+	}
+	if rawTx.Fees != fees.StringFixed(wm.Decimal()) {
+		t.Errorf("fees = %s, want %s", rawTx.Fees, fees)
+	}
+
+	//接收数量低于粉尘阈值
+	rawTx = newTestRawTx(account, "0.0001", map[string]string{"b": "0.000005"})
+	err := decoder.CreateILCRawTransaction(wrapper, rawTx)
+	if owErr, ok := err.(*openwallet.Error); !ok || owErr.Code() != openwallet.ErrDustLimit {
+		t.Errorf("dust recipient error = %v, want ErrDustLimit", err)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/blocktree/openwallet/log"
 	"github.com/blocktree/openwallet/openwallet"
@@ -47,6 +48,8 @@ func NewExplorer(url string, debug bool) *Explorer {
 	}
 
 	api := req.New()
+	//先创建http客户端，req在首次请求时才创建，并发请求时会产生竞争
+	api.Client()
 	c.client = api
 
 	return &c
@@ -118,7 +121,7 @@ func (wm *WalletManager) getBlockByExplorer(hash string) (*Block, error) {
 	miniblocks := result.Get("miniblocks").Array()
 
 	for _, mb := range miniblocks {
-		path = "miniblock/"+mb.String()
+		path = "miniblock/" + mb.String()
 		result, err = wm.ExplorerClient.Call(path, nil, "GET")
 		if err != nil {
 			return nil, err
@@ -181,6 +184,24 @@ func (wm *WalletManager) getTransactionByExplorer(txid string) (*Transaction, er
 
 }
 
+//getMemPoolEntryTimeByExplorer 获取insight首次看到未确认交易的时间
+func (wm *WalletManager) getMemPoolEntryTimeByExplorer(txid string) (time.Time, error) {
+
+	path := fmt.Sprintf("tx/%s", txid)
+
+	result, err := wm.ExplorerClient.Call(path, nil, "GET")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	entryTime := result.Get("time").Int()
+	if entryTime <= 0 {
+		return time.Time{}, fmt.Errorf("transaction %s has no time", txid)
+	}
+
+	return time.Unix(entryTime, 0), nil
+}
+
 //listUnspentByExplorer 获取未花交易
 func (wm *WalletManager) listUnspentByExplorer(min uint64, address ...string) ([]*Unspent, error) {
 
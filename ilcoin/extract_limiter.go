@@ -0,0 +1,177 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	minAdaptiveWindow     = 10  //自适应模式每次调整至少需要的样本数
+	adaptiveMaxErrorRate  = 0.1 //错误率超过此值时减半并发数
+	adaptiveLatencyFactor = 2   //平均延迟超过基准延迟的倍数时减半并发数
+)
+
+//extractLimiter 并发提取交易单的工作令牌
+//自适应模式下从workers开始，每个统计窗口内延迟及错误率正常时并发数加1，变差时减半，范围[1, maxWorkers]
+type extractLimiter struct {
+	mu         sync.Mutex
+	changed    chan struct{} //释放令牌或并发数变化时关闭，唤醒等待中的工作
+	limit      int           //当前并发数
+	inUse      int           //已分派的令牌
+	workers    int           //配置的并发数
+	maxWorkers int           //自适应模式的最大并发数
+	adaptive   bool
+
+	//统计窗口
+	samples  int
+	failures int
+	latency  time.Duration
+	baseline time.Duration //健康时的平均延迟
+}
+
+func newExtractLimiter(workers int) *extractLimiter {
+	l := &extractLimiter{
+		changed: make(chan struct{}),
+	}
+	l.configure(workers, workers, false)
+	return l
+}
+
+//configure 按配置设置并发数，配置未变化时保留自适应的状态
+func (l *extractLimiter) configure(workers, maxWorkers int, adaptive bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if workers < 1 {
+		workers = 1
+	}
+	if maxWorkers < workers {
+		maxWorkers = workers
+	}
+
+	if l.workers == workers && l.maxWorkers == maxWorkers && l.adaptive == adaptive {
+		return
+	}
+
+	l.workers = workers
+	l.maxWorkers = maxWorkers
+	l.adaptive = adaptive
+	l.limit = workers
+	l.baseline = 0
+	l.resetWindow()
+	l.broadcast()
+}
+
+//acquire 获取工作令牌，ctx取消时返回ctx的错误
+func (l *extractLimiter) acquire(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		l.mu.Lock()
+		if l.inUse < l.limit {
+			l.inUse++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//release 释放工作令牌，并记录本次提取的延迟及是否失败
+func (l *extractLimiter) release(latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inUse--
+
+	if l.adaptive {
+		l.record(latency, failed)
+	}
+
+	l.broadcast()
+}
+
+//concurrency 当前并发数
+func (l *extractLimiter) concurrency() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+//record 统计窗口满后调整并发数，窗口大小随并发数增长，保证每个令牌都有样本
+func (l *extractLimiter) record(latency time.Duration, failed bool) {
+
+	l.samples++
+	l.latency += latency
+	if failed {
+		l.failures++
+	}
+
+	window := l.limit
+	if window < minAdaptiveWindow {
+		window = minAdaptiveWindow
+	}
+	if l.samples < window {
+		return
+	}
+
+	avg := l.latency / time.Duration(l.samples)
+	errorRate := float64(l.failures) / float64(l.samples)
+
+	if errorRate > adaptiveMaxErrorRate || (l.baseline > 0 && avg > l.baseline*adaptiveLatencyFactor) {
+		//延迟或错误率变差，减半并发数
+		l.limit = l.limit / 2
+		if l.limit < 1 {
+			l.limit = 1
+		}
+	} else {
+		//延迟及错误率正常，基准延迟取最低值，并缓慢跟随当前延迟，避免一直以历史最低值为基准
+		if l.baseline == 0 || avg < l.baseline {
+			l.baseline = avg
+		} else {
+			l.baseline += (avg - l.baseline) / 8
+		}
+		if l.limit < l.maxWorkers {
+			l.limit++
+		}
+	}
+
+	l.resetWindow()
+}
+
+func (l *extractLimiter) resetWindow() {
+	l.samples = 0
+	l.failures = 0
+	l.latency = 0
+}
+
+//broadcast 唤醒等待令牌的工作，调用前需持有mu
+func (l *extractLimiter) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+//runLimiterWindow 以指定的延迟及失败数完成一个统计窗口
+func runLimiterWindow(t *testing.T, l *extractLimiter, latency time.Duration, failures int) {
+	window := l.concurrency()
+	if window < minAdaptiveWindow {
+		window = minAdaptiveWindow
+	}
+	for i := 0; i < window; i++ {
+		if err := l.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire unexpected error: %v", err)
+		}
+		l.release(latency, i < failures)
+	}
+}
+
+func TestExtractLimiter_Fixed(t *testing.T) {
+
+	l := newExtractLimiter(2)
+
+	for i := 0; i < 2; i++ {
+		if err := l.acquire(context.Background()); err != nil {
+			t.Fatalf("acquire unexpected error: %v", err)
+		}
+	}
+
+	//令牌用完后等待释放
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("acquire without free worker = %v, want deadline exceeded", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		l.acquire(context.Background())
+		close(acquired)
+	}()
+	l.release(time.Millisecond, false)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("acquire is not woken up by release")
+	}
+
+	//非自适应模式不调整并发数
+	for i := 0; i < 2; i++ {
+		l.release(time.Millisecond, false)
+	}
+	if c := l.concurrency(); c != 2 {
+		t.Errorf("concurrency = %d, want 2", c)
+	}
+
+	//配置变化后马上生效
+	l.configure(8, 64, false)
+	if c := l.concurrency(); c != 8 {
+		t.Errorf("concurrency = %d after configure, want 8", c)
+	}
+}
+
+func TestExtractLimiter_Adaptive(t *testing.T) {
+
+	l := newExtractLimiter(4)
+	l.configure(4, 6, true)
+
+	//延迟及错误率正常时逐步增加，不超过最大数量
+	for i := 0; i < 4; i++ {
+		runLimiterWindow(t, l, 10*time.Millisecond, 0)
+	}
+	if c := l.concurrency(); c != 6 {
+		t.Fatalf("concurrency = %d after healthy windows, want 6", c)
+	}
+
+	//错误率过高时减半
+	runLimiterWindow(t, l, 10*time.Millisecond, 5)
+	if c := l.concurrency(); c != 3 {
+		t.Fatalf("concurrency = %d after failures, want 3", c)
+	}
+
+	//延迟变差时减半，最少保留1个
+	runLimiterWindow(t, l, 50*time.Millisecond, 0)
+	if c := l.concurrency(); c != 1 {
+		t.Fatalf("concurrency = %d after latency spike, want 1", c)
+	}
+	runLimiterWindow(t, l, 100*time.Millisecond, 0)
+	if c := l.concurrency(); c != 1 {
+		t.Fatalf("concurrency = %d, want at least 1", c)
+	}
+
+	//恢复正常后重新增加
+	runLimiterWindow(t, l, 10*time.Millisecond, 0)
+	if c := l.concurrency(); c != 2 {
+		t.Errorf("concurrency = %d after recovery, want 2", c)
+	}
+
+	//相同的配置不重置自适应的状态
+	l.configure(4, 6, true)
+	if c := l.concurrency(); c != 2 {
+		t.Errorf("concurrency = %d after same configure, want 2", c)
+	}
+}
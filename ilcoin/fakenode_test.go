@@ -0,0 +1,713 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blocktree/go-owcdrivers/addressEncoder"
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shopspring/decimal"
+)
+
+/*
+	以下是不依赖真实节点的测试工具：
+	testNode 用httptest模拟ilcoin core的json-rpc接口，
+	testBlockchainDAI 是内存版的区块链数据访问接口，
+	testObserver 收集扫描器发出的通知。
+*/
+
+//testHash 根据标签生成一个固定的hash
+func testHash(label string) string {
+	h := sha256.Sum256([]byte(label))
+	return hex.EncodeToString(h[:])
+}
+
+//testScript 根据地址标签生成P2PKH锁定脚本
+func testScript(label string) []byte {
+	h := sha256.Sum256([]byte(label))
+	script := []byte{0x76, 0xa9, 0x14}
+	script = append(script, h[:20]...)
+	return append(script, 0x88, 0xac)
+}
+
+//testAddress 根据地址标签生成主网P2PKH地址
+func testAddress(label string) string {
+	h := sha256.Sum256([]byte(label))
+	return addressEncoder.AddressEncode(h[:20], addressEncoder.BTC_mainnetAddressP2PKH)
+}
+
+type testTxIn struct {
+	TxID string
+	Vout uint64
+}
+
+type testTxOut struct {
+	Addr  string //地址标签
+	Value string
+}
+
+type testTx struct {
+	TxID  string
+	Vins  []testTxIn
+	Vouts []testTxOut
+	msg   *wire.MsgTx
+}
+
+//newTestTx 创建测试交易单，ins为空时为coinbase交易
+func newTestTx(label string, ins []testTxIn, outs ...testTxOut) *testTx {
+	msg := wire.NewMsgTx(1)
+	if len(ins) == 0 {
+		msg.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte(label), nil))
+	}
+	for _, in := range ins {
+		hash, _ := chainhash.NewHashFromStr(in.TxID)
+		msg.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, uint32(in.Vout)), []byte{0x00}, nil))
+	}
+	for _, out := range outs {
+		value, _ := decimal.NewFromString(out.Value)
+		msg.AddTxOut(wire.NewTxOut(value.Shift(8).IntPart(), testScript(out.Addr)))
+	}
+	return &testTx{TxID: msg.TxHash().String(), Vins: ins, Vouts: outs, msg: msg}
+}
+
+type testBlock struct {
+	Hash   string
+	Prev   string
+	Height uint64
+	Time   int64
+	Txs    []*testTx
+	msg    *wire.MsgBlock
+}
+
+//testNode 模拟的ilcoin core节点
+type testNode struct {
+	mu      sync.Mutex
+	chain   []*testBlock
+	blocks  map[string]*testBlock
+	txs     map[string]*testTx
+	txBlock map[string]*testBlock
+	mempool []string
+	entered map[string]int64  //交易进入交易池的时间
+	omni    map[string]string //地址的omni代币余额
+	calls   map[string]int
+	server  *httptest.Server
+
+	//hook 每次接口调用前执行，可用于在扫描过程中改变链的状态
+	hook func(method string, params []json.RawMessage)
+	//fail 每次接口调用前执行，返回错误时接口调用失败
+	fail func(method string, params []json.RawMessage) error
+	//dir 连接此节点的扫描器的数据目录，Close时删除
+	dir string
+}
+
+//newTestNode 创建模拟节点，包含一个创世区块
+func newTestNode(t *testing.T) *testNode {
+	node := &testNode{
+		blocks:  make(map[string]*testBlock),
+		txs:     make(map[string]*testTx),
+		txBlock: make(map[string]*testBlock),
+		entered: make(map[string]int64),
+		omni:    make(map[string]string),
+		calls:   make(map[string]int),
+	}
+	node.mine("genesis", newTestTx("genesis", nil, testTxOut{"genesis_addr", "50"}))
+	node.server = httptest.NewServer(http.HandlerFunc(node.serveRPC))
+	dir, err := ioutil.TempDir("", "ilcoin-node")
+	if err != nil {
+		t.Fatalf("create temp dir unexpected error: %v", err)
+	}
+	node.dir = dir
+	return node
+}
+
+func (node *testNode) Close() {
+	node.server.Close()
+	os.RemoveAll(node.dir)
+}
+
+//mine 在主链最新区块上出一个新块
+func (node *testNode) mine(label string, txs ...*testTx) *testBlock {
+	return node.mineAt(0, label, txs...)
+}
+
+//mineAt 以指定的区块时间出块，t为0时按高度每600秒一个区块
+func (node *testNode) mineAt(t int64, label string, txs ...*testTx) *testBlock {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	block := &testBlock{
+		Height: uint64(len(node.chain)),
+		Time:   1500000000 + int64(len(node.chain))*600,
+		Txs:    txs,
+	}
+	if t > 0 {
+		block.Time = t
+	}
+	if len(block.Txs) == 0 {
+		block.Txs = []*testTx{newTestTx("coinbase_"+label, nil, testTxOut{"miner_addr", "50"})}
+	}
+
+	header := wire.BlockHeader{Version: 1, Timestamp: time.Unix(block.Time, 0), Bits: 0x1d00ffff}
+	if len(node.chain) > 0 {
+		block.Prev = node.chain[len(node.chain)-1].Hash
+		prev, _ := chainhash.NewHashFromStr(block.Prev)
+		header.PrevBlock = *prev
+	}
+	txHashes := make([]chainhash.Hash, 0, len(block.Txs))
+	for _, tx := range block.Txs {
+		txHashes = append(txHashes, tx.msg.TxHash())
+	}
+	header.MerkleRoot = blockMerkleRoot(txHashes)
+	block.msg = wire.NewMsgBlock(&header)
+	for _, tx := range block.Txs {
+		block.msg.AddTransaction(tx.msg)
+	}
+	block.Hash = header.BlockHash().String()
+
+	for _, tx := range block.Txs {
+		node.txs[tx.TxID] = tx
+		node.txBlock[tx.TxID] = block
+		node.removeMemPoolLocked(tx.TxID)
+	}
+	node.chain = append(node.chain, block)
+	node.blocks[block.Hash] = block
+	return block
+}
+
+//reorg 丢弃主链高度height之后的区块，被丢弃的区块仍可以通过hash查询
+func (node *testNode) reorg(height uint64) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for _, block := range node.chain[height+1:] {
+		for _, tx := range block.Txs {
+			delete(node.txBlock, tx.TxID)
+		}
+	}
+	node.chain = node.chain[:height+1]
+}
+
+//addMemPool 加入未确认交易
+func (node *testNode) addMemPool(tx *testTx) {
+	node.addMemPoolAt(time.Now().Unix(), tx)
+}
+
+//addMemPoolAt 加入未确认交易，t为进入交易池的时间
+func (node *testNode) addMemPoolAt(t int64, tx *testTx) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.txs[tx.TxID] = tx
+	node.mempool = append(node.mempool, tx.TxID)
+	node.entered[tx.TxID] = t
+}
+
+//removeMemPool 把交易移出交易池，模拟被节点驱逐或替换
+func (node *testNode) removeMemPool(txid string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.removeMemPoolLocked(txid)
+}
+
+func (node *testNode) removeMemPoolLocked(txid string) {
+	for i, id := range node.mempool {
+		if id == txid {
+			node.mempool = append(node.mempool[:i:i], node.mempool[i+1:]...)
+			return
+		}
+	}
+}
+
+//callCount 接口被调用的次数
+func (node *testNode) callCount(method string) int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.calls[method]
+}
+
+func (node *testNode) txJSON(tx *testTx) map[string]interface{} {
+	vins := make([]interface{}, 0)
+	for _, in := range tx.Vins {
+		vins = append(vins, map[string]interface{}{"txid": in.TxID, "vout": in.Vout})
+	}
+	if len(tx.Vins) == 0 {
+		vins = append(vins, map[string]interface{}{"coinbase": hex.EncodeToString(tx.msg.TxIn[0].SignatureScript)})
+	}
+	vouts := make([]interface{}, 0)
+	for i, out := range tx.Vouts {
+		vouts = append(vouts, map[string]interface{}{
+			"value": json.Number(out.Value),
+			"n":     i,
+			"scriptPubKey": map[string]interface{}{
+				"hex":       hex.EncodeToString(testScript(out.Addr)),
+				"type":      "pubkeyhash",
+				"addresses": []string{testAddress(out.Addr)},
+			},
+		})
+	}
+	obj := map[string]interface{}{
+		"txid":     tx.TxID,
+		"version":  1,
+		"locktime": 0,
+		"size":     tx.msg.SerializeSize(),
+		"vin":      vins,
+		"vout":     vouts,
+	}
+	if block, ok := node.txBlock[tx.TxID]; ok {
+		obj["blockhash"] = block.Hash
+		obj["blocktime"] = block.Time
+		obj["confirmations"] = uint64(len(node.chain)) - block.Height
+	}
+	return obj
+}
+
+//listUnspent 主链及交易池交易未被花费的输出，与core的listunspent格式一致
+func (node *testNode) listUnspent(minConf uint64, addrs []string) []interface{} {
+	watched := make(map[string]bool)
+	for _, a := range addrs {
+		watched[a] = true
+	}
+
+	txs := make([]*testTx, 0)
+	for _, block := range node.chain {
+		txs = append(txs, block.Txs...)
+	}
+	for _, txid := range node.mempool {
+		txs = append(txs, node.txs[txid])
+	}
+
+	spent := make(map[string]bool)
+	for _, tx := range txs {
+		for _, in := range tx.Vins {
+			spent[fmt.Sprintf("%s:%d", in.TxID, in.Vout)] = true
+		}
+	}
+
+	list := make([]interface{}, 0)
+	for _, tx := range txs {
+		confirmations := uint64(0)
+		if block, ok := node.txBlock[tx.TxID]; ok {
+			confirmations = uint64(len(node.chain)) - block.Height
+		}
+		if confirmations < minConf {
+			continue
+		}
+		for i, out := range tx.Vouts {
+			address := testAddress(out.Addr)
+			if spent[fmt.Sprintf("%s:%d", tx.TxID, i)] || (len(watched) > 0 && !watched[address]) {
+				continue
+			}
+			list = append(list, map[string]interface{}{
+				"txid":          tx.TxID,
+				"vout":          i,
+				"address":       address,
+				"scriptPubKey":  hex.EncodeToString(testScript(out.Addr)),
+				"amount":        json.Number(out.Value),
+				"confirmations": confirmations,
+				"spendable":     true,
+				"solvable":      true,
+			})
+		}
+	}
+	return list
+}
+
+func (node *testNode) blockJSON(block *testBlock, verbosity int) map[string]interface{} {
+	txs := make([]interface{}, 0)
+	for _, tx := range block.Txs {
+		if verbosity >= 2 {
+			txs = append(txs, node.txJSON(tx))
+		} else {
+			txs = append(txs, tx.TxID)
+		}
+	}
+	obj := node.headerJSON(block)
+	obj["tx"] = txs
+	return obj
+}
+
+func (node *testNode) headerJSON(block *testBlock) map[string]interface{} {
+	obj := map[string]interface{}{
+		"hash":       block.Hash,
+		"height":     block.Height,
+		"merkleroot": block.msg.Header.MerkleRoot.String(),
+		"version":    1,
+		"time":       block.Time,
+	}
+	if len(block.Prev) > 0 {
+		obj["previousblockhash"] = block.Prev
+	}
+	if int(block.Height) < len(node.chain) && node.chain[block.Height] == block {
+		obj["confirmations"] = uint64(len(node.chain)) - block.Height
+		obj["mediantime"] = node.medianTime(block.Height)
+	} else {
+		obj["confirmations"] = -1
+	}
+	return obj
+}
+
+//medianTime 主链区块的中位时间
+func (node *testNode) medianTime(height uint64) int64 {
+	times := make([]int64, 0)
+	for i := 0; i < 11 && uint64(i) <= height; i++ {
+		times = append(times, node.chain[height-uint64(i)].Time)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+func (node *testNode) call(method string, params []json.RawMessage) (interface{}, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	node.calls[method]++
+
+	var (
+		str string
+		num int
+	)
+
+	switch method {
+	case "getblockcount":
+		return len(node.chain) - 1, nil
+	case "getblockhash":
+		json.Unmarshal(params[0], &num)
+		if num < 0 || num >= len(node.chain) {
+			return nil, fmt.Errorf("[-8]Block height out of range")
+		}
+		return node.chain[num].Hash, nil
+	case "getblock":
+		json.Unmarshal(params[0], &str)
+		verbosity := 1
+		if len(params) > 1 {
+			json.Unmarshal(params[1], &verbosity)
+		}
+		block, ok := node.blocks[str]
+		if !ok {
+			return nil, fmt.Errorf("[-5]Block not found")
+		}
+		if verbosity == 0 {
+			var buf bytes.Buffer
+			block.msg.Serialize(&buf)
+			return hex.EncodeToString(buf.Bytes()), nil
+		}
+		return node.blockJSON(block, verbosity), nil
+	case "getblockheader":
+		json.Unmarshal(params[0], &str)
+		block, ok := node.blocks[str]
+		if !ok {
+			return nil, fmt.Errorf("[-5]Block not found")
+		}
+		return node.headerJSON(block), nil
+	case "getrawtransaction":
+		json.Unmarshal(params[0], &str)
+		tx, ok := node.txs[str]
+		if !ok {
+			return nil, fmt.Errorf("[-5]No information available about transaction")
+		}
+		return node.txJSON(tx), nil
+	case "getrawmempool":
+		return append([]string{}, node.mempool...), nil
+	case "listunspent":
+		var (
+			minConf uint64
+			addrs   []string
+		)
+		json.Unmarshal(params[0], &minConf)
+		if len(params) > 2 {
+			json.Unmarshal(params[2], &addrs)
+		}
+		return node.listUnspent(minConf, addrs), nil
+	case "getmempoolentry":
+		json.Unmarshal(params[0], &str)
+		for _, txid := range node.mempool {
+			if txid == str {
+				return map[string]interface{}{"fee": 0.0001, "time": node.entered[txid]}, nil
+			}
+		}
+		return nil, fmt.Errorf("[-5]Transaction not in mempool")
+	case "importaddress":
+		return nil, nil
+	case "omni_getbalance":
+		json.Unmarshal(params[0], &str)
+		balance, ok := node.omni[str]
+		if !ok {
+			balance = "0"
+		}
+		return map[string]interface{}{"balance": balance, "reserved": "0"}, nil
+	}
+	return nil, fmt.Errorf("[-32601]Method not found")
+}
+
+func (node *testNode) serveRPC(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	if node.hook != nil {
+		node.hook(body.Method, body.Params)
+	}
+
+	var (
+		result interface{}
+		err    error
+	)
+	if node.fail != nil {
+		err = node.fail(body.Method, body.Params)
+	}
+	if err == nil {
+		result, err = node.call(body.Method, body.Params)
+	}
+	resp := map[string]interface{}{"id": "1", "result": result, "error": nil}
+	if err != nil {
+		var code int
+		var message string
+		fmt.Sscanf(err.Error(), "[%d]", &code)
+		message = err.Error()[len(fmt.Sprintf("[%d]", code)):]
+		resp["result"] = nil
+		resp["error"] = map[string]interface{}{"code": code, "message": message}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+//testBlockchainDAI 内存版的区块链数据访问接口
+type testBlockchainDAI struct {
+	openwallet.BlockchainDAIBase
+	mu      sync.Mutex
+	current *openwallet.BlockHeader
+	headers map[uint64]*openwallet.BlockHeader
+	unscans map[string]*openwallet.UnscanRecord
+	history []uint64 //保存过的扫描高度
+}
+
+func newTestBlockchainDAI() *testBlockchainDAI {
+	return &testBlockchainDAI{
+		headers: make(map[uint64]*openwallet.BlockHeader),
+		unscans: make(map[string]*openwallet.UnscanRecord),
+	}
+}
+
+func (dai *testBlockchainDAI) SaveCurrentBlockHead(header *openwallet.BlockHeader) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	h := *header
+	dai.current = &h
+	dai.history = append(dai.history, header.Height)
+	return nil
+}
+
+func (dai *testBlockchainDAI) GetCurrentBlockHead(symbol string) (*openwallet.BlockHeader, error) {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	if dai.current == nil {
+		return &openwallet.BlockHeader{}, nil
+	}
+	h := *dai.current
+	return &h, nil
+}
+
+func (dai *testBlockchainDAI) SaveLocalBlockHead(header *openwallet.BlockHeader) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	h := *header
+	dai.headers[header.Height] = &h
+	return nil
+}
+
+func (dai *testBlockchainDAI) GetLocalBlockHeadByHeight(height uint64, symbol string) (*openwallet.BlockHeader, error) {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	h, ok := dai.headers[height]
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	c := *h
+	return &c, nil
+}
+
+func (dai *testBlockchainDAI) SaveUnscanRecord(record *openwallet.UnscanRecord) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	dai.unscans[record.ID] = record
+	return nil
+}
+
+func (dai *testBlockchainDAI) DeleteUnscanRecordByHeight(height uint64, symbol string) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	for id, r := range dai.unscans {
+		if r.BlockHeight == height {
+			delete(dai.unscans, id)
+		}
+	}
+	return nil
+}
+
+func (dai *testBlockchainDAI) DeleteUnscanRecordByID(id string, symbol string) error {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	delete(dai.unscans, id)
+	return nil
+}
+
+func (dai *testBlockchainDAI) GetUnscanRecords(symbol string) ([]*openwallet.UnscanRecord, error) {
+	dai.mu.Lock()
+	defer dai.mu.Unlock()
+	list := make([]*openwallet.UnscanRecord, 0)
+	for _, r := range dai.unscans {
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+//testObserver 收集扫描器的通知
+type testObserver struct {
+	mu      sync.Mutex
+	headers []*openwallet.BlockHeader
+	data    map[string][]*openwallet.TxExtractData
+}
+
+func newTestObserver() *testObserver {
+	return &testObserver{data: make(map[string][]*openwallet.TxExtractData)}
+}
+
+func (o *testObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.headers = append(o.headers, header)
+	return nil
+}
+
+func (o *testObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.data[sourceKey] = append(o.data[sourceKey], data)
+	return nil
+}
+
+//waitHeaders 等待收到count个区块通知
+func (o *testObserver) waitHeaders(t *testing.T, count int) []*openwallet.BlockHeader {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		o.mu.Lock()
+		if len(o.headers) >= count {
+			headers := append([]*openwallet.BlockHeader{}, o.headers...)
+			o.mu.Unlock()
+			return headers
+		}
+		o.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	t.Fatalf("wait block headers timeout, got %d, want %d", len(o.headers), count)
+	return nil
+}
+
+//newTestScanner 创建连接模拟节点的钱包管理及扫描器，addrs为关注的地址标签及其数据源标识
+func newTestScanner(node *testNode, addrs map[string]string) (*WalletManager, *ILCBlockScanner, *testObserver) {
+	wm := NewWalletManager()
+	wm.Config.RPCServerType = RPCServerCore
+	wm.Config.IsTestNet = false
+	wm.WalletClient = NewClient(node.server.URL, "", false)
+	wm.Config.DBPath = node.dir
+
+	watched := make(map[string]string)
+	for label, key := range addrs {
+		watched[testAddress(label)] = key
+	}
+
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(newTestBlockchainDAI())
+	bs.SetBlockScanAddressFunc(func(address string) (string, bool) {
+		key, ok := watched[address]
+		return key, ok
+	})
+
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+	return wm, bs, observer
+}
+
+//saveTestScanned 把模拟节点主链上的区块标记为已扫描
+func saveTestScanned(bs *ILCBlockScanner, node *testNode) {
+	for _, b := range node.chain {
+		bs.SaveLocalBlock(&Block{Hash: b.Hash, Height: b.Height, Previousblockhash: b.Prev, Time: uint64(b.Time)})
+	}
+	tip := node.chain[len(node.chain)-1]
+	bs.SaveLocalNewBlock(tip.Height, tip.Hash)
+}
+
+//newTestWallet 连接模拟节点用于创建交易单，返回的账户拥有labels对应的地址
+func newTestWallet(node *testNode, labels ...string) (*WalletManager, *testWalletDAI, *openwallet.AssetsAccount) {
+	wm := NewWalletManager()
+	wm.Config.RPCServerType = RPCServerCore
+	wm.Config.IsTestNet = false
+	wm.WalletClient = NewClient(node.server.URL, "", false)
+
+	account := &openwallet.AssetsAccount{AccountID: "test_account", Symbol: wm.Symbol(), Required: 1}
+	wrapper := &testWalletDAI{}
+	for i, label := range labels {
+		wrapper.addresses = append(wrapper.addresses, &openwallet.Address{
+			AccountID: account.AccountID,
+			Address:   testAddress(label),
+			Index:     uint64(i),
+		})
+	}
+	return wm, wrapper, account
+}
+
+//newTestRawTx 创建转账交易单，to为地址标签及数量
+func newTestRawTx(account *openwallet.AssetsAccount, feeRate string, to map[string]string) *openwallet.RawTransaction {
+	rawTx := &openwallet.RawTransaction{
+		Account: account,
+		FeeRate: feeRate,
+		To:      make(map[string]string),
+	}
+	for label, amount := range to {
+		rawTx.To[testAddress(label)] = amount
+	}
+	return rawTx
+}
+
+//decodeTestRawTx 解析交易单的原始数据
+func decodeTestRawTx(t *testing.T, rawTx *openwallet.RawTransaction) *wire.MsgTx {
+	t.Helper()
+	raw, err := hex.DecodeString(rawTx.RawHex)
+	if err != nil {
+		t.Fatalf("decode raw hex unexpected error: %v", err)
+	}
+	var msgTx wire.MsgTx
+	if err := msgTx.Deserialize(bytes.NewReader(raw)); err != nil {
+		t.Fatalf("deserialize raw transaction unexpected error: %v", err)
+	}
+	return &msgTx
+}
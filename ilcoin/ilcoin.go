@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/astaxie/beego/config"
 	"github.com/blocktree/openwallet/common"
@@ -632,6 +633,79 @@ func (wm *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	wm.Config.MinFees, _ = decimal.NewFromString(c.String("minFees"))
 	wm.Config.MinFees = wm.Config.MinFees.Round(wm.Decimal())
 	wm.Config.DataDir = c.String("dataDir")
+	if prefetchBlockCount, err := c.Int64("prefetchBlockCount"); err == nil && prefetchBlockCount > 0 {
+		wm.Config.PrefetchBlockCount = uint64(prefetchBlockCount)
+	}
+	wm.Config.DecodeRawBlock, _ = c.Bool("decodeRawBlock")
+	if txOutCacheSize, err := c.Int("txOutCacheSize"); err == nil {
+		wm.Config.TxOutCacheSize = txOutCacheSize
+		wm.TxOutCache = NewTxOutCache(txOutCacheSize)
+	}
+	if enableSocketIO, err := c.Bool("enableSocketIO"); err == nil {
+		wm.Config.EnableSocketIO = enableSocketIO
+	}
+	wm.Config.ZMQPubHashBlock = c.String("zmqPubHashBlock")
+	wm.Config.ZMQPubRawTx = c.String("zmqPubRawTx")
+	if zmqIdleTimeout, err := c.Int64("zmqIdleTimeout"); err == nil && zmqIdleTimeout >= 0 {
+		wm.Config.ZMQIdleTimeout = time.Duration(zmqIdleTimeout) * time.Second
+	}
+	if reconnectWait, err := c.Int64("pushReconnectWait"); err == nil && reconnectWait > 0 {
+		wm.Config.PushReconnectWait = time.Duration(reconnectWait) * time.Second
+	}
+	if maxReconnectWait, err := c.Int64("pushMaxReconnectWait"); err == nil && maxReconnectWait > 0 {
+		wm.Config.PushMaxReconnectWait = time.Duration(maxReconnectWait) * time.Second
+	}
+	if memPoolExpiry, err := c.Int64("memPoolExpiry"); err == nil && memPoolExpiry > 0 {
+		wm.Config.MemPoolExpiry = time.Duration(memPoolExpiry) * time.Hour
+	}
+	if finalityDepth, err := c.Int64("finalityDepth"); err == nil && finalityDepth > 0 {
+		wm.Config.FinalityDepth = uint64(finalityDepth)
+	}
+	if unscanRetryWait, err := c.Int64("unscanRetryWait"); err == nil && unscanRetryWait > 0 {
+		wm.Config.UnscanRetryWait = time.Duration(unscanRetryWait) * time.Second
+	}
+	if unscanMaxAttempts, err := c.Int("unscanMaxAttempts"); err == nil && unscanMaxAttempts >= 0 {
+		wm.Config.UnscanMaxAttempts = unscanMaxAttempts
+	}
+	if blockMaxFailures, err := c.Int("blockMaxFailures"); err == nil && blockMaxFailures >= 0 {
+		wm.Config.BlockMaxFailures = blockMaxFailures
+	}
+	if extractWorkers, err := c.Int("extractWorkers"); err == nil && extractWorkers > 0 {
+		wm.Config.ExtractWorkers = extractWorkers
+	}
+	if adaptiveExtract, err := c.Bool("adaptiveExtract"); err == nil {
+		wm.Config.AdaptiveExtract = adaptiveExtract
+	}
+	if maxExtractWorkers, err := c.Int("maxExtractWorkers"); err == nil && maxExtractWorkers > 0 {
+		wm.Config.MaxExtractWorkers = maxExtractWorkers
+	}
+	if maxBlockCache, err := c.Int64("maxBlockCache"); err == nil && maxBlockCache >= 0 {
+		wm.Config.MaxBlockCache = uint64(maxBlockCache)
+	}
+	wm.Config.UTXOIndex, _ = c.Bool("utxoIndex")
+	wm.Config.AddressTxIndex, _ = c.Bool("addressTxIndex")
+	wm.Config.EventLog, _ = c.Bool("eventLog")
+	if eventLogRetention, err := c.Int64("eventLogRetention"); err == nil && eventLogRetention >= 0 {
+		wm.Config.EventLogRetention = uint64(eventLogRetention)
+	}
+	if coinSelection := c.String("coinSelection"); len(coinSelection) > 0 {
+		wm.Config.CoinSelection = coinSelection
+	}
+	if changePolicy := c.String("changePolicy"); len(changePolicy) > 0 {
+		wm.Config.ChangePolicy = changePolicy
+	}
+	if _, err := NewCoinSelector(wm.Config.CoinSelection); err != nil {
+		return err
+	}
+	switch wm.Config.ChangePolicy {
+	case "", ChangePolicyReuse, ChangePolicyNew:
+	default:
+		return fmt.Errorf("unknown change policy: %s", wm.Config.ChangePolicy)
+	}
+	if dustRelayFee, err := decimal.NewFromString(c.String("dustRelayFee")); err == nil && dustRelayFee.GreaterThan(decimal.Zero) {
+		wm.Config.DustRelayFee = dustRelayFee
+	}
+	wm.Config.AutoConsolidate, _ = c.Bool("autoConsolidate")
 
 	//数据文件夹
 	wm.Config.makeDataDir()
@@ -59,6 +59,9 @@ type WalletManager struct {
 	TxDecoder       openwallet.TransactionDecoder //交易单编码器
 	Log             *log.OWLogger                 //日志工具
 	ContractDecoder *ContractDecoder              //智能合约解析器
+	TxOutCache      *TxOutCache                   //交易单输出缓存
+	blockTimes      *blockTimeCache               //按时间查找区块的区块头缓存
+	changeIndexes   *changeIndexReserver          //已分配的找零地址索引
 }
 
 func NewWalletManager() *WalletManager {
@@ -74,6 +77,9 @@ func NewWalletManager() *WalletManager {
 	wm.TxDecoder = NewTransactionDecoder(&wm)
 	wm.Log = log.NewOWLogger(wm.Symbol())
 	wm.ContractDecoder = NewContractDecoder(&wm)
+	wm.TxOutCache = NewTxOutCache(wm.Config.TxOutCacheSize)
+	wm.blockTimes = newBlockTimeCache()
+	wm.changeIndexes = newChangeIndexReserver()
 	return &wm
 }
 
@@ -988,6 +994,11 @@ func (wm *WalletManager) GetBlockChainInfo() (*BlockchainInfo, error) {
 //ListUnspent 获取未花记录
 func (wm *WalletManager) ListUnspent(min uint64, addresses ...string) ([]*Unspent, error) {
 
+	//开启本地未花索引时从索引查询，不再请求节点
+	if wm.Config.UTXOIndex && len(addresses) > 0 {
+		return wm.Blockscanner.ListUnspentFromIndex(min, addresses...)
+	}
+
 	//:分页限制
 
 	var (
@@ -1734,16 +1745,20 @@ func (wm *WalletManager) EstimateFee(inputs, outputs int64, feeRate decimal.Deci
 		piece = int64(math.Ceil(float64(inputs) / float64(wm.Config.MaxTxInputs)))
 	}
 
-	//计算公式如下：148 * 输入数额 + 34 * 输出数额 + 10
-	trx_bytes := decimal.New(inputs*148+outputs*34+piece*10, 0)
-	trx_fee := trx_bytes.Div(decimal.New(1000, 0)).Mul(feeRate)
-	trx_fee = trx_fee.Round(wm.Decimal())
+	//只知道数量时，输入及输出都按P2PKH估算，已知utxo及接收地址时使用EstimateTxFee
+	estimator := NewTxSizeEstimator()
+	for i := int64(0); i < inputs; i++ {
+		estimator.AddInput(InputP2PKH, 0, 0)
+	}
+	for i := int64(0); i < outputs; i++ {
+		estimator.AddOutput(make([]byte, p2pkhScriptSize))
+	}
+
+	//分拆的每笔交易单都有版本、锁定时间及输入输出数量
+	trx_bytes := estimator.VSize() + (piece-1)*(txVersionLockTimeSize+2)
+	trx_fee := wm.feeOfVSize(trx_bytes, feeRate)
 	//wm.Log.Debugf("trx_fee: %s", trx_fee.String())
 	//wm.Log.Debugf("MinFees: %s", wm.Config.MinFees.String())
-	//是否低于最小手续费
-	if trx_fee.LessThan(wm.Config.MinFees) {
-		trx_fee = wm.Config.MinFees
-	}
 
 	return trx_fee, nil
 }
@@ -22,6 +22,7 @@ import (
 	"github.com/codeskyblue/go-sh"
 	"github.com/shopspring/decimal"
 	"math"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -33,6 +34,11 @@ var (
 
 func init() {
 
+	//没有节点配置文件时使用默认配置，只能运行不依赖节点的测试
+	if _, err := os.Stat(filepath.Join("../openwtester/conf", "ILC.ini")); err != nil {
+		tw = NewWalletManager()
+		return
+	}
 	tw = testNewWalletManager()
 }
 
@@ -185,7 +185,9 @@ func (wm *WalletManager) NewBlock(json *gjson.Result) *Block {
 			txObj.BlockHeight = obj.Height
 			txObj.BlockHash = obj.Hash
 			txObj.Blocktime = int64(obj.Time)
+			txObj.Confirmations = obj.Confirmations
 			txDetails = append(txDetails, txObj)
+			txs = append(txs, txObj.TxID)
 		} else {
 			obj.isVerbose = false
 			txs = append(txs, tx.String())
@@ -56,6 +56,8 @@ func NewClient(url, token string, debug bool) *Client {
 	}
 
 	api := req.New()
+	//先创建http客户端，req在首次请求时才创建，并发请求时会产生竞争
+	api.Client()
 	//trans, _ := api.Client().Transport.(*http.Transport)
 	//trans.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	c.client = api
@@ -0,0 +1,60 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/common/file"
+)
+
+//stormFile 首次使用时才打开的storm数据库文件，打开后保持到Close
+type stormFile struct {
+	path   string
+	fileMu sync.Mutex
+	db     *storm.DB
+}
+
+//open 打开数据库，已打开则直接返回
+func (f *stormFile) open() (*storm.DB, error) {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+
+	if f.db == nil {
+		file.MkdirAll(filepath.Dir(f.path))
+		db, err := storm.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+		f.db = db
+	}
+	return f.db, nil
+}
+
+//Close 关闭数据库文件，再次访问时重新打开
+func (f *stormFile) Close() error {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+
+	if f.db == nil {
+		return nil
+	}
+	err := f.db.Close()
+	f.db = nil
+	return err
+}
@@ -146,26 +146,29 @@ func (decoder *TransactionDecoder) SubmitRawTransaction(wrapper openwallet.Walle
 //CreateRawTransaction 创建交易单
 func (decoder *TransactionDecoder) CreateILCRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
 
+	unspents, err := decoder.listAccountUnspents(wrapper, rawTx.Account)
+	if err != nil {
+		return err
+	}
+
+	return decoder.createILCRawTransactionFromUnspents(wrapper, rawTx, unspents)
+}
+
+//listAccountUnspents 查找账户地址的utxo，没有utxo时返回余额不足
+func (decoder *TransactionDecoder) listAccountUnspents(wrapper openwallet.WalletDAI, account *openwallet.AssetsAccount) ([]*Unspent, error) {
+
 	var (
-		usedUTXO     []*Unspent
-		outputAddrs  = make(map[string]decimal.Decimal)
-		balance      = decimal.New(0, 0)
-		totalSend    = decimal.New(0, 0)
-		actualFees   = decimal.New(0, 0)
-		feesRate     = decimal.New(0, 0)
-		accountID    = rawTx.Account.AccountID
-		destinations = make([]string, 0)
-		//accountTotalSent = decimal.Zero
-		limit = 2000
+		accountID = account.AccountID
+		limit     = 2000
 	)
 
-	address, err := wrapper.GetAddressList(0, limit, "AccountID", rawTx.Account.AccountID)
+	address, err := wrapper.GetAddressList(0, limit, "AccountID", accountID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(address) == 0 {
-		return openwallet.Errorf(openwallet.ErrAccountNotAddress, "[%s] have not addresses", accountID)
+		return nil, openwallet.Errorf(openwallet.ErrAccountNotAddress, "[%s] have not addresses", accountID)
 		//return fmt.Errorf("[%s] have not addresses", accountID)
 	}
 
@@ -177,13 +180,32 @@ func (decoder *TransactionDecoder) CreateILCRawTransaction(wrapper openwallet.Wa
 	//查找账户的utxo
 	unspents, err := decoder.wm.ListUnspent(0, searchAddrs...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(unspents) == 0 {
-		return openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAccount, "[%s] balance is not enough", accountID)
+		return nil, openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAccount, "[%s] balance is not enough", accountID)
 	}
 
+	return unspents, nil
+}
+
+//createILCRawTransactionFromUnspents 使用已查询的账户utxo创建交易单
+func (decoder *TransactionDecoder) createILCRawTransactionFromUnspents(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction, unspents []*Unspent) error {
+
+	var (
+		usedUTXO     []*Unspent
+		outputAddrs  = make(map[string]decimal.Decimal)
+		balance      = decimal.New(0, 0)
+		totalSend    = decimal.New(0, 0)
+		actualFees   = decimal.New(0, 0)
+		feesRate     = decimal.New(0, 0)
+		accountID    = rawTx.Account.AccountID
+		destinations = make([]string, 0)
+		//accountTotalSent = decimal.Zero
+		err error
+	)
+
 	if len(rawTx.To) == 0 {
 		return errors.New("Receiver addresses is empty!")
 	}
@@ -193,6 +215,8 @@ func (decoder *TransactionDecoder) CreateILCRawTransaction(wrapper openwallet.Wa
 		deamount, _ := decimal.NewFromString(amount)
 		totalSend = totalSend.Add(deamount)
 		destinations = append(destinations, addr)
+		//装配输出
+		outputAddrs = appendOutput(outputAddrs, addr, deamount)
 		//计算账户的实际转账amount
 		//addresses, findErr := wrapper.GetAddressList(0, -1, "AccountID", rawTx.Account.AccountID, "Address", addr)
 		//if findErr != nil || len(addresses) == 0 {
@@ -201,16 +225,11 @@ func (decoder *TransactionDecoder) CreateILCRawTransaction(wrapper openwallet.Wa
 		//}
 	}
 
-	//获取utxo，按小到大排序
-	sort.Sort(UnspentSort{unspents, func(a, b *Unspent) int {
-		a_amount, _ := decimal.NewFromString(a.Amount)
-		b_amount, _ := decimal.NewFromString(b.Amount)
-		if a_amount.GreaterThan(b_amount) {
-			return 1
-		} else {
-			return -1
-		}
-	}})
+	//接收数量低于粉尘阈值，节点会拒绝交易单
+	err = decoder.checkDustOutputs(outputAddrs)
+	if err != nil {
+		return err
+	}
 
 	if len(rawTx.FeeRate) == 0 {
 		feesRate, err = decoder.wm.EstimateFeeRate()
@@ -221,61 +240,71 @@ func (decoder *TransactionDecoder) CreateILCRawTransaction(wrapper openwallet.Wa
 		feesRate, _ = decimal.NewFromString(rawTx.FeeRate)
 	}
 
-	decoder.wm.Log.Info("Calculating wallet unspent record to build transaction...")
-	computeTotalSend := totalSend
-	//循环的计算余额是否足够支付发送数额+手续费
-	for {
+	selector, err := decoder.coinSelector(rawTx)
+	if err != nil {
+		return err
+	}
 
-		usedUTXO = make([]*Unspent, 0)
-		balance = decimal.New(0, 0)
+	//按找零策略选择找零地址
+	changeOutput, err := decoder.changeOutput(wrapper, rawTx)
+	if err != nil {
+		return err
+	}
 
-		//计算一个可用于支付的余额
-		for _, u := range unspents {
+	//接收地址的锁定脚本，用于按脚本类型估算手续费
+	outputScripts, err := decoder.wm.outputScripts(destinations...)
+	if err != nil {
+		return err
+	}
 
-			if u.Spendable {
-				ua, _ := decimal.NewFromString(u.Amount)
-				balance = balance.Add(ua)
-				usedUTXO = append(usedUTXO, u)
-				if balance.GreaterThanOrEqual(computeTotalSend) {
-					break
+	//找零输出及日后花费它的手续费
+	costOfChange, err := decoder.wm.EstimateFee(1, 1, feesRate)
+	if err != nil {
+		return err
+	}
+
+	decoder.wm.Log.Info("Calculating wallet unspent record to build transaction...")
+	computeTotalSend := totalSend
+	selection, err := selector.SelectCoins(unspents, &CoinSelectionParams{
+		Target:       totalSend,
+		MaxInputs:    decoder.wm.Config.MaxTxInputs,
+		CostOfChange: costOfChange,
+		FeeFunc: func(inputs []*Unspent, change bool) (decimal.Decimal, error) {
+			scripts := outputScripts
+			if change {
+				changeScript, scriptErr := changeOutput.Script(inputs)
+				if scriptErr != nil {
+					return decimal.Zero, scriptErr
 				}
+				scripts = append(scripts[:len(scripts):len(scripts)], changeScript)
 			}
-		}
+			return decoder.wm.EstimateTxFee(rawTx.Account, inputs, scripts, feesRate)
+		},
+	})
+	if err != nil {
+		return err
+	}
 
-		if balance.LessThan(computeTotalSend) {
-			return openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAccount, "The balance: %s is not enough! ", balance.StringFixed(decoder.wm.Decimal()))
-		}
+	usedUTXO = selection.Inputs
+	balance = selection.Balance
+	changeScript, err := changeOutput.Script(usedUTXO)
+	if err != nil {
+		return err
+	}
 
-		//计算手续费，找零地址有2个，一个是发送，一个是新创建的
-		fees, err := decoder.wm.EstimateFee(int64(len(usedUTXO)), int64(len(destinations)+1), feesRate)
+	//找零低于粉尘阈值则作为手续费，有找零输出时才获取找零地址
+	changeAmount, actualFees, err := decoder.foldDustChangeScript(changeScript, selection.Change, selection.Fees)
+	if err != nil {
+		return err
+	}
+	changeAddress := ""
+	if changeAmount.GreaterThan(decimal.Zero) {
+		changeAddress, err = changeOutput.Address(usedUTXO)
 		if err != nil {
 			return err
 		}
-
-		//如果要手续费有发送支付，得计算加入手续费后，计算余额是否足够
-		//总共要发送的
-		computeTotalSend = totalSend.Add(fees)
-		if computeTotalSend.GreaterThan(balance) {
-			continue
-		}
-		computeTotalSend = totalSend
-
-		actualFees = fees
-
-		break
-
-	}
-
-	//UTXO如果大于设定限制，则分拆成多笔交易单发送
-	if len(usedUTXO) > decoder.wm.Config.MaxTxInputs {
-		errStr := fmt.Sprintf("The transaction is use max inputs over: %d", decoder.wm.Config.MaxTxInputs)
-		return errors.New(errStr)
 	}
 
-	//取账户最后一个地址
-	changeAddress := usedUTXO[0].Address
-
-	changeAmount := balance.Sub(computeTotalSend).Sub(actualFees)
 	rawTx.FeeRate = feesRate.StringFixed(decoder.wm.Decimal())
 	rawTx.Fees = actualFees.StringFixed(decoder.wm.Decimal())
 
@@ -289,13 +318,6 @@ func (decoder *TransactionDecoder) CreateILCRawTransaction(wrapper openwallet.Wa
 	decoder.wm.Log.Std.Notice("Change Address: %v", changeAddress)
 	decoder.wm.Log.Std.Notice("-----------------------------------------------")
 
-	//装配输出
-	for to, amount := range rawTx.To {
-		decamount, _ := decimal.NewFromString(amount)
-		outputAddrs = appendOutput(outputAddrs, to, decamount)
-		//outputAddrs[to] = amount
-	}
-
 	//changeAmount := balance.Sub(totalSend).Sub(actualFees)
 	if changeAmount.GreaterThan(decimal.New(0, 0)) {
 		outputAddrs = appendOutput(outputAddrs, changeAddress, changeAmount)
@@ -304,6 +326,7 @@ func (decoder *TransactionDecoder) CreateILCRawTransaction(wrapper openwallet.Wa
 
 	err = decoder.createILCRawTransaction(wrapper, rawTx, usedUTXO, outputAddrs)
 	if err != nil {
+		changeOutput.Release()
 		return err
 	}
 
@@ -442,9 +465,13 @@ func (decoder *TransactionDecoder) VerifyILCRawTransaction(wrapper openwallet.Wa
 
 	for _, vin := range trx.Vins {
 
-		utxo, err := decoder.wm.GetTxOut(vin.GetTxID(), uint64(vin.GetVout()))
-		if err != nil {
-			return err
+		//优先从输出缓存中查找
+		utxo, ok := decoder.wm.TxOutCache.Get(vin.GetTxID(), uint64(vin.GetVout()))
+		if !ok {
+			utxo, err = decoder.wm.GetTxOut(vin.GetTxID(), uint64(vin.GetVout()))
+			if err != nil {
+				return err
+			}
 		}
 
 		txUnlock := btcTransaction.TxUnlock{
@@ -575,6 +602,12 @@ func (decoder *TransactionDecoder) CreateOmniRawTransaction(wrapper openwallet.W
 		//}
 	}
 
+	//omni接收地址的主链币输出为最低转账成本，低于粉尘阈值节点会拒绝交易单
+	err = decoder.checkDustOutputs(map[string]decimal.Decimal{toAddress: transferCost})
+	if err != nil {
+		return err
+	}
+
 	/*
 
 		1. 遍历所有地址，获取token余额。
@@ -696,6 +729,17 @@ func (decoder *TransactionDecoder) CreateOmniRawTransaction(wrapper openwallet.W
 		feesRate, _ = decimal.NewFromString(rawTx.FeeRate)
 	}
 
+	//按找零策略选择找零地址
+	changeOutput, err := decoder.changeOutput(wrapper, rawTx)
+	if err != nil {
+		return err
+	}
+
+	toScripts, err := decoder.wm.outputScripts(toAddress)
+	if err != nil {
+		return err
+	}
+
 	decoder.wm.Log.Info("Calculating wallet unspent record to build transaction...")
 	computeTotalSend := transferCost
 	//循环的计算余额是否足够支付发送数额+手续费
@@ -721,8 +765,12 @@ func (decoder *TransactionDecoder) CreateOmniRawTransaction(wrapper openwallet.W
 			return openwallet.Errorf(openwallet.ErrInsufficientFees, "The [%s] available utxo balance: %s is not enough! ", decoder.wm.Symbol(), balance.StringFixed(decoder.wm.Decimal()))
 		}
 
-		//计算手续费，输出地址有2个，一个是发送，一个是找零，一个是op_reture
-		fees, err := decoder.wm.EstimateFee(int64(len(usedUTXO)), int64(3), feesRate)
+		//计算手续费，输出有3个，一个是发送，一个是找零，一个是op_return
+		changeScript, err := changeOutput.Script(usedUTXO)
+		if err != nil {
+			return err
+		}
+		fees, err := decoder.wm.EstimateTxFee(rawTx.Account, usedUTXO, [][]byte{toScripts[0], changeScript, omniSimpleSendScript()}, feesRate)
 		if err != nil {
 			return err
 		}
@@ -747,10 +795,23 @@ func (decoder *TransactionDecoder) CreateOmniRawTransaction(wrapper openwallet.W
 		return errors.New(errStr)
 	}
 
-	//取账户最后一个地址
-	changeAddress := usedUTXO[0].Address
+	changeScript, err := changeOutput.Script(usedUTXO)
+	if err != nil {
+		return err
+	}
 
-	changeAmount := balance.Sub(computeTotalSend).Sub(actualFees)
+	//找零低于粉尘阈值则作为手续费，有找零输出时才获取找零地址
+	changeAmount, actualFees, err := decoder.foldDustChangeScript(changeScript, balance.Sub(computeTotalSend).Sub(actualFees), actualFees)
+	if err != nil {
+		return err
+	}
+	changeAddress := ""
+	if changeAmount.GreaterThan(decimal.Zero) {
+		changeAddress, err = changeOutput.Address(usedUTXO)
+		if err != nil {
+			return err
+		}
+	}
 	rawTx.FeeRate = feesRate.StringFixed(decoder.wm.Decimal())
 	rawTx.Fees = actualFees.StringFixed(decoder.wm.Decimal())
 
@@ -778,6 +839,7 @@ func (decoder *TransactionDecoder) CreateOmniRawTransaction(wrapper openwallet.W
 
 	err = decoder.createOmniRawTransaction(wrapper, rawTx, usedUTXO, outputAddrs, omniOutputAddrs)
 	if err != nil {
+		changeOutput.Release()
 		return err
 	}
 
@@ -1071,7 +1133,15 @@ func (decoder *TransactionDecoder) CreateILCSummaryRawTransaction(wrapper openwa
 			//执行构建交易单工作
 			//decoder.wm.Log.Debugf("sumUnspents: %+v", sumUnspents)
 			//计算手续费，构建交易单inputs，地址保留余额>0，地址需要加入输出，最后+1是汇总地址
-			fees, createErr := decoder.wm.EstimateFee(int64(len(sumUnspents)), int64(len(outputAddrs)+1), feesRate)
+			sumOutputs := []string{sumRawTx.SummaryAddress}
+			for a := range outputAddrs {
+				sumOutputs = append(sumOutputs, a)
+			}
+			outputScripts, createErr := decoder.wm.outputScripts(sumOutputs...)
+			if createErr != nil {
+				return nil, createErr
+			}
+			fees, createErr := decoder.wm.EstimateTxFee(sumRawTx.Account, sumUnspents, outputScripts, feesRate)
 			if createErr != nil {
 				return nil, createErr
 			}
@@ -1174,6 +1244,11 @@ func (decoder *TransactionDecoder) createILCRawTransaction(
 		return fmt.Errorf("Receiver addresses is empty! ")
 	}
 
+	err = decoder.checkDustOutputs(to)
+	if err != nil {
+		return err
+	}
+
 	//计算总发送金额
 	for addr, amount := range to {
 		//deamount, _ := decimal.NewFromString(amount)
@@ -1334,6 +1409,11 @@ func (decoder *TransactionDecoder) createOmniRawTransaction(
 		return fmt.Errorf("Receiver addresses is empty! ")
 	}
 
+	err = decoder.checkDustOutputs(coinTo)
+	if err != nil {
+		return err
+	}
+
 	//Omni代币编号
 	propertyID := common.NewString(rawTx.Coin.Contract.Address).UInt64()
 	tokenDecimals := int32(rawTx.Coin.Contract.Decimals)
@@ -1566,6 +1646,12 @@ func (decoder *TransactionDecoder) CreateOmniSummaryRawTransaction(wrapper openw
 		feesRate, _ = decimal.NewFromString(sumRawTx.FeeRate)
 	}
 
+	//汇总地址无法解析时所有地址都不能汇总
+	summaryScripts, err := decoder.wm.outputScripts(sumRawTx.SummaryAddress)
+	if err != nil {
+		return nil, err
+	}
+
 	/*
 
 		1. 遍历账户所有地址。
@@ -1610,8 +1696,20 @@ func (decoder *TransactionDecoder) CreateOmniSummaryRawTransaction(wrapper openw
 			}
 		}
 		//decoder.wm.Log.Debug("addrBalance:", addrBalance)
-		//计算手续费，构建交易单inputs + 1（可选手续费地址），输出2个，1个为目标地址，1个为找零
-		fees, createErr := decoder.wm.EstimateFee(int64(len(unspents))+1, 2, feesRate)
+		_, createErr = decoder.wm.outputScripts(address.Address)
+		if createErr != nil {
+			//地址无法解析，记录该地址的汇总失败，继续汇总其他地址
+			rawTxArray = append(rawTxArray, &openwallet.RawTransactionWithError{
+				RawTx: &openwallet.RawTransaction{
+					Coin:    sumRawTx.Coin,
+					Account: sumRawTx.Account,
+				},
+				Error: openwallet.ConvertError(createErr),
+			})
+			continue
+		}
+		//计算手续费，地址自己支付时输出为汇总地址（找零也到汇总地址）及op_return
+		fees, createErr := decoder.wm.EstimateTxFee(sumRawTx.Account, unspents, append(summaryScripts[:1:1], omniSimpleSendScript()), feesRate)
 		if createErr != nil {
 			return nil, createErr
 		}
@@ -1638,8 +1736,28 @@ func (decoder *TransactionDecoder) CreateOmniSummaryRawTransaction(wrapper openw
 				continue
 			}
 
-			//查找足够付费的utxo
-			supportUnspent, supportErr := decoder.getUTXOSatisfyAmount(feesSupportUnspents, totalCost)
+			//查找足够付费的utxo，按实际的输入及输出（汇总地址、手续费地址找零及op_return）重新估算手续费，
+			//选中的utxo不足以支付新的手续费时再选一次
+			var (
+				supportUnspent *Unspent
+				supportErr     *openwallet.Error
+			)
+			for try := 0; try < 2; try++ {
+				supportUnspent, supportErr = decoder.getUTXOSatisfyAmount(feesSupportUnspents, totalCost)
+				if supportErr != nil {
+					break
+				}
+				fees, createErr = decoder.omniSummarySupportFee(sumRawTx, unspents, supportUnspent, summaryScripts[0], feesRate)
+				if createErr != nil {
+					supportErr = openwallet.ConvertError(createErr)
+					break
+				}
+				totalCost = transferCost.Add(fees)
+				if unspentAmount(supportUnspent).GreaterThanOrEqual(totalCost) {
+					break
+				}
+				supportErr = openwallet.Errorf(openwallet.ErrInsufficientFees, "fees support utxo: %s is less than totalCost: %s", supportUnspent.Amount, totalCost.String())
+			}
 			//supportUnspent, supportErr := decoder.getAssetsAccountUnspentSatisfyAmount(wrapper, feesSupportAccount, totalCost)
 			if supportErr != nil {
 				rawTxWithErr := &openwallet.RawTransactionWithError{
@@ -1664,8 +1782,15 @@ func (decoder *TransactionDecoder) CreateOmniSummaryRawTransaction(wrapper openw
 			//手续费地址utxo作为输入
 			unspents = append(unspents, supportUnspent)
 
-			//手续费地址 计算找零 = 手续费支持数量 + 地址余额 - 手续费 - 最低成本
-			changeAmount = supportAmount.Add(addrBalance).Sub(totalCost)
+			//手续费地址 计算找零 = 手续费支持数量 + 地址余额 - 手续费 - 最低成本，低于粉尘阈值则作为手续费
+			changeAmount, fees, createErr = decoder.foldDustChange(supportUnspent.Address, supportAmount.Add(addrBalance).Sub(totalCost), fees)
+			if createErr != nil {
+				rawTxArray = append(rawTxArray, &openwallet.RawTransactionWithError{
+					RawTx: feeSupportRawTx,
+					Error: openwallet.ConvertError(createErr),
+				})
+				continue
+			}
 			if changeAmount.GreaterThan(decimal.Zero) {
 				//主币输出第二个地址为找零地址，找零主币
 				outputAddrs = appendOutput(outputAddrs, supportUnspent.Address, changeAmount)
@@ -1677,8 +1802,18 @@ func (decoder *TransactionDecoder) CreateOmniSummaryRawTransaction(wrapper openw
 
 		} else {
 
-			//计算找零 = 地址余额 - 手续费 - 汇总地址的最低转账成本
-			changeAmount = addrBalance.Sub(totalCost)
+			//计算找零 = 地址余额 - 手续费 - 汇总地址的最低转账成本，低于粉尘阈值则作为手续费
+			changeAmount, fees, createErr = decoder.foldDustChange(sumRawTx.SummaryAddress, addrBalance.Sub(totalCost), fees)
+			if createErr != nil {
+				rawTxArray = append(rawTxArray, &openwallet.RawTransactionWithError{
+					RawTx: &openwallet.RawTransaction{
+						Coin:    sumRawTx.Coin,
+						Account: sumRawTx.Account,
+					},
+					Error: openwallet.ConvertError(createErr),
+				})
+				continue
+			}
 			if changeAmount.GreaterThan(decimal.Zero) {
 				//主币输出第二个地址为找零地址，找零主币到汇总地址
 				//outputAddrs = appendOutput(outputAddrs, address.Address, changeAmount)
@@ -1727,6 +1862,20 @@ func (decoder *TransactionDecoder) CreateOmniSummaryRawTransaction(wrapper openw
 	return rawTxArray, nil
 }
 
+//omniSummarySupportFee 手续费账户支持时的手续费，输入为地址的utxo及手续费utxo，输出为汇总地址、手续费地址找零及op_return
+func (decoder *TransactionDecoder) omniSummarySupportFee(sumRawTx *openwallet.SummaryRawTransaction, unspents []*Unspent, supportUnspent *Unspent, summaryScript []byte, feesRate decimal.Decimal) (decimal.Decimal, error) {
+
+	changeScripts, err := decoder.wm.outputScripts(supportUnspent.Address)
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	inputs := append(unspents[:len(unspents):len(unspents)], supportUnspent)
+	outputs := [][]byte{summaryScript, changeScripts[0], omniSimpleSendScript()}
+
+	return decoder.wm.EstimateTxFee(sumRawTx.Account, inputs, outputs, feesRate)
+}
+
 // CreateSummaryRawTransactionWithError 创建汇总交易，返回能原始交易单数组（包含带错误的原始交易单）
 func (decoder *TransactionDecoder) CreateSummaryRawTransactionWithError(wrapper openwallet.WalletDAI, sumRawTx *openwallet.SummaryRawTransaction) ([]*openwallet.RawTransactionWithError, error) {
 	if sumRawTx.Coin.IsContract {
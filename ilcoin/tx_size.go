@@ -0,0 +1,233 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	//InputP2PKH 普通公钥哈希输入
+	InputP2PKH = "p2pkh"
+	//InputP2WPKH 原生隔离见证公钥哈希输入
+	InputP2WPKH = "p2wpkh"
+	//InputP2SHP2WPKH 嵌套在P2SH中的隔离见证公钥哈希输入
+	InputP2SHP2WPKH = "p2sh-p2wpkh"
+	//InputP2SHMultisig P2SH多重签名输入
+	InputP2SHMultisig = "p2sh-multisig"
+
+	//签名按最大的DER编码72字节（含sighash类型）计算，公钥为压缩公钥
+	txSigSize    = 72
+	txPubKeySize = 33
+	//输入的前序输出及sequence
+	txOutPointSize = 32 + 4
+	txSequenceSize = 4
+	//版本及锁定时间
+	txVersionLockTimeSize = 4 + 4
+	//隔离见证交易的marker及flag
+	txWitnessFlagSize = 2
+
+	//P2PKH锁定脚本：OP_DUP OP_HASH160 20字节公钥哈希 OP_EQUALVERIFY OP_CHECKSIG
+	p2pkhScriptSize = 25
+
+	//omni简单转账的OP_RETURN数据："omni" + 版本2 + 类型2 + 代币编号4 + 数量8
+	omniSimpleSendPayloadSize = 4 + 2 + 2 + 4 + 8
+)
+
+//TxSizeEstimator 按输入输出的脚本类型估算交易单的虚拟大小
+type TxSizeEstimator struct {
+	inputs      int
+	outputs     int
+	baseSize    int64
+	witnessSize int64
+	hasWitness  bool
+}
+
+//NewTxSizeEstimator 创建交易单大小估算器
+func NewTxSizeEstimator() *TxSizeEstimator {
+	return &TxSizeEstimator{}
+}
+
+//pushDataSize 把n字节数据压入栈的操作码大小
+func pushDataSize(n int) int64 {
+	switch {
+	case n <= txscript.OP_DATA_75:
+		return 1
+	case n <= 0xff:
+		return 2
+	case n <= 0xffff:
+		return 3
+	}
+	return 5
+}
+
+//AddInput 增加一个输入，多重签名输入需要提供required-of-total
+func (e *TxSizeEstimator) AddInput(inputType string, required, total int) error {
+
+	var (
+		scriptSig int64
+		witness   int64
+	)
+
+	//见证数据：项数 + 签名 + 公钥
+	p2wpkhWitness := int64(1 + 1 + txSigSize + 1 + txPubKeySize)
+
+	switch inputType {
+	case InputP2PKH:
+		scriptSig = 1 + txSigSize + 1 + txPubKeySize
+	case InputP2WPKH:
+		scriptSig = 0
+		witness = p2wpkhWitness
+	case InputP2SHP2WPKH:
+		//赎回脚本：OP_0 + 20字节公钥哈希
+		scriptSig = 1 + 22
+		witness = p2wpkhWitness
+	case InputP2SHMultisig:
+		if required <= 0 || total < required {
+			return fmt.Errorf("invalid multisig %d-of-%d", required, total)
+		}
+		//赎回脚本：OP_m + n个公钥 + OP_n + OP_CHECKMULTISIG
+		redeemScript := 3 + total*(1+txPubKeySize)
+		scriptSig = 1 + int64(required)*(1+txSigSize) + pushDataSize(redeemScript) + int64(redeemScript)
+	default:
+		return fmt.Errorf("unknown input type: %s", inputType)
+	}
+
+	e.inputs++
+	e.baseSize += txOutPointSize + int64(wire.VarIntSerializeSize(uint64(scriptSig))) + scriptSig + txSequenceSize
+	if witness > 0 {
+		e.hasWitness = true
+		e.witnessSize += witness
+	} else {
+		//隔离见证交易中非见证输入的见证数据为一个空的项数
+		e.witnessSize += 1
+	}
+	return nil
+}
+
+//AddOutput 增加一个输出
+func (e *TxSizeEstimator) AddOutput(script []byte) {
+	e.outputs++
+	e.baseSize += 8 + int64(wire.VarIntSerializeSize(uint64(len(script)))) + int64(len(script))
+}
+
+//Weight 交易单的重量
+func (e *TxSizeEstimator) Weight() int64 {
+	base := e.baseSize + txVersionLockTimeSize +
+		int64(wire.VarIntSerializeSize(uint64(e.inputs))) +
+		int64(wire.VarIntSerializeSize(uint64(e.outputs)))
+	weight := base * 4
+	if e.hasWitness {
+		weight += txWitnessFlagSize + e.witnessSize
+	}
+	return weight
+}
+
+//VSize 交易单的虚拟大小，重量除以4向上取整
+func (e *TxSizeEstimator) VSize() int64 {
+	return (e.Weight() + 3) / 4
+}
+
+//omniSimpleSendScript omni简单转账的OP_RETURN锁定脚本，只用于估算大小
+func omniSimpleSendScript() []byte {
+	return append([]byte{txscript.OP_RETURN, omniSimpleSendPayloadSize}, make([]byte, omniSimpleSendPayloadSize)...)
+}
+
+//unspentInputType 按utxo的锁定脚本判断输入类型，多重签名账户的P2SH总是按账户的多重签名估算，
+//单签账户的P2SH只在开启隔离见证时出现，为P2SH-P2WPKH
+func (wm *WalletManager) unspentInputType(u *Unspent, account *openwallet.AssetsAccount) (string, int, int) {
+
+	script, _ := hex.DecodeString(u.ScriptPubKey)
+
+	switch txscript.GetScriptClass(script) {
+	case txscript.WitnessV0PubKeyHashTy:
+		return InputP2WPKH, 0, 0
+	case txscript.ScriptHashTy:
+		if account != nil && len(account.OwnerKeys) > 1 {
+			return InputP2SHMultisig, int(account.Required), len(account.OwnerKeys)
+		}
+		return InputP2SHP2WPKH, 0, 0
+	}
+
+	//其他类型按P2PKH估算
+	return InputP2PKH, 0, 0
+}
+
+//EstimateTxVSize 按输入utxo及输出锁定脚本的类型估算交易单的虚拟大小
+func (wm *WalletManager) EstimateTxVSize(account *openwallet.AssetsAccount, inputs []*Unspent, outputs [][]byte) (int64, error) {
+	estimator := NewTxSizeEstimator()
+	for _, u := range inputs {
+		inputType, required, total := wm.unspentInputType(u, account)
+		if err := estimator.AddInput(inputType, required, total); err != nil {
+			return 0, err
+		}
+	}
+	for _, script := range outputs {
+		estimator.AddOutput(script)
+	}
+	return estimator.VSize(), nil
+}
+
+//EstimateTxFee 按输入utxo及输出锁定脚本的类型估算手续费
+func (wm *WalletManager) EstimateTxFee(account *openwallet.AssetsAccount, inputs []*Unspent, outputs [][]byte, feeRate decimal.Decimal) (decimal.Decimal, error) {
+	vsize, err := wm.EstimateTxVSize(account, inputs, outputs)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	return wm.feeOfVSize(vsize, feeRate), nil
+}
+
+//unspentInputFee 花费utxo的输入本身需要的手续费，不计最小手续费
+func (wm *WalletManager) unspentInputFee(u *Unspent, account *openwallet.AssetsAccount, feeRate decimal.Decimal) (decimal.Decimal, error) {
+	estimator := NewTxSizeEstimator()
+	inputType, required, total := wm.unspentInputType(u, account)
+	if err := estimator.AddInput(inputType, required, total); err != nil {
+		return decimal.Zero, err
+	}
+	vsize := (estimator.Weight() - NewTxSizeEstimator().Weight() + 3) / 4
+	fee := decimal.New(vsize, 0).Mul(feeRate).Div(decimal.New(1000, 0))
+	return fee.Shift(wm.Decimal()).Ceil().Shift(-wm.Decimal()), nil
+}
+
+//feeOfVSize 虚拟大小按每KB费率计算的手续费，向上取整到最小单位，保证不低于目标费率
+func (wm *WalletManager) feeOfVSize(vsize int64, feeRate decimal.Decimal) decimal.Decimal {
+	fee := decimal.New(vsize, 0).Mul(feeRate).Div(decimal.New(1000, 0))
+	fee = fee.Shift(wm.Decimal()).Ceil().Shift(-wm.Decimal())
+	//是否低于最小手续费
+	if fee.LessThan(wm.Config.MinFees) {
+		fee = wm.Config.MinFees
+	}
+	return fee
+}
+
+//outputScripts 地址对应的锁定脚本
+func (wm *WalletManager) outputScripts(addresses ...string) ([][]byte, error) {
+	scripts := make([][]byte, 0, len(addresses))
+	for _, address := range addresses {
+		script, err := wm.addressScriptPubKey(address)
+		if err != nil {
+			return nil, openwallet.Errorf(openwallet.ErrAdressDecodeFailed, err.Error())
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts, nil
+}
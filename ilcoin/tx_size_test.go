@@ -0,0 +1,253 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/blocktree/openwallet/openwallet"
+	"github.com/shopspring/decimal"
+)
+
+func TestTxSizeEstimator_VSize(t *testing.T) {
+
+	p2pkh := testScript("a")
+	p2wpkh := append([]byte{0x00, 0x14}, bytes.Repeat([]byte{0x01}, 20)...)
+
+	type input struct {
+		inputType       string
+		required, total int
+	}
+
+	cases := []struct {
+		name    string
+		inputs  []input
+		outputs [][]byte
+		want    int64
+	}{
+		{"p2pkh", []input{{InputP2PKH, 0, 0}}, [][]byte{p2pkh, p2pkh}, 226},
+		{"p2wpkh", []input{{InputP2WPKH, 0, 0}}, [][]byte{p2wpkh}, 110},
+		{"p2sh-p2wpkh", []input{{InputP2SHP2WPKH, 0, 0}}, [][]byte{p2pkh}, 136},
+		{"p2sh 2-of-3", []input{{InputP2SHMultisig, 2, 3}}, [][]byte{p2pkh}, 341},
+		{"mixed with nulldata", []input{{InputP2PKH, 0, 0}, {InputP2WPKH, 0, 0}}, [][]byte{omniSimpleSendScript()}, 258},
+	}
+
+	for _, c := range cases {
+		estimator := NewTxSizeEstimator()
+		for _, in := range c.inputs {
+			if err := estimator.AddInput(in.inputType, in.required, in.total); err != nil {
+				t.Fatalf("%s: AddInput unexpected error: %v", c.name, err)
+			}
+		}
+		for _, script := range c.outputs {
+			estimator.AddOutput(script)
+		}
+		if got := estimator.VSize(); got != c.want {
+			t.Errorf("%s: vsize = %d, want %d", c.name, got, c.want)
+		}
+	}
+
+	if err := NewTxSizeEstimator().AddInput(InputP2SHMultisig, 3, 2); err == nil {
+		t.Errorf("invalid multisig should fail")
+	}
+	if err := NewTxSizeEstimator().AddInput("p2tr", 0, 0); err == nil {
+		t.Errorf("unknown input type should fail")
+	}
+}
+
+func TestWalletManager_EstimateFee(t *testing.T) {
+
+	wm := NewWalletManager()
+	wm.Config.IsTestNet = false
+	feeRate := decimal.RequireFromString("0.0001")
+
+	//只知道数量时与原来的148 * 输入 + 34 * 输出 + 10一致
+	fees, _ := wm.EstimateFee(10, 2, feeRate)
+	if !fees.Equal(decimal.RequireFromString("0.0001558")) {
+		t.Errorf("EstimateFee(10, 2) = %s", fees)
+	}
+	wm.Config.MaxTxInputs = 2
+	fees, _ = wm.EstimateFee(3, 2, feeRate)
+	if !fees.Equal(decimal.RequireFromString("0.0000532")) {
+		t.Errorf("EstimateFee(3, 2) in 2 pieces = %s", fees)
+	}
+
+	//向上取整到最小单位
+	if fee := wm.feeOfVSize(226, decimal.RequireFromString("0.000011")); !fee.Equal(decimal.RequireFromString("0.00000249")) {
+		t.Errorf("fee of 226 vbytes = %s", fee)
+	}
+	wm.Config.MinFees = decimal.RequireFromString("0.00001")
+	if fee := wm.feeOfVSize(226, decimal.RequireFromString("0.000011")); !fee.Equal(wm.Config.MinFees) {
+		t.Errorf("fee below min fees = %s", fee)
+	}
+}
+
+func TestTransactionDecoder_CreateILCRawTransaction_FeeRate(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+	node.mine("b1", newTestTx("cb1", nil, testTxOut{"a", "1"}))
+
+	wm, wrapper, account := newTestWallet(node, "a")
+	decoder := NewTransactionDecoder(wm)
+
+	//接收地址为P2WPKH，找零为P2PKH：10 + 148 + 31 + 34 = 223
+	bech32, _ := scriptPubKeyToBech32Address(append([]byte{0x00, 0x14}, bytes.Repeat([]byte{0x01}, 20)...), false)
+	rawTx := newTestRawTx(account, "0.0001", nil)
+	rawTx.To[bech32] = "0.1"
+	if err := decoder.CreateILCRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("CreateILCRawTransaction unexpected error: %v", err)
+	}
+	if rawTx.Fees != "0.00002230" {
+		t.Errorf("fees = %s, want 0.0000223", rawTx.Fees)
+	}
+}
+
+func TestWalletManager_UnspentInputType(t *testing.T) {
+
+	wm := NewWalletManager()
+	p2sh := hex.EncodeToString(append(append([]byte{0xa9, 0x14}, bytes.Repeat([]byte{0x01}, 20)...), 0x87))
+	single := &openwallet.AssetsAccount{OwnerKeys: []string{"k1"}, Required: 1}
+	multisig := &openwallet.AssetsAccount{OwnerKeys: []string{"k1", "k2", "k3"}, Required: 2}
+
+	for _, segWit := range []bool{false, true} {
+		wm.Config.SupportSegWit = segWit
+
+		//多重签名账户不受隔离见证配置影响
+		inputType, required, total := wm.unspentInputType(&Unspent{ScriptPubKey: p2sh}, multisig)
+		if inputType != InputP2SHMultisig || required != 2 || total != 3 {
+			t.Errorf("segwit %v multisig: %s %d-of-%d", segWit, inputType, required, total)
+		}
+
+		inputType, _, _ = wm.unspentInputType(&Unspent{ScriptPubKey: p2sh}, single)
+		if inputType != InputP2SHP2WPKH {
+			t.Errorf("segwit %v single: %s", segWit, inputType)
+		}
+	}
+}
+
+//newTestOmniSummary 开启omni的钱包，a地址自己支付手续费，c地址的主币不足，由手续费账户的f地址支持
+func newTestOmniSummary(t *testing.T, node *testNode, aAmount, cAmount, supportAmount string) (*TransactionDecoder, *testWalletDAI, *openwallet.SummaryRawTransaction) {
+
+	node.mine("b1", newTestTx("cb1", nil, testTxOut{"a", aAmount}, testTxOut{"c", cAmount}, testTxOut{"f", supportAmount}))
+	node.omni[testAddress("a")] = "100"
+	node.omni[testAddress("c")] = "100"
+
+	wm, wrapper, account := newTestWallet(node, "a", "c")
+	wm.Config.OmniSupport = true
+	wm.Config.OmniTransferCost = "0.00000546"
+	wm.OnmiClient = NewClient(node.server.URL, "", false)
+
+	feesAccount := &openwallet.AssetsAccount{AccountID: "fees_account", Symbol: wm.Symbol(), Required: 1}
+	wrapper.accounts = append(wrapper.accounts, feesAccount)
+	wrapper.addresses = append(wrapper.addresses, &openwallet.Address{AccountID: feesAccount.AccountID, Address: testAddress("f")})
+
+	sumRawTx := &openwallet.SummaryRawTransaction{
+		Coin: openwallet.Coin{
+			Symbol:     wm.Symbol(),
+			IsContract: true,
+			Contract:   openwallet.SmartContract{Address: "31", Decimals: 8},
+		},
+		Account:            account,
+		FeeRate:            "0.0001",
+		SummaryAddress:     testAddress("s"),
+		MinTransfer:        "0",
+		RetainedBalance:    "0",
+		AddressLimit:       -1,
+		FeesSupportAccount: &openwallet.FeesSupportAccount{AccountID: feesAccount.AccountID},
+	}
+
+	return NewTransactionDecoder(wm), wrapper, sumRawTx
+}
+
+//testRawTxFees 交易单输入减输出的实际手续费，输入都来自节点上的交易单
+func testRawTxFees(t *testing.T, node *testNode, rawTx *openwallet.RawTransaction) int64 {
+	msgTx := decodeTestRawTx(t, rawTx)
+	fees := int64(0)
+	for _, in := range msgTx.TxIn {
+		prev := node.txs[in.PreviousOutPoint.Hash.String()]
+		value, _ := decimal.NewFromString(prev.Vouts[in.PreviousOutPoint.Index].Value)
+		fees += value.Shift(8).IntPart()
+	}
+	for _, out := range msgTx.TxOut {
+		fees -= out.Value
+	}
+	return fees
+}
+
+func TestTransactionDecoder_CreateOmniSummaryRawTransaction_Fees(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+	decoder, wrapper, sumRawTx := newTestOmniSummary(t, node, "0.01", "0.00001", "0.01")
+
+	rawTxs, err := decoder.CreateOmniSummaryRawTransaction(wrapper, sumRawTx)
+	if err != nil {
+		t.Fatalf("CreateOmniSummaryRawTransaction unexpected error: %v", err)
+	}
+	if len(rawTxs) != 2 {
+		t.Fatalf("summary transactions = %d, want 2", len(rawTxs))
+	}
+
+	//a：1个输入，汇总地址（含找零）及op_return 2个输出：10 + 148 + 34 + 31 = 223
+	//c：加上手续费地址的输入及找零：10 + 2 * 148 + 2 * 34 + 31 = 405
+	wantFees := []int64{2230, 4050}
+	for i, rawTxWithErr := range rawTxs {
+		if rawTxWithErr.Error != nil {
+			t.Fatalf("summary[%d] unexpected error: %v", i, rawTxWithErr.Error)
+		}
+		rawTx := rawTxWithErr.RawTx
+		fees, _ := decimal.NewFromString(rawTx.Fees)
+		if fees.Shift(8).IntPart() != wantFees[i] || testRawTxFees(t, node, rawTx) != wantFees[i] {
+			t.Errorf("summary[%d] fees = %s, actual %d, want %d", i, rawTx.Fees, testRawTxFees(t, node, rawTx), wantFees[i])
+		}
+	}
+}
+
+func TestTransactionDecoder_CreateOmniSummaryRawTransaction_DustChange(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+	//两笔交易单的找零都是100，低于粉尘阈值546
+	//a：546 + 2230 + 100；c：546 + 4050 + 100 - 1
+	decoder, wrapper, sumRawTx := newTestOmniSummary(t, node, "0.00002876", "0.00000001", "0.00004695")
+
+	rawTxs, err := decoder.CreateOmniSummaryRawTransaction(wrapper, sumRawTx)
+	if err != nil {
+		t.Fatalf("CreateOmniSummaryRawTransaction unexpected error: %v", err)
+	}
+	if len(rawTxs) != 2 {
+		t.Fatalf("summary transactions = %d, want 2", len(rawTxs))
+	}
+
+	wantFees := []int64{2330, 4150}
+	for i, rawTxWithErr := range rawTxs {
+		if rawTxWithErr.Error != nil {
+			t.Fatalf("summary[%d] unexpected error: %v", i, rawTxWithErr.Error)
+		}
+		rawTx := rawTxWithErr.RawTx
+		fees, _ := decimal.NewFromString(rawTx.Fees)
+		if fees.Shift(8).IntPart() != wantFees[i] || testRawTxFees(t, node, rawTx) != wantFees[i] {
+			t.Errorf("summary[%d] fees = %s, actual %d, want %d", i, rawTx.Fees, testRawTxFees(t, node, rawTx), wantFees[i])
+		}
+		//只有汇总地址及op_return
+		if msgTx := decodeTestRawTx(t, rawTx); len(msgTx.TxOut) != 2 {
+			t.Errorf("summary[%d] outputs = %d, want 2", i, len(msgTx.TxOut))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+//TxOutCache 最近扫描到的交易单输出缓存，key = txid:vout
+//用于追溯交易单输入的地址及金额，超过容量时淘汰最久未使用的输出
+type TxOutCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	lru      *list.List
+	hits     uint64
+	misses   uint64
+}
+
+type txOutCacheItem struct {
+	key  string
+	vout Vout
+}
+
+//NewTxOutCache 创建输出缓存，capacity <= 0 时不缓存
+func NewTxOutCache(capacity int) *TxOutCache {
+	if capacity <= 0 {
+		return nil
+	}
+	cache := TxOutCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	return &cache
+}
+
+func txOutCacheKey(txid string, n uint64) string {
+	return fmt.Sprintf("%s:%d", txid, n)
+}
+
+//Add 缓存交易单的第n个输出
+func (c *TxOutCache) Add(txid string, n uint64, vout *Vout) {
+	if c == nil || vout == nil {
+		return
+	}
+
+	key := txOutCacheKey(txid, n)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, exist := c.items[key]; exist {
+		e.Value.(*txOutCacheItem).vout = *vout
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.lru.PushFront(&txOutCacheItem{key: key, vout: *vout})
+
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*txOutCacheItem).key)
+	}
+}
+
+//AddTransaction 缓存交易单的所有输出
+func (c *TxOutCache) AddTransaction(trx *Transaction) {
+	if c == nil || trx == nil {
+		return
+	}
+	for i, vout := range trx.Vouts {
+		c.Add(trx.TxID, uint64(i), vout)
+	}
+}
+
+//Get 查找交易单输出，并累计命中及未命中次数
+func (c *TxOutCache) Get(txid string, n uint64) (*Vout, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, exist := c.items[txOutCacheKey(txid, n)]
+	if !exist {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+	c.lru.MoveToFront(e)
+	vout := e.Value.(*txOutCacheItem).vout
+	return &vout, true
+}
+
+//Len 缓存的输出数量
+func (c *TxOutCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+//Hits 命中次数
+func (c *TxOutCache) Hits() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.hits)
+}
+
+//Misses 未命中次数
+func (c *TxOutCache) Misses() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.misses)
+}
+
+//getPrevTxOut 获取交易单输入引用的上一笔输出，优先从缓存中查找，没有则查询上一笔交易单
+//上一笔交易单没有该输出时返回nil
+func (wm *WalletManager) getPrevTxOut(txid string, vout uint64) (*Vout, error) {
+
+	if output, ok := wm.TxOutCache.Get(txid, vout); ok {
+		return output, nil
+	}
+
+	preTx, err := wm.GetTransaction(txid)
+	if err != nil {
+		return nil, err
+	}
+
+	wm.TxOutCache.AddTransaction(preTx)
+
+	if len(preTx.Vouts) <= int(vout) {
+		return nil, nil
+	}
+
+	return preTx.Vouts[vout], nil
+}
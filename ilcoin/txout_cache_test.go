@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTxOutCache(t *testing.T) {
+
+	cache := NewTxOutCache(2)
+
+	cache.Add("tx1", 0, &Vout{Addr: "addr1", Value: "1"})
+	cache.Add("tx1", 1, &Vout{Addr: "addr2", Value: "2"})
+
+	if out, ok := cache.Get("tx1", 0); !ok || out.Addr != "addr1" {
+		t.Errorf("Get tx1:0 = %v %v", out, ok)
+	}
+
+	//tx1:1 最久未使用，被淘汰
+	cache.Add("tx2", 0, &Vout{Addr: "addr3", Value: "3"})
+	if _, ok := cache.Get("tx1", 1); ok {
+		t.Errorf("tx1:1 should be evicted")
+	}
+	if out, ok := cache.Get("tx2", 0); !ok || out.Value != "3" {
+		t.Errorf("Get tx2:0 = %v %v", out, ok)
+	}
+
+	if cache.Len() != 2 || cache.Hits() != 2 || cache.Misses() != 1 {
+		t.Errorf("cache len = %d, hits = %d, misses = %d", cache.Len(), cache.Hits(), cache.Misses())
+	}
+
+	//容量为0不缓存
+	var disabled = NewTxOutCache(0)
+	disabled.Add("tx1", 0, &Vout{})
+	if _, ok := disabled.Get("tx1", 0); ok || disabled.Len() != 0 {
+		t.Errorf("disabled cache should not store outputs")
+	}
+}
+
+func TestILCBlockScanner_ExtractInputsFromTxOutCache(t *testing.T) {
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	fund := newTestTx("fund", nil, testTxOut{"alice_addr", "10"}, testTxOut{"carol_addr", "5"})
+	node.mine("a1", fund)
+	pay := newTestTx("pay", []testTxIn{{TxID: fund.TxID, Vout: 0}}, testTxOut{"bob_addr", "7"}, testTxOut{"alice_addr", "2.9"})
+	//同一区块内花费上一笔交易单的输出
+	spend := newTestTx("spend", []testTxIn{{TxID: pay.TxID, Vout: 1}, {TxID: fund.TxID, Vout: 1}}, testTxOut{"bob_addr", "7.8"})
+	node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), pay, spend)
+
+	wm, bs, observer := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+
+	for h := uint64(1); h <= 2; h++ {
+		if err := bs.ScanBlock(h); err != nil {
+			t.Fatalf("ScanBlock(%d) unexpected error: %v", h, err)
+		}
+	}
+
+	if n := node.callCount("getrawtransaction"); n != 0 {
+		t.Errorf("getrawtransaction called %d times, want 0", n)
+	}
+	if wm.TxOutCache.Hits() != 3 || wm.TxOutCache.Misses() != 0 {
+		t.Errorf("cache hits = %d, misses = %d", wm.TxOutCache.Hits(), wm.TxOutCache.Misses())
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	var spent []string
+	for _, data := range observer.data["alice"] {
+		for _, input := range data.TxInputs {
+			spent = append(spent, fmt.Sprintf("%s:%s", input.TxID, input.Amount))
+		}
+	}
+	if len(spent) != 2 || spent[0] != pay.TxID+":10" || spent[1] != spend.TxID+":2.9" {
+		t.Errorf("alice spent = %v", spent)
+	}
+}
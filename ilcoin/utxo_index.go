@@ -0,0 +1,325 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/asdine/storm"
+)
+
+//UTXORecord 本地未花索引中关注地址的输出
+//先扫描到花费的输出（如补扫历史区块）没有所在区块，收到输出后补全
+type UTXORecord struct {
+	Key          string `storm:"id"` //txid:vout
+	TxID         string
+	Vout         uint64
+	Address      string `storm:"index"`
+	ScriptPubKey string
+	Amount       string
+	BlockHeight  uint64 `storm:"index"` //输出所在区块高度，0则未知
+	BlockHash    string
+	SpentTxID    string //花费的交易单号，为空则未花
+	SpentHeight  uint64 `storm:"index"` //花费的交易单所在区块高度
+}
+
+//UTXOIndex 由扫描结果维护的关注地址未花索引
+type UTXOIndex struct {
+	stormFile
+}
+
+//NewUTXOIndex 创建未花索引，数据库文件在首次使用时打开
+func NewUTXOIndex(dbFile string) *UTXOIndex {
+	return &UTXOIndex{stormFile{path: dbFile}}
+}
+
+//Apply 按顺序应用区块中提取成功的交易单：收到的输出加入索引，输入花费的输出标记为已花
+//spentDepth 花费超过此深度的输出从索引中删除，0则保留
+func (index *UTXOIndex) Apply(height uint64, results []ExtractResult, spentDepth uint64) error {
+
+	db, err := index.open()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, result := range results {
+		if !result.Success {
+			continue
+		}
+
+		for _, data := range result.extractData {
+
+			for _, output := range data.TxOutputs {
+				record, err := findUTXORecord(tx, txOutCacheKey(output.TxID, output.Index))
+				if err != nil {
+					return err
+				}
+				record.TxID = output.TxID
+				record.Vout = output.Index
+				record.Address = output.Address
+				record.Amount = output.Amount
+				record.ScriptPubKey = output.GetExtParam().Get("scriptPubKey").String()
+				record.BlockHeight = height
+				record.BlockHash = output.BlockHash
+				err = tx.Save(record)
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, input := range data.TxInputs {
+				record, err := findUTXORecord(tx, txOutCacheKey(input.SourceTxID, input.SourceIndex))
+				if err != nil {
+					return err
+				}
+				if len(record.TxID) == 0 {
+					record.TxID = input.SourceTxID
+					record.Vout = input.SourceIndex
+					record.Address = input.Address
+					record.Amount = input.Amount
+				}
+				record.SpentTxID = input.TxID
+				record.SpentHeight = height
+				err = tx.Save(record)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if spentDepth > 0 && height > spentDepth {
+		//超过最大回滚深度的已花输出不再需要
+		var expired []*UTXORecord
+		err = tx.Range("SpentHeight", uint64(1), height-spentDepth, &expired)
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		for _, record := range expired {
+			err = tx.DeleteStruct(record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+//findUTXORecord 查找索引中的输出，不存在则返回新记录
+func findUTXORecord(node storm.Node, key string) (*UTXORecord, error) {
+	var record UTXORecord
+	err := node.One("Key", key, &record)
+	if err == storm.ErrNotFound {
+		return &UTXORecord{Key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+//Rollback 撤销被孤立区块对索引的修改：删除区块中收到的输出，恢复区块中花费的输出
+func (index *UTXOIndex) Rollback(height uint64) error {
+
+	db, err := index.open()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var spent []*UTXORecord
+	err = tx.Find("SpentHeight", height, &spent)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, record := range spent {
+		if record.BlockHeight == 0 {
+			//只有花费记录
+			err = tx.DeleteStruct(record)
+		} else {
+			record.SpentTxID = ""
+			record.SpentHeight = 0
+			err = tx.Save(record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	var received []*UTXORecord
+	err = tx.Find("BlockHeight", height, &received)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, record := range received {
+		err = tx.DeleteStruct(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+//ListUnspent 查询地址在索引中已确认的未花输出，tipHeight为已扫描的区块高度
+func (index *UTXOIndex) ListUnspent(tipHeight, min uint64, addresses ...string) ([]*Unspent, error) {
+
+	db, err := index.open()
+	if err != nil {
+		return nil, err
+	}
+
+	utxos := make([]*Unspent, 0)
+	for _, address := range addresses {
+
+		var records []*UTXORecord
+		err = db.Find("Address", address, &records)
+		if err != nil && err != storm.ErrNotFound {
+			return nil, err
+		}
+
+		for _, record := range records {
+			if len(record.SpentTxID) > 0 || record.BlockHeight == 0 || record.BlockHeight > tipHeight {
+				continue
+			}
+			confirmations := tipHeight - record.BlockHeight + 1
+			if confirmations < min {
+				continue
+			}
+			utxos = append(utxos, &Unspent{
+				Key:           record.Key,
+				TxID:          record.TxID,
+				Vout:          record.Vout,
+				Address:       record.Address,
+				ScriptPubKey:  record.ScriptPubKey,
+				Amount:        record.Amount,
+				Confirmations: confirmations,
+				Spendable:     true,
+				Solvable:      true,
+			})
+		}
+	}
+
+	return utxos, nil
+}
+
+//utxoIndex 返回未花索引，没有开启时返回nil
+func (bs *ILCBlockScanner) utxoIndex() *UTXOIndex {
+	if !bs.wm.Config.UTXOIndex {
+		return nil
+	}
+
+	bs.utxoIndexMu.Lock()
+	defer bs.utxoIndexMu.Unlock()
+
+	if bs.utxos == nil {
+		bs.utxos = NewUTXOIndex(filepath.Join(bs.wm.Config.DBPath, bs.wm.Config.UTXOIndexFile))
+	}
+	return bs.utxos
+}
+
+//indexUTXO 用区块的提取结果更新未花索引，没有开启索引时忽略
+func (bs *ILCBlockScanner) indexUTXO(height uint64, results []ExtractResult) error {
+
+	index := bs.utxoIndex()
+	if index == nil || height == 0 {
+		return nil
+	}
+
+	err := index.Apply(height, results, bs.wm.Config.MaxBlockCache)
+	if err != nil {
+		bs.wm.Log.Std.Error("block height: %d update utxo index failed. unexpected error: %v", height, err)
+	}
+	return err
+}
+
+//rollbackUTXOIndex 撤销被孤立区块对未花索引的修改
+func (bs *ILCBlockScanner) rollbackUTXOIndex(height uint64) error {
+
+	index := bs.utxoIndex()
+	if index == nil {
+		return nil
+	}
+
+	err := index.Rollback(height)
+	if err != nil {
+		bs.wm.Log.Std.Error("block height: %d rollback utxo index failed. unexpected error: %v", height, err)
+	}
+	return err
+}
+
+//ListUnspentFromIndex 从本地未花索引查询地址的未花输出
+//min = 0 时包括跟踪中的交易池交易收到的输出，已被交易池交易花费的输出不返回
+func (bs *ILCBlockScanner) ListUnspentFromIndex(min uint64, addresses ...string) ([]*Unspent, error) {
+
+	index := bs.utxoIndex()
+	if index == nil {
+		return nil, fmt.Errorf("utxo index is not enabled")
+	}
+
+	utxos, err := index.ListUnspent(bs.GetScannedBlockHeight(), min, addresses...)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Unspent, 0, len(utxos))
+	for _, u := range utxos {
+		if !bs.memPool.isSpent(u.Key) {
+			list = append(list, u)
+		}
+	}
+
+	if min > 0 {
+		return list, nil
+	}
+
+	watched := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		watched[address] = true
+	}
+
+	for _, output := range bs.memPool.unspentOutputs() {
+		if !watched[output.Address] {
+			continue
+		}
+		list = append(list, &Unspent{
+			Key:           txOutCacheKey(output.TxID, output.Index),
+			TxID:          output.TxID,
+			Vout:          output.Index,
+			Address:       output.Address,
+			ScriptPubKey:  output.GetExtParam().Get("scriptPubKey").String(),
+			Amount:        output.Amount,
+			Confirmations: 0,
+			Spendable:     true,
+			Solvable:      true,
+		})
+	}
+
+	return list, nil
+}
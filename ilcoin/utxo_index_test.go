@@ -0,0 +1,138 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+//checkTestUnspent 检查未花输出，want的key = txid:vout，value = 金额
+func checkTestUnspent(t *testing.T, step string, utxos []*Unspent, want map[string]string) {
+	got := make(map[string]string)
+	for _, u := range utxos {
+		got[txOutCacheKey(u.TxID, u.Vout)] = u.Amount
+	}
+	if len(got) != len(want) {
+		t.Errorf("%s: unspent = %v, want %v", step, got, want)
+		return
+	}
+	for key, amount := range want {
+		if got[key] != amount {
+			t.Errorf("%s: unspent = %v, want %v", step, got, want)
+			return
+		}
+	}
+}
+
+func TestILCBlockScanner_UTXOIndex(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ilcoin-utxo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := newTestNode(t)
+	defer node.Close()
+
+	node.mine("a1")
+
+	wm, bs, _ := newTestScanner(node, map[string]string{"alice_addr": "alice"})
+	wm.Config.UTXOIndex = true
+	wm.Config.DBPath = dir
+	saveTestScanned(bs, node)
+	defer func() { bs.utxoIndex().Close() }()
+	bs.Restart()
+
+	alice := testAddress("alice_addr")
+
+	//收到两笔
+	deposit1 := newTestTx("deposit1", []testTxIn{{node.chain[1].Txs[0].TxID, 0}}, testTxOut{"alice_addr", "1"})
+	deposit2 := newTestTx("deposit2", []testTxIn{{node.chain[0].Txs[0].TxID, 0}}, testTxOut{"bob_addr", "3"}, testTxOut{"alice_addr", "2"})
+	node.mine("a2", newTestTx("coinbase_a2", nil, testTxOut{"miner_addr", "50"}), deposit1, deposit2)
+	bs.ScanBlockTask()
+
+	utxos, err := wm.ListUnspent(1, alice)
+	if err != nil {
+		t.Fatalf("ListUnspent unexpected error: %v", err)
+	}
+	checkTestUnspent(t, "received", utxos, map[string]string{
+		txOutCacheKey(deposit1.TxID, 0): "1",
+		txOutCacheKey(deposit2.TxID, 1): "2",
+	})
+
+	//花费一笔，找零到自己
+	spend := newTestTx("spend", []testTxIn{{deposit1.TxID, 0}}, testTxOut{"bob_addr", "0.5"}, testTxOut{"alice_addr", "0.4"})
+	spendBlock := node.mine("a3", newTestTx("coinbase_a3", nil, testTxOut{"miner_addr", "50"}), spend)
+	bs.ScanBlockTask()
+
+	utxos, _ = wm.ListUnspent(1, alice)
+	checkTestUnspent(t, "spent", utxos, map[string]string{
+		txOutCacheKey(deposit2.TxID, 1): "2",
+		txOutCacheKey(spend.TxID, 1):    "0.4",
+	})
+	for _, u := range utxos {
+		if u.TxID == deposit2.TxID && u.Confirmations != 2 {
+			t.Errorf("confirmations = %d, want 2", u.Confirmations)
+		}
+	}
+
+	if utxos, _ = wm.ListUnspent(2, alice); len(utxos) != 1 {
+		t.Errorf("unspent with 2 confirmations = %d, want 1", len(utxos))
+	}
+
+	balances, err := bs.GetBalanceByAddress(alice)
+	if err != nil || len(balances) != 1 || balances[0].Balance != "2.4" {
+		t.Errorf("GetBalanceByAddress = %v, %v, want 2.4", balances, err)
+	}
+
+	//交易池中的花费不再返回被花费的输出，收到的输出只在min = 0时返回
+	pending := newTestTx("pending", []testTxIn{{deposit2.TxID, 1}}, testTxOut{"bob_addr", "0.4"}, testTxOut{"alice_addr", "1.5"})
+	node.addMemPool(pending)
+	bs.ScanBlockTask()
+
+	utxos, _ = wm.ListUnspent(0, alice)
+	checkTestUnspent(t, "mempool", utxos, map[string]string{
+		txOutCacheKey(spend.TxID, 1):   "0.4",
+		txOutCacheKey(pending.TxID, 1): "1.5",
+	})
+	utxos, _ = wm.ListUnspent(1, alice)
+	checkTestUnspent(t, "mempool confirmed", utxos, map[string]string{
+		txOutCacheKey(spend.TxID, 1): "0.4",
+	})
+
+	//交易池交易被驱逐，花费区块被孤立
+	node.removeMemPool(pending.TxID)
+	node.reorg(spendBlock.Height - 1)
+	node.mine("b3")
+	node.mine("b4")
+	bs.ScanBlockTask()
+
+	//重新打开索引数据库
+	bs.utxoIndex().Close()
+
+	utxos, _ = wm.ListUnspent(0, alice)
+	checkTestUnspent(t, "reorg", utxos, map[string]string{
+		txOutCacheKey(deposit1.TxID, 0): "1",
+		txOutCacheKey(deposit2.TxID, 1): "2",
+	})
+
+	if calls := node.callCount("listunspent"); calls != 0 {
+		t.Errorf("listunspent calls = %d, want 0", calls)
+	}
+}
@@ -0,0 +1,348 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+//节点zmq推送的主题
+const (
+	ZMQTopicHashBlock = "hashblock"
+	ZMQTopicRawTx     = "rawtx"
+)
+
+//ZMTP 3.0帧标志
+const (
+	zmtpFlagMore    = 0x01
+	zmtpFlagLong    = 0x02
+	zmtpFlagCommand = 0x04
+
+	zmtpMaxFrameSize = 32 * 1024 * 1024
+)
+
+//ZMTP 3.1心跳命令
+const (
+	zmtpCommandPing = "PING"
+	zmtpCommandPong = "PONG"
+)
+
+//zmqSubscriber 基于ZMTP 3.1（NULL安全机制）的SUB套接字，只实现订阅节点推送所需的部分
+type zmqSubscriber struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	idleTimeout time.Duration
+}
+
+//dialZMQSubscriber 连接节点的zmq推送地址（tcp://host:port），完成握手并订阅主题
+//idleTimeout > 0时，超过该时间没有收到数据则发送PING，再等待idleTimeout仍没有数据视为连接已断开
+func dialZMQSubscriber(endpoint string, topics []string, timeout, idleTimeout time.Duration) (*zmqSubscriber, error) {
+
+	if !strings.HasPrefix(endpoint, "tcp://") {
+		return nil, fmt.Errorf("unsupported zmq endpoint: %s", endpoint)
+	}
+
+	conn, err := net.DialTimeout("tcp", strings.TrimPrefix(endpoint, "tcp://"), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &zmqSubscriber{
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		idleTimeout: idleTimeout,
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	err = zmtpHandshake(conn, sub.reader, "SUB", "PUB", false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	for _, topic := range topics {
+		//ZMTP 3.0的订阅是一条首字节为1的消息
+		err = writeZMTPFrame(conn, 0, append([]byte{1}, topic...))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return sub, nil
+}
+
+//recvMessage 接收一条完整的多帧消息，忽略命令帧
+func (sub *zmqSubscriber) recvMessage() ([][]byte, error) {
+
+	frames := make([][]byte, 0, 3)
+	for {
+		err := sub.waitFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		flags, body, err := readZMTPFrame(sub.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if flags&zmtpFlagCommand != 0 {
+			continue
+		}
+
+		frames = append(frames, body)
+		if flags&zmtpFlagMore == 0 {
+			return frames, nil
+		}
+	}
+}
+
+//waitFrame 等待下一帧数据到达，空闲超时后发送一次PING，仍没有数据（包括PONG）则返回错误
+func (sub *zmqSubscriber) waitFrame() error {
+
+	if sub.idleTimeout <= 0 {
+		return nil
+	}
+
+	pinged := false
+	for {
+		//同时作为本帧的读取期限，帧读取到一半超时按断开处理
+		sub.conn.SetReadDeadline(time.Now().Add(sub.idleTimeout))
+
+		_, err := sub.reader.Peek(1)
+		if err == nil {
+			return nil
+		}
+
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			return err
+		}
+
+		if pinged {
+			return fmt.Errorf("zmq connection has been idle for %v", 2*sub.idleTimeout)
+		}
+
+		sub.conn.SetWriteDeadline(time.Now().Add(sub.idleTimeout))
+		err = writeZMTPFrame(sub.conn, zmtpFlagCommand, zmtpPingCommand(2*sub.idleTimeout))
+		if err != nil {
+			return err
+		}
+		pinged = true
+	}
+}
+
+//Close 关闭连接，阻塞中的recvMessage会返回错误
+func (sub *zmqSubscriber) Close() error {
+	return sub.conn.Close()
+}
+
+//zmtpHandshake 交换问候及READY命令，并检查对方的套接字类型
+func zmtpHandshake(w io.Writer, r *bufio.Reader, socketType, peerType string, asServer bool) error {
+
+	_, err := w.Write(zmtpGreeting(asServer))
+	if err != nil {
+		return err
+	}
+
+	greeting := make([]byte, 64)
+	_, err = io.ReadFull(r, greeting)
+	if err != nil {
+		return err
+	}
+
+	if greeting[0] != 0xff || greeting[9]&0x01 == 0 {
+		return fmt.Errorf("invalid zmtp greeting signature")
+	}
+
+	if greeting[10] < 3 {
+		return fmt.Errorf("unsupported zmtp version: %d.%d", greeting[10], greeting[11])
+	}
+
+	if mechanism := strings.TrimRight(string(greeting[12:32]), "\x00"); mechanism != "NULL" {
+		return fmt.Errorf("unsupported zmtp security mechanism: %s", mechanism)
+	}
+
+	err = writeZMTPFrame(w, zmtpFlagCommand, zmtpReadyCommand(socketType))
+	if err != nil {
+		return err
+	}
+
+	flags, body, err := readZMTPFrame(r)
+	if err != nil {
+		return err
+	}
+
+	if flags&zmtpFlagCommand == 0 {
+		return fmt.Errorf("expect zmtp READY command")
+	}
+
+	properties, err := parseZMTPReadyCommand(body)
+	if err != nil {
+		return err
+	}
+
+	if properties["Socket-Type"] != peerType {
+		return fmt.Errorf("zmtp peer socket type is %s, want %s", properties["Socket-Type"], peerType)
+	}
+
+	return nil
+}
+
+//zmtpGreeting ZMTP 3.1问候，安全机制为NULL
+func zmtpGreeting(asServer bool) []byte {
+	greeting := make([]byte, 64)
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3
+	greeting[11] = 1
+	copy(greeting[12:32], "NULL")
+	if asServer {
+		greeting[32] = 1
+	}
+	return greeting
+}
+
+//zmtpReadyCommand READY命令，只包含套接字类型属性
+func zmtpReadyCommand(socketType string) []byte {
+
+	name := "READY"
+	property := "Socket-Type"
+
+	body := make([]byte, 0, 1+len(name)+1+len(property)+4+len(socketType))
+	body = append(body, byte(len(name)))
+	body = append(body, name...)
+	body = append(body, byte(len(property)))
+	body = append(body, property...)
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(socketType)))
+	body = append(body, size...)
+	body = append(body, socketType...)
+
+	return body
+}
+
+//zmtpPingCommand PING命令，ttl以0.1秒为单位，没有上下文
+func zmtpPingCommand(ttl time.Duration) []byte {
+
+	deciseconds := ttl / (100 * time.Millisecond)
+	if deciseconds > 0xffff {
+		deciseconds = 0xffff
+	}
+
+	body := make([]byte, 0, 1+len(zmtpCommandPing)+2)
+	body = append(body, byte(len(zmtpCommandPing)))
+	body = append(body, zmtpCommandPing...)
+
+	size := make([]byte, 2)
+	binary.BigEndian.PutUint16(size, uint16(deciseconds))
+	body = append(body, size...)
+
+	return body
+}
+
+//parseZMTPReadyCommand 解析READY命令的属性
+func parseZMTPReadyCommand(body []byte) (map[string]string, error) {
+
+	if len(body) < 1 || len(body) < 1+int(body[0]) || string(body[1:1+int(body[0])]) != "READY" {
+		return nil, fmt.Errorf("invalid zmtp READY command")
+	}
+
+	properties := make(map[string]string)
+	data := body[1+int(body[0]):]
+	for len(data) > 0 {
+
+		nameSize := int(data[0])
+		if len(data) < 1+nameSize+4 {
+			return nil, fmt.Errorf("invalid zmtp READY command property")
+		}
+		name := string(data[1 : 1+nameSize])
+		data = data[1+nameSize:]
+
+		valueSize := binary.BigEndian.Uint32(data[:4])
+		data = data[4:]
+		if uint64(len(data)) < uint64(valueSize) {
+			return nil, fmt.Errorf("invalid zmtp READY command property")
+		}
+		properties[name] = string(data[:valueSize])
+		data = data[valueSize:]
+	}
+
+	return properties, nil
+}
+
+//writeZMTPFrame 写入一帧数据
+func writeZMTPFrame(w io.Writer, flags byte, body []byte) error {
+
+	var header []byte
+	if len(body) > 255 {
+		header = make([]byte, 9)
+		header[0] = flags | zmtpFlagLong
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+	} else {
+		header = []byte{flags, byte(len(body))}
+	}
+
+	_, err := w.Write(append(header, body...))
+	return err
+}
+
+//readZMTPFrame 读取一帧数据
+func readZMTPFrame(r *bufio.Reader) (byte, []byte, error) {
+
+	flags, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var size uint64
+	if flags&zmtpFlagLong != 0 {
+		buf := make([]byte, 8)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(buf)
+	} else {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(b)
+	}
+
+	if size > zmtpMaxFrameSize {
+		return 0, nil, fmt.Errorf("zmtp frame size %d is too large", size)
+	}
+
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return flags, body, nil
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package ilcoin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//testZMQPublisher 模拟节点的zmq推送（PUB套接字）
+type testZMQPublisher struct {
+	listener    net.Listener
+	socketType  string
+	mu          sync.Mutex
+	peers       map[net.Conn][]string
+	sequence    uint32
+	connections int32
+	//silent 不为0时不回应心跳
+	silent int32
+}
+
+func newTestZMQPublisher(t *testing.T, socketType string) *testZMQPublisher {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen zmq publisher failed: %v", err)
+	}
+	pub := &testZMQPublisher{
+		listener:   listener,
+		socketType: socketType,
+		peers:      make(map[net.Conn][]string),
+	}
+	go pub.accept()
+	return pub
+}
+
+func (pub *testZMQPublisher) endpoint() string {
+	return "tcp://" + pub.listener.Addr().String()
+}
+
+func (pub *testZMQPublisher) accept() {
+	for {
+		conn, err := pub.listener.Accept()
+		if err != nil {
+			return
+		}
+		go pub.serve(conn)
+	}
+}
+
+func (pub *testZMQPublisher) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	if err := zmtpHandshake(conn, reader, pub.socketType, "SUB", true); err != nil {
+		conn.Close()
+		return
+	}
+
+	atomic.AddInt32(&pub.connections, 1)
+	pub.mu.Lock()
+	pub.peers[conn] = nil
+	pub.mu.Unlock()
+
+	for {
+		flags, body, err := readZMTPFrame(reader)
+		if err != nil {
+			pub.mu.Lock()
+			delete(pub.peers, conn)
+			pub.mu.Unlock()
+			conn.Close()
+			return
+		}
+		if flags&zmtpFlagCommand != 0 {
+			//PING：名称、2字节ttl、上下文，PONG带回上下文
+			if len(body) >= 1+len(zmtpCommandPing)+2 && string(body[1:1+len(zmtpCommandPing)]) == zmtpCommandPing &&
+				atomic.LoadInt32(&pub.silent) == 0 {
+				pong := append([]byte{byte(len(zmtpCommandPong))}, zmtpCommandPong...)
+				pong = append(pong, body[1+len(zmtpCommandPing)+2:]...)
+				pub.mu.Lock()
+				writeZMTPFrame(conn, zmtpFlagCommand, pong)
+				pub.mu.Unlock()
+			}
+			continue
+		}
+		if len(body) > 0 && body[0] == 1 {
+			pub.mu.Lock()
+			pub.peers[conn] = append(pub.peers[conn], string(body[1:]))
+			pub.mu.Unlock()
+		}
+	}
+}
+
+//subscribed 订阅了topic的连接数量
+func (pub *testZMQPublisher) subscribed(topic string) int {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	count := 0
+	for _, topics := range pub.peers {
+		for _, t := range topics {
+			if strings.HasPrefix(topic, t) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+//publish 推送消息给订阅了topic的连接，消息帧与节点一致：主题、内容、序号
+func (pub *testZMQPublisher) publish(topic string, body []byte) {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+
+	seq := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seq, pub.sequence)
+	pub.sequence++
+
+	for conn, topics := range pub.peers {
+		for _, t := range topics {
+			if strings.HasPrefix(topic, t) {
+				writeZMTPFrame(conn, zmtpFlagMore, []byte(topic))
+				writeZMTPFrame(conn, zmtpFlagMore, body)
+				writeZMTPFrame(conn, 0, seq)
+				break
+			}
+		}
+	}
+}
+
+//dropAll 断开所有连接
+func (pub *testZMQPublisher) dropAll() {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	for conn := range pub.peers {
+		conn.Close()
+		delete(pub.peers, conn)
+	}
+}
+
+func (pub *testZMQPublisher) Close() {
+	pub.listener.Close()
+	pub.dropAll()
+}
+
+func TestZMQSubscriber(t *testing.T) {
+
+	pub := newTestZMQPublisher(t, "PUB")
+	defer pub.Close()
+
+	sub, err := dialZMQSubscriber(pub.endpoint(), []string{ZMQTopicRawTx}, time.Second, 0)
+	if err != nil {
+		t.Fatalf("dialZMQSubscriber unexpected error: %v", err)
+	}
+	defer sub.Close()
+
+	waitCondition(t, "zmq subscribed", func() bool { return pub.subscribed(ZMQTopicRawTx) == 1 })
+
+	//未订阅的主题不会推送，长帧正确读取
+	raw := bytes.Repeat([]byte{0xab}, 1000)
+	pub.publish(ZMQTopicHashBlock, []byte{1, 2, 3})
+	pub.publish(ZMQTopicRawTx, raw)
+
+	frames, err := sub.recvMessage()
+	if err != nil {
+		t.Fatalf("recvMessage unexpected error: %v", err)
+	}
+	if len(frames) != 3 || string(frames[0]) != ZMQTopicRawTx || !bytes.Equal(frames[1], raw) {
+		t.Fatalf("recvMessage frames = %d %q, want rawtx with %d bytes", len(frames), frames[0], len(raw))
+	}
+	if seq := binary.LittleEndian.Uint32(frames[2]); seq != 1 {
+		t.Errorf("sequence = %d, want 1", seq)
+	}
+
+	//断开后返回错误
+	pub.dropAll()
+	if _, err := sub.recvMessage(); err == nil {
+		t.Errorf("recvMessage should be failed after disconnected")
+	}
+
+	//对方不是PUB套接字
+	rep := newTestZMQPublisher(t, "REP")
+	defer rep.Close()
+	if _, err := dialZMQSubscriber(rep.endpoint(), []string{ZMQTopicRawTx}, time.Second, 0); err == nil {
+		t.Errorf("dialZMQSubscriber to REP socket should be failed")
+	}
+
+	if _, err := dialZMQSubscriber("ipc:///tmp/ilcoin", []string{ZMQTopicRawTx}, time.Second, 0); err == nil {
+		t.Errorf("dialZMQSubscriber to ipc endpoint should be failed")
+	}
+}
+
+func TestZMQSubscriber_Heartbeat(t *testing.T) {
+
+	pub := newTestZMQPublisher(t, "PUB")
+	defer pub.Close()
+
+	idleTimeout := 50 * time.Millisecond
+	sub, err := dialZMQSubscriber(pub.endpoint(), []string{ZMQTopicRawTx}, time.Second, idleTimeout)
+	if err != nil {
+		t.Fatalf("dialZMQSubscriber unexpected error: %v", err)
+	}
+	defer sub.Close()
+
+	waitCondition(t, "zmq subscribed", func() bool { return pub.subscribed(ZMQTopicRawTx) == 1 })
+
+	//对方回应心跳时，空闲多个周期后仍能收到推送
+	received := make(chan error, 1)
+	go func() {
+		_, recvErr := sub.recvMessage()
+		received <- recvErr
+	}()
+	time.Sleep(5 * idleTimeout)
+	pub.publish(ZMQTopicRawTx, []byte{1})
+	select {
+	case err = <-received:
+		if err != nil {
+			t.Fatalf("recvMessage unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("recvMessage timeout")
+	}
+
+	//对方不回应心跳，视为连接已断开
+	atomic.StoreInt32(&pub.silent, 1)
+	start := time.Now()
+	if _, err := sub.recvMessage(); err == nil || !strings.Contains(err.Error(), "idle") {
+		t.Errorf("recvMessage error = %v, want idle timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*idleTimeout || elapsed > time.Second {
+		t.Errorf("idle timeout after %v", elapsed)
+	}
+}
+
+func TestParseZMTPReadyCommand(t *testing.T) {
+	properties, err := parseZMTPReadyCommand(zmtpReadyCommand("PUB"))
+	if err != nil {
+		t.Fatalf("parseZMTPReadyCommand unexpected error: %v", err)
+	}
+	if properties["Socket-Type"] != "PUB" {
+		t.Errorf("Socket-Type = %s, want PUB", properties["Socket-Type"])
+	}
+
+	for _, body := range [][]byte{nil, []byte("\x05ERROR"), append(zmtpReadyCommand("PUB"), 11, 'I')} {
+		if _, err := parseZMTPReadyCommand(body); err == nil {
+			t.Errorf("parseZMTPReadyCommand(%q) should be failed", body)
+		}
+	}
+}